@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requireAdmin wraps an admin endpoint so it only runs for requests that
+// carry the configured token as a bearer credential.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin API disabled"})
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func maintenanceHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+
+		h.setMaintenance(req.Enabled)
+		h.writeAudit(r, "maintenance", "", strconv.FormatBool(req.Enabled))
+		writeJSON(w, http.StatusOK, map[string]bool{"maintenance": req.Enabled})
+	}
+}
+
+// reapIdleHandler disconnects every client idle for longer than the
+// olderThan query parameter, in seconds.
+func reapIdleHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		secs, err := strconv.Atoi(r.URL.Query().Get("olderThan"))
+		if err != nil || secs <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "olderThan must be a positive number of seconds"})
+			return
+		}
+
+		req := reapRequest{olderThan: time.Duration(secs) * time.Second, result: make(chan int, 1)}
+		h.reapIdle <- req
+		n := <-req.result
+		h.writeAudit(r, "reap_idle", "idle over "+req.olderThan.String(), "disconnected "+strconv.Itoa(n))
+		writeJSON(w, http.StatusOK, map[string]int{"disconnected": n})
+	}
+}
+
+// roomAdminHandler serves the per-room admin endpoints:
+// POST /api/admin/rooms/{room}/clear disconnects everyone in a room and
+// drops its history, and DELETE /api/admin/rooms/{room}/messages/{id}
+// drops one message from its history.
+func roomAdminHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/rooms/"), "/")
+		id, isMessage := strings.CutPrefix(rest, "messages/")
+		switch {
+		case !roomPattern.MatchString(room):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		case rest == "clear":
+			clearRoom(h, w, r, room)
+		case isMessage && id != "" && !strings.Contains(id, "/"):
+			deleteMessage(h, w, r, room, id)
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		}
+	}
+}
+
+func clearRoom(h *hub, w http.ResponseWriter, r *http.Request, room string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	req := clearRequest{room: room, result: make(chan int, 1)}
+	h.clears <- req
+	n := <-req.result
+	h.writeAudit(r, "clear_room", room, "disconnected "+strconv.Itoa(n))
+	writeJSON(w, http.StatusOK, map[string]int{"disconnected": n})
+}
+
+func deleteMessage(h *hub, w http.ResponseWriter, r *http.Request, room, id string) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if h.history == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "history is disabled"})
+		return
+	}
+	if !h.history.delete(room, id) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such message"})
+		return
+	}
+	h.writeAudit(r, "delete_message", room, id)
+	writeJSON(w, http.StatusOK, map[string]string{"deleted": id})
+}
+
+// deadLetterHandler returns the buffered dead-letter log, oldest first.
+func deadLetterHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if h.deadLetters == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "dead-letter log disabled"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]deadLetter{"entries": h.deadLetters.snapshot()})
+	}
+}
+
+// flaggedHandler returns the chats moderation flagged most recently,
+// oldest first, for moderators to review.
+func flaggedHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if h.moderator == nil || h.flagged == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "moderation is disabled"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]deadLetter{"entries": h.flagged.snapshot()})
+	}
+}
+
+// snapshotHandler returns a dump of the hub's state, taken by Run so it is
+// consistent.
+func snapshotHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		result := make(chan hubSnapshot, 1)
+		h.snapshots <- result
+		writeJSON(w, http.StatusOK, <-result)
+	}
+}
+
+// injectableTypes are the message types external systems may broadcast
+// through /api/broadcast.
+var injectableTypes = map[string]bool{
+	"system": true,
+}
+
+// injectHandler serves POST /api/broadcast, letting automation holding
+// the admin token post a notice to a room, or every client, through the
+// hub. A room must have someone in it to be posted to.
+func injectHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		var req struct {
+			Room string `json:"room"`
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessage)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+		// No room means every room.
+		if req.Room != "" && !roomPattern.MatchString(req.Room) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid room"})
+			return
+		}
+		if !injectableTypes[req.Type] {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "type cannot be injected"})
+			return
+		}
+		text := strings.TrimSpace(req.Text)
+		if text == "" || len(text) > maxTextBytes {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "text must be non-empty and at most " + strconv.Itoa(maxTextBytes) + " bytes"})
+			return
+		}
+		if h.cfg.sanitizeHTML {
+			text = html.EscapeString(text)
+		}
+		// Rooms exist only while someone is in them.
+		if req.Room != "" && len(h.presenceOf(req.Room)) == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "room not found"})
+			return
+		}
+
+		key := r.Header.Get("Idempotency-Key")
+		if len(key) > maxIdempotencyKey {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Idempotency-Key must be at most " + strconv.Itoa(maxIdempotencyKey) + " bytes"})
+			return
+		}
+		// A retry with the same key gets the first request's id back
+		// rather than a second broadcast.
+		id, replayed := h.idempotency.do(key, h.now(), func() string {
+			return h.injectSystem(text, req.Room)
+		})
+		if id == "" {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+			return
+		}
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		} else {
+			h.writeAudit(r, "broadcast", req.Room, "message "+id)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id": id})
+	}
+}
+
+// drainHandler tells every client the server is going away, with the
+// reason and reconnect delay from the request body, and disconnects them.
+func drainHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		var req struct {
+			Reason           string `json:"reason"`
+			ReconnectAfterMs int64  `json:"reconnectAfterMs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+		if !shutdownReasons[req.Reason] {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reason must be deploy, maintenance or overload"})
+			return
+		}
+		if req.ReconnectAfterMs < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reconnectAfterMs must not be negative"})
+			return
+		}
+
+		n := h.drain(req.Reason, time.Duration(req.ReconnectAfterMs)*time.Millisecond)
+		h.writeAudit(r, "drain", req.Reason, "disconnected "+strconv.Itoa(n))
+		writeJSON(w, http.StatusOK, map[string]int{"disconnected": n})
+	}
+}
+
+// migrateHandler starts migrating every client to the instance at the
+// target URL in the request body.
+func migrateHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if h.cfg.migrationSecret == "" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "migration is not configured"})
+			return
+		}
+
+		var req struct {
+			Target string `json:"target"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+		u, err := url.Parse(req.Target)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "target must be a ws or wss URL"})
+			return
+		}
+
+		n := h.migrate(u.String())
+		h.writeAudit(r, "migrate", u.String(), "migrating "+strconv.Itoa(n))
+		writeJSON(w, http.StatusOK, map[string]int{"migrating": n})
+	}
+}
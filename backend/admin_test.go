@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// injectTest posts body to injectHandler, returning the status and the
+// decoded response.
+func injectTest(h *hub, body string) (int, map[string]string) {
+	rec := httptest.NewRecorder()
+	injectHandler(h)(rec, httptest.NewRequest(http.MethodPost, "/api/broadcast", strings.NewReader(body)))
+	var resp map[string]string
+	_ = json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp
+}
+
+func TestInjectReachesRoomAndHistory(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	inRoom := dialTestClient(t, base, "ops", "")
+	elsewhere := dialTestClient(t, base, "", "")
+	inRoom.RecvAll(100 * time.Millisecond)
+	elsewhere.RecvAll(100 * time.Millisecond)
+
+	status, resp := injectTest(h, `{"room":"ops","type":"system","text":"deploy starting"}`)
+	if status != http.StatusOK || resp["id"] == "" {
+		t.Fatalf("inject got %d %v", status, resp)
+	}
+	var got *message
+	for _, m := range inRoom.RecvAll(200 * time.Millisecond) {
+		if m.Type == "system" && m.Key == msgExternal {
+			notice := m
+			got = &notice
+		}
+	}
+	if got == nil || got.ID != resp["id"] || got.Text != "deploy starting" || len(got.ServerTime) == 0 {
+		t.Fatalf("room got %+v, want notice %s with serverTime", got, resp["id"])
+	}
+	for _, m := range elsewhere.RecvAll(50 * time.Millisecond) {
+		if m.Key == msgExternal {
+			t.Error("notice for ops reached the default room")
+		}
+	}
+
+	late := dialTestClient(t, base, "ops", "")
+	var replayed bool
+	for _, m := range late.RecvAll(200 * time.Millisecond) {
+		replayed = replayed || m.ID == resp["id"]
+	}
+	if !replayed {
+		t.Error("notice wasn't replayed from history to a later arrival")
+	}
+}
+
+func TestInjectRejectsUnknownRoomAndType(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	registerTestClients(t, h, 1)
+
+	if status, _ := injectTest(h, `{"room":"nobody-here","type":"system","text":"hello"}`); status != http.StatusNotFound {
+		t.Errorf("empty room got %d, want 404", status)
+	}
+	if status, _ := injectTest(h, `{"type":"chat","text":"hello"}`); status != http.StatusBadRequest {
+		t.Errorf("chat type got %d, want 400", status)
+	}
+	if status, _ := injectTest(h, `{"type":"system","text":"hello"}`); status != http.StatusOK {
+		t.Errorf("every-room notice got %d, want 200", status)
+	}
+}
+
+func TestInjectIdempotencyKey(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+
+	post := func(key string) (int, string, bool) {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/api/broadcast", strings.NewReader(`{"type":"system","text":"deploy starting"}`))
+		r.Header.Set("Idempotency-Key", key)
+		injectHandler(h)(rec, r)
+		var resp map[string]string
+		_ = json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp["id"], rec.Header().Get("Idempotent-Replayed") == "true"
+	}
+	notices := func() int {
+		var n int
+		for _, m := range c.RecvAll(200 * time.Millisecond) {
+			if m.Key == msgExternal {
+				n++
+			}
+		}
+		return n
+	}
+
+	status, first, replayed := post("deploy-42")
+	if status != http.StatusOK || first == "" || replayed {
+		t.Fatalf("first post got %d id %q replayed %t", status, first, replayed)
+	}
+	status, again, replayed := post("deploy-42")
+	if status != http.StatusOK || again != first || !replayed {
+		t.Errorf("retry got %d id %q replayed %t, want 200 with id %q replayed", status, again, replayed, first)
+	}
+	if n := notices(); n != 1 {
+		t.Errorf("two posts with one key broadcast %d notices, want 1", n)
+	}
+
+	if _, other, replayed := post("deploy-43"); other == first || replayed {
+		t.Errorf("a new key got id %q replayed %t, want a fresh broadcast", other, replayed)
+	}
+	if n := notices(); n != 1 {
+		t.Errorf("a new key broadcast %d notices, want 1", n)
+	}
+	if status, _, _ := post(strings.Repeat("k", maxIdempotencyKey+1)); status != http.StatusBadRequest {
+		t.Errorf("an overlong key got %d, want 400", status)
+	}
+}
+
+// closeTestCode reads from conn until it closes and returns the close
+// frame's code and text.
+func closeTestCode(t *testing.T, conn *websocket.Conn) (int, string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				t.Fatalf("connection ended without a close frame: %v", err)
+			}
+			return ce.Code, ce.Text
+		}
+	}
+}
+
+func TestClearRoomDisconnectsMembersAndHistory(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	var members []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws?room=abuse", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		members = append(members, conn)
+	}
+	bystander := dialTestClient(t, base, "", "")
+	waitFor(t, "members to join", func() bool { return len(h.presenceOf("abuse")) == len(members) })
+	storeTestChat(t, h, "abuse", "spam")
+	storeTestChat(t, h, defaultRoom, "hello")
+
+	rec := httptest.NewRecorder()
+	roomAdminHandler(h)(rec, httptest.NewRequest(http.MethodPost, "/api/admin/rooms/abuse/clear", nil))
+	var resp map[string]int
+	_ = json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp["disconnected"] != len(members) {
+		t.Fatalf("clear got %d %v, want %d disconnected", rec.Code, resp, len(members))
+	}
+	for i, conn := range members {
+		if code, text := closeTestCode(t, conn); code != closeCodeRoomClosed || text != "room_closed" {
+			t.Errorf("member %d closed with %d %q, want %d room_closed", i, code, text, closeCodeRoomClosed)
+		}
+	}
+	if n := len(h.presenceOf("abuse")); n != 0 {
+		t.Errorf("%d members left in the cleared room", n)
+	}
+	if got := h.history.recent("abuse", time.Time{}, 10); len(got) != 0 {
+		t.Errorf("cleared room kept %d history entries", len(got))
+	}
+	if got := h.history.recent(defaultRoom, time.Time{}, 10); len(got) != 1 {
+		t.Errorf("lobby history has %d entries, want its 1 untouched", len(got))
+	}
+	if len(h.presenceOf(defaultRoom)) != 1 {
+		t.Error("clearing one room disconnected a client in another")
+	}
+	bystander.RecvAll(50 * time.Millisecond)
+}
+
+func TestSnapshotListsRoomsAndHistory(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	for _, room := range []string{"ops", "ops", ""} {
+		dialTestClient(t, base, room, "").RecvAll(50 * time.Millisecond)
+	}
+	storeTestChat(t, h, "ops", "one")
+	storeTestChat(t, h, "ops", "two")
+	storeTestChat(t, h, defaultRoom, "three")
+
+	rec := httptest.NewRecorder()
+	snapshotHandler(h)(rec, httptest.NewRequest(http.MethodGet, "/api/admin/snapshot", nil))
+	var snap hubSnapshot
+	if err := json.NewDecoder(rec.Body).Decode(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Clients != 3 || len(snap.Members) != 3 {
+		t.Errorf("snapshot has %d clients and %d members, want 3", snap.Clients, len(snap.Members))
+	}
+	sizes := make(map[string]int)
+	for _, r := range snap.Rooms {
+		sizes[r.Name] = r.Clients
+	}
+	if len(sizes) != 2 || sizes["ops"] != 2 || sizes[defaultRoom] != 1 {
+		t.Errorf("snapshot rooms %v, want ops with 2 and the lobby with 1", sizes)
+	}
+	if snap.History == nil || snap.History.Stored != 3 || snap.History.Capacity != h.cfg.historySize {
+		t.Errorf("snapshot history %+v, want 3 of %d stored", snap.History, h.cfg.historySize)
+	}
+}
+
+// maintenanceTest posts enabled to maintenanceHandler.
+func maintenanceTest(t *testing.T, h *hub, enabled bool) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	body := `{"enabled":` + strconv.FormatBool(enabled) + `}`
+	maintenanceHandler(h)(rec, httptest.NewRequest(http.MethodPost, "/api/admin/maintenance", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("maintenance %t answered %d", enabled, rec.Code)
+	}
+}
+
+func TestMaintenanceBlocksChatButNotPresence(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	sender := dialTestClient(t, base, "", "")
+	watcher := dialTestClient(t, base, "", "")
+	sender.RecvAll(100 * time.Millisecond)
+	watcher.RecvAll(100 * time.Millisecond)
+
+	maintenanceTest(t, h, true)
+	var advised bool
+	for _, m := range watcher.RecvAll(100 * time.Millisecond) {
+		advised = advised || (m.Type == "maintenance" && m.Active && m.Key == msgMaintenanceOn)
+	}
+	if !advised {
+		t.Error("clients weren't sent the maintenance advisory")
+	}
+
+	sender.Send(message{Type: "chat", Text: "hello"})
+	if !refusedWith(sender.RecvAll(200*time.Millisecond), msgMaintenanceOn) {
+		t.Error("chat during maintenance wasn't refused")
+	}
+	dialTestClient(t, base, "", "")
+	var joined, chat bool
+	for _, m := range watcher.RecvAll(200 * time.Millisecond) {
+		joined = joined || (m.Type == "presence" && m.Presence == "join")
+		chat = chat || m.Type == "chat"
+	}
+	if chat || !joined {
+		t.Errorf("during maintenance watcher saw chat %t and a join %t, want only the join", chat, joined)
+	}
+
+	maintenanceTest(t, h, false)
+	sender.Send(message{Type: "chat", Text: "back"})
+	if _, ok := relayedChat(watcher.RecvAll(200 * time.Millisecond)); !ok {
+		t.Error("chat didn't flow again after maintenance")
+	}
+}
+
+func TestReapIdleEndpoint(t *testing.T) {
+	h := NewHub(testConfig())
+	var clock atomic.Int64
+	clock.Store(time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC).UnixNano())
+	h.now = func() time.Time { return time.Unix(0, clock.Load()) }
+	go h.Run()
+
+	idle := registerTestClients(t, h, 1)[0]
+	clock.Add(int64(10 * time.Minute))
+	active := registerTestClients(t, h, 1)[0]
+
+	reap := func(auth string) (int, map[string]int) {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/reap-idle?olderThan=300", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rec := httptest.NewRecorder()
+		requireAdmin("admin", reapIdleHandler(h))(rec, req)
+		var resp map[string]int
+		_ = json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+	if status, _ := reap(""); status != http.StatusUnauthorized {
+		t.Errorf("reap without the admin token answered %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, resp := reap("admin"); status != http.StatusOK || resp["disconnected"] != 1 {
+		t.Errorf("reap answered %d %v, want the one idle client disconnected", status, resp)
+	}
+	if n, reason := idle.closed(); n != 1 || reason != closeKicked {
+		t.Errorf("idle client closed %d times with %v, want once with %v", n, reason, closeKicked)
+	}
+	if n, _ := active.closed(); n != 0 {
+		t.Errorf("active client closed %d times", n)
+	}
+}
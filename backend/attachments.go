@@ -0,0 +1,96 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"strings"
+)
+
+// Per-attachment field limits, sized so a few attachments still fit in
+// maxMessage alongside the text.
+const (
+	maxAttachmentURL  = 512
+	maxAttachmentName = 128
+	maxAttachmentType = 64
+)
+
+// attachment describes a file shared with a chat. The bytes are hosted
+// elsewhere; the server only relays the metadata, after checking it.
+type attachment struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	Size int64  `json:"size,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// checkAttachments validates a chat's attachments against the configured
+// limits, returning the message key of the first violation or "".
+func (cfg *config) checkAttachments(list []attachment) string {
+	if len(list) == 0 {
+		return ""
+	}
+	hosts := hostSet(cfg.attachmentHosts)
+	if len(hosts) == 0 {
+		return msgAttachmentInvalid
+	}
+	if len(list) > cfg.maxAttachments {
+		return msgAttachmentsTooMany
+	}
+	var total int64
+	for _, a := range list {
+		if len(a.URL) > maxAttachmentURL || len(a.Name) > maxAttachmentName || len(a.Type) > maxAttachmentType || a.Size < 0 {
+			return msgAttachmentInvalid
+		}
+		if !attachmentTypeAllowed(cfg.attachmentTypes, a.Type) {
+			return msgAttachmentInvalid
+		}
+		u, err := url.Parse(a.URL)
+		if err != nil || u.Scheme != "https" || !matchesHost(hosts, strings.ToLower(u.Hostname())) {
+			return msgAttachmentInvalid
+		}
+		total += a.Size
+	}
+	if total > int64(cfg.maxAttachmentBytes) {
+		return msgAttachmentsTooLarge
+	}
+	return ""
+}
+
+// attachmentTypeAllowed reports whether the MIME type t is in allowed, a
+// comma-separated list where "image/*" admits every image type.
+func attachmentTypeAllowed(allowed, t string) bool {
+	t = strings.ToLower(strings.TrimSpace(t))
+	major, _, ok := strings.Cut(t, "/")
+	if !ok {
+		return false
+	}
+	for _, want := range strings.Split(allowed, ",") {
+		want = strings.ToLower(strings.TrimSpace(want))
+		if want == t || want == major+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentRules vets a chat's attachments. Other types can't carry
+// them, so theirs are dropped rather than relayed unchecked.
+func attachmentRules(c *client, msg *message) error {
+	if msg.Type != "chat" {
+		msg.Attachments = nil
+		return nil
+	}
+	if key := c.hub.cfg.checkAttachments(msg.Attachments); key != "" {
+		return notifyReject(key)
+	}
+	if c.hub.cfg.sanitizeHTML {
+		escapeAttachmentNames(msg.Attachments)
+	}
+	return nil
+}
+
+func escapeAttachmentNames(list []attachment) {
+	for i := range list {
+		list[i].Name = html.EscapeString(list[i].Name)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckAttachments(t *testing.T) {
+	cfg := testConfig()
+	cfg.attachmentHosts = "cdn.example.com"
+	cfg.maxAttachments = 2
+	cfg.maxAttachmentBytes = 1000
+	image := attachment{Type: "image/png", URL: "https://cdn.example.com/a.png", Size: 400, Name: "a.png"}
+	for _, tc := range []struct {
+		name string
+		list []attachment
+		want string
+	}{
+		{"None", nil, ""},
+		{"Valid", []attachment{image, {Type: "application/pdf", URL: "https://files.cdn.example.com/b.pdf", Size: 600}}, ""},
+		{"TooMany", []attachment{image, image, image}, msgAttachmentsTooMany},
+		{"TooLarge", []attachment{image, {Type: "video/mp4", URL: "https://cdn.example.com/v.mp4", Size: 601}}, msgAttachmentsTooLarge},
+		{"OtherHost", []attachment{{Type: "image/png", URL: "https://evil.example.net/a.png"}}, msgAttachmentInvalid},
+		{"LookalikeHost", []attachment{{Type: "image/png", URL: "https://cdn.example.com.evil.net/a.png"}}, msgAttachmentInvalid},
+		{"PlainHTTP", []attachment{{Type: "image/png", URL: "http://cdn.example.com/a.png"}}, msgAttachmentInvalid},
+		{"TypeNotAllowed", []attachment{{Type: "application/x-msdownload", URL: "https://cdn.example.com/a.exe"}}, msgAttachmentInvalid},
+		{"NegativeSize", []attachment{{Type: "image/png", URL: "https://cdn.example.com/a.png", Size: -1}}, msgAttachmentInvalid},
+		{"LongName", []attachment{{Type: "image/png", URL: "https://cdn.example.com/a.png", Name: strings.Repeat("n", maxAttachmentName+1)}}, msgAttachmentInvalid},
+	} {
+		if got := cfg.checkAttachments(tc.list); got != tc.want {
+			t.Errorf("%s: checkAttachments = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	cfg.attachmentHosts = ""
+	if got := cfg.checkAttachments([]attachment{image}); got != msgAttachmentInvalid {
+		t.Errorf("with no hosts configured checkAttachments = %q, want %q", got, msgAttachmentInvalid)
+	}
+}
+
+func TestAttachmentsRelayedWithChat(t *testing.T) {
+	cfg := testConfig()
+	cfg.attachmentHosts = "cdn.example.com"
+	cfg.maxAttachments = 1
+	_, sender, receiver := replyTestPair(t, cfg)
+	image := attachment{Type: "image/png", URL: "https://cdn.example.com/a.png", Size: 10, Name: "a.png"}
+
+	sender.Send(message{Type: "chat", Text: "look", Attachments: []attachment{image}})
+	got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond))
+	if !ok || len(got.Attachments) != 1 || got.Attachments[0] != image {
+		t.Errorf("room got %+v, want the chat with its attachment", got.Attachments)
+	}
+
+	sender.Send(message{Type: "chat", Text: "two", Attachments: []attachment{image, image}})
+	if !refusedWith(sender.RecvAll(200*time.Millisecond), msgAttachmentsTooMany) {
+		t.Errorf("sender wasn't told about too many attachments")
+	}
+	if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+		t.Error("a chat over the attachment limit was relayed")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readAuditEntries decodes every line of the audit log at path, failing
+// on any line that isn't exactly an auditEntry.
+func readAuditEntries(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		dec := json.NewDecoder(strings.NewReader(scanner.Text()))
+		dec.DisallowUnknownFields()
+		var e auditEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Reaping idle clients is the operator's kick: they are closed as
+// kicked.
+func TestKickIsAudited(t *testing.T) {
+	cfg := testConfig()
+	cfg.auditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	h := NewHub(cfg)
+	var clock atomic.Int64
+	clock.Store(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano())
+	h.now = func() time.Time { return time.Unix(0, clock.Load()) }
+	go h.Run()
+	idle := registerTestClients(t, h, 1)[0]
+	clock.Add(int64(time.Hour))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/reap-idle?olderThan=60", nil)
+	req.RemoteAddr = "192.0.2.7:4000"
+	req.Header.Set("X-Audit-Reason", "  stale sessions after the outage "+strings.Repeat("x", maxAuditReason))
+	rec := httptest.NewRecorder()
+	reapIdleHandler(h)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reap answered %d", rec.Code)
+	}
+	if n, reason := idle.closed(); n != 1 || reason != closeKicked {
+		t.Fatalf("idle client closed %d times with %v, want kicked", n, reason)
+	}
+
+	entries := readAuditEntries(t, cfg.auditLogPath)
+	if len(entries) != 1 {
+		t.Fatalf("audit log has %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	want := auditEntry{
+		Time:   "2024-01-02T04:04:05Z",
+		Actor:  "admin@192.0.2.7",
+		Action: "reap_idle",
+		Target: "idle over 1m0s",
+		Result: "disconnected 1",
+	}
+	reason := e.Reason
+	e.Reason = ""
+	if e != want {
+		t.Errorf("audit entry %+v, want %+v", e, want)
+	}
+	if !strings.HasPrefix(reason, "stale sessions after the outage") || len(reason) != maxAuditReason {
+		t.Errorf("audit reason %q, want the trimmed header cut to %d bytes", reason, maxAuditReason)
+	}
+}
+
+func TestAuditDisabledWithoutPath(t *testing.T) {
+	h := NewHub(testConfig())
+	if h.audit != nil {
+		t.Fatal("an audit log was opened without AUDIT_LOG_PATH")
+	}
+	// A nil log records nothing and doesn't panic.
+	h.writeAudit(httptest.NewRequest(http.MethodPost, "/api/admin/drain", nil), "drain", "", "")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The challenge flow keeps credentials out of upgrade URLs: once
+// connected, the server sends an auth_challenge carrying a nonce and the
+// client must answer with an auth_response whose token is the hex
+// HMAC-SHA256 of that nonce under the shared secret. Until it does, the
+// client may not send anything else.
+
+func (h *hub) authRequired() bool {
+	return h.cfg.authSecret != ""
+}
+
+// startAuthChallenge sends the challenge and closes the connection if it
+// isn't answered within the configured timeout.
+func (c *client) startAuthChallenge() {
+	nonce, err := newNonce()
+	if err != nil {
+		c.fail("generate auth nonce", err)
+		return
+	}
+	c.authNonce = nonce
+
+	data, err := encode(message{
+		Type:       "auth_challenge",
+		Nonce:      nonce,
+		ID:         c.hub.idGen(),
+		ServerTime: c.hub.serverTime(),
+	}, "auth challenge")
+	if err != nil {
+		c.closeWith(websocket.CloseInternalServerErr, "")
+		return
+	}
+	// Send rather than reply: the direct queue may reach Run ahead of the
+	// registration. Send also copes with a client that is already closed.
+	if err := c.Send("auth_challenge", data); err != nil {
+		c.closeWith(websocket.CloseTryAgainLater, "")
+		return
+	}
+
+	c.authTimer = time.AfterFunc(c.hub.cfg.authTimeout, func() {
+		if !c.authenticated.Load() {
+			log.Printf("client %s did not authenticate in time", c.id)
+			c.closeWith(websocket.ClosePolicyViolation, "authentication timeout")
+		}
+	})
+}
+
+// handleAuthResponse checks a challenge response, closing the connection
+// if it is wrong.
+func (c *client) handleAuthResponse(token string) {
+	if c.authenticated.Load() {
+		return
+	}
+	if !hmac.Equal([]byte(token), []byte(signNonce(c.hub.cfg.authSecret, c.authNonce))) {
+		log.Printf("client %s sent an invalid auth response", c.id)
+		c.closeWith(websocket.ClosePolicyViolation, "authentication failed")
+		return
+	}
+	c.authenticated.Store(true)
+	c.authTimer.Stop()
+	c.notify(msgAuthenticated)
+}
+
+// signNonce returns the response a client holding secret should send for
+// nonce.
+func signNonce(secret, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Bearer tokens are HS256 JWTs signed with tokenSecret, whose sub claim
+// names the user. Everything a verified client sends is stamped with the
+// user alongside its per-connection id, and while the user is connected
+// no other client may take the name as its nick.
+
+// errNoToken reports a request that carried no bearer token.
+var errNoToken = errors.New("no token")
+
+// tokensRequired reports whether connections without a valid bearer
+// token are refused.
+func (h *hub) tokensRequired() bool {
+	return h.cfg.tokenSecret != "" && !h.cfg.allowAnonymous
+}
+
+// requestUser returns the user named by the bearer token a request
+// carries in its Authorization header or, since browsers can't set
+// headers on a websocket upgrade, its ?token= parameter. It returns
+// errNoToken if there is none and any other error if it is invalid.
+func (h *hub) requestUser(r *http.Request) (string, error) {
+	if h.cfg.tokenSecret == "" {
+		return "", errNoToken
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return "", errNoToken
+	}
+	return verifyToken(h.cfg.tokenSecret, token, h.now())
+}
+
+// verifyToken checks an HS256 JWT against secret and returns its sub
+// claim, which must be a valid nick. exp and nbf are enforced when set.
+func verifyToken(secret, token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	// Checking alg first rules out "none" and key-confusion tricks.
+	if header.Alg != "HS256" {
+		return "", errors.New("unsupported token algorithm")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errors.New("bad token signature")
+	}
+	var claims struct {
+		Sub string   `json:"sub"`
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	unix := float64(now.Unix())
+	if claims.Exp != nil && unix >= *claims.Exp {
+		return "", errors.New("token expired")
+	}
+	if claims.Nbf != nil && unix < *claims.Nbf {
+		return "", errors.New("token not yet valid")
+	}
+	if !nickPattern.MatchString(claims.Sub) {
+		return "", errors.New("token subject is not a valid user name")
+	}
+	return claims.Sub, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func newNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAuthChallengeToClosedClient(t *testing.T) {
+	cfg := testConfig()
+	cfg.authSecret = "secret"
+	h := NewHub(cfg)
+	c := &client{id: "c1", hub: h, send: make(chan outbound, 16), sendLow: make(chan outbound, 16)}
+	c.Close(closeKicked)
+
+	// Run may remove the client before its connection goroutine gets to
+	// the challenge; that must not send on the closed lane.
+	c.startAuthChallenge()
+	if c.authTimer == nil {
+		t.Fatal("no auth timeout was started")
+	}
+	c.authTimer.Stop()
+	if c.authNonce == "" {
+		t.Error("no nonce was issued")
+	}
+}
+
+// signTestToken returns an HS256 JWT for sub signed with secret.
+func signTestToken(secret, sub string) string {
+	enc := base64.RawURLEncoding
+	payload := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		enc.EncodeToString([]byte(`{"sub":"`+sub+`"}`))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// userTestClient is a test client verified as user.
+type userTestClient struct {
+	testClient
+	user string
+}
+
+func (c *userTestClient) username() string { return c.user }
+
+// renameSync asks Run to rename c and returns the refusal key, if any.
+func (h *hub) renameSync(c Client, nick string) string {
+	req := renameRequest{client: c, nick: nick, result: make(chan string, 1)}
+	h.renames <- req
+	return <-req.result
+}
+
+func TestVerifiedUserConnectionsKeepTheirOwnIDs(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	first := &userTestClient{testClient: testClient{id: randomID()}, user: "alice"}
+	second := &userTestClient{testClient: testClient{id: randomID()}, user: "alice"}
+	h.register <- first
+	h.register <- second
+	waitFor(t, "both connections to register", func() bool { return h.clientCount.Load() == 2 })
+
+	entries := h.presenceOf(defaultRoom)
+	if len(entries) != 2 || entries[0].ID == entries[1].ID {
+		t.Fatalf("presence is %+v, want two entries with distinct ids", entries)
+	}
+	for _, e := range entries {
+		if e.User != "alice" {
+			t.Errorf("entry %+v is not stamped with the verified user", e)
+		}
+	}
+}
+
+func TestVerifiedNameIsReservedFromNick(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	alice := &userTestClient{testClient: testClient{id: randomID()}, user: "alice"}
+	h.register <- alice
+	waitFor(t, "alice to register", func() bool { return h.clientCount.Load() == 1 })
+	anon := registerTestClients(t, h, 1)[0]
+
+	if key := h.renameSync(anon, "alice"); key != msgNickTaken {
+		t.Errorf("anonymous rename to a verified name answered %q, want %q", key, msgNickTaken)
+	}
+	// alice may take her own name back after moving off it.
+	if key := h.renameSync(alice, "alice-away"); key != "" {
+		t.Fatalf("rename answered %q", key)
+	}
+	if key := h.renameSync(alice, "alice"); key != "" {
+		t.Errorf("verified user's rename to her own name answered %q", key)
+	}
+
+	h.unregister <- alice
+	waitFor(t, "alice to leave", func() bool { return h.clientCount.Load() == 1 })
+	if key := h.renameSync(anon, "alice"); key != "" {
+		t.Errorf("rename after the user left answered %q, want it allowed", key)
+	}
+}
+
+func TestChatStampedWithVerifiedUser(t *testing.T) {
+	cfg := testConfig()
+	cfg.tokenSecret = "secret"
+	cfg.allowAnonymous = true
+	_, base := newTestServer(t, cfg)
+	verified := dialTestClient(t, base, "", signTestToken("secret", "alice"))
+	anon := dialTestClient(t, base, "", "")
+	verified.RecvAll(100 * time.Millisecond)
+	anon.RecvAll(100 * time.Millisecond)
+
+	anon.Send(message{Type: "chat", Text: "forged", User: "alice"})
+	verified.Send(message{Type: "chat", Text: "genuine"})
+	for _, m := range anon.RecvAll(200 * time.Millisecond) {
+		switch {
+		case m.Type != "chat":
+		case m.Text == "forged" && m.User != "":
+			t.Errorf("anonymous chat kept a claimed user %q", m.User)
+		case m.Text == "genuine" && m.User != "alice":
+			t.Errorf("verified chat stamped with user %q, want alice", m.User)
+		}
+	}
+}
+
+func TestVerifiedUserReconnectChurn(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	anon := registerTestClients(t, h, 1)[0]
+
+	// Each reconnect registers before the connection it replaces is
+	// unregistered, as a fast reconnect can.
+	var last *userTestClient
+	for i := 0; i < 50; i++ {
+		next := &userTestClient{testClient: testClient{id: randomID()}, user: "alice"}
+		h.register <- next
+		if last != nil {
+			h.unregister <- last
+		}
+		last = next
+	}
+	waitFor(t, "the churn to settle", func() bool {
+		entries := h.presenceOf(defaultRoom)
+		return len(entries) == 2 && h.clientCount.Load() == 2
+	})
+	if key := h.renameSync(anon, "alice"); key != msgNickTaken {
+		t.Errorf("rename to a connected user's name answered %q, want %q", key, msgNickTaken)
+	}
+
+	h.unregister <- last
+	waitFor(t, "alice to leave", func() bool { return h.clientCount.Load() == 1 })
+	if key := h.renameSync(anon, "alice"); key != "" {
+		t.Errorf("rename after every connection left answered %q, want it allowed", key)
+	}
+}
+
+// dialTestChallenged connects to a server requiring the auth challenge
+// and returns the connection with the nonce it was challenged with.
+func dialTestChallenged(t *testing.T, base string) (*websocket.Conn, string) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("no auth_challenge: %v", err)
+		}
+		if msg.Type == "auth_challenge" {
+			_ = conn.SetReadDeadline(time.Time{})
+			return conn, msg.Nonce
+		}
+	}
+}
+
+// readTestKey reads from conn until a message with key arrives,
+// reporting false if the connection ends or a second passes first.
+func readTestKey(conn *websocket.Conn, key string) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return false
+		}
+		if msg.Key == key {
+			return true
+		}
+	}
+}
+
+func TestAuthChallenge(t *testing.T) {
+	cfg := testConfig()
+	cfg.authSecret = "secret"
+
+	t.Run("Success", func(t *testing.T) {
+		_, base := newTestServer(t, cfg)
+		conn, nonce := dialTestChallenged(t, base)
+		if err := conn.WriteJSON(message{Type: "chat", Text: "too early"}); err != nil {
+			t.Fatal(err)
+		}
+		if !readTestKey(conn, msgAuthRequired) {
+			t.Fatal("chat before authenticating wasn't refused")
+		}
+		if err := conn.WriteJSON(message{Type: "auth_response", Token: signNonce(cfg.authSecret, nonce)}); err != nil {
+			t.Fatal(err)
+		}
+		if !readTestKey(conn, msgAuthenticated) {
+			t.Fatal("a correct response wasn't accepted")
+		}
+		if err := conn.WriteJSON(message{Type: "chat", ID: "m1", Text: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			var msg message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("chat after authenticating wasn't relayed: %v", err)
+			}
+			if msg.Key == msgAuthRequired {
+				t.Fatal("chat after authenticating was refused")
+			}
+			if msg.Type == "chat" && msg.ID == "m1" {
+				break
+			}
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		cfg := cfg
+		cfg.authTimeout = 50 * time.Millisecond
+		_, base := newTestServer(t, cfg)
+		conn, _ := dialTestChallenged(t, base)
+		if code, text := closeTestCode(t, conn); code != websocket.ClosePolicyViolation || text != "authentication timeout" {
+			t.Errorf("closed with %d %q, want %d for the timeout", code, text, websocket.ClosePolicyViolation)
+		}
+	})
+
+	t.Run("InvalidResponse", func(t *testing.T) {
+		_, base := newTestServer(t, cfg)
+		conn, nonce := dialTestChallenged(t, base)
+		if err := conn.WriteJSON(message{Type: "auth_response", Token: signNonce("wrong", nonce)}); err != nil {
+			t.Fatal(err)
+		}
+		if code, text := closeTestCode(t, conn); code != websocket.ClosePolicyViolation || text != "authentication failed" {
+			t.Errorf("closed with %d %q, want %d for the bad response", code, text, websocket.ClosePolicyViolation)
+		}
+	})
+}
+
+func TestAnonymousTypesRestricted(t *testing.T) {
+	cfg := testConfig()
+	cfg.tokenSecret = "secret"
+	cfg.allowAnonymous = true
+	cfg.anonymousTypes = parseTypeSet("chat,ping,typing")
+	_, base := newTestServer(t, cfg)
+	verified := dialTestClient(t, base, "", signTestToken("secret", "alice"))
+	anon := dialTestClient(t, base, "", "")
+	idOf := func(c *testConn) string {
+		for _, m := range c.RecvAll(100 * time.Millisecond) {
+			if m.Key == msgConnected {
+				return m.Sender
+			}
+		}
+		t.Fatal("no welcome")
+		return ""
+	}
+	verifiedID, anonID := idOf(verified), idOf(anon)
+
+	// There is no dm type; a webrtc-offer is the directed message here.
+	anon.Send(message{Type: "webrtc-offer", Target: verifiedID, SDP: "v=0"})
+	if msgs := anon.RecvAll(200 * time.Millisecond); !refusedWith(msgs, msgTypeNotAllowed) {
+		t.Error("anonymous offer was not refused")
+	}
+	verified.Send(message{Type: "webrtc-offer", Target: anonID, SDP: "v=0"})
+	var offered bool
+	for _, m := range anon.RecvAll(200 * time.Millisecond) {
+		offered = offered || m.Type == "webrtc-offer"
+	}
+	if !offered {
+		t.Error("authenticated offer was not delivered")
+	}
+	for _, m := range verified.RecvAll(100 * time.Millisecond) {
+		if m.Type == "webrtc-offer" && m.Sender == anonID {
+			t.Error("anonymous offer reached its target")
+		}
+	}
+
+	anon.Send(message{Type: "chat", Text: "still here"})
+	var relayed bool
+	for _, m := range verified.RecvAll(200 * time.Millisecond) {
+		relayed = relayed || (m.Type == "chat" && m.Text == "still here")
+	}
+	if !relayed {
+		t.Error("anonymous chat, which is in its set, was not relayed")
+	}
+}
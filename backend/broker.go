@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// brokerQueue bounds the broadcasts waiting to be published. Past it
+	// they are dropped rather than holding up Run.
+	brokerQueue = 1024
+
+	// brokerRetry is how long the broker waits before reconnecting after
+	// losing its connection.
+	brokerRetry = time.Second
+
+	// brokerDialTimeout bounds connecting to the broker.
+	brokerDialTimeout = 5 * time.Second
+)
+
+// broker relays broadcasts between instances of the server, so clients
+// connected to different processes behind a load balancer still hear
+// each other. Each instance publishes what its own hub broadcasts and
+// fans out what the others publish.
+type broker interface {
+	// publish queues msg for the other instances without blocking.
+	publish(msg brokerMessage)
+	// subscribe calls deliver with every message another instance
+	// publishes. It runs until the process exits.
+	subscribe(deliver func(brokerMessage))
+}
+
+// brokerMessage is a broadcast as it travels between instances. Node
+// names the instance that published it, which ignores its own messages
+// when they come back.
+type brokerMessage struct {
+	Node   string          `json:"node"`
+	Type   string          `json:"type"`
+	ID     string          `json:"id,omitempty"`
+	Room   string          `json:"room,omitempty"`
+	Typing string          `json:"typing,omitempty"`
+	Depth  int             `json:"depth,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// relay fans out a broadcast published by another instance. It is
+// marked remote so Run doesn't publish it again.
+func (h *hub) relay(msg brokerMessage) {
+	h.broadcast <- envelope{msgType: msg.Type, msgID: msg.ID, data: msg.Data, room: msg.Room, typing: msg.Typing, depth: msg.Depth, remote: true}
+}
+
+// redisBroker relays broadcasts over a Redis pub/sub channel. It speaks
+// just enough RESP for AUTH, PUBLISH and SUBSCRIBE.
+type redisBroker struct {
+	addr     string
+	user     string
+	password string
+	channel  string
+	node     string
+	queue    chan brokerMessage
+}
+
+// newRedisBroker parses a redis://[user:password@]host[:port] URL and
+// starts publishing to channel as node.
+func newRedisBroker(rawURL, channel, node string) (*redisBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	b := &redisBroker{
+		addr:    addr,
+		channel: channel,
+		node:    node,
+		queue:   make(chan brokerMessage, brokerQueue),
+	}
+	if u.User != nil {
+		b.user = u.User.Username()
+		b.password, _ = u.User.Password()
+	}
+	go b.publishLoop()
+	return b, nil
+}
+
+func (b *redisBroker) publish(msg brokerMessage) {
+	msg.Node = b.node
+	select {
+	case b.queue <- msg:
+	default:
+		brokerDropped.inc()
+	}
+}
+
+// publishLoop publishes queued messages over one connection, reconnecting
+// whenever it fails. Messages that fail to publish are dropped.
+func (b *redisBroker) publishLoop() {
+	var conn *redisConn
+	for msg := range b.queue {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			marshalErrors.inc()
+			continue
+		}
+		if conn == nil {
+			if conn, err = b.dial(); err != nil {
+				log.Printf("broker: connecting to %s failed: %v", b.addr, err)
+				brokerDropped.inc()
+				conn = nil
+				time.Sleep(brokerRetry)
+				continue
+			}
+		}
+		if _, err := conn.do("PUBLISH", b.channel, string(data)); err != nil {
+			log.Printf("broker: publish failed: %v", err)
+			brokerDropped.inc()
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (b *redisBroker) subscribe(deliver func(brokerMessage)) {
+	for {
+		err := b.listen(deliver)
+		log.Printf("broker: subscription to %s lost: %v", b.addr, err)
+		time.Sleep(brokerRetry)
+	}
+}
+
+// listen subscribes to the channel and delivers messages until the
+// connection fails.
+func (b *redisBroker) listen(deliver func(brokerMessage)) error {
+	conn, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.send("SUBSCRIBE", b.channel); err != nil {
+		return err
+	}
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		// Pushes are ["subscribe", channel, count] once, then
+		// ["message", channel, payload] for each publish.
+		push, ok := reply.([]any)
+		if !ok || len(push) != 3 || push[0] != "message" {
+			continue
+		}
+		payload, _ := push[2].(string)
+		var msg brokerMessage
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			log.Printf("broker: ignoring malformed message: %v", err)
+			continue
+		}
+		if msg.Node == b.node || msg.Type == "" {
+			continue
+		}
+		deliver(msg)
+	}
+}
+
+func (b *redisBroker) dial() (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", b.addr, brokerDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if b.password != "" {
+		args := []string{"AUTH", b.password}
+		if b.user != "" {
+			args = []string{"AUTH", b.user, b.password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// redisConn is a connection speaking RESP, Redis's wire protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and reads its reply.
+func (c *redisConn) do(args ...string) (any, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"...)
+		buf = append(buf, a...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// read parses one reply: a string for simple and bulk strings, an int64
+// for integers, nil for null, a []any for arrays, and an error for error
+// replies.
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, errors.New(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", kind)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server speaking just the pub/sub the broker uses.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu          sync.Mutex
+	subscribers []*redisConn
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, c := range r.subscribers {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(&redisConn{Conn: nc, r: bufio.NewReader(nc)})
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) url() string {
+	return "redis://" + r.ln.Addr().String()
+}
+
+func (r *fakeRedis) subscriberCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.subscribers)
+}
+
+// serve answers one connection's commands. Writes to a subscriber hold
+// mu, so a push never interleaves with another.
+func (r *fakeRedis) serve(c *redisConn) {
+	defer c.Close()
+	for {
+		cmd, err := c.read()
+		if err != nil {
+			return
+		}
+		args, _ := cmd.([]any)
+		if len(args) == 0 {
+			return
+		}
+		switch name, _ := args[0].(string); strings.ToUpper(name) {
+		case "SUBSCRIBE":
+			channel, _ := args[1].(string)
+			r.mu.Lock()
+			r.subscribers = append(r.subscribers, c)
+			_, _ = c.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n:1\r\n"))
+			r.mu.Unlock()
+		case "PUBLISH":
+			channel, _ := args[1].(string)
+			payload, _ := args[2].(string)
+			r.mu.Lock()
+			for _, s := range r.subscribers {
+				_ = s.send("message", channel, payload)
+			}
+			n := len(r.subscribers)
+			r.mu.Unlock()
+			_, _ = c.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+		default:
+			_, _ = c.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func TestBrokerRelaysBetweenInstancesOnce(t *testing.T) {
+	redis := startFakeRedis(t)
+	cfg := testConfig()
+	cfg.redisURL = redis.url()
+	_, baseA := newTestServer(t, cfg)
+	_, baseB := newTestServer(t, cfg)
+	waitFor(t, "both instances to subscribe", func() bool { return redis.subscriberCount() == 2 })
+
+	sender := dialTestClient(t, baseA, "", "")
+	local := dialTestClient(t, baseA, "", "")
+	remote := dialTestClient(t, baseB, "", "")
+	elsewhere := dialTestClient(t, baseB, "other", "")
+	for _, c := range []*testConn{sender, local, remote, elsewhere} {
+		c.RecvAll(100 * time.Millisecond)
+	}
+
+	sender.Send(message{Type: "chat", Text: "across the bridge"})
+	count := func(c *testConn) int {
+		var n int
+		for _, m := range c.RecvAll(300 * time.Millisecond) {
+			if m.Type == "chat" && m.Text == "across the bridge" {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(local); n != 1 {
+		t.Errorf("a client on the sending instance got the chat %d times, want once", n)
+	}
+	if n := count(remote); n != 1 {
+		t.Errorf("a client on the other instance got the chat %d times, want once", n)
+	}
+	if n := count(elsewhere); n != 0 {
+		t.Errorf("a client in another room on the other instance got the chat %d times", n)
+	}
+}
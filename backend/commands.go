@@ -0,0 +1,282 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chatCommand is a slash command typed into chat. run handles the
+// command's arguments; it may rewrite msg and return true to have it
+// broadcast as chat, or return false once it has dealt with it.
+type chatCommand struct {
+	usage string
+	run   func(c *client, msg *message, args string) bool
+}
+
+// defaultCommands is the command set every hub starts with. NewHub
+// installs it as hub.commands; embedders may add to it before calling
+// Run.
+func defaultCommands() map[string]chatCommand {
+	return map[string]chatCommand{
+		"me":   {usage: "/me <action>", run: meCommand},
+		"nick": {usage: "/nick <name>", run: nickCommand},
+		"who":  {usage: "/who", run: whoCommand},
+		"help": {usage: "/help", run: helpCommand},
+	}
+}
+
+// runCommands is the transform that interprets a chat starting with '/'
+// as a command. It runs after the flood and overload checks, so commands
+// are limited like any other chat. A leading "//" escapes the slash,
+// sending the rest as ordinary chat.
+func runCommands(c *client, msg *message) error {
+	if msg.Type != "chat" {
+		return nil
+	}
+	text := strings.TrimSpace(msg.Text)
+	switch {
+	case !strings.HasPrefix(text, "/"):
+		return nil
+	case strings.HasPrefix(text, "//"):
+		msg.Text = text[1:]
+		return nil
+	}
+	if !c.runCommand(msg, text) {
+		return errDropMessage
+	}
+	return nil
+}
+
+// runCommand dispatches a command line to the hub's registry and reports
+// whether msg should still be broadcast.
+func (c *client) runCommand(msg *message, text string) bool {
+	name, args, _ := strings.Cut(text[1:], " ")
+	cmd, ok := c.hub.commands[strings.ToLower(name)]
+	if !ok {
+		c.reply(message{
+			Type: "system",
+			Key:  msgUnknownCommand,
+			Text: strings.ReplaceAll(c.hub.cfg.catalog.text(msgUnknownCommand, c.locale), "{command}", "/"+name),
+			ID:   c.hub.idGen(),
+		})
+		return false
+	}
+	return cmd.run(c, msg, strings.TrimSpace(args))
+}
+
+// meCommand sends the arguments as an action, which clients render as
+// "<nick> <action>".
+func meCommand(c *client, msg *message, args string) bool {
+	if args == "" {
+		c.notifyUsage("me")
+		return false
+	}
+	msg.Text = args
+	msg.Action = true
+	return true
+}
+
+func nickCommand(c *client, _ *message, args string) bool {
+	if args == "" {
+		c.notifyUsage("nick")
+		return false
+	}
+	result := make(chan string, 1)
+	c.hub.renames <- renameRequest{client: c.hubClient(), nick: args, result: result}
+	if key := <-result; key != "" {
+		c.notify(key)
+	}
+	return false
+}
+
+func whoCommand(c *client, _ *message, _ string) bool {
+	result := make(chan roster, 1)
+	c.hub.rosters <- rosterRequest{client: c.hubClient(), result: result}
+	r := <-result
+	users := strings.Join(r.nicks, ", ")
+	if r.groups != nil {
+		users = r.summary()
+	}
+	c.reply(message{
+		Type:   "system",
+		Key:    msgWho,
+		Text:   strings.ReplaceAll(c.hub.cfg.catalog.text(msgWho, c.locale), "{users}", users),
+		ID:     c.hub.idGen(),
+		Users:  r.nicks,
+		Groups: r.groups,
+	})
+	return false
+}
+
+func helpCommand(c *client, _ *message, _ string) bool {
+	usages := make([]string, 0, len(c.hub.commands))
+	for _, cmd := range c.hub.commands {
+		usages = append(usages, cmd.usage)
+	}
+	sort.Strings(usages)
+	c.reply(message{
+		Type: "system",
+		Key:  msgHelp,
+		Text: strings.ReplaceAll(c.hub.cfg.catalog.text(msgHelp, c.locale), "{commands}", strings.Join(usages, ", ")),
+		ID:   c.hub.idGen(),
+	})
+	return false
+}
+
+// notifyUsage tells this client how the named command is used.
+func (c *client) notifyUsage(name string) {
+	c.reply(message{
+		Type: "system",
+		Key:  msgUsage,
+		Text: strings.ReplaceAll(c.hub.cfg.catalog.text(msgUsage, c.locale), "{usage}", c.hub.commands[name].usage),
+		ID:   c.hub.idGen(),
+	})
+}
+
+// renameRequest asks Run to change a client's nick. result receives the
+// key of the reason it was refused, or "" once the rename is announced.
+type renameRequest struct {
+	client Client
+	nick   string
+	result chan string
+}
+
+// nickPattern is what a chosen nick may look like: letters, digits and a
+// little punctuation, so a nick can't carry markup or pass for a
+// system message.
+var nickPattern = regexp.MustCompile(`^[\p{L}\p{N}_.-]{1,32}$`)
+
+// rename applies a rename request and announces the new nick to the
+// member's room. Nicks stay unique across rooms. It must only be called
+// from Run.
+func (h *hub) rename(m *member, req renameRequest) string {
+	if !nickPattern.MatchString(req.nick) {
+		return msgNickInvalid
+	}
+	if req.nick == m.nick {
+		return ""
+	}
+	if h.nickTaken(req.nick, m) {
+		return msgNickTaken
+	}
+	old := m.nick
+	delete(h.nicks, old)
+	h.nicks[req.nick] = req.client
+	m.nick = req.nick
+
+	// Like the maintenance advisory, the notice is one encoding in the
+	// default locale; clients can localize it from the key.
+	msg := message{
+		Type: "system",
+		Key:  msgNickChanged,
+		Text: strings.NewReplacer("{old}", old, "{nick}", m.nick).
+			Replace(h.cfg.catalog.text(msgNickChanged, defaultLocale)),
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Sender:     req.client.ID(),
+		User:       m.user,
+		Nick:       m.nick,
+		Room:       m.room,
+	}
+	if data, err := encode(msg, "nick change"); err == nil {
+		h.fanOut(envelope{msgType: msg.Type, msgID: msg.ID, data: data, room: m.room})
+	}
+	return ""
+}
+
+// nickTaken reports whether nick is unavailable to m: another client has
+// it, or it is the name of a connected verified user other than m's. It
+// must only be called from Run.
+func (h *hub) nickTaken(nick string, m *member) bool {
+	if _, ok := h.nicks[nick]; ok {
+		return true
+	}
+	return h.users[nick] > 0 && nick != m.user
+}
+
+// presenceIdleAfter is how long a member may go without sending before
+// the status grouping counts it as idle.
+const presenceIdleAfter = 5 * time.Minute
+
+// roster is the reply to /who: every nick in join order or, with
+// presenceGroupBy set, the members grouped with a capped sample of each
+// group's nicks.
+type roster struct {
+	nicks  []string
+	groups []presenceGroup
+}
+
+// rosterRequest asks Run for the roster of client's room.
+type rosterRequest struct {
+	client Client
+	result chan roster
+}
+
+// presenceGroup is one group of a grouped roster.
+type presenceGroup struct {
+	Name   string   `json:"name"`
+	Count  int      `json:"count"`
+	Sample []string `json:"sample"`
+}
+
+// summary renders a grouped roster as e.g. "active: 340 (showing 20),
+// idle: 50".
+func (r roster) summary() string {
+	parts := make([]string, 0, len(r.groups))
+	for _, g := range r.groups {
+		part := g.Name + ": " + strconv.Itoa(g.Count)
+		if len(g.Sample) < g.Count {
+			part += " (showing " + strconv.Itoa(len(g.Sample)) + ")"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// roster lists the clients registered in room for /who. It must only be
+// called from Run.
+func (h *hub) roster(room string) roster {
+	if h.cfg.presenceGroupBy == "" {
+		nicks := make([]string, 0, len(h.rooms[room]))
+		for _, c := range h.order {
+			if m := h.clients[c]; m.room == room {
+				nicks = append(nicks, m.nick)
+			}
+		}
+		return roster{nicks: nicks}
+	}
+
+	now := h.now()
+	byName := make(map[string]*presenceGroup)
+	for _, c := range h.order {
+		m := h.clients[c]
+		if m.room != room {
+			continue
+		}
+		name := m.version
+		if h.cfg.presenceGroupBy == presenceGroupStatus {
+			name = "active"
+			if now.Sub(m.lastActive) > presenceIdleAfter {
+				name = "idle"
+			}
+		}
+		g := byName[name]
+		if g == nil {
+			g = &presenceGroup{Name: name, Sample: []string{}}
+			byName[name] = g
+		}
+		g.Count++
+		if len(g.Sample) < h.cfg.presenceGroupSample {
+			g.Sample = append(g.Sample, m.nick)
+		}
+	}
+	groups := make([]presenceGroup, 0, len(byName))
+	for _, g := range byName {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return roster{groups: groups}
+}
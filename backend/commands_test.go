@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeCommandBroadcastsAction(t *testing.T) {
+	_, sender, receiver := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", Text: "/me waves"})
+	got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond))
+	if !ok || !got.Action || got.Text != "waves" {
+		t.Errorf("room got %+v, want the action waves", got)
+	}
+
+	sender.Send(message{Type: "chat", Text: "/me"})
+	if !refusedWith(sender.RecvAll(200*time.Millisecond), msgUsage) {
+		t.Error("/me without an action wasn't answered with its usage")
+	}
+	if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+		t.Error("/me without an action was relayed")
+	}
+}
+
+func TestNickCommandRenames(t *testing.T) {
+	h, sender, receiver := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", Text: "/nick robin"})
+	changed, ok := announced(receiver.RecvAll(200*time.Millisecond), msgNickChanged)
+	if !ok || changed.Nick != "robin" {
+		t.Fatalf("room got nick change %+v, want robin", changed)
+	}
+	var listed bool
+	for _, e := range h.presenceOf(defaultRoom) {
+		listed = listed || (e.ID == changed.Sender && e.Nick == "robin")
+	}
+	if !listed {
+		t.Error("presence doesn't list the new nick")
+	}
+
+	receiver.Send(message{Type: "chat", Text: "/nick robin"})
+	if !refusedWith(receiver.RecvAll(200*time.Millisecond), msgNickTaken) {
+		t.Error("taking another client's nick wasn't refused")
+	}
+	sender.Send(message{Type: "chat", Text: "/nick <b>"})
+	if !refusedWith(sender.RecvAll(200*time.Millisecond), msgNickInvalid) {
+		t.Error("a nick with markup wasn't refused")
+	}
+}
+
+func TestWhoCommandRepliesToSenderOnly(t *testing.T) {
+	h, sender, receiver := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", Text: "/who"})
+	who, ok := announced(sender.RecvAll(200*time.Millisecond), msgWho)
+	if !ok {
+		t.Fatal("/who got no reply")
+	}
+	var nicks []string
+	for _, e := range h.presenceOf(defaultRoom) {
+		nicks = append(nicks, e.Nick)
+	}
+	if strings.Join(who.Users, ",") != strings.Join(nicks, ",") {
+		t.Errorf("/who listed %v, want the room's %v", who.Users, nicks)
+	}
+	if _, ok := announced(receiver.RecvAll(100*time.Millisecond), msgWho); ok {
+		t.Error("/who reply reached another client")
+	}
+}
+
+func TestRosterGroupedWithCappedSample(t *testing.T) {
+	cfg := testConfig()
+	cfg.presenceGroupBy = presenceGroupStatus
+	cfg.presenceGroupSample = 2
+	h := NewHub(cfg)
+	now := time.Unix(100000, 0)
+	h.now = func() time.Time { return now }
+	add := func(nick, version string, idle time.Duration) {
+		c := newTestClient(randomID())
+		h.clients[c] = &member{nick: nick, room: defaultRoom, version: version, lastActive: now.Add(-idle)}
+		h.order = append(h.order, c)
+	}
+	add("a", "1.0.0", 0)
+	add("b", "1.0.0", time.Minute)
+	add("c", "2.0.0", 0)
+	add("d", "2.0.0", time.Hour)
+	other := newTestClient(randomID())
+	h.clients[other] = &member{nick: "e", room: "elsewhere", version: "1.0.0", lastActive: now}
+	h.order = append(h.order, other)
+
+	r := h.roster(defaultRoom)
+	if r.nicks != nil {
+		t.Errorf("grouped roster also listed every nick: %v", r.nicks)
+	}
+	if got, want := fmt.Sprint(r.groups), "[{active 3 [a b]} {idle 1 [d]}]"; got != want {
+		t.Errorf("status groups = %s, want %s", got, want)
+	}
+	if got, want := r.summary(), "active: 3 (showing 2), idle: 1"; got != want {
+		t.Errorf("summary = %q, want %q", got, want)
+	}
+
+	h.cfg.presenceGroupBy = presenceGroupVersion
+	if got, want := fmt.Sprint(h.roster(defaultRoom).groups), "[{1.0.0 2 [a b]} {2.0.0 2 [c d]}]"; got != want {
+		t.Errorf("version groups = %s, want %s", got, want)
+	}
+}
+
+func TestWhoCommandGrouped(t *testing.T) {
+	cfg := testConfig()
+	cfg.presenceGroupBy = presenceGroupStatus
+	cfg.presenceGroupSample = 1
+	_, sender, _ := replyTestPair(t, cfg)
+	sender.Send(message{Type: "chat", Text: "/who"})
+	who, ok := announced(sender.RecvAll(200*time.Millisecond), msgWho)
+	if !ok {
+		t.Fatal("/who got no reply")
+	}
+	if len(who.Users) != 0 {
+		t.Errorf("grouped /who listed every nick: %v", who.Users)
+	}
+	if len(who.Groups) != 1 || who.Groups[0].Name != "active" || who.Groups[0].Count != 2 || len(who.Groups[0].Sample) != 1 {
+		t.Errorf("/who groups = %+v, want both clients active with one in the sample", who.Groups)
+	}
+	if !strings.Contains(who.Text, "active: 2 (showing 1)") {
+		t.Errorf("/who text %q doesn't summarise the groups", who.Text)
+	}
+}
+
+func TestUnknownCommandRejected(t *testing.T) {
+	_, sender, receiver := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", Text: "/frobnicate now"})
+	notice, ok := announced(sender.RecvAll(200*time.Millisecond), msgUnknownCommand)
+	if !ok || !strings.Contains(notice.Text, "/frobnicate") {
+		t.Errorf("unknown command answered %+v, want %s naming it", notice, msgUnknownCommand)
+	}
+	if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+		t.Error("an unknown command was relayed as chat")
+	}
+
+	sender.Send(message{Type: "chat", Text: "//frobnicate"})
+	if got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond)); !ok || got.Text != "/frobnicate" {
+		t.Errorf("escaped slash relayed %+v, want the chat /frobnicate", got)
+	}
+}
+
+func TestHelpListsRegisteredCommands(t *testing.T) {
+	h, sender, _ := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", Text: "/help"})
+	help, ok := announced(sender.RecvAll(200*time.Millisecond), msgHelp)
+	if !ok {
+		t.Fatal("/help got no reply")
+	}
+	for _, cmd := range h.commands {
+		if !strings.Contains(help.Text, cmd.usage) {
+			t.Errorf("/help %q doesn't list %s", help.Text, cmd.usage)
+		}
+	}
+}
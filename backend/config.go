@@ -0,0 +1,992 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	oversizeTruncate = "truncate"
+	oversizeReject   = "reject"
+)
+
+// Formats for the serverTime stamped on outgoing messages.
+const (
+	timeFormatRFC3339Nano = "rfc3339nano"
+	timeFormatRFC3339     = "rfc3339"
+	timeFormatUnixMillis  = "unixms"
+)
+
+// What the hub does after recovering a panic in Run.
+const (
+	hubPanicRestart = "restart"
+	hubPanicExit    = "exit"
+)
+
+// Which rooms a client may bring into being by joining them.
+const (
+	roomCreationOpen       = "open"
+	roomCreationRestricted = "restricted"
+	roomCreationClosed     = "closed"
+)
+
+// Attributes the /who roster can be grouped by.
+const (
+	presenceGroupVersion = "version"
+	presenceGroupStatus  = "status"
+)
+
+// config holds the hub's tunables. Values come from the environment at
+// startup; defaultConfig describes the behaviour when nothing is set.
+type config struct {
+	// oversizePolicy decides what happens to a message whose encoded form
+	// grows past maxMessage once the server has enriched it: truncate its
+	// text, or reject it and tell the sender.
+	oversizePolicy string
+
+	// serverTimeFormat is how serverTime is written: an RFC 3339 string
+	// with or without fractional seconds, or Unix milliseconds as a
+	// number.
+	serverTimeFormat string
+
+	// broadcastEnqueueTimeout bounds how long a reader waits to hand a
+	// message to the hub before dropping it and nacking the sender. Zero
+	// waits indefinitely.
+	broadcastEnqueueTimeout time.Duration
+
+	// adminToken is the bearer token required by /api/admin endpoints.
+	// The admin API is disabled when it is empty.
+	adminToken string
+
+	// strictProtocol rejects upgrades that don't offer a supported
+	// useebird subprotocol instead of assuming the latest version.
+	strictProtocol bool
+
+	// registrationQueue is the capacity of the hub's register and
+	// unregister queues, letting upgrades hand off without waiting for Run
+	// to finish a broadcast fan-out.
+	registrationQueue int
+
+	// serverStatusInterval is how often each client is sent a
+	// server_status load hint, layered on top of protocol pings. Zero
+	// disables it.
+	serverStatusInterval time.Duration
+
+	// egressBytesPerSec caps the bytes written to each client per second,
+	// smoothing bursts by delaying writes. Zero means unlimited.
+	egressBytesPerSec int
+
+	// readGrace extends each read deadline past pongWait so a brief signal
+	// loss on mobile networks doesn't drop the connection. Zero keeps the
+	// strict deadline.
+	readGrace time.Duration
+
+	// pingJitterPercent shortens each connection's ping interval by a
+	// random amount up to this percentage, so clients that connected
+	// together don't ping in lockstep. It only ever shortens the interval,
+	// keeping pings inside the peer's read deadline.
+	pingJitterPercent int
+
+	// sanitizeHTML escapes HTML in chat text before broadcast, as defence
+	// in depth for clients that render text as markup.
+	sanitizeHTML bool
+
+	// normalizeText strips zero-width and bidi control characters from
+	// chat and collapses whitespace, keeping at most maxNewlines line
+	// breaks in a row.
+	normalizeText bool
+	maxNewlines   int
+
+	// authSecret enables the post-upgrade auth challenge: clients must
+	// answer with an HMAC of the server's nonce under this secret within
+	// authTimeout before they may send messages.
+	authSecret  string
+	authTimeout time.Duration
+
+	// tokenSecret, if set, verifies the HS256 bearer tokens clients
+	// present at connect, and connections without a valid one are
+	// refused unless allowAnonymous is set.
+	tokenSecret    string
+	allowAnonymous bool
+
+	// handshakeTimeout closes a connection that sends no message at all
+	// within this long of its upgrade, reclaiming half-open connections
+	// that go silent. Pongs don't count. Zero disables it, since a
+	// listen-only client legitimately never sends.
+	handshakeTimeout time.Duration
+
+	// announceJoinLeave broadcasts a system message rendered from
+	// joinTemplate or leaveTemplate whenever a client registers or
+	// unregisters. Templates may use {nick}, {room} and {count}.
+	announceJoinLeave bool
+	joinTemplate      string
+	leaveTemplate     string
+
+	// chatRate and chatBurst limit how fast each client may send chat.
+	// Tripping the limit escalates: the first offense within floodWindow
+	// draws a warning, the next a floodCooldown during which all the
+	// client's chat is dropped, and floodMaxOffenses a disconnect. Zero
+	// chatRate disables the limit.
+	chatRate         int
+	chatBurst        int
+	floodWindow      time.Duration
+	floodCooldown    time.Duration
+	floodMaxOffenses int
+
+	// messageRate and messageBurst limit how fast each client may send
+	// messages of any type but ping, so one socket can't crowd the hub's
+	// broadcast queue. Messages over the limit are dropped. Zero
+	// messageRate disables the limit.
+	messageRate  int
+	messageBurst int
+
+	// firstMessageDelay is how long a new connection must stay up before
+	// its chat is accepted, to raise the cost of hit-and-run spam. Zero
+	// disables the gate.
+	firstMessageDelay time.Duration
+
+	// rulesText, when set, is sent to every client as a rules message on
+	// joining a room, and its chat in that room is refused until it
+	// answers with accept_rules. A room's config can override it, an
+	// empty text turning the gate off there.
+	rulesText string
+
+	// rooms holds the settings individual rooms override, loaded from
+	// the JSON object of room name to roomConfig that ROOM_CONFIG_FILE
+	// names. Rooms without an entry use the global settings.
+	rooms map[string]roomConfig
+
+	// roomCreation decides which empty rooms a client may join:
+	// roomCreationOpen any, roomCreationRestricted those listed in
+	// rooms, roomCreationClosed none. The lobby is always open.
+	roomCreation string
+
+	// pollDuration is how long a poll stays open unless its creator
+	// closes it first.
+	pollDuration time.Duration
+
+	// presenceGroupBy groups the /who roster by client version or by
+	// active/idle status instead of listing every nick, giving each
+	// group's count and at most presenceGroupSample of its nicks. Empty
+	// lists every nick.
+	presenceGroupBy     string
+	presenceGroupSample int
+
+	// dedupWindow suppresses a chat whose text, ignoring case and
+	// spacing, matches one the same sender sent within the window. Zero
+	// disables it.
+	dedupWindow time.Duration
+
+	// minClientVersion turns away clients announcing an older version
+	// (MIN_CLIENT_VERSION), telling them to reload for the new assets.
+	// Clients that announce none, or an unparseable one, are turned away
+	// too unless allowUnversioned is set. Nil admits every version.
+	minClientVersion *semver
+	allowUnversioned bool
+
+	// memoryHighWater puts the server in a protective mode that rejects
+	// new chat once the heap reaches this many bytes, until it falls below
+	// memoryLowWater (default 80% of the high mark). Zero disables it.
+	memoryHighWater int
+	memoryLowWater  int
+
+	// shutdownReason and shutdownReconnectAfter go in the server_shutdown
+	// message clients receive when the process is asked to stop.
+	shutdownReason         string
+	shutdownReconnectAfter time.Duration
+
+	// debugEcho enables the "echo" message type, which returns a message
+	// to its sender as the server parsed it instead of broadcasting it.
+	// It is for protocol development and off by default.
+	debugEcho bool
+
+	// typingTimeout is how long a client's "typing":"start" lasts without
+	// a fresh start before the server broadcasts a stop on its behalf.
+	// Zero leaves the indicator to the client.
+	typingTimeout time.Duration
+
+	// maxTypingIndicators caps how many clients' typing events are
+	// relayed individually; beyond it, only the number of typers is
+	// broadcast. Zero relays every one.
+	maxTypingIndicators int
+
+	// quietHours suppresses join/leave announcements, typing and presence
+	// broadcasts during a daily window (QUIET_HOURS, e.g. "22:00-07:00",
+	// in QUIET_HOURS_TZ). Nil means never quiet.
+	quietHours *quietHours
+
+	// strictSenderOrder guarantees per-sender FIFO delivery: clients use a
+	// single send queue instead of priority lanes, and broadcasts carry a
+	// per-sender senderSeq so recipients can detect drops.
+	strictSenderOrder bool
+
+	// maxUpgrades caps websocket handshakes in progress at once. An
+	// upgrade beyond it waits up to upgradeQueueWait for a slot and is
+	// then refused with 503. Zero means unlimited.
+	maxUpgrades      int
+	upgradeQueueWait time.Duration
+
+	// maxReplays caps history replays in progress at once, so a reconnect
+	// storm doesn't have every new connection encoding and writing its
+	// history together. A connection beyond it waits up to
+	// replayQueueWait for a slot and otherwise connects without a replay,
+	// its welcome saying history was left out. Zero means unlimited.
+	maxReplays      int
+	replayQueueWait time.Duration
+
+	// admissionRate caps how many new connections per second are
+	// registered and sent their welcome; the rest wait their turn after
+	// the upgrade. It spreads out a reconnect flood. Zero means unlimited.
+	// admissionRamp is how long a surge takes to climb from a tenth of
+	// the rate to all of it.
+	admissionRate int
+	admissionRamp time.Duration
+
+	// broadcastRate caps how many broadcasts Run fans out per second, so a
+	// burst is spread out instead of starving registrations. Excess waits
+	// in the broadcast queue. Zero means unlimited.
+	broadcastRate int
+
+	// fanOutOffloadMinClients hands broadcasts to at least this many
+	// recipients to a worker goroutine, so Run keeps serving registrations
+	// while a large fan-out is in progress. Zero fans out inline.
+	fanOutOffloadMinClients int
+
+	// compressMinClients turns on per-message deflate for writes while at
+	// least this many clients are connected, where fan-out is large enough
+	// for the bandwidth saving to pay for the CPU. Zero disables
+	// compression.
+	compressMinClients int
+
+	// maxSendBacklog disconnects a websocket client with more than this
+	// many messages queued across its lanes, even where the low-priority
+	// lane would simply drop. Each lane holds 16, so it only bites below
+	// 32. Zero leaves only the per-lane limits.
+	maxSendBacklog int
+
+	// sendQueueMetrics times a sample of messages through each client's
+	// lanes into useebird_send_queue_wait_seconds.
+	sendQueueMetrics bool
+
+	// compressTypes refines compression per message type: a frame of a
+	// listed type is only compressed when at least its threshold in
+	// bytes, and never when the threshold is negative. Unlisted types are
+	// compressed whenever compression is on.
+	compressTypes map[string]int
+
+	// anonymousTypes and authenticatedTypes restrict the message types a
+	// client may send, by whether it has authenticated. A nil set allows
+	// every type.
+	anonymousTypes     map[string]bool
+	authenticatedTypes map[string]bool
+
+	// deadLetterCapacity enables an in-memory log of the most recent
+	// dropped messages, served by the admin API. deadLetterFile, if set,
+	// also receives every entry as a JSON line.
+	deadLetterCapacity int
+	deadLetterFile     string
+
+	// auditLogPath, if set, is a file every admin action is appended to
+	// as a JSON line.
+	auditLogPath string
+
+	// httpReadTimeout, httpWriteTimeout and httpIdleTimeout bound plain
+	// HTTP requests such as static files, so a slow client can't hold a
+	// connection indefinitely. Websockets are unaffected: the upgrade
+	// clears the server's deadlines and the pumps set their own. Long
+	// polls extend their write deadline to fit pollTimeout. Zero
+	// disables a timeout.
+	httpReadTimeout  time.Duration
+	httpWriteTimeout time.Duration
+	httpIdleTimeout  time.Duration
+
+	// tcpKeepAlive is the OS keepalive probe period for client sockets,
+	// for networks where the websocket ping interval detects dead peers
+	// too slowly. Zero keeps the server default.
+	tcpKeepAlive time.Duration
+
+	// userAgentAllow and userAgentDeny filter connections by User-Agent:
+	// an agent matching deny is refused, and when allow is set only
+	// matching agents are accepted. Nil patterns don't filter.
+	userAgentAllow *regexp.Regexp
+	userAgentDeny  *regexp.Regexp
+
+	// maxUpgradeHeaderBytes, maxOriginBytes and maxCookieBytes bound an
+	// upgrade request's headers in total, its Origin and its Cookie
+	// headers combined; larger requests get 431. Zero disables a check.
+	maxUpgradeHeaderBytes int
+	maxOriginBytes        int
+	maxCookieBytes        int
+
+	// trustedProxies are the peers whose X-Forwarded-For and X-Real-IP
+	// headers are believed when working out a client's address.
+	trustedProxies []netip.Prefix
+
+	// linkPreviews fetches OpenGraph metadata for the first link in each
+	// chat and broadcasts it as a link_preview. linkPreviewAllow and
+	// linkPreviewDeny are comma-separated host lists, matching
+	// subdomains; an empty allow list allows every public host.
+	linkPreviews     bool
+	linkPreviewAllow string
+	linkPreviewDeny  string
+
+	// attachmentHosts is a comma-separated list of hosts, matching
+	// subdomains, that chat attachments may link to; attachments are
+	// refused while it is empty. attachmentTypes lists the MIME types
+	// allowed, with "type/*" wildcards. maxAttachments and
+	// maxAttachmentBytes cap a chat's attachment count and total
+	// declared size.
+	attachmentHosts    string
+	attachmentTypes    string
+	maxAttachments     int
+	maxAttachmentBytes int
+
+	// migrationSecret signs the tokens handed to clients told to migrate
+	// to another instance, and enables /api/admin/migrate. Migrating
+	// clients that haven't confirmed within migrationTimeout are closed.
+	migrationSecret  string
+	migrationTimeout time.Duration
+
+	// translateURL, if set, is a translation API each chat is sent to
+	// once per language declared by connected clients; the results are
+	// broadcast as translation events.
+	translateURL string
+
+	// moderationURL, if set, is a moderation API each chat is sent to
+	// before broadcast, waiting at most moderationTimeout. A chat it
+	// can't judge in time is allowed or blocked per moderationFailure.
+	// The newest moderationFlagged chats it flags are kept for moderators
+	// to review at /api/admin/flagged.
+	moderationURL     string
+	moderationTimeout time.Duration
+	moderationFailure string
+	moderationFlagged int
+
+	// redisURL, if set, relays broadcasts between instances over the
+	// Redis pub/sub channel redisChannel, so clients on different
+	// processes share rooms.
+	redisURL     string
+	redisChannel string
+
+	// historyStore selects where broadcast chat is kept for replay:
+	// historyMemory keeps the newest historySize messages in process,
+	// historyNone keeps nothing. A new client is sent the newest
+	// historyReplay of its room's messages before live traffic, at most
+	// historyReplayBytes of them when that is positive.
+	historyStore       string
+	historySize        int
+	historyReplay      int
+	historyReplayBytes int
+
+	// danglingReplies lets a chat reply to an id history doesn't hold,
+	// such as one it has already forgotten. Otherwise the reply is
+	// refused. replyQuoteLength is how many characters of the parent's
+	// text a reply carries as its quote; zero leaves quotes off.
+	danglingReplies  bool
+	replyQuoteLength int
+
+	// maxReplyDepth caps how long a reply chain may grow: a chat whose
+	// parent is already that deep is refused. Zero leaves chains
+	// unbounded.
+	maxReplyDepth int
+
+	// idempotencyTTL is how long /api/broadcast remembers an
+	// Idempotency-Key, answering a retry with the original result. Zero
+	// ignores the header.
+	idempotencyTTL time.Duration
+
+	// hubPanicPolicy is what Run does after recovering a panic: exit the
+	// process, the default, or restart its loop. A restarted loop keeps
+	// whatever state the panic left, which may be half updated, and
+	// callers waiting on the request it was handling are never answered,
+	// so restart only suits a server that must limp along regardless.
+	hubPanicPolicy string
+
+	// scheduleFile names a JSON file of interval-based system
+	// announcements. It is re-read on SIGHUP.
+	scheduleFile string
+
+	// logOutput is where logs go: stderr, file or both. logFile rotates
+	// once it reaches logMaxBytes, keeping logBackups old files; zero
+	// logMaxBytes leaves rotation to an external tool, which can signal
+	// a reopen with SIGHUP.
+	logOutput   string
+	logFile     string
+	logMaxBytes int64
+	logBackups  int
+
+	// catalog holds the localized text for server messages. MESSAGE_CATALOG
+	// names a JSON file layered over the built-in translations.
+	catalog catalog
+}
+
+func defaultConfig() config {
+	return config{
+		oversizePolicy:         oversizeTruncate,
+		serverTimeFormat:       timeFormatRFC3339Nano,
+		registrationQueue:      64,
+		admissionRamp:          30 * time.Second,
+		catalog:                defaultCatalog,
+		authTimeout:            10 * time.Second,
+		announceJoinLeave:      true,
+		joinTemplate:           "{nick} joined",
+		leaveTemplate:          "{nick} left",
+		logOutput:              logStderr,
+		logBackups:             3,
+		typingTimeout:          6 * time.Second,
+		shutdownReason:         "deploy",
+		shutdownReconnectAfter: 5 * time.Second,
+		maxUpgrades:            256,
+		upgradeQueueWait:       time.Second,
+		maxReplays:             32,
+		replayQueueWait:        2 * time.Second,
+		httpReadTimeout:        15 * time.Second,
+		httpWriteTimeout:       30 * time.Second,
+		httpIdleTimeout:        2 * time.Minute,
+		chatBurst:              5,
+		messageRate:            10,
+		messageBurst:           20,
+		floodWindow:            time.Minute,
+		floodCooldown:          10 * time.Second,
+		floodMaxOffenses:       3,
+		maxNewlines:            2,
+		migrationTimeout:       30 * time.Second,
+		attachmentTypes:        "image/*,video/*,audio/*,application/pdf,text/plain",
+		maxAttachments:         4,
+		maxAttachmentBytes:     25 << 20,
+		pollDuration:           time.Hour,
+		roomCreation:           roomCreationOpen,
+		pingJitterPercent:      10,
+		presenceGroupSample:    20,
+		moderationTimeout:      time.Second,
+		moderationFailure:      moderationFailOpen,
+		moderationFlagged:      100,
+		idempotencyTTL:         time.Hour,
+		historyStore:           historyMemory,
+		redisChannel:           "useebird",
+		historySize:            500,
+		historyReplay:          50,
+		historyReplayBytes:     128 << 10,
+		replyQuoteLength:       100,
+		maxReplyDepth:          10,
+		hubPanicPolicy:         hubPanicExit,
+		maxUpgradeHeaderBytes:  64 << 10,
+		maxOriginBytes:         1 << 10,
+		maxCookieBytes:         16 << 10,
+	}
+}
+
+func loadConfig() config {
+	cfg := defaultConfig()
+
+	if v := os.Getenv("OVERSIZE_POLICY"); v != "" {
+		switch v = strings.ToLower(v); v {
+		case oversizeTruncate, oversizeReject:
+			cfg.oversizePolicy = v
+		default:
+			log.Printf("ignoring unknown OVERSIZE_POLICY %q", v)
+		}
+	}
+
+	if v := os.Getenv("HUB_PANIC_POLICY"); v != "" {
+		switch v = strings.ToLower(v); v {
+		case hubPanicRestart, hubPanicExit:
+			cfg.hubPanicPolicy = v
+		default:
+			log.Printf("ignoring unknown HUB_PANIC_POLICY %q", v)
+		}
+	}
+
+	if v := os.Getenv("SERVER_TIME_FORMAT"); v != "" {
+		switch v = strings.ToLower(v); v {
+		case timeFormatRFC3339Nano, timeFormatRFC3339, timeFormatUnixMillis:
+			cfg.serverTimeFormat = v
+		default:
+			log.Printf("ignoring unknown SERVER_TIME_FORMAT %q", v)
+		}
+	}
+
+	cfg.logFile = os.Getenv("LOG_FILE")
+	if cfg.logFile != "" {
+		cfg.logOutput = logFile
+	}
+	if v := os.Getenv("LOG_OUTPUT"); v != "" {
+		switch v = strings.ToLower(v); v {
+		case logStderr, logFile, logBoth:
+			cfg.logOutput = v
+		default:
+			log.Printf("ignoring unknown LOG_OUTPUT %q", v)
+		}
+	}
+	cfg.logMaxBytes = int64(envInt("LOG_MAX_BYTES", int(cfg.logMaxBytes)))
+	cfg.logBackups = envInt("LOG_BACKUPS", cfg.logBackups)
+	cfg.memoryHighWater = envInt("MEMORY_HIGH_WATERMARK", cfg.memoryHighWater)
+	cfg.memoryLowWater = envInt("MEMORY_LOW_WATERMARK", cfg.memoryHighWater*4/5)
+	if cfg.memoryLowWater > cfg.memoryHighWater {
+		log.Printf("ignoring MEMORY_LOW_WATERMARK above MEMORY_HIGH_WATERMARK")
+		cfg.memoryLowWater = cfg.memoryHighWater * 4 / 5
+	}
+
+	cfg.adminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.authSecret = os.Getenv("AUTH_CHALLENGE_SECRET")
+	cfg.tokenSecret = os.Getenv("JWT_SECRET")
+	cfg.allowAnonymous = envBool("ALLOW_ANONYMOUS", cfg.allowAnonymous)
+	cfg.scheduleFile = os.Getenv("ANNOUNCEMENT_SCHEDULE")
+	cfg.translateURL = os.Getenv("TRANSLATE_URL")
+	cfg.moderationURL = os.Getenv("MODERATION_URL")
+	cfg.moderationTimeout = envDuration("MODERATION_TIMEOUT", cfg.moderationTimeout)
+	cfg.moderationFlagged = envInt("MODERATION_FLAGGED_CAPACITY", cfg.moderationFlagged)
+	cfg.idempotencyTTL = envDuration("IDEMPOTENCY_TTL", cfg.idempotencyTTL)
+	// HISTORY_STORE is the older name for HISTORY_BACKEND.
+	backendEnv := "HISTORY_BACKEND"
+	if os.Getenv(backendEnv) == "" && os.Getenv("HISTORY_STORE") != "" {
+		backendEnv = "HISTORY_STORE"
+	}
+	if v := os.Getenv(backendEnv); v != "" {
+		switch v = strings.ToLower(v); v {
+		case historyMemory, historyNone:
+			cfg.historyStore = v
+		default:
+			log.Printf("ignoring unknown %s %q", backendEnv, v)
+		}
+	}
+	cfg.historySize = envInt("HISTORY_SIZE", cfg.historySize)
+	cfg.redisURL = os.Getenv("REDIS_URL")
+	if v := os.Getenv("REDIS_CHANNEL"); v != "" {
+		cfg.redisChannel = v
+	}
+	cfg.historyReplay = envInt("HISTORY_REPLAY", cfg.historyReplay)
+	cfg.historyReplayBytes = envInt("HISTORY_REPLAY_BYTES", cfg.historyReplayBytes)
+	cfg.danglingReplies = envBool("ALLOW_DANGLING_REPLIES", cfg.danglingReplies)
+	cfg.replyQuoteLength = envInt("REPLY_QUOTE_LENGTH", cfg.replyQuoteLength)
+	cfg.maxReplyDepth = envInt("MAX_REPLY_DEPTH", cfg.maxReplyDepth)
+	if v := os.Getenv("MODERATION_FAILURE"); v != "" {
+		switch v = strings.ToLower(v); v {
+		case moderationFailOpen, moderationFailClosed:
+			cfg.moderationFailure = v
+		default:
+			log.Printf("ignoring unknown MODERATION_FAILURE %q", v)
+		}
+	}
+	cfg.trustedProxies = parseTrustedProxies(os.Getenv("TRUST_PROXY"))
+	cfg.userAgentAllow = envRegexp("USER_AGENT_ALLOW")
+	cfg.userAgentDeny = envRegexp("USER_AGENT_DENY")
+	cfg.maxUpgradeHeaderBytes = envInt("MAX_UPGRADE_HEADER_BYTES", cfg.maxUpgradeHeaderBytes)
+	cfg.maxOriginBytes = envInt("MAX_ORIGIN_BYTES", cfg.maxOriginBytes)
+	cfg.maxCookieBytes = envInt("MAX_COOKIE_BYTES", cfg.maxCookieBytes)
+	cfg.authTimeout = envDuration("AUTH_CHALLENGE_TIMEOUT", cfg.authTimeout)
+	cfg.handshakeTimeout = envDuration("HANDSHAKE_TIMEOUT", cfg.handshakeTimeout)
+	cfg.broadcastEnqueueTimeout = envDuration("BROADCAST_ENQUEUE_TIMEOUT", cfg.broadcastEnqueueTimeout)
+	cfg.strictProtocol = envBool("STRICT_PROTOCOL", cfg.strictProtocol)
+	cfg.sanitizeHTML = envBool("SANITIZE_HTML", cfg.sanitizeHTML)
+	cfg.normalizeText = envBool("NORMALIZE_TEXT", cfg.normalizeText)
+	cfg.maxNewlines = envInt("NORMALIZE_MAX_NEWLINES", cfg.maxNewlines)
+	cfg.debugEcho = envBool("DEBUG_ECHO", cfg.debugEcho)
+	if v := os.Getenv("SHUTDOWN_REASON"); v != "" {
+		if shutdownReasons[v] {
+			cfg.shutdownReason = v
+		} else {
+			log.Printf("ignoring unknown SHUTDOWN_REASON %q", v)
+		}
+	}
+	cfg.shutdownReconnectAfter = envDuration("SHUTDOWN_RECONNECT_AFTER", cfg.shutdownReconnectAfter)
+	cfg.linkPreviews = envBool("LINK_PREVIEWS", cfg.linkPreviews)
+	cfg.linkPreviewAllow = os.Getenv("LINK_PREVIEW_ALLOW")
+	cfg.linkPreviewDeny = os.Getenv("LINK_PREVIEW_DENY")
+	cfg.attachmentHosts = os.Getenv("ATTACHMENT_HOSTS")
+	cfg.migrationSecret = os.Getenv("MIGRATION_SECRET")
+	cfg.migrationTimeout = envDuration("MIGRATION_TIMEOUT", cfg.migrationTimeout)
+	if v := os.Getenv("ATTACHMENT_TYPES"); v != "" {
+		cfg.attachmentTypes = v
+	}
+	cfg.maxAttachments = envInt("MAX_ATTACHMENTS", cfg.maxAttachments)
+	cfg.maxAttachmentBytes = envInt("MAX_ATTACHMENT_BYTES", cfg.maxAttachmentBytes)
+	cfg.strictSenderOrder = envBool("STRICT_SENDER_ORDER", cfg.strictSenderOrder)
+	if v := os.Getenv("MIN_CLIENT_VERSION"); v != "" {
+		if floor, ok := parseSemver(v); ok {
+			cfg.minClientVersion = &floor
+		} else {
+			log.Printf("ignoring invalid MIN_CLIENT_VERSION %q", v)
+		}
+	}
+	cfg.allowUnversioned = envBool("ALLOW_UNVERSIONED_CLIENTS", cfg.allowUnversioned)
+	cfg.announceJoinLeave = envBool("ANNOUNCE_JOIN_LEAVE", cfg.announceJoinLeave)
+	if v := os.Getenv("JOIN_TEMPLATE"); v != "" {
+		cfg.joinTemplate = v
+	}
+	if v := os.Getenv("LEAVE_TEMPLATE"); v != "" {
+		cfg.leaveTemplate = v
+	}
+	cfg.serverStatusInterval = envDuration("SERVER_STATUS_INTERVAL", cfg.serverStatusInterval)
+	cfg.readGrace = envDuration("READ_GRACE", cfg.readGrace)
+	cfg.pingJitterPercent = envInt("PING_JITTER_PERCENT", cfg.pingJitterPercent)
+	if cfg.pingJitterPercent < 0 || cfg.pingJitterPercent > 50 {
+		log.Printf("ignoring PING_JITTER_PERCENT outside 0-50")
+		cfg.pingJitterPercent = 10
+	}
+	cfg.dedupWindow = envDuration("DEDUP_WINDOW", cfg.dedupWindow)
+	cfg.firstMessageDelay = envDuration("FIRST_MESSAGE_DELAY", cfg.firstMessageDelay)
+	cfg.rulesText = os.Getenv("RULES_TEXT")
+	if v := os.Getenv("ROOM_CREATION"); v != "" {
+		switch v = strings.ToLower(v); v {
+		case roomCreationOpen, roomCreationRestricted, roomCreationClosed:
+			cfg.roomCreation = v
+		default:
+			log.Printf("ignoring unknown ROOM_CREATION %q", v)
+		}
+	}
+	if path := os.Getenv("ROOM_CONFIG_FILE"); path != "" {
+		if rooms, err := loadRoomConfig(path); err != nil {
+			log.Printf("ignoring ROOM_CONFIG_FILE: %v", err)
+		} else {
+			cfg.rooms = rooms
+		}
+	}
+	cfg.pollDuration = envDuration("POLL_DURATION", cfg.pollDuration)
+	if v := os.Getenv("PRESENCE_GROUP_BY"); v != "" {
+		switch v = strings.ToLower(v); v {
+		case presenceGroupVersion, presenceGroupStatus:
+			cfg.presenceGroupBy = v
+		default:
+			log.Printf("ignoring unknown PRESENCE_GROUP_BY %q", v)
+		}
+	}
+	cfg.presenceGroupSample = envInt("PRESENCE_GROUP_SAMPLE", cfg.presenceGroupSample)
+	cfg.chatRate = envInt("CHAT_RATE", cfg.chatRate)
+	cfg.chatBurst = envInt("CHAT_BURST", cfg.chatBurst)
+	cfg.floodWindow = envDuration("FLOOD_WINDOW", cfg.floodWindow)
+	cfg.floodCooldown = envDuration("FLOOD_COOLDOWN", cfg.floodCooldown)
+	cfg.floodMaxOffenses = envInt("FLOOD_MAX_OFFENSES", cfg.floodMaxOffenses)
+	cfg.messageRate = envInt("RATE_LIMIT_PER_SEC", cfg.messageRate)
+	cfg.messageBurst = envInt("RATE_LIMIT_BURST", cfg.messageBurst)
+	cfg.typingTimeout = envDuration("TYPING_TIMEOUT", cfg.typingTimeout)
+	cfg.maxTypingIndicators = envInt("MAX_TYPING_INDICATORS", cfg.maxTypingIndicators)
+	cfg.tcpKeepAlive = envDuration("TCP_KEEPALIVE_PERIOD", cfg.tcpKeepAlive)
+	cfg.httpReadTimeout = envDuration("HTTP_READ_TIMEOUT", cfg.httpReadTimeout)
+	cfg.httpWriteTimeout = envDuration("HTTP_WRITE_TIMEOUT", cfg.httpWriteTimeout)
+	cfg.httpIdleTimeout = envDuration("HTTP_IDLE_TIMEOUT", cfg.httpIdleTimeout)
+	cfg.registrationQueue = envInt("REGISTRATION_QUEUE_SIZE", cfg.registrationQueue)
+	cfg.egressBytesPerSec = envInt("CLIENT_EGRESS_BYTES_PER_SEC", cfg.egressBytesPerSec)
+	cfg.deadLetterCapacity = envInt("DEAD_LETTER_CAPACITY", cfg.deadLetterCapacity)
+	cfg.deadLetterFile = os.Getenv("DEAD_LETTER_FILE")
+	cfg.auditLogPath = os.Getenv("AUDIT_LOG_PATH")
+	cfg.maxUpgrades = envInt("MAX_CONCURRENT_UPGRADES", cfg.maxUpgrades)
+	cfg.upgradeQueueWait = envDuration("UPGRADE_QUEUE_WAIT", cfg.upgradeQueueWait)
+	cfg.maxReplays = envInt("MAX_CONCURRENT_REPLAYS", cfg.maxReplays)
+	cfg.replayQueueWait = envDuration("REPLAY_QUEUE_WAIT", cfg.replayQueueWait)
+	cfg.admissionRate = envInt("ADMISSION_RATE", cfg.admissionRate)
+	cfg.admissionRamp = envDuration("ADMISSION_RAMP", cfg.admissionRamp)
+	cfg.broadcastRate = envInt("BROADCAST_RATE", cfg.broadcastRate)
+	cfg.compressMinClients = envInt("COMPRESSION_MIN_CLIENTS", cfg.compressMinClients)
+	cfg.maxSendBacklog = envInt("MAX_SEND_BACKLOG", cfg.maxSendBacklog)
+	cfg.sendQueueMetrics = envBool("SEND_QUEUE_METRICS", cfg.sendQueueMetrics)
+	if v := os.Getenv("COMPRESSION_TYPES"); v != "" {
+		if types, err := parseCompressTypes(v); err != nil {
+			log.Printf("ignoring invalid COMPRESSION_TYPES %q: %v", v, err)
+		} else {
+			cfg.compressTypes = types
+		}
+	}
+	cfg.anonymousTypes = parseTypeSet(os.Getenv("ANONYMOUS_MESSAGE_TYPES"))
+	cfg.authenticatedTypes = parseTypeSet(os.Getenv("AUTHENTICATED_MESSAGE_TYPES"))
+	cfg.fanOutOffloadMinClients = envInt("FANOUT_OFFLOAD_MIN_CLIENTS", cfg.fanOutOffloadMinClients)
+
+	if v := os.Getenv("QUIET_HOURS"); v != "" {
+		loc := time.Local
+		if tz := os.Getenv("QUIET_HOURS_TZ"); tz != "" {
+			if l, err := time.LoadLocation(tz); err != nil {
+				log.Printf("ignoring invalid QUIET_HOURS_TZ %q", tz)
+			} else {
+				loc = l
+			}
+		}
+		if q, err := parseQuietHours(v, loc); err != nil {
+			log.Printf("ignoring QUIET_HOURS: %v", err)
+		} else {
+			cfg.quietHours = q
+		}
+	}
+
+	if path := os.Getenv("MESSAGE_CATALOG"); path != "" {
+		if cat, err := loadCatalog(path); err != nil {
+			log.Printf("ignoring MESSAGE_CATALOG: %v", err)
+		} else {
+			cfg.catalog = cat
+		}
+	}
+
+	return cfg
+}
+
+// envInt parses a non-negative integer from the named variable, returning
+// def when it is unset or invalid.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("ignoring invalid %s %q", name, v)
+		return def
+	}
+	return n
+}
+
+// envBool parses a boolean such as "true" or "1" from the named variable,
+// returning def when it is unset or invalid.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("ignoring invalid %s %q", name, v)
+		return def
+	}
+	return b
+}
+
+// envRegexp compiles the pattern in an environment variable, or returns
+// nil when it is unset or invalid.
+func envRegexp(name string) *regexp.Regexp {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	re, err := regexp.Compile(v)
+	if err != nil {
+		log.Printf("ignoring invalid %s %q: %v", name, v, err)
+		return nil
+	}
+	return re
+}
+
+// parseCompressTypes parses a list such as "chat:256,typing:never" into
+// per-type compression thresholds, with never as -1.
+func parseCompressTypes(v string) (map[string]int, error) {
+	types := make(map[string]int)
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		msgType, size, ok := strings.Cut(entry, ":")
+		if !ok || msgType == "" {
+			return nil, fmt.Errorf("want type:bytes, got %q", entry)
+		}
+		if size == "never" {
+			types[msgType] = -1
+			continue
+		}
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid threshold in %q", entry)
+		}
+		types[msgType] = n
+	}
+	return types, nil
+}
+
+// parseTypeSet parses a comma-separated list of message types, returning
+// nil for an empty list.
+func parseTypeSet(v string) map[string]bool {
+	var types map[string]bool
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if types == nil {
+			types = make(map[string]bool)
+		}
+		types[t] = true
+	}
+	return types
+}
+
+// roomConfig is what ROOM_CONFIG_FILE can set for one room. A field left
+// out falls back to the global setting.
+type roomConfig struct {
+	// Rules replaces rulesText in the room; "" turns the gate off.
+	Rules *string `json:"rules"`
+
+	// Types, when set, lists the message types clients may broadcast in
+	// the room. An empty list makes it announcement-only, carrying
+	// nothing but what the server and admins post.
+	Types []string `json:"types"`
+
+	// MaxTextBytes and MaxMessageBytes, when positive, replace the
+	// limits on chat text and on a whole frame. A larger text limit
+	// needs a larger frame limit to be of use.
+	MaxTextBytes    int `json:"maxTextBytes"`
+	MaxMessageBytes int `json:"maxMessageBytes"`
+
+	// AllowedUsers, when set, makes the room private to the bearer token
+	// subjects it lists. Anyone else, anonymous clients included, is
+	// kept out of it and its history and presence.
+	AllowedUsers []string `json:"allowedUsers"`
+
+	// MaxMembers, when positive, caps how many clients the room holds.
+	MaxMembers int `json:"maxMembers"`
+}
+
+// loadRoomConfig reads a JSON object mapping room names to their config.
+func loadRoomConfig(path string) (map[string]roomConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rooms map[string]roomConfig
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return rooms, nil
+}
+
+// rulesFor returns the rules a client must accept to chat in room, or ""
+// if it needn't accept any.
+func (cfg config) rulesFor(room string) string {
+	if rules := cfg.rooms[room].Rules; rules != nil {
+		return *rules
+	}
+	return cfg.rulesText
+}
+
+// textLimit returns the most bytes of text a message may carry in room.
+func (cfg config) textLimit(room string) int {
+	if n := cfg.rooms[room].MaxTextBytes; n > 0 {
+		return n
+	}
+	return maxTextBytes
+}
+
+// frameLimit returns the largest frame a client may send, or have
+// broadcast, in room.
+func (cfg config) frameLimit(room string) int {
+	if n := cfg.rooms[room].MaxMessageBytes; n > 0 {
+		return n
+	}
+	return maxMessage
+}
+
+// longField returns the name of the first field of msg over its limit in
+// room, or "" if none is. Only the text limit varies by room.
+func (cfg config) longField(room string, msg *message) string {
+	for _, f := range fieldLimits {
+		limit := f.max
+		if f.name == "text" {
+			limit = cfg.textLimit(room)
+		}
+		if len(f.value(msg)) > limit {
+			return f.name
+		}
+	}
+	return ""
+}
+
+// roomFull reports whether room, holding members clients, takes no more.
+func (cfg config) roomFull(room string, members int) bool {
+	max := cfg.rooms[room].MaxMembers
+	return max > 0 && members >= max
+}
+
+// userMayJoin reports whether user, "" when anonymous, may enter room.
+func (cfg config) userMayJoin(room, user string) bool {
+	allowed := cfg.rooms[room].AllowedUsers
+	if allowed == nil {
+		return true
+	}
+	for _, u := range allowed {
+		if u == user && user != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// roomAllows reports whether clients may broadcast msgType in room.
+func (cfg config) roomAllows(room, msgType string) bool {
+	types := cfg.rooms[room].Types
+	if types == nil {
+		return true
+	}
+	for _, t := range types {
+		if t == msgType {
+			return true
+		}
+	}
+	return false
+}
+
+// typeAllowed reports whether a client may send msgType, given whether it
+// has authenticated.
+func (cfg config) typeAllowed(msgType string, authenticated bool) bool {
+	types := cfg.anonymousTypes
+	if authenticated {
+		types = cfg.authenticatedTypes
+	}
+	return types == nil || types[msgType]
+}
+
+// compressible reports whether a frame of msgType and size bytes should
+// be compressed when compression is on.
+func (cfg config) compressible(msgType string, size int) bool {
+	threshold, ok := cfg.compressTypes[msgType]
+	return !ok || (threshold >= 0 && size >= threshold)
+}
+
+// userAgentAllowed reports whether a connection with User-Agent ua passes
+// the allow and deny patterns. An empty agent only passes when no allow
+// pattern is set.
+func (cfg config) userAgentAllowed(ua string) bool {
+	if cfg.userAgentDeny != nil && cfg.userAgentDeny.MatchString(ua) {
+		return false
+	}
+	if cfg.userAgentAllow != nil {
+		return ua != "" && cfg.userAgentAllow.MatchString(ua)
+	}
+	return true
+}
+
+// headersTooLarge reports whether an upgrade request's headers exceed the
+// configured limits. Each header line counts its name, value and
+// separators.
+func (cfg config) headersTooLarge(header http.Header) bool {
+	total, cookies := 0, 0
+	for name, values := range header {
+		for _, v := range values {
+			total += len(name) + len(v) + 4
+		}
+		if name == "Cookie" {
+			for _, v := range values {
+				cookies += len(v)
+			}
+		}
+	}
+	return cfg.maxUpgradeHeaderBytes > 0 && total > cfg.maxUpgradeHeaderBytes ||
+		cfg.maxOriginBytes > 0 && len(header.Get("Origin")) > cfg.maxOriginBytes ||
+		cfg.maxCookieBytes > 0 && cookies > cfg.maxCookieBytes
+}
+
+// envDuration parses a duration such as "250ms" from the named variable,
+// returning def when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("ignoring invalid %s %q", name, v)
+		return def
+	}
+	return d
+}
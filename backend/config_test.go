@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUserAgentAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name, allow, deny string
+		ua                string
+		want              bool
+	}{
+		{"NoPolicy", "", "", "curl/8.0", true},
+		{"NoPolicyEmpty", "", "", "", true},
+		{"Denied", "", `(?i)scrapy|python-requests`, "Scrapy/2.11", false},
+		{"NotDenied", "", `(?i)scrapy|python-requests`, "Mozilla/5.0", true},
+		{"DenyOnlyEmpty", "", `(?i)scrapy`, "", true},
+		{"Allowed", `^USeeBird/\d+`, "", "USeeBird/3 (iOS)", true},
+		{"NotAllowed", `^USeeBird/\d+`, "", "Mozilla/5.0", false},
+		{"AllowEmpty", `^USeeBird/\d+`, "", "", false},
+		{"DenyWins", `^USeeBird/`, `beta`, "USeeBird/3-beta", false},
+	} {
+		cfg := testConfig()
+		if tc.allow != "" {
+			cfg.userAgentAllow = regexp.MustCompile(tc.allow)
+		}
+		if tc.deny != "" {
+			cfg.userAgentDeny = regexp.MustCompile(tc.deny)
+		}
+		if got := cfg.userAgentAllowed(tc.ua); got != tc.want {
+			t.Errorf("%s: userAgentAllowed(%q) = %t, want %t", tc.name, tc.ua, got, tc.want)
+		}
+	}
+}
+
+func TestDeniedUserAgentRefusedUpgrade(t *testing.T) {
+	cfg := testConfig()
+	cfg.userAgentDeny = regexp.MustCompile(`(?i)scrapy`)
+	_, base := newTestServer(t, cfg)
+	u := "ws" + strings.TrimPrefix(base, "http") + "/ws"
+	for ua, want := range map[string]int{"Scrapy/2.11": http.StatusForbidden, "Mozilla/5.0": http.StatusSwitchingProtocols} {
+		conn, resp, err := websocket.DefaultDialer.Dial(u, http.Header{"User-Agent": {ua}})
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("dial as %q: %v", ua, err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("upgrade as %q answered %d, want %d", ua, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestOversizedHeadersRefusedUpgrade(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	u := "ws" + strings.TrimPrefix(base, "http") + "/ws"
+	for name, tc := range map[string]struct {
+		header http.Header
+		want   int
+	}{
+		"Normal":      {http.Header{"Cookie": {"session=abc"}, "User-Agent": {"Mozilla/5.0"}}, http.StatusSwitchingProtocols},
+		"Origin":      {http.Header{"Origin": {"http://" + strings.Repeat("a", 2<<10) + ".example"}}, http.StatusRequestHeaderFieldsTooLarge},
+		"Cookies":     {http.Header{"Cookie": {"a=" + strings.Repeat("x", 10<<10), "b=" + strings.Repeat("y", 10<<10)}}, http.StatusRequestHeaderFieldsTooLarge},
+		"TotalHeader": {http.Header{"X-Padding": {strings.Repeat("p", 70<<10)}}, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(u, tc.header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("dial with %s headers: %v", name, err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("upgrade with %s headers answered %d, want %d", name, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestCompressTypesPolicy(t *testing.T) {
+	types, err := parseCompressTypes("chat:256, typing:never,presence:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig()
+	cfg.compressTypes = types
+	for _, tc := range []struct {
+		msgType string
+		size    int
+		want    bool
+	}{
+		{"chat", 255, false},
+		{"chat", 256, true},
+		{"typing", 1 << 20, false},
+		{"presence", 1, true},
+		{"system", 1, true},
+	} {
+		if got := cfg.compressible(tc.msgType, tc.size); got != tc.want {
+			t.Errorf("compressible(%s, %d) = %t, want %t", tc.msgType, tc.size, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"chat", ":10", "chat:-1", "chat:big"} {
+		if _, err := parseCompressTypes(bad); err == nil {
+			t.Errorf("parseCompressTypes(%q) accepted it", bad)
+		}
+	}
+}
+
+// compressionMix is traffic typical of a busy room: mostly typing and
+// presence churn, some short chat and the odd long paste.
+func compressionMix() []outbound {
+	frame := func(msgType string, msg message) outbound {
+		msg.Type = msgType
+		msg.ID = "0123456789abcdef"
+		msg.ServerTime = stamp(`"2024-01-02T03:04:05.123456789Z"`)
+		data, _ := json.Marshal(msg)
+		return outbound{msgType: msgType, data: data}
+	}
+	var mix []outbound
+	for i := 0; i < 40; i++ {
+		mix = append(mix, frame("typing", message{Typing: "start", Sender: "fedcba9876543210"}))
+	}
+	for i := 0; i < 20; i++ {
+		mix = append(mix, frame("presence", message{Presence: "join", Sender: "fedcba9876543210", Nick: "quiet-otter"}))
+	}
+	for i := 0; i < 15; i++ {
+		mix = append(mix, frame("chat", message{Text: "sounds good, see you at " + strconv.Itoa(i), Sender: "fedcba9876543210"}))
+	}
+	for i := 0; i < 3; i++ {
+		mix = append(mix, frame("chat", message{Text: strings.Repeat("a long paste of a stack trace line ", 40), Sender: "fedcba9876543210"}))
+	}
+	return mix
+}
+
+// BenchmarkCompressionPolicy compares the bytes written and the time
+// spent for compressionMix under per-type thresholds and under blanket
+// compression. Each compressed frame is deflated on its own at level 1,
+// as gorilla does without context takeover.
+func BenchmarkCompressionPolicy(b *testing.B) {
+	policy, _ := parseCompressTypes("chat:256,typing:never,presence:never")
+	mix := compressionMix()
+	for _, bc := range []struct {
+		name  string
+		types map[string]int
+	}{
+		{"PerType", policy},
+		{"Blanket", nil},
+	} {
+		cfg := testConfig()
+		cfg.compressTypes = bc.types
+		b.Run(bc.name, func(b *testing.B) {
+			var buf bytes.Buffer
+			fw, _ := flate.NewWriter(&buf, 1)
+			var written int
+			for i := 0; i < b.N; i++ {
+				written = 0
+				for _, o := range mix {
+					if !cfg.compressible(o.msgType, len(o.data)) {
+						written += len(o.data)
+						continue
+					}
+					buf.Reset()
+					fw.Reset(&buf)
+					_, _ = fw.Write(o.data)
+					_ = fw.Flush()
+					written += buf.Len()
+				}
+			}
+			b.ReportMetric(float64(written), "bytes/mix")
+		})
+	}
+}
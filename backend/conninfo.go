@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// connInfo is a client's view of its own connection, sent in reply to a
+// conninfo request for debugging and "connection details" panels.
+type connInfo struct {
+	ID          string    `json:"id"`
+	Nick        string    `json:"nick"`
+	Room        string    `json:"room"`
+	Protocol    int       `json:"protocol"`
+	Version     string    `json:"version"`
+	Locale      string    `json:"locale"`
+	Deflate     bool      `json:"deflate"`
+	Compressing bool      `json:"compressing"`
+	ConnectedAt time.Time `json:"connectedAt"`
+
+	// ChatBudget is how many chats the client could send right now
+	// before hitting the rate limit, when there is one.
+	ChatBudget *int `json:"chatBudget,omitempty"`
+}
+
+// nickQuery asks Run for a client's current nick.
+type nickQuery struct {
+	client Client
+	result chan string
+}
+
+// nickOf returns the nick Run holds for c, or "" if c isn't registered.
+// It must only be called from Run.
+func (h *hub) nickOf(c Client) string {
+	if m, ok := h.clients[c]; ok {
+		return m.nick
+	}
+	return ""
+}
+
+// connInfo answers a conninfo request from the client's own state, with
+// its nick from Run.
+func (c *client) connInfo(id string) {
+	h := c.hub
+	result := make(chan string, 1)
+	h.lookups <- nickQuery{client: c, result: result}
+
+	info := &connInfo{
+		ID:          c.id,
+		Nick:        <-result,
+		Room:        c.room,
+		Protocol:    c.protocol,
+		Version:     clientVersionLabel(c.version),
+		Locale:      c.locale,
+		Deflate:     c.deflate,
+		Compressing: c.deflate && h.compress.Load(),
+		ConnectedAt: c.connectedAt.UTC(),
+	}
+	if h.cfg.chatRate > 0 {
+		// Before the first chat there is no bucket yet; it will start full.
+		budget := max(h.cfg.chatBurst, 1)
+		now := time.Now()
+		switch {
+		case now.Before(c.cooldownUntil):
+			budget = 0
+		case c.chatLimit != nil:
+			budget = int(math.Floor(c.chatLimit.available(now)))
+		}
+		info.ChatBudget = &budget
+	}
+	c.reply(message{Type: "conninfo", ID: id, ConnInfo: info})
+}
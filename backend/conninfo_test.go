@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnInfoDescribesTheConnection(t *testing.T) {
+	cfg := testConfig()
+	cfg.chatRate = 1
+	cfg.chatBurst = 5
+	cfg.compressMinClients = 1
+	h, base := newTestServer(t, cfg)
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws?room=ops&lang=fr&clientVersion=2.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	before := time.Now()
+
+	var welcome message
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []message{{Type: "chat", Text: "one"}, {Type: "conninfo", ID: "q"}} {
+		if err := conn.WriteJSON(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var reply message
+	for reply.Type != "conninfo" {
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("no conninfo reply: %v", err)
+		}
+	}
+
+	info := reply.ConnInfo
+	if reply.ID != "q" || info == nil {
+		t.Fatalf("conninfo reply %+v, want the request's id and info", reply)
+	}
+	var nick string
+	for _, e := range h.presenceOf("ops") {
+		if e.ID == welcome.Sender {
+			nick = e.Nick
+		}
+	}
+	if info.ID != welcome.Sender || info.Nick != nick || info.Room != "ops" {
+		t.Errorf("conninfo names %s %q in %q, want %s %q in ops", info.ID, info.Nick, info.Room, welcome.Sender, nick)
+	}
+	if info.Protocol != latestProtocol || info.Version != "2.0.1" || info.Locale != "fr" {
+		t.Errorf("conninfo has protocol %d version %q locale %q", info.Protocol, info.Version, info.Locale)
+	}
+	if !info.Deflate || !info.Compressing {
+		t.Errorf("conninfo has deflate %t compressing %t, want both", info.Deflate, info.Compressing)
+	}
+	if info.ConnectedAt.IsZero() || info.ConnectedAt.After(before) {
+		t.Errorf("conninfo connectedAt %v, want before %v", info.ConnectedAt, before)
+	}
+	if info.ChatBudget == nil || *info.ChatBudget != 4 {
+		t.Errorf("conninfo chat budget %v, want 4 after one chat of a burst of 5", info.ChatBudget)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetter is a message the server gave up on delivering.
+type deadLetter struct {
+	Time    string          `json:"time"`
+	Reason  string          `json:"reason"`
+	Client  string          `json:"client,omitempty"`
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+// deadLetterLog keeps the most recent dropped messages in a ring buffer,
+// optionally appending every entry to a file as JSON lines. A nil log
+// records nothing, so call sites don't need to check whether the feature
+// is on. It is safe for concurrent use.
+type deadLetterLog struct {
+	mu      sync.Mutex
+	entries []deadLetter
+	next    int
+	full    bool
+	file    *os.File
+}
+
+// newDeadLetterLog returns a log holding up to capacity entries, or nil if
+// capacity is zero. A file that can't be opened is logged and skipped.
+func newDeadLetterLog(capacity int, path string) *deadLetterLog {
+	if capacity <= 0 {
+		return nil
+	}
+	l := &deadLetterLog{entries: make([]deadLetter, capacity)}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Printf("ignoring DEAD_LETTER_FILE: %v", err)
+		} else {
+			l.file = f
+		}
+	}
+	return l
+}
+
+// record stores a dropped message. client is the intended recipient, or
+// the sender for messages that never reached the hub.
+func (l *deadLetterLog) record(now time.Time, reason, client, msgType string, data []byte) {
+	if l == nil {
+		return
+	}
+	entry := deadLetter{
+		Time:    now.UTC().Format(time.RFC3339Nano),
+		Reason:  reason,
+		Client:  client,
+		Type:    msgType,
+		Message: json.RawMessage(data),
+	}
+	if !json.Valid(data) {
+		entry.Message = nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+	if l.file != nil {
+		line, err := encode(entry, "dead letter")
+		if err != nil {
+			return
+		}
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			log.Printf("failed to write dead letter: %v", err)
+		}
+	}
+}
+
+// snapshot returns the buffered entries, oldest first.
+func (l *deadLetterLog) snapshot() []deadLetter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]deadLetter(nil), l.entries[:l.next]...)
+	}
+	out := make([]deadLetter, 0, len(l.entries))
+	out = append(out, l.entries[l.next:]...)
+	return append(out, l.entries[:l.next]...)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterLogKeepsNewest(t *testing.T) {
+	var off *deadLetterLog
+	off.record(time.Now(), "dropped", "c1", "chat", []byte(`{}`))
+
+	l := newDeadLetterLog(2, "")
+	for _, id := range []string{"a", "b", "c"} {
+		l.record(time.Now(), "dropped", id, "chat", []byte(`{}`))
+	}
+	got := l.snapshot()
+	if len(got) != 2 || got[0].Client != "b" || got[1].Client != "c" {
+		t.Errorf("log holds %+v, want b then c", got)
+	}
+	l.record(time.Now(), "dropped", "d", "chat", []byte("not json"))
+	if got := l.snapshot(); got[1].Client != "d" || got[1].Message != nil {
+		t.Errorf("invalid JSON recorded as %+v, want no message", got[1])
+	}
+}
+
+func TestDeadLetterFileGetsEachEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	l := newDeadLetterLog(1, path)
+	l.record(time.Now(), "dropped", "a", "chat", []byte(`{"text":"one"}`))
+	l.record(time.Now(), "dropped", "b", "chat", []byte(`{"text":"two"}`))
+	l.file.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("file has %d lines, want one per entry even past capacity", len(lines))
+	}
+	var entry deadLetter
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil || entry.Client != "b" {
+		t.Errorf("second line %s, want b's entry", lines[1])
+	}
+}
+
+func TestSlowConsumerDropIsDeadLettered(t *testing.T) {
+	cfg := testConfig()
+	cfg.deadLetterCapacity = 10
+	h := startTestHub(t, cfg)
+	slow := registerTestClients(t, h, 1)[0]
+	slow.stall()
+	h.broadcast <- envelope{msgType: "chat", data: []byte(`{"type":"chat","text":"lost"}`)}
+	waitFor(t, "the slow client to be dropped", func() bool { return h.clientCount.Load() == 0 })
+
+	rec := httptest.NewRecorder()
+	deadLetterHandler(h)(rec, httptest.NewRequest(http.MethodGet, "/api/admin/deadletter", nil))
+	var resp struct {
+		Entries []deadLetter `json:"entries"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range resp.Entries {
+		if e.Client == slow.ID() && e.Reason == errSlowClient.Error() && strings.Contains(string(e.Message), "lost") {
+			return
+		}
+	}
+	t.Errorf("dead-letter log %+v lacks the chat dropped for %s", resp.Entries, slow.ID())
+}
+
+func TestDeadLetterEndpointOffByDefault(t *testing.T) {
+	rec := httptest.NewRecorder()
+	deadLetterHandler(NewHub(testConfig()))(rec, httptest.NewRequest(http.MethodGet, "/api/admin/deadletter", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("with no capacity the endpoint answered %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Message stores HISTORY_BACKEND can select.
+const (
+	historyMemory = "memory"
+	historyNone   = "none"
+)
+
+// storedMessage is a broadcast chat as kept for replay: the encoding
+// clients received, the room it went to, its id, its reply depth and
+// when Run sent it.
+// The store numbers messages with an increasing seq as they are added.
+type storedMessage struct {
+	room    string
+	id      string
+	seq     uint64
+	depth   int
+	at      time.Time
+	msgType string
+	data    []byte
+}
+
+// messageStore keeps recent chat so clients joining mid-conversation can
+// catch up. Run adds to it; readers query it from handler goroutines, so
+// implementations must be safe for concurrent use. testMessageStore in
+// history_test.go is the behaviour every implementation must pass.
+type messageStore interface {
+	// add stores m, assigning its seq.
+	add(m storedMessage)
+	// recent returns up to limit of the newest messages sent to room
+	// after since, oldest first.
+	recent(room string, since time.Time, limit int) []storedMessage
+	// rangeBefore returns up to limit of the newest messages sent to
+	// room with a seq below beforeSeq, oldest first. A beforeSeq of zero
+	// starts from the newest, so a client pages back by passing the
+	// oldest seq it has.
+	rangeBefore(room string, beforeSeq uint64, limit int) []storedMessage
+	// get returns the message in room with id, if it is still kept.
+	get(room, id string) (storedMessage, bool)
+	// delete forgets the message in room with id, reporting whether
+	// there was one.
+	delete(room, id string) bool
+	// clear forgets every message sent to room and returns how many it
+	// dropped.
+	clear(room string) int
+	// trim forgets all but the newest keep messages across every room
+	// and returns how many it dropped.
+	trim(keep int) int
+	// size returns how many messages it holds across every room.
+	size() int
+}
+
+// newMessageStore returns the store selected by historyStore, or nil if
+// history is off.
+func newMessageStore(cfg config) messageStore {
+	if cfg.historyStore != historyMemory || cfg.historySize <= 0 {
+		return nil
+	}
+	return newMemoryStore(cfg.historySize)
+}
+
+// storedKey is how memoryStore indexes messages by id.
+type storedKey struct{ room, id string }
+
+// memoryStore is a fixed-size ring of the newest messages across all
+// rooms. It forgets everything on restart.
+type memoryStore struct {
+	mu      sync.Mutex
+	entries []storedMessage
+	next    int
+	full    bool
+	seq     uint64
+	// ids maps each kept message with an id to its slot in entries.
+	ids map[storedKey]int
+}
+
+func newMemoryStore(size int) *memoryStore {
+	return &memoryStore{entries: make([]storedMessage, size), ids: make(map[storedKey]int)}
+}
+
+func (s *memoryStore) add(m storedMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.entries[s.next]; s.full && old.id != "" && s.ids[storedKey{old.room, old.id}] == s.next {
+		delete(s.ids, storedKey{old.room, old.id})
+	}
+	s.seq++
+	m.seq = s.seq
+	s.entries[s.next] = m
+	if m.id != "" {
+		s.ids[storedKey{m.room, m.id}] = s.next
+	}
+	s.next = (s.next + 1) % len(s.entries)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// newest returns up to limit of room's messages, oldest first, walking
+// back from the newest while keep accepts them. s.mu must be held.
+func (s *memoryStore) newest(room string, limit int, keep func(storedMessage) (take, more bool)) []storedMessage {
+	n := s.next
+	if s.full {
+		n = len(s.entries)
+	}
+	var out []storedMessage
+	for i := 1; i <= n && len(out) < limit; i++ {
+		m := s.entries[(s.next-i+len(s.entries))%len(s.entries)]
+		take, more := keep(m)
+		if !more {
+			break
+		}
+		if take && m.room == room {
+			out = append(out, m)
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func (s *memoryStore) recent(room string, since time.Time, limit int) []storedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newest(room, limit, func(m storedMessage) (bool, bool) {
+		after := m.at.After(since)
+		return after, after
+	})
+}
+
+func (s *memoryStore) rangeBefore(room string, beforeSeq uint64, limit int) []storedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newest(room, limit, func(m storedMessage) (bool, bool) {
+		return beforeSeq == 0 || m.seq < beforeSeq, true
+	})
+}
+
+func (s *memoryStore) get(room, id string) (storedMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.ids[storedKey{room, id}]
+	if !ok {
+		return storedMessage{}, false
+	}
+	return s.entries[i], true
+}
+
+func (s *memoryStore) delete(room, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ids[storedKey{room, id}]; !ok {
+		return false
+	}
+	s.drop(func(m storedMessage) bool { return m.room == room && m.id == id })
+	return true
+}
+
+func (s *memoryStore) clear(room string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drop(func(m storedMessage) bool { return m.room == room })
+}
+
+func (s *memoryStore) trim(keep int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.next
+	if s.full {
+		n = len(s.entries)
+	}
+	// drop visits oldest first, so the first n-keep are the ones to go.
+	seen := 0
+	return s.drop(func(storedMessage) bool {
+		seen++
+		return seen <= n-keep
+	})
+}
+
+func (s *memoryStore) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.full {
+		return len(s.entries)
+	}
+	return s.next
+}
+
+// drop removes the messages gone reports, compacting the rest to the
+// front of the ring in order, and returns how many it removed. s.mu
+// must be held.
+func (s *memoryStore) drop(gone func(storedMessage) bool) int {
+	start, n := 0, s.next
+	if s.full {
+		start, n = s.next, len(s.entries)
+	}
+	kept := make([]storedMessage, 0, n)
+	for i := 0; i < n; i++ {
+		if m := s.entries[(start+i)%len(s.entries)]; !gone(m) {
+			kept = append(kept, m)
+		}
+	}
+	s.entries = make([]storedMessage, len(s.entries))
+	copy(s.entries, kept)
+	s.next = len(kept) % len(s.entries)
+	s.full = len(kept) == len(s.entries)
+	s.ids = make(map[storedKey]int, len(kept))
+	for i, m := range kept {
+		if m.id != "" {
+			s.ids[storedKey{m.room, m.id}] = i
+		}
+	}
+	return n - len(kept)
+}
+
+// requestedSince parses a ?since= timestamp, reporting false if it is
+// malformed. No timestamp means the whole history.
+func requestedSince(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	return t, err == nil
+}
+
+// replaySet returns the messages a client joining room should be
+// replayed: the newest historyReplay sent after since, less the oldest
+// of them while they come to more than historyReplayBytes. It reports
+// whether older messages were left out.
+func (h *hub) replaySet(room string, since time.Time) ([]storedMessage, bool) {
+	if h.history == nil || h.cfg.historyReplay <= 0 {
+		return nil, false
+	}
+	// One more than the replay holds tells whether there is more.
+	msgs := h.history.recent(room, since, h.cfg.historyReplay+1)
+	truncated := len(msgs) > h.cfg.historyReplay
+	if truncated {
+		msgs = msgs[1:]
+	}
+	if budget := h.cfg.historyReplayBytes; budget > 0 {
+		keep := len(msgs)
+		for size := 0; keep > 0; keep-- {
+			if size += len(msgs[keep-1].data); size > budget {
+				break
+			}
+		}
+		truncated = truncated || keep > 0
+		msgs = msgs[keep:]
+	}
+	return msgs, truncated
+}
+
+// replayHistory writes replay, from replaySet, straight to the socket,
+// so it arrives after the welcome and ahead of live traffic. It must be
+// called before the client is registered, while nothing else writes to
+// the connection, and reports false if the connection should be
+// abandoned.
+func (c *client) replayHistory(replay []storedMessage) bool {
+	for _, m := range replay {
+		if !c.writeText(m.msgType, m.data) {
+			return false
+		}
+	}
+	return true
+}
+
+// historyHandler serves GET /api/history?room=&limit=&since=, returning
+// a room's recent chat oldest first. Instead of since, before=<seq> pages
+// back through older chat; each response's "before" is the seq of
+// its oldest message, the cursor for the page ahead of it.
+func historyHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		// History is as private as the chat it holds.
+		if h.authRequired() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "history is unavailable while authentication is required"})
+			return
+		}
+		user, err := h.requestUser(r)
+		if err != nil && (err != errNoToken || h.tokensRequired()) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		if h.history == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "history is disabled"})
+			return
+		}
+		q := r.URL.Query()
+		room, ok := requestedRoom(q.Get("room"))
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid room"})
+			return
+		}
+		if !h.cfg.userMayJoin(room, user) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+		since, ok := requestedSince(q.Get("since"))
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be an RFC 3339 timestamp"})
+			return
+		}
+		var before uint64
+		if v := q.Get("before"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || n == 0 || q.Get("since") != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "before must be a positive seq and can't be combined with since"})
+				return
+			}
+			before = n
+		}
+		limit := h.cfg.historyReplay
+		if limit <= 0 {
+			limit = h.cfg.historySize
+		}
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > h.cfg.historySize {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(h.cfg.historySize)})
+				return
+			}
+			limit = n
+		}
+
+		var stored []storedMessage
+		if before != 0 {
+			stored = h.history.rangeBefore(room, before, limit)
+		} else {
+			stored = h.history.recent(room, since, limit)
+		}
+		messages := make([]json.RawMessage, 0, len(stored))
+		for _, m := range stored {
+			messages = append(messages, m.data)
+		}
+		resp := map[string]any{"room": room, "messages": messages}
+		if len(stored) > 0 {
+			resp["before"] = stored[0].seq
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testMessageStore is the behaviour every messageStore must have. A new
+// backend gets its own Test function calling it with a constructor for
+// an empty store holding size messages.
+func testMessageStore(t *testing.T, newStore func(size int) messageStore) {
+	// fill adds one message per room listed, with data and id its index
+	// and at that many seconds after the epoch.
+	fill := func(s messageStore, rooms ...string) {
+		for i, room := range rooms {
+			id := strconv.Itoa(i)
+			s.add(storedMessage{room: room, id: id, at: time.Unix(int64(i+1), 0), msgType: "chat", data: []byte(id)})
+		}
+	}
+	joined := func(msgs []storedMessage) string {
+		var out string
+		for _, m := range msgs {
+			out += string(m.data)
+		}
+		return out
+	}
+
+	t.Run("RecentOldestFirst", func(t *testing.T) {
+		s := newStore(10)
+		fill(s, "a", "b", "a", "a", "b")
+		if got := joined(s.recent("a", time.Time{}, 10)); got != "023" {
+			t.Errorf("recent a = %q, want 023", got)
+		}
+		if got := joined(s.recent("a", time.Time{}, 2)); got != "23" {
+			t.Errorf("recent a with limit 2 = %q, want the newest two, 23", got)
+		}
+		if got := joined(s.recent("a", time.Unix(1, 0), 10)); got != "23" {
+			t.Errorf("recent a since the first = %q, want 23", got)
+		}
+		if got := s.recent("c", time.Time{}, 10); len(got) != 0 {
+			t.Errorf("an empty room returned %d messages", len(got))
+		}
+	})
+
+	t.Run("ForgetsOldestAtCapacity", func(t *testing.T) {
+		s := newStore(3)
+		fill(s, "a", "a", "a", "a", "a")
+		if got := joined(s.recent("a", time.Time{}, 10)); got != "234" {
+			t.Errorf("full store kept %q, want the newest three, 234", got)
+		}
+		if n := s.size(); n != 3 {
+			t.Errorf("full store's size is %d, want 3", n)
+		}
+		if _, ok := s.get("a", "0"); ok {
+			t.Error("get found a message the store had forgotten")
+		}
+	})
+
+	t.Run("RangeBeforePagesBack", func(t *testing.T) {
+		s := newStore(10)
+		fill(s, "a", "b", "a", "a", "b", "a")
+		page := s.rangeBefore("a", 0, 2)
+		if got := joined(page); got != "35" {
+			t.Fatalf("first page = %q, want the newest two, 35", got)
+		}
+		if page[0].seq >= page[1].seq {
+			t.Errorf("seqs %d, %d don't increase", page[0].seq, page[1].seq)
+		}
+		page = s.rangeBefore("a", page[0].seq, 2)
+		if got := joined(page); got != "02" {
+			t.Fatalf("second page = %q, want 02", got)
+		}
+		if got := s.rangeBefore("a", page[0].seq, 2); len(got) != 0 {
+			t.Errorf("paging past the oldest returned %q", joined(got))
+		}
+	})
+
+	t.Run("GetByID", func(t *testing.T) {
+		s := newStore(10)
+		fill(s, "a", "b")
+		if m, ok := s.get("b", "1"); !ok || string(m.data) != "1" {
+			t.Errorf("get b/1 = %q, %t, want 1", m.data, ok)
+		}
+		if _, ok := s.get("a", "1"); ok {
+			t.Error("get found a message under the wrong room")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := newStore(10)
+		fill(s, "a", "a", "a")
+		if !s.delete("a", "1") {
+			t.Fatal("delete of a kept message reported none")
+		}
+		if s.delete("a", "1") || s.delete("b", "0") {
+			t.Error("delete of a missing message reported one")
+		}
+		if _, ok := s.get("a", "1"); ok {
+			t.Error("get found a deleted message")
+		}
+		if got := joined(s.recent("a", time.Time{}, 10)); got != "02" {
+			t.Errorf("after deleting 1 room a has %q, want 02", got)
+		}
+		if n := s.size(); n != 2 {
+			t.Errorf("size is %d after deleting one of 3, want 2", n)
+		}
+		if m, ok := s.get("a", "2"); !ok || string(m.data) != "2" {
+			t.Errorf("deleting one message lost another: get a/2 = %q, %t", m.data, ok)
+		}
+	})
+
+	t.Run("ClearKeepsOrder", func(t *testing.T) {
+		s := newStore(4)
+		fill(s, "a", "b", "a", "b", "a", "b")
+		if n := s.clear("a"); n != 2 {
+			t.Errorf("cleared %d, want the 2 of a still kept", n)
+		}
+		s.add(storedMessage{room: "b", id: "6", at: time.Unix(7, 0), data: []byte("6")})
+		if got := joined(s.recent("b", time.Time{}, 10)); got != "356" {
+			t.Errorf("b's history is %q after clearing a, want 356", got)
+		}
+		if _, ok := s.get("b", "3"); !ok {
+			t.Error("get lost a message that clearing another room kept")
+		}
+	})
+
+	t.Run("TrimKeepsNewest", func(t *testing.T) {
+		s := newStore(10)
+		fill(s, "a", "b", "a", "b", "a")
+		if n := s.trim(2); n != 3 {
+			t.Errorf("trimmed %d, want 3 of 5", n)
+		}
+		if got := joined(s.recent("a", time.Time{}, 10)) + joined(s.recent("b", time.Time{}, 10)); got != "43" {
+			t.Errorf("after trimming to 2 the store holds %q, want the newest, 4 and 3", got)
+		}
+		if _, ok := s.get("a", "0"); ok {
+			t.Error("get found a trimmed message")
+		}
+		if n := s.trim(5); n != 0 {
+			t.Errorf("trimming to more than it holds dropped %d", n)
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testMessageStore(t, func(size int) messageStore { return newMemoryStore(size) })
+}
+
+func TestHistoryBackendSelection(t *testing.T) {
+	for _, tc := range []struct {
+		backend, store, want string
+	}{
+		{"none", "", historyNone},
+		{"", "none", historyNone},
+		{"memory", "none", historyMemory},
+		{"bogus", "", historyMemory},
+	} {
+		t.Setenv("HISTORY_BACKEND", tc.backend)
+		t.Setenv("HISTORY_STORE", tc.store)
+		if got := loadConfig().historyStore; got != tc.want {
+			t.Errorf("HISTORY_BACKEND=%q HISTORY_STORE=%q selected %q, want %q", tc.backend, tc.store, got, tc.want)
+		}
+	}
+}
+
+func TestHistoryHandlerPagesBefore(t *testing.T) {
+	h := NewHub(testConfig())
+	for i := 0; i < 5; i++ {
+		storeTestChat(t, h, defaultRoom, strconv.Itoa(i))
+	}
+	page := func(query string) (int, []string, uint64) {
+		rec := httptest.NewRecorder()
+		historyHandler(h)(rec, httptest.NewRequest(http.MethodGet, "/api/history?"+query, nil))
+		var resp struct {
+			Messages []message `json:"messages"`
+			Before   uint64    `json:"before"`
+		}
+		_ = json.NewDecoder(rec.Body).Decode(&resp)
+		var texts []string
+		for _, m := range resp.Messages {
+			texts = append(texts, m.Text)
+		}
+		return rec.Code, texts, resp.Before
+	}
+
+	status, texts, before := page("limit=2")
+	if status != http.StatusOK || len(texts) != 2 || texts[1] != "4" {
+		t.Fatalf("first page got %d %v, want the newest two", status, texts)
+	}
+	status, texts, _ = page("limit=2&before=" + strconv.FormatUint(before, 10))
+	if status != http.StatusOK || len(texts) != 2 || texts[0] != "1" || texts[1] != "2" {
+		t.Errorf("second page got %d %v, want [1 2]", status, texts)
+	}
+	if status, _, _ := page("before=1&since=2020-01-01T00:00:00Z"); status != http.StatusBadRequest {
+		t.Errorf("before with since answered %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestAdminDeletesMessage(t *testing.T) {
+	h := NewHub(testConfig())
+	h.history.add(storedMessage{room: defaultRoom, id: "spam", at: time.Now(), msgType: "chat", data: []byte(`{}`)})
+	del := func() int {
+		rec := httptest.NewRecorder()
+		roomAdminHandler(h)(rec, httptest.NewRequest(http.MethodDelete, "/api/admin/rooms/"+defaultRoom+"/messages/spam", nil))
+		return rec.Code
+	}
+	if code := del(); code != http.StatusOK {
+		t.Fatalf("delete answered %d, want %d", code, http.StatusOK)
+	}
+	if _, ok := h.history.get(defaultRoom, "spam"); ok {
+		t.Error("deleted message is still in history")
+	}
+	if code := del(); code != http.StatusNotFound {
+		t.Errorf("deleting it again answered %d, want %d", code, http.StatusNotFound)
+	}
+}
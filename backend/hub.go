@@ -0,0 +1,1407 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Client is a hub member. The hub only talks to clients through this
+// interface, so transports other than websockets can reuse the fan-out.
+type Client interface {
+	// ID is unique to the connection. A verified user connected twice,
+	// or reconnecting before its old connection is unregistered, is two
+	// clients with different ids carrying the same user, so Run never
+	// has to order one's register after the other's unregister.
+	ID() string
+	// Send queues an encoded message for delivery without blocking. The
+	// type lets implementations prioritise; an error means the client
+	// can't keep up and should be dropped.
+	Send(msgType string, data []byte) error
+	// Close is called exactly once, by Run, after the client has been
+	// removed from the hub. reason says why, so the transport can tell
+	// the peer.
+	Close(reason closeReason)
+}
+
+// closeReason is why the hub removed a client.
+type closeReason int
+
+const (
+	// closeNormal means the client left on its own.
+	closeNormal closeReason = iota
+	// closeSlowConsumer means the client's send queue overflowed.
+	closeSlowConsumer
+	// closeKicked means an operator disconnected the client, for example
+	// by reaping idle clients.
+	closeKicked
+	// closeShutdown means the server is draining or shutting down.
+	closeShutdown
+	// closeMigrated means the client moved to another instance, or was
+	// told to and didn't confirm in time.
+	closeMigrated
+	// closeRateLimited means the client kept sending faster than its
+	// rate limit allows.
+	closeRateLimited
+	// closeRoomClosed means an operator cleared the client's room.
+	closeRoomClosed
+)
+
+func (r closeReason) String() string {
+	switch r {
+	case closeSlowConsumer:
+		return errSlowClient.Error()
+	case closeKicked:
+		return "kicked"
+	case closeShutdown:
+		return "server shutdown"
+	case closeMigrated:
+		return "migrated"
+	case closeRateLimited:
+		return "rate limited"
+	case closeRoomClosed:
+		return "room closed"
+	default:
+		return "disconnected"
+	}
+}
+
+// label is r as a metric label value.
+func (r closeReason) label() string {
+	switch r {
+	case closeSlowConsumer:
+		return "slow_consumer"
+	case closeKicked:
+		return "kicked"
+	case closeShutdown:
+		return "shutdown"
+	case closeMigrated:
+		return "migrated"
+	case closeRateLimited:
+		return "rate_limited"
+	case closeRoomClosed:
+		return "room_closed"
+	default:
+		return "normal"
+	}
+}
+
+// errSlowClient is returned by Send when a client's queue is full.
+var errSlowClient = errors.New("client send queue full")
+
+// errBacklogExceeded is returned by Send when a client has more messages
+// queued across its lanes than cfg.maxSendBacklog.
+var errBacklogExceeded = errors.New("client send backlog exceeded")
+
+// sessionReporter is implemented by clients that count their traffic, so
+// the hub can log a session summary when they leave.
+type sessionReporter interface {
+	session() sessionStats
+}
+
+// versionReporter is implemented by clients that announced their build
+// at connect, so the hub can break down connections by client version.
+type versionReporter interface {
+	clientVersion() string
+}
+
+// queueReporter is implemented by clients that queue messages for
+// delivery, so the admin snapshot can show which are falling behind.
+type queueReporter interface {
+	queueDepth() int
+	// lastQueueWait is how long the most recently sampled message sat in
+	// the queue, or zero if none was sampled.
+	lastQueueWait() time.Duration
+}
+
+// userReporter is implemented by clients that may carry a verified user
+// name, which the hub then uses as their nick and reserves from others.
+type userReporter interface {
+	username() string
+}
+
+// presenceDecliner is implemented by clients that can ask at connect not
+// to be sent presence, such as bots and loggers with no member list.
+type presenceDecliner interface {
+	declinesPresence() bool
+}
+
+// sessionStats is a client's traffic over its lifetime. reason is why the
+// client closed its side, if it knows.
+type sessionStats struct {
+	remoteIP          string
+	msgsIn, msgsOut   int64
+	bytesIn, bytesOut int64
+	reason            string
+}
+
+type hub struct {
+	cfg        config
+	clients    map[Client]*member
+	register   chan Client
+	unregister chan Client
+	broadcast  chan envelope
+	subscribe  chan subscription
+	blocks     chan blockRequest
+	mutes      chan muteRequest
+	presence   chan presenceOpt
+	direct     chan directMessage
+	reapIdle   chan reapRequest
+	clears     chan clearRequest
+	snapshots  chan chan hubSnapshot
+	roomLists  chan chan []roomSummary
+	drains     chan drainRequest
+	renames    chan renameRequest
+	rosters    chan rosterRequest
+	migrations chan migrationRequest
+	migrated   chan migrationDone
+	lookups    chan nickQuery
+	pollOps    chan pollOp
+	joins      chan joinRequest
+	occupants  chan presenceQuery
+
+	// fanOutJobs hands large fan-outs to the offload worker, which reports
+	// the clients it found too slow on fanOutDone. pendingFanOuts queues
+	// jobs not yet taken and fanOutsInFlight counts those taken but not
+	// finished; while either is non-zero every fan-out is queued, so a
+	// small one can't overtake a large one. All three are owned by Run.
+	fanOutJobs      chan fanOutJob
+	fanOutDone      chan []Client
+	pendingFanOuts  []fanOutJob
+	fanOutsInFlight int
+
+	// nicks is the set of names given to registered clients, so no two
+	// share one. Owned by Run.
+	nicks map[string]Client
+
+	// users counts the registered clients of each verified user. While
+	// it is non-zero nobody else may take the user's name as a nick.
+	// Owned by Run.
+	users map[string]int
+
+	// rooms groups registered clients by room. A room is forgotten once
+	// its last member leaves. Owned by Run.
+	rooms map[string]map[Client]struct{}
+
+	// typers counts the members currently typing in each room. Owned by
+	// Run.
+	typers map[string]int
+
+	// polls holds the open polls by id. Owned by Run.
+	polls map[string]*poll
+
+	// order lists registered clients for fan-out, and nextStart is where
+	// the next fan-out begins. Both are owned by Run.
+	order     []Client
+	nextStart int
+
+	// maintenance puts the server in read-only mode: connections stay up
+	// but chat is rejected.
+	maintenance atomic.Bool
+
+	// draining is set by drain, and refuses new upgrades while the
+	// server sends its clients away.
+	draining atomic.Bool
+
+	// overloaded is set while heap usage is above the high watermark;
+	// chat is rejected and history kept from growing until it falls
+	// below the low one. memUsage is the
+	// heap sample watchMemory uses, replaceable in tests.
+	overloaded atomic.Bool
+	memUsage   func() uint64
+
+	// clientCount mirrors len(clients) for readers outside Run.
+	clientCount atomic.Int64
+
+	// compress reports whether writes should use per-message deflate. Run
+	// recomputes it from the client count against cfg.compressMinClients.
+	compress atomic.Bool
+
+	// admission paces new connections. Nil when unlimited.
+	admission *admissionRamp
+
+	// upgrades is a semaphore bounding handshakes in progress. Nil when
+	// unlimited.
+	upgrades chan struct{}
+
+	// replays is a semaphore bounding history replays in progress. Nil
+	// when unlimited.
+	replays chan struct{}
+
+	// previews fetches link previews for chat. Nil when disabled.
+	previews *linkPreviewer
+
+	// translations translates chat for the languages clients declared.
+	// Nil when disabled.
+	translations *translationService
+
+	// moderator judges chat before it is broadcast. Nil when disabled.
+	// flagged keeps the chats it flagged for moderators to review; it
+	// is a dead-letter ring put to another use. Nil when disabled.
+	moderator moderator
+	flagged   *deadLetterLog
+
+	// idempotency remembers injected broadcasts by Idempotency-Key. Nil
+	// when disabled.
+	idempotency *idempotencyCache
+
+	// history keeps recent chat for replay and /api/history. Nil when
+	// disabled.
+	history messageStore
+
+	// broker relays broadcasts to and from other instances. Nil when
+	// this instance runs alone.
+	broker broker
+
+	// deadLetters records dropped messages. Nil when disabled.
+	deadLetters *deadLetterLog
+
+	// audit records admin actions. Nil when disabled.
+	audit *auditLog
+
+	// transforms vet and enrich each client message before broadcast.
+	// NewHub installs defaultTransforms; embedders may extend the chain
+	// before calling Run.
+	transforms []messageTransform
+
+	// commands are the slash commands chat may invoke, by name. NewHub
+	// installs defaultCommands; embedders may add to them before calling
+	// Run.
+	commands map[string]chatCommand
+
+	// idGen and now are the hub's sources of message and client ids and
+	// server timestamps. Tests may replace them for deterministic output.
+	idGen func() string
+	now   func() time.Time
+}
+
+func NewHub(cfg config) *hub {
+	h := &hub{
+		cfg:         cfg,
+		clients:     make(map[Client]*member),
+		nicks:       make(map[string]Client),
+		users:       make(map[string]int),
+		register:    make(chan Client, cfg.registrationQueue),
+		unregister:  make(chan Client, cfg.registrationQueue),
+		broadcast:   make(chan envelope, 32),
+		subscribe:   make(chan subscription),
+		blocks:      make(chan blockRequest),
+		mutes:       make(chan muteRequest),
+		presence:    make(chan presenceOpt),
+		direct:      make(chan directMessage, 32),
+		reapIdle:    make(chan reapRequest),
+		clears:      make(chan clearRequest),
+		snapshots:   make(chan chan hubSnapshot),
+		roomLists:   make(chan chan []roomSummary),
+		drains:      make(chan drainRequest),
+		renames:     make(chan renameRequest),
+		rosters:     make(chan rosterRequest),
+		migrations:  make(chan migrationRequest),
+		migrated:    make(chan migrationDone),
+		lookups:     make(chan nickQuery),
+		pollOps:     make(chan pollOp),
+		polls:       make(map[string]*poll),
+		rooms:       make(map[string]map[Client]struct{}),
+		typers:      make(map[string]int),
+		joins:       make(chan joinRequest),
+		occupants:   make(chan presenceQuery),
+		fanOutJobs:  make(chan fanOutJob),
+		fanOutDone:  make(chan []Client),
+		transforms:  defaultTransforms(),
+		commands:    defaultCommands(),
+		idGen:       randomID,
+		memUsage:    heapInUse,
+		admission:   newAdmissionRamp(cfg.admissionRate, cfg.admissionRamp),
+		deadLetters: newDeadLetterLog(cfg.deadLetterCapacity, cfg.deadLetterFile),
+		flagged:     newDeadLetterLog(cfg.moderationFlagged, ""),
+		audit:       newAuditLog(cfg.auditLogPath),
+		idempotency: newIdempotencyCache(cfg.idempotencyTTL),
+		history:     newMessageStore(cfg),
+		now:         time.Now,
+	}
+	if cfg.maxUpgrades > 0 {
+		h.upgrades = make(chan struct{}, cfg.maxUpgrades)
+	}
+	if cfg.maxReplays > 0 {
+		h.replays = make(chan struct{}, cfg.maxReplays)
+	}
+	h.previews = newLinkPreviewer(h)
+	if cfg.translateURL != "" {
+		h.translations = newTranslationService(h, newHTTPTranslator(cfg.translateURL))
+	}
+	if cfg.moderationURL != "" {
+		h.moderator = newHTTPModerator(cfg.moderationURL)
+	}
+	if cfg.redisURL != "" {
+		b, err := newRedisBroker(cfg.redisURL, cfg.redisChannel, h.idGen())
+		if err != nil {
+			log.Fatalf("invalid REDIS_URL: %v", err)
+		}
+		h.broker = b
+		go b.subscribe(h.relay)
+	}
+	return h
+}
+
+// member is the hub's per-client state. It is owned by Run.
+type member struct {
+	// index is the client's position in hub.order.
+	index int
+
+	// nick is the client's display name, generated from its id at
+	// registration.
+	nick string
+
+	// user is the client's verified user name, or "" if it is anonymous.
+	user string
+
+	// room is the room the client is in. Messages it sends go to that
+	// room only.
+	room string
+
+	// connectedAt is when the client registered.
+	connectedAt time.Time
+
+	// version is the client build it announced, normalized by
+	// clientVersionLabel.
+	version string
+
+	// lastActive is when the client registered or last had a message
+	// broadcast.
+	lastActive time.Time
+
+	// subscriptions is the set of message types the client wants to
+	// receive. A nil set means all types.
+	subscriptions map[string]struct{}
+
+	// blocked is the set of client ids whose messages are not delivered
+	// to this client. It lasts as long as the session.
+	blocked map[string]struct{}
+
+	// muted is the set of rooms the client muted: their broadcasts are
+	// not delivered unless addressed to the client or mentioning it.
+	muted map[string]struct{}
+
+	// typing is whether the client's last typing event was a start.
+	typing bool
+
+	// meta is the metadata of the client's last meta update, listed in
+	// presence so others can show avatars and badges.
+	meta map[string]string
+
+	// wantsPresence is whether the client is sent presence: join and
+	// leave announcements and the presenceTypes.
+	wantsPresence bool
+
+	// migrationToken is the token the client was sent with a migrate
+	// message, or "" if it isn't migrating.
+	migrationToken string
+}
+
+// envelope is an encoded message queued for fan-out along with its type,
+// so Run can filter without decoding the payload again.
+type envelope struct {
+	msgType string
+	msgID   string
+	data    []byte
+
+	// sender is the client the message came from, or nil for messages
+	// generated by the server.
+	sender Client
+
+	// room is the room the message is delivered to, or "" for every
+	// room.
+	room string
+
+	// link is the first URL in a chat message, previewed once the
+	// message has been accepted for broadcast.
+	link string
+
+	// translate is the text of a chat to translate once accepted.
+	translate string
+
+	// typing is a typing event's "start" or "stop".
+	typing string
+
+	// target is the id of the client a message is addressed to, such as
+	// a WebRTC signal's peer, and mentions the nicks a chat @-mentions.
+	// Both still reach a client that muted the room.
+	target   string
+	mentions []string
+
+	// meta is a meta update's full metadata, for Run to keep on the
+	// sender's member.
+	meta map[string]string
+
+	// depth is how deep in a reply chain a chat is: one for a reply to
+	// an unreplied message, one more than its parent for a reply to a
+	// reply, zero when it replies to nothing. History keeps it so the
+	// next reply's depth needn't walk the chain.
+	depth int
+
+	// presence marks a server message about who is here, such as a join
+	// announcement, which clients declining presence don't get.
+	presence bool
+
+	// history keeps a server message in its room's history alongside the
+	// chat, as for a notice injected through /api/broadcast.
+	history bool
+
+	// remote marks a message another instance published through the
+	// broker, and local one every instance produces for itself, such as
+	// a scheduled announcement. Neither is published.
+	remote bool
+	local  bool
+}
+
+// subscription replaces a client's message type filter. An empty types
+// list resets the client to receiving everything.
+type subscription struct {
+	client Client
+	types  []string
+}
+
+// blockRequest adds users, by id or nick, to a client's block list, or
+// removes them when unblock is set.
+type blockRequest struct {
+	client  Client
+	users   []string
+	unblock bool
+}
+
+// muteRequest mutes a room for a client, or unmutes it when unmute is
+// set.
+type muteRequest struct {
+	client Client
+	room   string
+	unmute bool
+}
+
+// presenceOpt turns presence delivery on or off for a client.
+type presenceOpt struct {
+	client Client
+	wants  bool
+}
+
+// presenceTypes are the relayed message types that count as presence.
+var presenceTypes = map[string]bool{
+	"presence":                true,
+	"webrtc-presence":         true,
+	"webrtc-presence-request": true,
+}
+
+// maxBlockedUsers caps a client's block list.
+const maxBlockedUsers = 256
+
+// fanOutJob is a broadcast and the recipients Run selected for it, for
+// the offload worker to deliver.
+type fanOutJob struct {
+	msg     envelope
+	targets []Client
+}
+
+// connectionAgeInterval is how often Run refreshes the
+// open-connections-by-age gauge.
+const connectionAgeInterval = 15 * time.Second
+
+// maxPendingFanOuts is how many offloaded fan-outs may queue before Run
+// stops taking broadcasts, leaving the rest waiting in h.broadcast.
+const maxPendingFanOuts = 16
+
+// reapRequest asks Run to disconnect every client idle for longer than
+// olderThan and report how many it removed.
+type reapRequest struct {
+	olderThan time.Duration
+	result    chan int
+}
+
+// clearRequest asks Run to disconnect everyone in room and forget its
+// history, reporting how many clients it removed.
+type clearRequest struct {
+	room   string
+	result chan int
+}
+
+// directMessage is an encoded message for a single client, such as an
+// error reply to the sender. With disconnect set, Run removes the client
+// for rate limiting once the message is queued, so it goes out just
+// ahead of the close frame.
+type directMessage struct {
+	client     Client
+	msgType    string
+	data       []byte
+	disconnect bool
+}
+
+type message struct {
+	Type       string   `json:"type"`
+	Key        string   `json:"key,omitempty"`
+	Text       string   `json:"text,omitempty"`
+	ID         string   `json:"id,omitempty"`
+	SentAt     string   `json:"sentAt,omitempty"`
+	ServerTime stamp    `json:"serverTime,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	User       string   `json:"user,omitempty"`
+	Nick       string   `json:"nick,omitempty"`
+	Target     string   `json:"target,omitempty"`
+	SDP        string   `json:"sdp,omitempty"`
+	Candidate  string   `json:"candidate,omitempty"`
+	Types      []string `json:"types,omitempty"`
+	Users      []string `json:"users,omitempty"`
+	Truncated  bool     `json:"truncated,omitempty"`
+	// HistoryTruncated, on a welcome, says the room has older history
+	// than the replay that follows, for /api/history to fetch.
+	HistoryTruncated bool   `json:"historyTruncated,omitempty"`
+	Flagged          bool   `json:"flagged,omitempty"`
+	Room             string `json:"room,omitempty"`
+	Active           bool   `json:"active,omitempty"`
+	Action           bool   `json:"action,omitempty"`
+	ReplyTo          string `json:"replyTo,omitempty"`
+	Quote            string `json:"quote,omitempty"`
+	DraftID          string `json:"draftId,omitempty"`
+	Typing           string `json:"typing,omitempty"`
+	Presence         string `json:"presence,omitempty"`
+	Lang             string `json:"lang,omitempty"`
+	Nonce            string `json:"nonce,omitempty"`
+	Token            string `json:"token,omitempty"`
+	SenderSeq        uint64 `json:"senderSeq,omitempty"`
+	URL              string `json:"url,omitempty"`
+	Count            int    `json:"count,omitempty"`
+
+	// server_shutdown: why the server is going away and how long clients
+	// should wait before reconnecting.
+	Reason           string `json:"reason,omitempty"`
+	ReconnectAfterMs int64  `json:"reconnectAfterMs,omitempty"`
+
+	// Time sync exchange: the client's clock as it sent the request, and
+	// the server's clock when it received the request and sent the reply.
+	ClientTime   string `json:"clientTime,omitempty"`
+	ReceiveTime  string `json:"receiveTime,omitempty"`
+	TransmitTime string `json:"transmitTime,omitempty"`
+
+	Meta        map[string]string `json:"meta,omitempty"`
+	Attachments []attachment      `json:"attachments,omitempty"`
+
+	// Polls: a new poll's options, and a vote's poll and chosen option.
+	Options []string `json:"options,omitempty"`
+	PollID  string   `json:"pollId,omitempty"`
+	Choice  *int     `json:"choice,omitempty"`
+
+	// Debug echo reply: the payload as received and as the server parsed
+	// it.
+	Raw  json.RawMessage `json:"raw,omitempty"`
+	Echo *message        `json:"echo,omitempty"`
+
+	Status       *serverStatus `json:"status,omitempty"`
+	Capabilities *capabilities `json:"capabilities,omitempty"`
+	ConnInfo     *connInfo     `json:"connInfo,omitempty"`
+	Preview      *linkPreview  `json:"preview,omitempty"`
+	Translation  *translation  `json:"translation,omitempty"`
+	Poll         *pollView     `json:"poll,omitempty"`
+
+	// who reply with PRESENCE_GROUP_BY set.
+	Groups []presenceGroup `json:"groups,omitempty"`
+
+	// roster: each member listed in users, with its metadata.
+	Members []presenceEntry `json:"members,omitempty"`
+}
+
+// serverStatus is a load hint clients can use to warn about a busy server
+// or decide to reconnect elsewhere.
+type serverStatus struct {
+	Clients     int64 `json:"clients"`
+	Maintenance bool  `json:"maintenance"`
+}
+
+// capabilities tells a client in its welcome which optional features are
+// on and what limits apply, so it can adapt its UI.
+type capabilities struct {
+	Receipts          bool `json:"receipts"`
+	AuthRequired      bool `json:"authRequired"`
+	Compression       bool `json:"compression"`
+	StrictSenderOrder bool `json:"strictSenderOrder"`
+	// History is whether the server keeps chat for replay and
+	// /api/history, and Rooms whether there is any room but the lobby to
+	// join.
+	History bool `json:"history"`
+	Rooms   bool `json:"rooms"`
+
+	MaxMessageBytes   int `json:"maxMessageBytes"`
+	MaxTextBytes      int `json:"maxTextBytes"`
+	MaxMetaKeys       int `json:"maxMetaKeys"`
+	MaxMetaBytes      int `json:"maxMetaBytes"`
+	EgressBytesPerSec int `json:"egressBytesPerSec,omitempty"`
+
+	// The per-client rate limits, per second with their bursts. They are
+	// left out when the limit is off.
+	ChatPerSec     int `json:"chatPerSec,omitempty"`
+	ChatBurst      int `json:"chatBurst,omitempty"`
+	MessagesPerSec int `json:"messagesPerSec,omitempty"`
+	MessageBurst   int `json:"messageBurst,omitempty"`
+}
+
+// Run owns the hub's client set. Register and unregister are buffered so
+// upgrades don't stall behind a large fan-out; the fan-out itself doesn't
+// yield, since a single pass only does non-blocking sends.
+//
+// With cfg.broadcastRate set, Run stops receiving broadcasts once the rate
+// is used up and resumes when it recovers, so the other cases keep being
+// served during a storm.
+//
+// A panic in the loop is recovered and logged with its stack. Per
+// cfg.hubPanicPolicy the process then exits so an orchestrator can
+// restart it, or the loop carries on with whatever state the panic left
+// behind; either beats a server that accepts connections but never
+// delivers.
+func (h *hub) Run() {
+	if h.cfg.fanOutOffloadMinClients > 0 {
+		go h.fanOutWorker()
+	}
+	for {
+		h.runRecovering()
+	}
+}
+
+// runRecovering runs the hub loop until it panics, then applies
+// cfg.hubPanicPolicy.
+func (h *hub) runRecovering() {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		hubPanics.inc()
+		log.Printf("hub loop panicked: %v\n%s", p, debug.Stack())
+		if h.cfg.hubPanicPolicy == hubPanicExit {
+			log.Printf("exiting after hub panic")
+			os.Exit(1)
+		}
+		log.Printf("restarting hub loop; its state may be inconsistent")
+	}()
+	h.loop()
+}
+
+func (h *hub) loop() {
+	broadcast := h.broadcast
+	var limit *tokenBucket
+	var resume <-chan time.Time
+	if rate := float64(h.cfg.broadcastRate); rate > 0 {
+		limit = newTokenBucket(rate, rate, h.now())
+	}
+
+	ageTicker := time.NewTicker(connectionAgeInterval)
+	defer ageTicker.Stop()
+	pollTicker := time.NewTicker(pollUpdateInterval)
+	defer pollTicker.Stop()
+
+	for {
+		in := broadcast
+		if len(h.pendingFanOuts) >= maxPendingFanOuts {
+			in = nil
+		}
+		var jobs chan fanOutJob
+		var next fanOutJob
+		if len(h.pendingFanOuts) > 0 {
+			jobs, next = h.fanOutJobs, h.pendingFanOuts[0]
+		}
+
+		select {
+		case c := <-h.register:
+			h.admit(c)
+		case c := <-h.unregister:
+			// A connection queues its register before its unregister,
+			// but select may pick either first. Admitting whatever is
+			// queued first means an unregister never overtakes the
+			// register it follows.
+			for pending := true; pending; {
+				select {
+				case r := <-h.register:
+					h.admit(r)
+				default:
+					pending = false
+				}
+			}
+			if _, ok := h.clients[c]; ok {
+				h.remove(c, closeNormal)
+			}
+		case s := <-h.subscribe:
+			if m, ok := h.clients[s.client]; ok {
+				m.setSubscriptions(s.types)
+			}
+		case b := <-h.blocks:
+			if m, ok := h.clients[b.client]; ok {
+				h.updateBlocks(m, b)
+			}
+		case req := <-h.mutes:
+			if m, ok := h.clients[req.client]; ok {
+				m.updateMutes(req)
+			}
+		case p := <-h.presence:
+			if m, ok := h.clients[p.client]; ok {
+				m.wantsPresence = p.wants
+			}
+		case d := <-h.direct:
+			if _, ok := h.clients[d.client]; ok {
+				// Replies are best effort; a full queue drops the reply
+				// rather than the client.
+				if err := d.client.Send(d.msgType, d.data); err != nil {
+					h.deadLetters.record(h.now(), err.Error(), d.client.ID(), d.msgType, d.data)
+				}
+				if d.disconnect {
+					h.remove(d.client, closeRateLimited)
+				}
+			}
+		case msg := <-in:
+			if m, ok := h.clients[msg.sender]; ok {
+				m.lastActive = h.now()
+				// A sender's messages go to the room Run has it in,
+				// whichever goroutine queued them.
+				msg.room = m.room
+				if msg.msgType == "meta" {
+					m.meta = msg.meta
+				}
+			}
+			if msg.msgType != "typing" || h.routeTyping(msg) {
+				h.fanOut(msg)
+			}
+			if (msg.msgType == "chat" || msg.history) && h.history != nil && !h.overloaded.Load() {
+				h.history.add(storedMessage{room: msg.room, id: msg.msgID, depth: msg.depth, at: h.now(), msgType: msg.msgType, data: msg.data})
+			}
+			if h.broker != nil && !msg.remote && !msg.local {
+				h.broker.publish(brokerMessage{Type: msg.msgType, ID: msg.msgID, Room: msg.room, Typing: msg.typing, Depth: msg.depth, Data: msg.data})
+			}
+			broadcastsTotal.inc()
+			if limit != nil {
+				if wait := limit.take(1, h.now()); wait > 0 {
+					broadcast, resume = nil, time.After(wait)
+				}
+			}
+		case <-resume:
+			broadcast, resume = h.broadcast, nil
+		case req := <-h.reapIdle:
+			req.result <- h.reap(req.olderThan)
+		case req := <-h.clears:
+			req.result <- h.clearRoom(req.room)
+		case result := <-h.snapshots:
+			result <- h.snapshot()
+		case result := <-h.roomLists:
+			result <- h.roomSummaries()
+		case req := <-h.drains:
+			h.drainAll(req)
+		case req := <-h.renames:
+			if m, ok := h.clients[req.client]; ok {
+				req.result <- h.rename(m, req)
+			} else {
+				req.result <- ""
+			}
+		case req := <-h.rosters:
+			if m, ok := h.clients[req.client]; ok {
+				req.result <- h.roster(m.room)
+			} else {
+				req.result <- roster{}
+			}
+		case q := <-h.occupants:
+			q.result <- h.roomPresence(q.room)
+		case req := <-h.joins:
+			var refused string
+			if m, ok := h.clients[req.client]; ok {
+				refused = h.switchRoom(m, req)
+			}
+			req.done <- refused
+		case req := <-h.migrations:
+			req.result <- h.startMigration(req.target)
+		case d := <-h.migrated:
+			h.finishMigration(d)
+		case q := <-h.lookups:
+			q.result <- h.nickOf(q.client)
+		case op := <-h.pollOps:
+			if _, ok := h.clients[op.client]; ok {
+				op.result <- h.applyPollOp(op)
+			} else {
+				op.result <- ""
+			}
+		case <-ageTicker.C:
+			h.updateConnectionAges()
+		case <-pollTicker.C:
+			h.updatePolls()
+		case jobs <- next:
+			h.pendingFanOuts[0] = fanOutJob{}
+			h.pendingFanOuts = h.pendingFanOuts[1:]
+			h.fanOutsInFlight++
+		case dropped := <-h.fanOutDone:
+			h.fanOutsInFlight--
+			for _, c := range dropped {
+				if _, ok := h.clients[c]; ok {
+					h.remove(c, closeSlowConsumer)
+				}
+			}
+		}
+	}
+}
+
+// admit registers c, sends it its room's roster and announces it. It
+// must only be called from Run.
+func (h *hub) admit(c Client) {
+	now := h.now()
+	m := &member{index: len(h.order), lastActive: now, connectedAt: now, wantsPresence: true}
+	if d, ok := c.(presenceDecliner); ok && d.declinesPresence() {
+		m.wantsPresence = false
+	}
+	if v, ok := c.(versionReporter); ok {
+		m.version = clientVersionLabel(v.clientVersion())
+	} else {
+		m.version = clientVersionLabel("")
+	}
+	connectedByVersion.add(m.version, 1)
+	room := defaultRoom
+	if r, ok := c.(roomReporter); ok {
+		room = r.initialRoom()
+	}
+	name := generateFriendlyName(c.ID())
+	if u, ok := c.(userReporter); ok && u.username() != "" {
+		m.user = u.username()
+		name = m.user
+	}
+	m.nick = uniqueName(name, func(n string) bool { return h.nickTaken(n, m) })
+	h.clients[c] = m
+	h.nicks[m.nick] = c
+	if m.user != "" {
+		h.users[m.user]++
+	}
+	h.order = append(h.order, c)
+	h.enterRoom(c, m, room)
+	h.updateClientCount()
+	log.Printf("client %s connected as %s in %s", c.ID(), m.nick, room)
+	h.sendRoster(c, m)
+	h.broadcastPresence("join", c, m)
+	h.announce(msgUserJoined, h.cfg.joinTemplate, c, m)
+}
+
+// fanOut delivers a broadcast to every subscribed client. Each fan-out
+// starts one position further along h.order so that no client is always
+// served last: sends are non-blocking today, but with bounded blocking
+// sends a fixed order would let slow clients early in the list starve
+// the ones after them.
+//
+// A sender's messages arrive here in the order it sent them (one reader
+// goroutine per client feeding one channel) and are handed to every
+// recipient in that order. With strictSenderOrder each recipient keeps a
+// single queue, so they are also written in that order or dropped, and
+// senderSeq makes any drop visible as a gap. Offloaded fan-outs keep this
+// guarantee because they are delivered one at a time, in order, and
+// nothing is delivered inline while any are outstanding.
+func (h *hub) fanOut(msg envelope) {
+	n := len(h.order)
+	if n == 0 {
+		return
+	}
+	start := h.nextStart % n
+	h.nextStart = start + 1
+
+	if quietSuppressedTypes[msg.msgType] && h.cfg.quietHours.active(h.now()) {
+		return
+	}
+
+	targets := make([]Client, 0, n)
+	for i := 0; i < n; i++ {
+		c := h.order[(start+i)%n]
+		if m := h.clients[c]; (msg.room == "" || m.room == msg.room) && m.wants(msg) && !m.blocks(msg.sender) && !m.mutes(msg, c.ID()) {
+			targets = append(targets, c)
+		}
+	}
+
+	if threshold := h.cfg.fanOutOffloadMinClients; threshold > 0 &&
+		(len(targets) >= threshold || len(h.pendingFanOuts) > 0 || h.fanOutsInFlight > 0) {
+		h.pendingFanOuts = append(h.pendingFanOuts, fanOutJob{msg: msg, targets: targets})
+		return
+	}
+	for _, c := range h.deliver(msg, targets) {
+		h.remove(c, closeSlowConsumer)
+	}
+}
+
+// deliver sends msg to each target and returns the ones too slow to take
+// it. It only calls Send, so it is safe off the Run goroutine.
+func (h *hub) deliver(msg envelope, targets []Client) []Client {
+	var dropped []Client
+	for _, c := range targets {
+		if err := c.Send(msg.msgType, msg.data); err != nil {
+			log.Printf("dropping client %s: %v", c.ID(), err)
+			h.deadLetters.record(h.now(), err.Error(), c.ID(), msg.msgType, msg.data)
+			dropped = append(dropped, c)
+		}
+	}
+	return dropped
+}
+
+// fanOutWorker delivers offloaded fan-outs in the order Run hands them
+// over. A client Run removes meanwhile is skipped by its own Send, and
+// any slow client reported back is removed by Run if still registered.
+func (h *hub) fanOutWorker() {
+	for job := range h.fanOutJobs {
+		h.fanOutDone <- h.deliver(job.msg, job.targets)
+	}
+}
+
+// reap disconnects clients that have been idle for longer than olderThan
+// and returns how many it disconnected. An idle client dropped as a slow
+// consumer while an earlier one's leave was announced isn't counted. It
+// must only be called from Run.
+func (h *hub) reap(olderThan time.Duration) int {
+	cutoff := h.now().Add(-olderThan)
+	var idle []Client
+	for c, m := range h.clients {
+		if m.lastActive.Before(cutoff) {
+			idle = append(idle, c)
+		}
+	}
+	reaped := 0
+	for _, c := range idle {
+		if _, ok := h.clients[c]; !ok {
+			continue
+		}
+		log.Printf("reaping idle client %s", c.ID())
+		h.remove(c, closeKicked)
+		reaped++
+	}
+	return reaped
+}
+
+// clearRoom disconnects every member of room and drops its history,
+// returning how many members it removed. It must only be called from
+// Run.
+func (h *hub) clearRoom(room string) int {
+	members := make([]Client, 0, len(h.rooms[room]))
+	for c := range h.rooms[room] {
+		members = append(members, c)
+	}
+	cleared := 0
+	for _, c := range members {
+		if _, ok := h.clients[c]; !ok {
+			continue
+		}
+		h.remove(c, closeRoomClosed)
+		cleared++
+	}
+	if h.history != nil {
+		h.history.clear(room)
+	}
+	return cleared
+}
+
+// updateConnectionAges refreshes the open-connections-by-age gauge. It
+// must only be called from Run.
+func (h *hub) updateConnectionAges() {
+	counts := make([]float64, len(connectionAgeBands)+1)
+	now := h.now()
+	for _, m := range h.clients {
+		age := now.Sub(m.connectedAt)
+		band := 0
+		for band < len(connectionAgeBands) && age >= connectionAgeBands[band] {
+			band++
+		}
+		counts[band]++
+	}
+	openConnectionsByAge.set(counts)
+}
+
+// remove deletes a registered client, closes it, tells its room it left
+// unless the server is shutting down, and logs its session summary. A
+// client that is no longer registered is ignored: announcing
+// one departure can drop another slow client before a caller iterating
+// over its own list reaches it. It must only be called from Run.
+func (h *hub) remove(c Client, reason closeReason) {
+	m, ok := h.clients[c]
+	if !ok {
+		return
+	}
+	last := len(h.order) - 1
+	if m.index != last {
+		moved := h.order[last]
+		h.order[m.index] = moved
+		h.clients[moved].index = m.index
+	}
+	h.order[last] = nil
+	h.order = h.order[:last]
+
+	delete(h.clients, c)
+	delete(h.nicks, m.nick)
+	if m.user != "" {
+		if h.users[m.user]--; h.users[m.user] == 0 {
+			delete(h.users, m.user)
+		}
+	}
+	h.leaveRoom(c, m)
+	connectionAge.observe(h.now().Sub(m.connectedAt).Seconds())
+	disconnectsTotal.inc(reason.label())
+	connectedByVersion.add(m.version, -1)
+	c.Close(reason)
+	h.updateClientCount()
+	if reason != closeShutdown {
+		h.broadcastPresence("leave", c, m)
+		h.announce(msgUserLeft, h.cfg.leaveTemplate, c, m)
+	}
+	h.logSession(c, m, reason)
+}
+
+// logSession writes a single line summarizing a departed client's
+// session.
+func (h *hub) logSession(c Client, m *member, why closeReason) {
+	var stats sessionStats
+	if r, ok := c.(sessionReporter); ok {
+		stats = r.session()
+	}
+	// The client's own account of a normal departure is more specific.
+	reason := why.String()
+	if why == closeNormal && stats.reason != "" {
+		reason = stats.reason
+	}
+	log.Printf("session id=%s nick=%s room=%s version=%s ip=%s connected=%s duration=%s sent=%d received=%d bytes_in=%d bytes_out=%d reason=%q",
+		c.ID(), m.nick, m.room, m.version, stats.remoteIP, m.connectedAt.UTC().Format(time.RFC3339),
+		h.now().Sub(m.connectedAt).Round(time.Millisecond),
+		stats.msgsIn, stats.msgsOut, stats.bytesIn, stats.bytesOut, reason)
+}
+
+// updateClientCount publishes the size of the client set and switches
+// compression on or off as it crosses the threshold. It must only be
+// called from Run.
+func (h *hub) updateClientCount() {
+	n := len(h.clients)
+	h.clientCount.Store(int64(n))
+	compress := h.cfg.compressMinClients > 0 && n >= h.cfg.compressMinClients
+	if h.compress.Swap(compress) != compress {
+		log.Printf("write compression set to %t at %d clients", compress, n)
+	}
+}
+
+// announce broadcasts a join or leave system message about c to its
+// room, rendered from tmpl. It must only be called from Run.
+func (h *hub) announce(key, tmpl string, c Client, m *member) {
+	if !h.cfg.announceJoinLeave || h.cfg.quietHours.active(h.now()) {
+		return
+	}
+	text := strings.NewReplacer(
+		"{nick}", m.nick,
+		"{room}", m.room,
+		"{count}", strconv.Itoa(len(h.rooms[m.room])),
+	).Replace(tmpl)
+
+	msg := message{
+		Type:       "system",
+		Key:        key,
+		Text:       text,
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Sender:     c.ID(),
+		User:       m.user,
+		Nick:       m.nick,
+		Room:       m.room,
+	}
+	data, err := encode(msg, "announcement")
+	if err != nil {
+		return
+	}
+	h.fanOut(envelope{msgType: msg.Type, msgID: msg.ID, data: data, room: m.room, presence: true})
+}
+
+// broadcastPresence tells c's room that it joined or left, as event
+// "join" or "leave". Unlike announce it carries no text and is sent
+// whether or not announceJoinLeave is set. It must only be called from
+// Run.
+func (h *hub) broadcastPresence(event string, c Client, m *member) {
+	msg := message{
+		Type:       "presence",
+		Presence:   event,
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Sender:     c.ID(),
+		User:       m.user,
+		Nick:       m.nick,
+		Room:       m.room,
+	}
+	if data, err := encode(msg, "presence"); err == nil {
+		h.fanOut(envelope{msgType: msg.Type, msgID: msg.ID, data: data, room: m.room, presence: true})
+	}
+}
+
+// sendRoster sends c the ids of the other members of its room, in join
+// order, along with their presence entries, so it can list them without waiting for presence events. Run
+// sends it before telling the room about c, so c never sees a join for
+// someone already in its roster. A client that declined presence gets
+// none. It must only be called from Run.
+func (h *hub) sendRoster(c Client, m *member) {
+	if !m.wantsPresence {
+		return
+	}
+	ids := make([]string, 0, len(h.rooms[m.room]))
+	members := make([]presenceEntry, 0, len(h.rooms[m.room]))
+	for _, other := range h.order {
+		if om := h.clients[other]; other != c && om.room == m.room {
+			ids = append(ids, other.ID())
+			members = append(members, om.presence(other))
+		}
+	}
+	msg := message{
+		Type:       "roster",
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Room:       m.room,
+		Users:      ids,
+		Members:    members,
+	}
+	data, err := encode(msg, "roster")
+	if err != nil {
+		return
+	}
+	if err := c.Send(msg.Type, data); err != nil {
+		h.deadLetters.record(h.now(), err.Error(), c.ID(), msg.Type, data)
+	}
+}
+
+func (m *member) setSubscriptions(types []string) {
+	if len(types) == 0 {
+		m.subscriptions = nil
+		return
+	}
+	m.subscriptions = make(map[string]struct{}, len(types))
+	for _, t := range types {
+		m.subscriptions[t] = struct{}{}
+	}
+}
+
+// wants reports whether the member's presence setting and subscription
+// filter admit msg.
+func (m *member) wants(msg envelope) bool {
+	if !m.wantsPresence && (msg.presence || presenceTypes[msg.msgType]) {
+		return false
+	}
+	if m.subscriptions == nil {
+		return true
+	}
+	_, ok := m.subscriptions[msg.msgType]
+	return ok
+}
+
+// updateBlocks applies a block or unblock request, resolving nicks to the
+// ids they currently belong to. It must only be called from Run.
+func (h *hub) updateBlocks(m *member, b blockRequest) {
+	for _, u := range b.users {
+		id := u
+		if c, ok := h.nicks[u]; ok {
+			id = c.ID()
+		}
+		if b.unblock {
+			delete(m.blocked, id)
+			continue
+		}
+		if m.blocked == nil {
+			m.blocked = make(map[string]struct{})
+		}
+		if len(m.blocked) < maxBlockedUsers {
+			m.blocked[id] = struct{}{}
+		}
+	}
+}
+
+// maxMutedRooms caps how many rooms a client may mute.
+const maxMutedRooms = 32
+
+// updateMutes applies a mute or unmute request. It must only be called
+// from Run.
+func (m *member) updateMutes(req muteRequest) {
+	if req.unmute {
+		delete(m.muted, req.room)
+		return
+	}
+	if m.muted == nil {
+		m.muted = make(map[string]struct{})
+	}
+	if len(m.muted) < maxMutedRooms {
+		m.muted[req.room] = struct{}{}
+	}
+}
+
+// mutes reports whether the member muted msg's room and msg is neither
+// addressed to it, whose id is id, nor mentions it. Messages for every
+// room are never muted.
+func (m *member) mutes(msg envelope, id string) bool {
+	if _, ok := m.muted[msg.room]; !ok || msg.room == "" {
+		return false
+	}
+	if msg.target == id {
+		return false
+	}
+	for _, nick := range msg.mentions {
+		if strings.EqualFold(nick, m.nick) {
+			return false
+		}
+	}
+	return true
+}
+
+// mentionPattern finds @nick mentions in chat text.
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{N}_.-]{1,32})`)
+
+// mentionedNicks returns the nicks text @-mentions, less any trailing
+// full stop, which reads as punctuation.
+func mentionedNicks(text string) []string {
+	var nicks []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if nick := strings.TrimRight(match[1], "."); nick != "" {
+			nicks = append(nicks, nick)
+		}
+	}
+	return nicks
+}
+
+// blocks reports whether the member has blocked sender. Server messages,
+// which have no sender, are never blocked.
+func (m *member) blocks(sender Client) bool {
+	if sender == nil || m.blocked == nil {
+		return false
+	}
+	_, ok := m.blocked[sender.ID()]
+	return ok
+}
+
+// setMaintenance switches read-only mode on or off, advising every
+// connected client when the mode changes.
+func (h *hub) setMaintenance(on bool) {
+	if h.maintenance.Swap(on) == on {
+		return
+	}
+
+	// The advisory is fanned out as a single encoding, so its text is in
+	// the default locale; clients can localize it from the key.
+	advisory := message{
+		Type:       "maintenance",
+		Key:        msgMaintenanceOff,
+		Active:     on,
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+	}
+	if on {
+		advisory.Key = msgMaintenanceOn
+	}
+	advisory.Text = h.cfg.catalog.text(advisory.Key, defaultLocale)
+	data, err := encode(advisory, "maintenance advisory")
+	if err != nil {
+		return
+	}
+	// Maintenance is per instance, so the advisory isn't published.
+	h.broadcast <- envelope{msgType: advisory.Type, msgID: advisory.ID, data: data, local: true}
+}
+
+// broadcastSystem queues a server-generated system message for the
+// clients in room, or every client if room is "", and returns its id.
+// A local message is kept from other instances. It must not be called
+// from Run.
+func (h *hub) broadcastSystem(key, text, room string, local bool) string {
+	env, ok := h.systemEnvelope(key, text, room)
+	if !ok {
+		return ""
+	}
+	env.local = local
+	h.broadcast <- env
+	return env.msgID
+}
+
+// injectSystem queues a notice posted through /api/broadcast and returns
+// its id like broadcastSystem. A notice for one room is kept in that
+// room's history; one for every room has no history to join.
+func (h *hub) injectSystem(text, room string) string {
+	env, ok := h.systemEnvelope(msgExternal, text, room)
+	if !ok {
+		return ""
+	}
+	env.history = room != ""
+	h.broadcast <- env
+	return env.msgID
+}
+
+// systemEnvelope encodes a system message for room, reporting false if
+// it can't be encoded.
+func (h *hub) systemEnvelope(key, text, room string) (envelope, bool) {
+	msg := message{
+		Type:       "system",
+		Key:        key,
+		Text:       text,
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Room:       room,
+	}
+	data, err := encode(msg, "system message")
+	if err != nil {
+		return envelope{}, false
+	}
+	return envelope{msgType: msg.Type, msgID: msg.ID, data: data, room: room}, true
+}
+
+// statusMessage encodes a server_status load hint, or returns nil if it
+// can't be encoded.
+func (h *hub) statusMessage() []byte {
+	data, _ := encode(message{
+		Type:       "server_status",
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Status: &serverStatus{
+			Clients:     h.clientCount.Load(),
+			Maintenance: h.maintenance.Load(),
+		},
+	}, "server status")
+	return data
+}
+
+// encode marshals an outgoing message. Every encoding failure is logged
+// and counted here, so callers only need to decide what happens to the
+// message that couldn't be sent.
+func encode(v any, what string) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		marshalErrors.inc()
+		log.Printf("failed to encode %s: %v", what, err)
+	}
+	return data, err
+}
+
+// stamp is an encoded serverTime: a JSON string or number, depending on
+// cfg.serverTimeFormat.
+type stamp = json.RawMessage
+
+// serverTime returns the hub clock's current time encoded for the
+// ServerTime field in the configured format.
+func (h *hub) serverTime() stamp {
+	t := h.now().UTC()
+	switch h.cfg.serverTimeFormat {
+	case timeFormatUnixMillis:
+		return strconv.AppendInt(nil, t.UnixMilli(), 10)
+	case timeFormatRFC3339:
+		return strconv.AppendQuote(nil, t.Format(time.RFC3339))
+	default:
+		return strconv.AppendQuote(nil, t.Format(time.RFC3339Nano))
+	}
+}
+
+// clockTime returns the hub clock's current time at full precision, for
+// the time sync exchange, which needs it whatever serverTime's format.
+func (h *hub) clockTime() string {
+	return h.now().UTC().Format(time.RFC3339Nano)
+}
+
+func randomID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		ts := time.Now().UnixNano()
+		return hex.EncodeToString([]byte{byte(ts >> 8), byte(ts)})
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFanOutRemovesEachSlowConsumerOnce(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	clients := registerTestClients(t, h, 6)
+	slow := clients[:3]
+	for _, c := range slow {
+		c.stall()
+	}
+
+	// Removing the first slow client announces its leave, which finds
+	// the others slow too before the fan-out gets back to them.
+	h.broadcast <- envelope{msgType: "chat", data: []byte(`{"type":"chat"}`)}
+	waitFor(t, "slow clients to be removed", func() bool { return h.clientCount.Load() == 3 })
+
+	for _, c := range slow {
+		if n, reason := c.closed(); n != 1 || reason != closeSlowConsumer {
+			t.Errorf("slow client closed %d times with %v, want once with %v", n, reason, closeSlowConsumer)
+		}
+	}
+	for _, c := range clients[3:] {
+		if n, _ := c.closed(); n != 0 {
+			t.Errorf("healthy client closed %d times", n)
+		}
+	}
+	if got := len(h.presenceOf(defaultRoom)); got != 3 {
+		t.Errorf("room has %d members after fan-out, want 3", got)
+	}
+}
+
+func TestFanOutReachesEveryClientUntilItLeaves(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	clients := registerTestClients(t, h, 3)
+	chats := func(c *testClient) int {
+		var n int
+		for _, msgType := range c.received() {
+			if msgType == "chat" {
+				n++
+			}
+		}
+		return n
+	}
+
+	h.broadcast <- envelope{msgType: "chat", data: []byte(`{"type":"chat"}`)}
+	waitFor(t, "every client to get the chat", func() bool {
+		return chats(clients[0]) == 1 && chats(clients[1]) == 1 && chats(clients[2]) == 1
+	})
+
+	h.unregister <- clients[0]
+	waitFor(t, "the client to leave", func() bool { return h.clientCount.Load() == 2 })
+	h.broadcast <- envelope{msgType: "chat", data: []byte(`{"type":"chat"}`)}
+	waitFor(t, "the others to get the second chat", func() bool {
+		return chats(clients[1]) == 2 && chats(clients[2]) == 2
+	})
+	if n := chats(clients[0]); n != 1 {
+		t.Errorf("a client that left was sent %d chats, want only the first", n)
+	}
+}
+
+// orderClient is a testClient that also appends its id to a log shared
+// with other clients on each chat it is sent, recording delivery order.
+type orderClient struct {
+	testClient
+	log *deliveryLog
+}
+
+type deliveryLog struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (c *orderClient) Send(msgType string, data []byte) error {
+	if msgType == "chat" {
+		c.log.mu.Lock()
+		c.log.ids = append(c.log.ids, c.id)
+		c.log.mu.Unlock()
+	}
+	return c.testClient.Send(msgType, data)
+}
+
+func TestFanOutRotatesWhoIsServedFirst(t *testing.T) {
+	const clients, broadcasts = 4, 400
+	h := startTestHub(t, testConfig())
+	deliveries := &deliveryLog{}
+	for i := 0; i < clients; i++ {
+		h.register <- &orderClient{testClient: testClient{id: strconv.Itoa(i)}, log: deliveries}
+	}
+	waitFor(t, "clients to register", func() bool { return h.clientCount.Load() == clients })
+
+	for i := 0; i < broadcasts; i++ {
+		h.broadcast <- envelope{msgType: "chat", data: []byte(`{"type":"chat"}`)}
+	}
+	waitFor(t, "every broadcast to be delivered", func() bool {
+		deliveries.mu.Lock()
+		defer deliveries.mu.Unlock()
+		return len(deliveries.ids) == clients*broadcasts
+	})
+
+	first := map[string]int{}
+	for i := 0; i < broadcasts; i++ {
+		first[deliveries.ids[i*clients]]++
+	}
+	for id, n := range first {
+		if n < broadcasts/clients*8/10 || n > broadcasts/clients*12/10 {
+			t.Errorf("client %s was served first %d times in %d broadcasts, want about %d", id, n, broadcasts, broadcasts/clients)
+		}
+	}
+	if len(first) != clients {
+		t.Errorf("only %d of %d clients were ever served first", len(first), clients)
+	}
+}
+
+// reapSync asks Run to reap clients idle for longer than olderThan.
+func (h *hub) reapSync(olderThan time.Duration) int {
+	req := reapRequest{olderThan: olderThan, result: make(chan int, 1)}
+	h.reapIdle <- req
+	return <-req.result
+}
+
+func TestReapRemovesOnlyIdleClients(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	idle := registerTestClients(t, h, 3)
+	time.Sleep(50 * time.Millisecond)
+	fresh := registerTestClients(t, h, 2)
+
+	if n := h.reapSync(25 * time.Millisecond); n != len(idle) {
+		t.Errorf("reaped %d clients, want %d", n, len(idle))
+	}
+	for _, c := range idle {
+		if n, reason := c.closed(); n != 1 || reason != closeKicked {
+			t.Errorf("idle client closed %d times with %v, want once with %v", n, reason, closeKicked)
+		}
+	}
+	for _, c := range fresh {
+		if n, _ := c.closed(); n != 0 {
+			t.Errorf("fresh client closed %d times", n)
+		}
+	}
+}
+
+func TestReapToleratesIdleClientsDroppedMeanwhile(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	idle := registerTestClients(t, h, 4)
+	time.Sleep(50 * time.Millisecond)
+	fresh := registerTestClients(t, h, 2)
+	for _, c := range idle {
+		c.stall()
+	}
+
+	// The first idle client's leave finds the rest slow, so they are
+	// gone before reap reaches them.
+	n := h.reapSync(25 * time.Millisecond)
+	if n < 1 || n > len(idle) {
+		t.Errorf("reaped %d clients, want between 1 and %d", n, len(idle))
+	}
+	for _, c := range idle {
+		if closes, _ := c.closed(); closes != 1 {
+			t.Errorf("idle client closed %d times, want once", closes)
+		}
+	}
+	if got := len(h.presenceOf(defaultRoom)); got != len(fresh) {
+		t.Errorf("room has %d members after reaping, want %d", got, len(fresh))
+	}
+}
+
+// panickingClient panics as soon as Run asks who it is.
+type panickingClient struct{ testClient }
+
+func (c *panickingClient) ID() string { panic("test panic") }
+
+func TestRunRestartsAfterPanic(t *testing.T) {
+	if defaultConfig().hubPanicPolicy != hubPanicExit {
+		t.Errorf("default panic policy is %q, want %q", defaultConfig().hubPanicPolicy, hubPanicExit)
+	}
+	cfg := testConfig()
+	cfg.hubPanicPolicy = hubPanicRestart
+	h := startTestHub(t, cfg)
+
+	before := hubPanicCount()
+	h.register <- &panickingClient{}
+	waitFor(t, "the panic to be recovered", func() bool { return hubPanicCount() > before })
+
+	registerTestClients(t, h, 2)
+	if got := len(h.presenceOf(defaultRoom)); got != 2 {
+		t.Errorf("room has %d members after restart, want 2", got)
+	}
+}
+
+func hubPanicCount() float64 {
+	hubPanics.mu.Lock()
+	defer hubPanics.mu.Unlock()
+	return hubPanics.value
+}
+
+func TestSubscriptionLeavesOutOtherTypes(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	sender := dialTestClient(t, base, "", "")
+	dashboard := dialTestClient(t, base, "", "")
+	everything := dialTestClient(t, base, "", "")
+	for _, c := range []*testConn{sender, dashboard, everything} {
+		c.RecvAll(100 * time.Millisecond)
+	}
+	dashboard.Send(message{Type: "subscribe", Types: []string{"chat"}})
+	syncTestConn(t, dashboard)
+
+	sender.Send(message{Type: "typing", Typing: "start"})
+	sender.Send(message{Type: "chat", Text: "hello"})
+	if got := dashboard.RecvAll(200 * time.Millisecond); hasType(got, "typing") || !hasType(got, "chat") {
+		t.Errorf("chat-only subscriber got %v, want the chat and no typing", types(got))
+	}
+	if got := everything.RecvAll(100 * time.Millisecond); !hasType(got, "typing") || !hasType(got, "chat") {
+		t.Errorf("unsubscribed client got %v, want both the typing and the chat", types(got))
+	}
+}
+
+func TestInjectedIDsAndClockAreUsed(t *testing.T) {
+	h := NewHub(testConfig())
+	var next atomic.Int64
+	h.idGen = func() string { return "id-" + strconv.FormatInt(next.Add(1), 10) }
+	fixed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	h.now = func() time.Time { return fixed }
+	go h.Run()
+	base := serveTestHub(t, h)
+
+	welcome, ok := dialTestClient(t, base, "", "").Recv(time.Second)
+	if !ok || welcome.Key != msgConnected {
+		t.Fatalf("first message %+v, want the welcome", welcome)
+	}
+	if !strings.HasPrefix(welcome.Sender, "id-") || !strings.HasPrefix(welcome.ID, "id-") || welcome.Sender == welcome.ID {
+		t.Errorf("welcome has client id %q and message id %q, want distinct ids from the injected generator", welcome.Sender, welcome.ID)
+	}
+	if got := string(welcome.ServerTime); got != `"2024-01-02T03:04:05Z"` {
+		t.Errorf("welcome serverTime %s, want the injected clock's", got)
+	}
+}
+
+// announced returns the first message among msgs with key.
+func announced(msgs []message, key string) (message, bool) {
+	for _, m := range msgs {
+		if m.Key == key {
+			return m, true
+		}
+	}
+	return message{}, false
+}
+
+func TestJoinLeaveAnnouncementsRendered(t *testing.T) {
+	cfg := testConfig()
+	cfg.joinTemplate = "{nick} joined {room} ({count} here)"
+	cfg.leaveTemplate = "{nick} left {room}"
+	_, base := newTestServer(t, cfg)
+	watcher := dialTestClient(t, base, "", "")
+	watcher.RecvAll(100 * time.Millisecond)
+
+	joiner := dialTestClient(t, base, "", "")
+	joined, ok := announced(watcher.RecvAll(100*time.Millisecond), msgUserJoined)
+	if !ok {
+		t.Fatal("no join announcement")
+	}
+	if want := joined.Nick + " joined " + defaultRoom + " (2 here)"; joined.Text != want {
+		t.Errorf("join announced as %q, want %q", joined.Text, want)
+	}
+
+	joiner.conn.Close()
+	left, ok := announced(watcher.RecvAll(100*time.Millisecond), msgUserLeft)
+	if !ok {
+		t.Fatal("no leave announcement")
+	}
+	if want := joined.Nick + " left " + defaultRoom; left.Text != want {
+		t.Errorf("leave announced as %q, want %q", left.Text, want)
+	}
+}
+
+func TestJoinLeaveAnnouncementsDisabled(t *testing.T) {
+	cfg := testConfig()
+	cfg.announceJoinLeave = false
+	_, base := newTestServer(t, cfg)
+	watcher := dialTestClient(t, base, "", "")
+	watcher.RecvAll(100 * time.Millisecond)
+
+	dialTestClient(t, base, "", "").conn.Close()
+	msgs := watcher.RecvAll(100 * time.Millisecond)
+	for _, key := range []string{msgUserJoined, msgUserLeft} {
+		if _, ok := announced(msgs, key); ok {
+			t.Errorf("%s announced with announcements off", key)
+		}
+	}
+}
+
+func TestCompressionFollowsClientCount(t *testing.T) {
+	cfg := testConfig()
+	cfg.compressMinClients = 3
+	h := startTestHub(t, cfg)
+	clients := registerTestClients(t, h, 2)
+	if h.compress.Load() {
+		t.Fatal("compression on below the threshold")
+	}
+	registerTestClients(t, h, 1)
+	if !h.compress.Load() {
+		t.Fatal("compression still off at the threshold")
+	}
+	h.unregister <- clients[0]
+	waitFor(t, "compression to switch off", func() bool { return !h.compress.Load() })
+}
+
+func TestDeflateConnectionsCounted(t *testing.T) {
+	cfg := testConfig()
+	cfg.compressMinClients = 1
+	_, base := newTestServer(t, cfg)
+	before := deflateConns.Load()
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the deflate connection to be counted", func() bool { return deflateConns.Load() == before+1 })
+	conn.Close()
+	waitFor(t, "the closed connection to be uncounted", func() bool { return deflateConns.Load() == before })
+}
+
+// logBuffer collects log output for a test.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureTestLog sends the standard logger's output to a buffer until
+// the test ends.
+func captureTestLog(t *testing.T) *logBuffer {
+	t.Helper()
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+func TestSessionSummaryCountsTraffic(t *testing.T) {
+	logs := captureTestLog(t)
+	_, base := newTestServer(t, testConfig())
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws?room=ops", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bytesIn int
+	for i := 0; i < 3; i++ {
+		frame := []byte(`{"type":"chat","text":"hello ` + strconv.Itoa(i) + `"}`)
+		bytesIn += len(frame)
+		if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var received, bytesOut int
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		received++
+		bytesOut += len(data)
+	}
+	conn.Close()
+
+	var summary string
+	waitFor(t, "the session summary", func() bool {
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "session id=") {
+				summary = line
+				return true
+			}
+		}
+		return false
+	})
+	for _, want := range []string{
+		"room=ops",
+		"sent=3 ",
+		"received=" + strconv.Itoa(received) + " ",
+		"bytes_in=" + strconv.Itoa(bytesIn) + " ",
+		"bytes_out=" + strconv.Itoa(bytesOut) + " ",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("session summary %q lacks %s", summary, want)
+		}
+	}
+}
+
+func TestRegistrationsServedDuringBroadcastStorm(t *testing.T) {
+	cfg := testConfig()
+	cfg.broadcastRate = 20
+	began := time.Now()
+	h := startTestHub(t, cfg)
+	watcher := registerTestClients(t, h, 1)[0]
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case h.broadcast <- envelope{msgType: "chat", data: []byte(`{"type":"chat"}`)}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	waitFor(t, "the broadcast queue to back up", func() bool { return len(h.broadcast) == cap(h.broadcast) })
+
+	start := time.Now()
+	registerTestClients(t, h, 5)
+	if took := time.Since(start); took > 200*time.Millisecond {
+		t.Errorf("registering behind a broadcast storm took %v", took)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	chats := 0
+	for _, typ := range watcher.received() {
+		if typ == "chat" {
+			chats++
+		}
+	}
+	// A full bucket of 20 plus 20 a second since the hub started.
+	if limit := 20 + int(20*time.Since(began).Seconds()) + 1; chats > limit {
+		t.Errorf("%d broadcasts fanned out, more than BROADCAST_RATE allows (%d)", chats, limit)
+	}
+}
+
+func TestBlockedSenderNotDelivered(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	sender := dialTestClient(t, base, "", "")
+	blocker := dialTestClient(t, base, "", "")
+	other := dialTestClient(t, base, "", "")
+	var senderID, blockerID string
+	for _, m := range sender.RecvAll(100 * time.Millisecond) {
+		if m.Key == msgConnected {
+			senderID = m.Sender
+		}
+	}
+	for _, m := range blocker.RecvAll(100 * time.Millisecond) {
+		if m.Key == msgConnected {
+			blockerID = m.Sender
+		}
+	}
+	other.RecvAll(100 * time.Millisecond)
+	var nick string
+	for _, e := range h.presenceOf(defaultRoom) {
+		if e.ID == senderID {
+			nick = e.Nick
+		}
+	}
+	if nick == "" {
+		t.Fatal("sender has no nick")
+	}
+	got := func(c *testConn) string {
+		var texts []string
+		for _, m := range c.RecvAll(100 * time.Millisecond) {
+			if m.Type == "chat" || m.Type == "webrtc-offer" {
+				texts = append(texts, m.Type+":"+m.Text)
+			}
+		}
+		return strings.Join(texts, "|")
+	}
+
+	// Blocked by nick, which Run resolves to the sender's id.
+	blocker.Send(message{Type: "block", Users: []string{nick}})
+	syncTestConn(t, blocker)
+	sender.Send(message{Type: "chat", Text: "hi"})
+	sender.Send(message{Type: "webrtc-offer", Target: blockerID, SDP: "v=0"})
+	if texts := got(blocker); texts != "" {
+		t.Errorf("blocking client got %q from a blocked sender", texts)
+	}
+	if texts := got(other); !strings.HasPrefix(texts, "chat:hi") {
+		t.Errorf("other client got %q, want the chat", texts)
+	}
+
+	blocker.Send(message{Type: "unblock", Users: []string{senderID}})
+	syncTestConn(t, blocker)
+	sender.Send(message{Type: "chat", Text: "again"})
+	if texts := got(blocker); texts != "chat:again" {
+		t.Errorf("after unblocking got %q, want the chat", texts)
+	}
+}
+
+func TestServerTimeFormatUsedEverywhere(t *testing.T) {
+	fixed := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	for _, tc := range []struct{ format, want string }{
+		{timeFormatRFC3339Nano, `"2024-01-02T03:04:05.123456789Z"`},
+		{timeFormatRFC3339, `"2024-01-02T03:04:05Z"`},
+		{timeFormatUnixMillis, "1704164645123"},
+	} {
+		tc := tc
+		t.Run(tc.format, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.serverTimeFormat = tc.format
+			h := NewHub(cfg)
+			h.now = func() time.Time { return fixed }
+			go h.Run()
+			base := serveTestHub(t, h)
+			sender := dialTestClient(t, base, "", "")
+			receiver := dialTestClient(t, base, "", "")
+			msgs := sender.RecvAll(100 * time.Millisecond)
+
+			sender.Send(message{Type: "chat", Text: "hi"})
+			sender.Send(message{Type: "typing", Typing: "start"})
+			sender.Send(message{Type: "chat", Text: "/nosuch"})
+			sender.Send(message{Type: "ping", ID: "p"})
+			msgs = append(msgs, sender.RecvAll(200*time.Millisecond)...)
+			msgs = append(msgs, receiver.RecvAll(200*time.Millisecond)...)
+			seen := map[string]bool{}
+			for _, m := range msgs {
+				if len(m.ServerTime) == 0 {
+					continue
+				}
+				seen[m.Type+"/"+m.Key] = true
+				if got := string(m.ServerTime); got != tc.want {
+					t.Errorf("%s %s has serverTime %s, want %s", m.Type, m.Key, got, tc.want)
+				}
+			}
+			for _, want := range []string{"system/" + msgConnected, "chat/", "typing/", "system/" + msgUnknownCommand, "pong/"} {
+				if !seen[want] {
+					t.Errorf("no %s with a serverTime among %v", want, types(msgs))
+				}
+			}
+		})
+	}
+}
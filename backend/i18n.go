@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const defaultLocale = "en"
+
+// Message keys for server-generated text.
+const (
+	msgConnected      = "connected"
+	msgTooLarge       = "message_too_large"
+	msgMaintenanceOn  = "maintenance_on"
+	msgMaintenanceOff = "maintenance_off"
+	msgSelfReply      = "self_reply"
+	msgReplyMissing   = "reply_missing"
+	msgReplyTooDeep   = "reply_too_deep"
+	msgServerBusy     = "server_busy"
+	msgMetaTooMany    = "meta_too_many_keys"
+	msgMetaTooLong    = "meta_too_long"
+	msgInternalError  = "internal_error"
+	msgAuthRequired   = "auth_required"
+	msgAuthenticated  = "authenticated"
+	msgFieldTooLong   = "field_too_long"
+	msgDuplicate      = "duplicate_message"
+	msgUpgrade        = "upgrade_required"
+	msgOverloaded     = "server_overloaded"
+	msgFloodWarning   = "flood_warning"
+	msgCooldown       = "cooldown"
+	msgUnknownCommand = "unknown_command"
+	msgUsage          = "command_usage"
+	msgHelp           = "command_help"
+	msgWho            = "who"
+	msgNickInvalid    = "nick_invalid"
+	msgNickTaken      = "nick_taken"
+	msgNickChanged    = "nick_changed"
+	msgNotYetAllowed  = "not_yet_allowed"
+	msgPollInvalid    = "poll_invalid"
+	msgPollLimit      = "poll_limit"
+	msgPollUnknown    = "poll_unknown"
+	msgPollNotCreator = "poll_not_creator"
+	msgTypeNotAllowed = "type_not_allowed"
+	msgRulesPending   = "rules_not_accepted"
+	msgBlocked        = "message_blocked"
+	msgRoomInvalid    = "room_invalid"
+	msgRoomJoined     = "room_joined"
+	msgRoomNotFound   = "room_not_found"
+	msgRoomPrivate    = "room_private"
+	msgRoomFull       = "room_full"
+	msgThrottled      = "throttled"
+	msgRateLimited    = "rate_limited"
+
+	msgAttachmentInvalid   = "attachment_invalid"
+	msgAttachmentsTooMany  = "attachments_too_many"
+	msgAttachmentsTooLarge = "attachments_too_large"
+
+	// Keys identifying rendered announcements. Their text comes from
+	// configurable templates, the operator's schedule or an external
+	// system rather than the catalog.
+	msgUserJoined = "user_joined"
+	msgUserLeft   = "user_left"
+	msgScheduled  = "scheduled"
+	msgExternal   = "external"
+)
+
+// catalog maps a message key to its text in each locale.
+type catalog map[string]map[string]string
+
+var defaultCatalog = catalog{
+	msgConnected: {
+		"en": "connected",
+		"es": "conectado",
+		"fr": "connecté",
+		"de": "verbunden",
+	},
+	msgTooLarge: {
+		"en": "message too large",
+		"es": "mensaje demasiado grande",
+		"fr": "message trop volumineux",
+		"de": "Nachricht zu groß",
+	},
+	msgMaintenanceOn: {
+		"en": "chat is read-only during maintenance",
+		"es": "el chat es de solo lectura durante el mantenimiento",
+		"fr": "le chat est en lecture seule pendant la maintenance",
+		"de": "der Chat ist während der Wartung schreibgeschützt",
+	},
+	msgMaintenanceOff: {
+		"en": "maintenance finished, chat is available again",
+		"es": "mantenimiento terminado, el chat vuelve a estar disponible",
+		"fr": "maintenance terminée, le chat est de nouveau disponible",
+		"de": "Wartung beendet, der Chat ist wieder verfügbar",
+	},
+	msgSelfReply: {
+		"en": "a message cannot reply to itself",
+		"es": "un mensaje no puede responderse a sí mismo",
+		"fr": "un message ne peut pas se répondre à lui-même",
+		"de": "eine Nachricht kann nicht auf sich selbst antworten",
+	},
+	msgReplyMissing: {
+		"en": "the message you replied to isn't in this room's history",
+		"es": "el mensaje al que respondiste no está en el historial de esta sala",
+		"fr": "le message auquel vous avez répondu n'est pas dans l'historique de ce salon",
+		"de": "die Nachricht, auf die du antwortest, ist nicht im Verlauf dieses Raums",
+	},
+	msgReplyTooDeep: {
+		"en": "that reply thread is too deep to reply to",
+		"es": "ese hilo de respuestas es demasiado profundo para responder",
+		"fr": "ce fil de réponses est trop profond pour y répondre",
+		"de": "dieser Antwortverlauf ist zu tief verschachtelt, um darauf zu antworten",
+	},
+	msgServerBusy: {
+		"en": "server busy",
+		"es": "servidor ocupado",
+		"fr": "serveur occupé",
+		"de": "Server ausgelastet",
+	},
+	msgMetaTooMany: {
+		"en": "too many metadata keys",
+		"es": "demasiadas claves de metadatos",
+		"fr": "trop de clés de métadonnées",
+		"de": "zu viele Metadatenschlüssel",
+	},
+	msgMetaTooLong: {
+		"en": "metadata key or value too long",
+		"es": "clave o valor de metadatos demasiado largo",
+		"fr": "clé ou valeur de métadonnées trop longue",
+		"de": "Metadatenschlüssel oder -wert zu lang",
+	},
+	msgInternalError: {
+		"en": "internal server error",
+		"es": "error interno del servidor",
+		"fr": "erreur interne du serveur",
+		"de": "interner Serverfehler",
+	},
+	msgAuthRequired: {
+		"en": "authenticate before sending messages",
+		"es": "autentícate antes de enviar mensajes",
+		"fr": "authentifiez-vous avant d'envoyer des messages",
+		"de": "vor dem Senden von Nachrichten anmelden",
+	},
+	msgAuthenticated: {
+		"en": "authenticated",
+		"es": "autenticado",
+		"fr": "authentifié",
+		"de": "angemeldet",
+	},
+	msgFieldTooLong: {
+		"en": "the {field} field is too long",
+		"es": "el campo {field} es demasiado largo",
+		"fr": "le champ {field} est trop long",
+		"de": "das Feld {field} ist zu lang",
+	},
+	msgDuplicate: {
+		"en": "duplicate message not sent",
+		"es": "mensaje duplicado no enviado",
+		"fr": "message en double non envoyé",
+		"de": "doppelte Nachricht nicht gesendet",
+	},
+	msgUpgrade: {
+		"en": "this version of the app is no longer supported, please reload",
+		"es": "esta versión de la aplicación ya no es compatible, recarga la página",
+		"fr": "cette version de l'application n'est plus prise en charge, veuillez recharger",
+		"de": "diese App-Version wird nicht mehr unterstützt, bitte neu laden",
+	},
+	msgOverloaded: {
+		"en": "server overloaded, try again shortly",
+		"es": "servidor sobrecargado, inténtalo de nuevo en breve",
+		"fr": "serveur surchargé, réessayez dans un instant",
+		"de": "Server überlastet, bitte gleich erneut versuchen",
+	},
+	msgFloodWarning: {
+		"en": "you are sending messages too quickly, slow down",
+		"es": "estás enviando mensajes demasiado rápido, ve más despacio",
+		"fr": "vous envoyez des messages trop rapidement, ralentissez",
+		"de": "du sendest Nachrichten zu schnell, bitte langsamer",
+	},
+	msgCooldown: {
+		"en": "you are in a cooldown, your messages are not being sent",
+		"es": "estás en un periodo de espera, tus mensajes no se envían",
+		"fr": "vous êtes en pause forcée, vos messages ne sont pas envoyés",
+		"de": "du bist in einer Abkühlphase, deine Nachrichten werden nicht gesendet",
+	},
+	msgUnknownCommand: {
+		"en": "unknown command {command}, try /help",
+		"es": "comando desconocido {command}, prueba /help",
+		"fr": "commande inconnue {command}, essayez /help",
+		"de": "unbekannter Befehl {command}, versuche /help",
+	},
+	msgUsage: {
+		"en": "usage: {usage}",
+		"es": "uso: {usage}",
+		"fr": "utilisation : {usage}",
+		"de": "Verwendung: {usage}",
+	},
+	msgHelp: {
+		"en": "commands: {commands}",
+		"es": "comandos: {commands}",
+		"fr": "commandes : {commands}",
+		"de": "Befehle: {commands}",
+	},
+	msgWho: {
+		"en": "online: {users}",
+		"es": "conectados: {users}",
+		"fr": "en ligne : {users}",
+		"de": "online: {users}",
+	},
+	msgNickInvalid: {
+		"en": "a nick is 1 to 32 letters, digits, '.', '_' or '-'",
+		"es": "un apodo tiene de 1 a 32 letras, dígitos, '.', '_' o '-'",
+		"fr": "un pseudo comporte de 1 à 32 lettres, chiffres, '.', '_' ou '-'",
+		"de": "ein Spitzname besteht aus 1 bis 32 Buchstaben, Ziffern, '.', '_' oder '-'",
+	},
+	msgNickTaken: {
+		"en": "that nick is already in use",
+		"es": "ese apodo ya está en uso",
+		"fr": "ce pseudo est déjà utilisé",
+		"de": "dieser Spitzname ist bereits vergeben",
+	},
+	msgNickChanged: {
+		"en": "{old} is now known as {nick}",
+		"es": "{old} ahora se llama {nick}",
+		"fr": "{old} s'appelle désormais {nick}",
+		"de": "{old} heißt jetzt {nick}",
+	},
+	msgNotYetAllowed: {
+		"en": "you have just joined, wait a moment before sending messages",
+		"es": "acabas de entrar, espera un momento antes de enviar mensajes",
+		"fr": "vous venez d'arriver, patientez un instant avant d'envoyer des messages",
+		"de": "du bist gerade beigetreten, warte kurz, bevor du Nachrichten sendest",
+	},
+	msgPollInvalid: {
+		"en": "a poll needs a question and 2 to 10 options, and a vote one of its options",
+		"es": "una encuesta necesita una pregunta y de 2 a 10 opciones, y un voto una de sus opciones",
+		"fr": "un sondage demande une question et 2 à 10 options, et un vote l'une de ses options",
+		"de": "eine Umfrage braucht eine Frage und 2 bis 10 Optionen, eine Stimme eine ihrer Optionen",
+	},
+	msgPollLimit: {
+		"en": "too many polls are open, close one first",
+		"es": "hay demasiadas encuestas abiertas, cierra una primero",
+		"fr": "trop de sondages sont ouverts, fermez-en un d'abord",
+		"de": "zu viele Umfragen sind offen, schließe zuerst eine",
+	},
+	msgPollUnknown: {
+		"en": "that poll is closed or does not exist",
+		"es": "esa encuesta está cerrada o no existe",
+		"fr": "ce sondage est fermé ou n'existe pas",
+		"de": "diese Umfrage ist geschlossen oder existiert nicht",
+	},
+	msgPollNotCreator: {
+		"en": "only the poll's creator can close it",
+		"es": "solo quien creó la encuesta puede cerrarla",
+		"fr": "seul le créateur du sondage peut le fermer",
+		"de": "nur wer die Umfrage erstellt hat, kann sie schließen",
+	},
+	msgTypeNotAllowed: {
+		"en": "you are not allowed to send that kind of message",
+		"es": "no tienes permiso para enviar ese tipo de mensaje",
+		"fr": "vous n'êtes pas autorisé à envoyer ce type de message",
+		"de": "du darfst diese Art von Nachricht nicht senden",
+	},
+	msgRulesPending: {
+		"en": "accept the rules before sending messages",
+		"es": "acepta las normas antes de enviar mensajes",
+		"fr": "acceptez les règles avant d'envoyer des messages",
+		"de": "akzeptiere die Regeln, bevor du Nachrichten sendest",
+	},
+	msgBlocked: {
+		"en": "your message was blocked by moderation",
+		"es": "tu mensaje fue bloqueado por la moderación",
+		"fr": "votre message a été bloqué par la modération",
+		"de": "deine Nachricht wurde von der Moderation blockiert",
+	},
+	msgRoomInvalid: {
+		"en": "a room name is 1 to 64 letters, digits, '.', '_' or '-'",
+		"es": "un nombre de sala tiene de 1 a 64 letras, dígitos, '.', '_' o '-'",
+		"fr": "un nom de salon comporte de 1 à 64 lettres, chiffres, '.', '_' ou '-'",
+		"de": "ein Raumname besteht aus 1 bis 64 Buchstaben, Ziffern, '.', '_' oder '-'",
+	},
+	msgRoomNotFound: {
+		"en": "that room doesn't exist and can't be created",
+		"es": "esa sala no existe y no se puede crear",
+		"fr": "ce salon n'existe pas et ne peut pas être créé",
+		"de": "diesen Raum gibt es nicht, und er kann nicht erstellt werden",
+	},
+	msgRoomPrivate: {
+		"en": "that room is private",
+		"es": "esa sala es privada",
+		"fr": "ce salon est privé",
+		"de": "dieser Raum ist privat",
+	},
+	msgRoomFull: {
+		"en": "that room is full",
+		"es": "esa sala está llena",
+		"fr": "ce salon est complet",
+		"de": "dieser Raum ist voll",
+	},
+	msgRoomJoined: {
+		"en": "you joined {room}",
+		"es": "te uniste a {room}",
+		"fr": "vous avez rejoint {room}",
+		"de": "du bist {room} beigetreten",
+	},
+	msgThrottled: {
+		"en": "you are sending too many messages, some are being dropped",
+		"es": "estás enviando demasiados mensajes, algunos se descartan",
+		"fr": "vous envoyez trop de messages, certains sont ignorés",
+		"de": "du sendest zu viele Nachrichten, einige werden verworfen",
+	},
+	msgRateLimited: {
+		"en": "you are being disconnected for sending too many messages",
+		"es": "se te desconecta por enviar demasiados mensajes",
+		"fr": "vous êtes déconnecté pour avoir envoyé trop de messages",
+		"de": "du wirst getrennt, weil du zu viele Nachrichten sendest",
+	},
+	msgAttachmentInvalid: {
+		"en": "attachment not allowed",
+		"es": "archivo adjunto no permitido",
+		"fr": "pièce jointe non autorisée",
+		"de": "Anhang nicht erlaubt",
+	},
+	msgAttachmentsTooMany: {
+		"en": "too many attachments",
+		"es": "demasiados archivos adjuntos",
+		"fr": "trop de pièces jointes",
+		"de": "zu viele Anhänge",
+	},
+	msgAttachmentsTooLarge: {
+		"en": "attachments too large",
+		"es": "archivos adjuntos demasiado grandes",
+		"fr": "pièces jointes trop volumineuses",
+		"de": "Anhänge zu groß",
+	},
+}
+
+// loadCatalog reads a JSON catalog of the same shape as defaultCatalog
+// and layers it over the defaults, so a file only needs the keys and
+// locales it adds or changes.
+func loadCatalog(path string) (catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides catalog
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	merged := make(catalog, len(defaultCatalog))
+	for key, texts := range defaultCatalog {
+		merged[key] = make(map[string]string, len(texts))
+		for locale, text := range texts {
+			merged[key][locale] = text
+		}
+	}
+	for key, texts := range overrides {
+		if merged[key] == nil {
+			merged[key] = make(map[string]string, len(texts))
+		}
+		for locale, text := range texts {
+			merged[key][normalizeLocale(locale)] = text
+		}
+	}
+	return merged, nil
+}
+
+// text returns the message for key in locale, falling back from a
+// regional locale to its language and then to English. Unknown keys are
+// returned as-is.
+func (c catalog) text(key, locale string) string {
+	texts, ok := c[key]
+	if !ok {
+		return key
+	}
+	if t, ok := texts[locale]; ok {
+		return t
+	}
+	if lang, _, ok := strings.Cut(locale, "-"); ok {
+		if t, ok := texts[lang]; ok {
+			return t
+		}
+	}
+	if t, ok := texts[defaultLocale]; ok {
+		return t
+	}
+	return key
+}
+
+// normalizeLocale lowercases a language tag and uses '-' as the
+// separator, e.g. "pt_BR" becomes "pt-br".
+func normalizeLocale(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// preferredLocale picks the client's locale from a ?lang= query parameter,
+// falling back to the first Accept-Language entry.
+func preferredLocale(lang, acceptLanguage string) string {
+	if lang != "" {
+		return normalizeLocale(lang)
+	}
+	first, _, _ := strings.Cut(acceptLanguage, ",")
+	first, _, _ = strings.Cut(first, ";")
+	if first = normalizeLocale(first); first != "" && first != "*" {
+		return first
+	}
+	return defaultLocale
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// welcomeTestText connects to the test server at base with query and
+// header and returns the text of the welcome.
+func welcomeTestText(t *testing.T, base, query string, header http.Header) string {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws?"+query, header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("no welcome: %v", err)
+		}
+		if msg.Key == msgConnected {
+			return msg.Text
+		}
+	}
+}
+
+func TestWelcomeLocalized(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	for _, tc := range []struct {
+		name, query, acceptLanguage, want string
+	}{
+		{"Supported", "lang=fr", "", "connecté"},
+		{"Regional", "lang=de_AT", "", "verbunden"},
+		{"AcceptLanguage", "", "es-MX;q=0.9, en;q=0.5", "conectado"},
+		{"QueryWins", "lang=de", "es", "verbunden"},
+		{"Unsupported", "lang=xx", "", "connected"},
+	} {
+		header := http.Header{}
+		if tc.acceptLanguage != "" {
+			header.Set("Accept-Language", tc.acceptLanguage)
+		}
+		if got := welcomeTestText(t, base, tc.query, header); got != tc.want {
+			t.Errorf("%s: welcome says %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLangMessageSwitchesLocale(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+
+	c.Send(message{Type: "lang", Lang: "es"})
+	c.Send(message{Type: "chat", ID: "loop", Text: "me again", ReplyTo: "loop"})
+	for _, m := range c.RecvAll(200 * time.Millisecond) {
+		if m.Key == msgSelfReply {
+			if want := defaultCatalog.text(msgSelfReply, "es"); m.Text != want {
+				t.Errorf("rejection says %q after switching to es, want %q", m.Text, want)
+			}
+			return
+		}
+	}
+	t.Error("self-reply wasn't rejected")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKey bounds the Idempotency-Key header a request may send.
+const maxIdempotencyKey = 256
+
+// idempotencyCache remembers the result of requests carrying an
+// Idempotency-Key for ttl, so a retried request is answered with the
+// original result instead of being carried out again. A nil cache
+// remembers nothing. It is safe for concurrent use.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResult
+}
+
+// idempotentResult is the outcome of the first request with a key. done
+// is closed once result is set, or once the request failed and the key
+// was forgotten.
+type idempotentResult struct {
+	result  string
+	expires time.Time
+	done    chan struct{}
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &idempotencyCache{ttl: ttl, entries: make(map[string]*idempotentResult)}
+}
+
+// do returns the remembered result for key, or runs fn to produce it. fn
+// returns "" on failure, in which case the key is forgotten so the
+// request can be retried. A request arriving while the first with its
+// key is still running waits for it. replayed reports whether the result
+// came from an earlier request.
+func (c *idempotencyCache) do(key string, now time.Time, fn func() string) (result string, replayed bool) {
+	if c == nil || key == "" {
+		return fn(), false
+	}
+	for {
+		c.mu.Lock()
+		for k, e := range c.entries {
+			if e.result != "" && now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		e, ok := c.entries[key]
+		if !ok {
+			e = &idempotentResult{done: make(chan struct{})}
+			c.entries[key] = e
+			c.mu.Unlock()
+			return c.finish(key, e, fn(), now), false
+		}
+		c.mu.Unlock()
+
+		<-e.done
+		if e.result != "" {
+			return e.result, true
+		}
+	}
+}
+
+func (c *idempotencyCache) finish(key string, e *idempotentResult, result string, now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if result == "" {
+		delete(c.entries, key)
+	} else {
+		e.result = result
+		e.expires = now.Add(c.ttl)
+	}
+	close(e.done)
+	return result
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	linkPreviewTimeout  = 5 * time.Second
+	linkPreviewMaxBytes = 256 << 10
+	linkPreviewWorkers  = 4
+	linkPreviewQueue    = 32
+
+	// Caps on the extracted metadata, so a preview stays well within
+	// maxMessage.
+	maxPreviewTitle       = 200
+	maxPreviewDescription = 500
+	maxPreviewImage       = 1024
+)
+
+// linkPreview is the page metadata broadcast after a chat containing a
+// link, referring back to that chat by id.
+type linkPreview struct {
+	MessageID   string `json:"messageId"`
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+type linkPreviewRequest struct {
+	messageID string
+	room      string
+	url       string
+}
+
+// linkPreviewer fetches previews on a fixed pool of workers so a burst of
+// links can't open unbounded outbound connections. Requests beyond the
+// queue are dropped.
+type linkPreviewer struct {
+	hub      *hub
+	requests chan linkPreviewRequest
+	client   *http.Client
+	allow    map[string]bool
+	deny     map[string]bool
+
+	// allowAddr decides whether a resolved address may be dialled. Tests
+	// may replace it to reach a local server.
+	allowAddr func(netip.Addr) bool
+}
+
+// newLinkPreviewer starts the worker pool, or returns nil if previews are
+// disabled.
+func newLinkPreviewer(h *hub) *linkPreviewer {
+	if !h.cfg.linkPreviews {
+		return nil
+	}
+	p := &linkPreviewer{
+		hub:       h,
+		requests:  make(chan linkPreviewRequest, linkPreviewQueue),
+		allow:     hostSet(h.cfg.linkPreviewAllow),
+		deny:      hostSet(h.cfg.linkPreviewDeny),
+		allowAddr: isPublicAddr,
+	}
+	dialer := &net.Dialer{
+		Timeout: linkPreviewTimeout,
+		// Check the address actually being dialled, after DNS, so a
+		// public name can't resolve or redirect to an internal host.
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || !p.allowAddr(ap.Addr()) {
+				return fmt.Errorf("link preview: address %s not allowed", address)
+			}
+			return nil
+		},
+	}
+	p.client = &http.Client{
+		Timeout:   linkPreviewTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			return p.checkURL(req.URL)
+		},
+	}
+	for i := 0; i < linkPreviewWorkers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// request queues a preview of link for the message with the given id,
+// sent in room. A nil previewer or an empty link does nothing.
+func (p *linkPreviewer) request(messageID, room, link string) {
+	if p == nil || link == "" {
+		return
+	}
+	select {
+	case p.requests <- linkPreviewRequest{messageID: messageID, room: room, url: link}:
+	default:
+		log.Printf("link preview queue full, skipping %s", link)
+	}
+}
+
+func (p *linkPreviewer) work() {
+	for req := range p.requests {
+		preview, err := p.fetch(req.url)
+		if err != nil {
+			log.Printf("link preview for %s failed: %v", req.url, err)
+			continue
+		}
+		preview.MessageID = req.messageID
+		p.broadcast(preview, req.room)
+	}
+}
+
+func (p *linkPreviewer) fetch(link string) (*linkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "text/html") {
+		return nil, fmt.Errorf("content type %q is not HTML", ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, linkPreviewMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	preview := parsePreview(string(body))
+	if preview.Title == "" && preview.Description == "" {
+		return nil, errors.New("no preview metadata")
+	}
+	preview.URL = link
+	return preview, nil
+}
+
+// checkURL rejects schemes other than http(s) and hosts excluded by the
+// allow and deny lists.
+func (p *linkPreviewer) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if matchesHost(p.deny, host) || (len(p.allow) > 0 && !matchesHost(p.allow, host)) {
+		return fmt.Errorf("host %s not allowed", host)
+	}
+	return nil
+}
+
+// broadcast sends preview to the room its message was sent in, so a link
+// never surfaces anywhere its chat didn't.
+func (p *linkPreviewer) broadcast(preview *linkPreview, room string) {
+	h := p.hub
+	if h.cfg.sanitizeHTML {
+		preview.Title = html.EscapeString(preview.Title)
+		preview.Description = html.EscapeString(preview.Description)
+	}
+	msg := message{
+		Type:       "link_preview",
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Room:       room,
+		Preview:    preview,
+	}
+	data, err := encode(msg, "link preview")
+	if err != nil {
+		return
+	}
+	h.broadcast <- envelope{msgType: msg.Type, msgID: msg.ID, data: data, room: room}
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// firstLink returns the first http(s) URL in text, without trailing
+// punctuation.
+func firstLink(text string) string {
+	return strings.TrimRight(linkPattern.FindString(text), ".,;:!?)]}'")
+}
+
+var (
+	metaTagPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrPattern     = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*("[^"]*"|'[^']*')`)
+	titleTagPattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// parsePreview extracts OpenGraph metadata from a page, falling back to
+// its title and description tags.
+func parsePreview(page string) *linkPreview {
+	meta := make(map[string]string)
+	for _, tag := range metaTagPattern.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attrPattern.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = html.UnescapeString(strings.Trim(m[2], `"'`))
+		}
+		name := attrs["property"]
+		if name == "" {
+			name = attrs["name"]
+		}
+		if name = strings.ToLower(name); name != "" && attrs["content"] != "" {
+			if _, seen := meta[name]; !seen {
+				meta[name] = strings.TrimSpace(attrs["content"])
+			}
+		}
+	}
+
+	preview := &linkPreview{
+		Title:       meta["og:title"],
+		Description: meta["og:description"],
+		Image:       meta["og:image"],
+	}
+	if preview.Title == "" {
+		if m := titleTagPattern.FindStringSubmatch(page); m != nil {
+			preview.Title = strings.TrimSpace(html.UnescapeString(m[1]))
+		}
+	}
+	if preview.Description == "" {
+		preview.Description = meta["description"]
+	}
+	if !strings.HasPrefix(preview.Image, "https://") && !strings.HasPrefix(preview.Image, "http://") || len(preview.Image) > maxPreviewImage {
+		preview.Image = ""
+	}
+	preview.Title = clipRunes(preview.Title, maxPreviewTitle)
+	preview.Description = clipRunes(preview.Description, maxPreviewDescription)
+	return preview
+}
+
+// clipRunes shortens s to at most n runes, marking the cut with an
+// ellipsis.
+func clipRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// specialPurposePrefixes are the unicast ranges from the IANA special-
+// purpose address registries that must not be fetched from: shared and
+// private networks, benchmarking and documentation ranges, and the
+// translation and tunnelling prefixes, such as NAT64 and 6to4, that
+// embed an IPv4 address a gateway would then reach, loopback included.
+var specialPurposePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.31.196.0/24"),
+	netip.MustParsePrefix("192.52.193.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("192.175.48.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("3fff::/20"),
+	netip.MustParsePrefix("5f00::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// isPublicAddr reports whether addr is a globally routable unicast
+// address, as opposed to loopback, link-local, multicast or any of the
+// specialPurposePrefixes.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() {
+		return false
+	}
+	for _, p := range specialPurposePrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// hostSet parses a comma-separated host list. An entry also matches its
+// subdomains.
+func hostSet(v string) map[string]bool {
+	set := make(map[string]bool)
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			set[h] = true
+		}
+	}
+	return set
+}
+
+func matchesHost(set map[string]bool, host string) bool {
+	for {
+		if set[host] {
+			return true
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return false
+		}
+		host = parent
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:4700::1111":      true,
+		"127.0.0.1":            false,
+		"::1":                  false,
+		"::ffff:127.0.0.1":     false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"100.127.255.254":      false,
+		"198.18.0.1":           false,
+		"198.19.255.255":       false,
+		"192.0.2.1":            false,
+		"203.0.113.9":          false,
+		"0.0.0.0":              false,
+		"240.0.0.1":            false,
+		"224.0.0.1":            false,
+		"64:ff9b::7f00:1":      false,
+		"64:ff9b:1::a00:1":     false,
+		"2002:7f00:1::1":       false,
+		"2001:db8::1":          false,
+		"2001::1":              false,
+		"fd00::1":              false,
+		"fe80::1":              false,
+		"ff02::1":              false,
+		"100::1":               false,
+		"3fff::1":              false,
+		"::ffff:100.64.0.1":    false,
+		"::ffff:93.184.216.34": true,
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPublicAddr(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+// newTestPage serves an HTML page with OpenGraph tags.
+func newTestPage(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><meta property="og:title" content="Test page"><meta property="og:description" content="About it"></head></html>`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLinkPreviewRefusesInternalAddress(t *testing.T) {
+	cfg := testConfig()
+	cfg.linkPreviews = true
+	h := NewHub(cfg)
+	page := newTestPage(t)
+
+	if _, err := h.previews.fetch(page.URL); err == nil {
+		t.Fatal("fetched a loopback address")
+	}
+	h.previews.allowAddr = func(addr netip.Addr) bool { return addr.IsLoopback() }
+	preview, err := h.previews.fetch(page.URL)
+	if err != nil || preview.Title != "Test page" {
+		t.Fatalf("with loopback allowed got %+v, %v", preview, err)
+	}
+}
+
+func TestLinkPreviewFollowsChat(t *testing.T) {
+	cfg := testConfig()
+	cfg.linkPreviews = true
+	h, base := newTestServer(t, cfg)
+	h.previews.allowAddr = func(addr netip.Addr) bool { return addr.IsLoopback() }
+	page := newTestPage(t)
+	sender := dialTestClient(t, base, "", "")
+	receiver := dialTestClient(t, base, "", "")
+	sender.RecvAll(100 * time.Millisecond)
+	receiver.RecvAll(100 * time.Millisecond)
+
+	sender.Send(message{Type: "chat", ID: "with-link", Text: "look at " + page.URL + "/page."})
+	var chat bool
+	for _, m := range receiver.RecvAll(300 * time.Millisecond) {
+		switch m.Type {
+		case "chat":
+			chat = true
+		case "link_preview":
+			if !chat {
+				t.Error("preview arrived before its chat")
+			}
+			if m.Preview == nil || m.Preview.MessageID != "with-link" || m.Preview.Title != "Test page" || m.Preview.URL != page.URL+"/page" {
+				t.Errorf("preview %+v, want Test page for with-link", m.Preview)
+			}
+			return
+		}
+	}
+	t.Fatal("receiver never got a link preview")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Log destinations for LOG_OUTPUT.
+const (
+	logStderr = "stderr"
+	logFile   = "file"
+	logBoth   = "both"
+)
+
+// setupLogging points the standard logger at the configured destination.
+// A log file that can't be opened is reported on stderr, which stays the
+// destination.
+func setupLogging(cfg config) {
+	if cfg.logOutput == logStderr || cfg.logFile == "" {
+		return
+	}
+	f, err := openRotatingFile(cfg.logFile, cfg.logMaxBytes, cfg.logBackups)
+	if err != nil {
+		log.Printf("ignoring LOG_FILE: %v", err)
+		return
+	}
+
+	var out io.Writer = f
+	if cfg.logOutput == logBoth {
+		out = io.MultiWriter(os.Stderr, f)
+	}
+	log.SetOutput(out)
+
+	// logrotate moves the file and sends SIGHUP; reopen so we write to the
+	// new one.
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGHUP)
+	go func() {
+		for range reopen {
+			if err := f.reopen(); err != nil {
+				log.Printf("failed to reopen log file: %v", err)
+			}
+		}
+	}()
+}
+
+// rotatingFile is a log file that rotates itself once it reaches maxBytes,
+// keeping up to backups old files as path.1, path.2, and so on. A zero
+// maxBytes never rotates. It is safe for concurrent use.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines.
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups along, dropping the oldest, and starts a new
+// file. With no backups the file is truncated instead. The caller must
+// hold r.mu.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	var moveErr error
+	if r.backups > 0 {
+		for i := r.backups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		moveErr = os.Rename(r.path, r.path+".1")
+	} else {
+		moveErr = os.Truncate(r.path, 0)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	return moveErr
+}
+
+// reopen closes the file and opens path again, for external rotation.
+func (r *rotatingFile) reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	return r.open()
+}
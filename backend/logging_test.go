@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	r, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.f.Close()
+	line := strings.Repeat("x", 39) + "\n"
+	// Two lines fit in a file, so ten lines rotate four times and the
+	// oldest backups are dropped.
+	for i := 0; i < 10; i++ {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(name), err)
+		}
+		if info.Size() > 100 {
+			t.Errorf("%s holds %d bytes, over the 100 byte limit", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("a third backup was kept with backups set to 2: %v", err)
+	}
+}
+
+func TestRotatingFileReopens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	r, err := openRotatingFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.f.Close()
+	r.Write([]byte("before\n"))
+	// logrotate moves the file away, then signals for a reopen.
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("after\n"))
+	if data, _ := os.ReadFile(path); string(data) != "after\n" {
+		t.Errorf("reopened file holds %q, want only the line written after", data)
+	}
+}
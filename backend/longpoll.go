@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pollTimeout is how long a poll waits for messages before returning
+	// empty.
+	pollTimeout = 25 * time.Second
+
+	// pollSessionTTL is how long a session survives without a poll before
+	// it is unregistered.
+	pollSessionTTL = 2 * pollTimeout
+
+	// maxPollQueue bounds the messages a session holds between polls.
+	maxPollQueue = 256
+)
+
+// polledMessage is a queued message with its position in the session.
+type polledMessage struct {
+	seq  uint64
+	data json.RawMessage
+}
+
+// pollClient is a hub member for a browser that can't open a websocket.
+// Messages fanned out to it are queued until the next poll collects
+// them; the session is unregistered once it stops polling.
+type pollClient struct {
+	id      string
+	token   string
+	version string
+	room    string
+	hub     *hub
+
+	// sender keeps the state the message pipeline tracks per client, such
+	// as rate limits and the rules gate, for the session's posts. sendMu
+	// serializes the posts, as a websocket's single reader would.
+	sendMu sync.Mutex
+	sender *client
+
+	mu      sync.Mutex
+	queue   []polledMessage
+	nextSeq uint64
+	closed  bool
+	// wake is signalled whenever a message arrives or the session closes.
+	wake   chan struct{}
+	expiry *time.Timer
+
+	// historyTruncated is whether the session was replayed less history
+	// than its room has, as its opening response says.
+	historyTruncated bool
+}
+
+func (p *pollClient) ID() string { return p.id }
+
+func (p *pollClient) clientVersion() string { return p.version }
+
+func (p *pollClient) initialRoom() string { return p.room }
+
+// Send queues a message for the next poll. Like the websocket lanes, a
+// full queue drops low-priority messages and reports anything else as a
+// slow client.
+func (p *pollClient) Send(msgType string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) >= maxPollQueue {
+		if lowPriorityTypes[msgType] {
+			p.hub.deadLetters.record(p.hub.now(), "low-priority queue full", p.id, msgType, data)
+			return nil
+		}
+		return errSlowClient
+	}
+	p.nextSeq++
+	p.queue = append(p.queue, polledMessage{seq: p.nextSeq, data: data})
+	p.signal()
+	return nil
+}
+
+func (p *pollClient) queueDepth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// lastQueueWait is zero, since a session's queue is drained by its polls
+// rather than timed.
+func (p *pollClient) lastQueueWait() time.Duration { return 0 }
+
+func (p *pollClient) Close(closeReason) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// The expiry timer is left running so it removes the session from
+	// the token map.
+	p.closed = true
+	p.signal()
+}
+
+// signal wakes a waiting poll. The caller must hold p.mu.
+func (p *pollClient) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// collect drops the messages the client has acknowledged with cursor and
+// returns the rest, and whether the session is still open.
+func (p *pollClient) collect(cursor uint64) ([]polledMessage, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := 0
+	for i < len(p.queue) && p.queue[i].seq <= cursor {
+		i++
+	}
+	p.queue = p.queue[i:]
+	return append([]polledMessage(nil), p.queue...), !p.closed
+}
+
+// pollSessions tracks long-poll sessions by their secret token. The token
+// is separate from the client id, which every other client sees.
+type pollSessions struct {
+	hub *hub
+
+	mu       sync.Mutex
+	sessions map[string]*pollClient
+}
+
+func newPollSessions(h *hub) *pollSessions {
+	return &pollSessions{hub: h, sessions: make(map[string]*pollClient)}
+}
+
+// open registers a new session with the hub for a client announcing
+// version, in room, queueing the room's chat history after since. A
+// session stays in the room it opened in, and is sent notices in locale.
+func (s *pollSessions) open(version, room, locale string, since time.Time) (*pollClient, error) {
+	token, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	p := &pollClient{
+		id:      s.hub.idGen(),
+		token:   token,
+		version: version,
+		room:    room,
+		hub:     s.hub,
+		wake:    make(chan struct{}, 1),
+	}
+	p.sender = &client{
+		id:          p.id,
+		hub:         s.hub,
+		room:        room,
+		locale:      locale,
+		version:     version,
+		connectedAt: time.Now(),
+		poll:        p,
+	}
+	p.expiry = time.AfterFunc(pollSessionTTL, func() { s.expire(p) })
+	if rules := s.hub.cfg.rulesFor(room); rules != "" {
+		if data, err := encode(message{Type: "rules", Text: rules, ID: s.hub.idGen(), Room: room, ServerTime: s.hub.serverTime()}, "rules"); err == nil {
+			_ = p.Send("rules", data)
+		}
+	}
+	var replay []storedMessage
+	replay, p.historyTruncated = s.hub.replaySet(room, since)
+	for _, m := range replay {
+		_ = p.Send(m.msgType, m.data)
+	}
+
+	s.mu.Lock()
+	s.sessions[token] = p
+	s.mu.Unlock()
+	s.hub.register <- p
+	return p, nil
+}
+
+// lookup returns the session for token, pushing back its expiry while it
+// is open. A closed session is returned until it expires, so a last poll
+// can still collect what was queued before it closed.
+func (s *pollSessions) lookup(token string) *pollClient {
+	s.mu.Lock()
+	p := s.sessions[token]
+	s.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.expiry.Reset(pollSessionTTL)
+	}
+	return p
+}
+
+func (p *pollClient) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (s *pollSessions) expire(p *pollClient) {
+	s.mu.Lock()
+	delete(s.sessions, p.token)
+	s.mu.Unlock()
+	s.hub.unregister <- p
+}
+
+// pollHandler serves GET /api/poll. Without a session parameter it opens
+// one; otherwise it returns the session's messages after cursor, waiting
+// up to pollTimeout for some to arrive.
+func pollHandler(s *pollSessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if s.hub.authRequired() || s.hub.tokensRequired() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "long-poll is unavailable while authentication is required"})
+			return
+		}
+
+		token := r.URL.Query().Get("session")
+		if token == "" {
+			if !s.hub.cfg.userAgentAllowed(r.UserAgent()) {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+				return
+			}
+			version := requestedClientVersion(r)
+			locale := preferredLocale(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"))
+			if !s.hub.cfg.clientVersionAllowed(version) {
+				writeJSON(w, http.StatusUpgradeRequired, map[string]string{"error": s.hub.cfg.catalog.text(msgUpgrade, locale), "key": msgUpgrade})
+				return
+			}
+			room, ok := requestedRoom(r.URL.Query().Get("room"))
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid room"})
+				return
+			}
+			// Long-poll sessions are anonymous, so private rooms are
+			// closed to them.
+			if !s.hub.cfg.userMayJoin(room, "") {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": s.hub.cfg.catalog.text(msgRoomPrivate, locale), "key": msgRoomPrivate})
+				return
+			}
+			if key := s.hub.entryRefused(room); key != "" {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": s.hub.cfg.catalog.text(key, locale), "key": key})
+				return
+			}
+			since, ok := requestedSince(r.URL.Query().Get("since"))
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be an RFC 3339 timestamp"})
+				return
+			}
+			p, err := s.open(version, room, locale, since)
+			if err != nil {
+				log.Printf("failed to open poll session: %v", err)
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+				return
+			}
+			writeJSON(w, http.StatusOK, pollResponse{Session: p.token, ID: p.id, Room: p.room, Messages: []json.RawMessage{}, HistoryTruncated: p.historyTruncated})
+			return
+		}
+
+		p := s.lookup(token)
+		if p == nil {
+			writeJSON(w, http.StatusGone, map[string]string{"error": "unknown or expired session"})
+			return
+		}
+		var cursor uint64
+		if v := r.URL.Query().Get("cursor"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "cursor must be a non-negative integer"})
+				return
+			}
+			cursor = n
+		}
+
+		// The server's write timeout may be shorter than a poll's wait.
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(pollTimeout + writeWait)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("extend poll write deadline: %v", err)
+		}
+		timeout := time.NewTimer(pollTimeout)
+		defer timeout.Stop()
+		for {
+			// Messages queued before the session closed, such as a
+			// server_shutdown, are still delivered.
+			msgs, open := p.collect(cursor)
+			if len(msgs) > 0 {
+				writeJSON(w, http.StatusOK, newPollResponse(p, cursor, msgs))
+				return
+			}
+			if !open {
+				writeJSON(w, http.StatusGone, map[string]string{"error": "session closed"})
+				return
+			}
+			select {
+			case <-p.wake:
+			case <-timeout.C:
+				writeJSON(w, http.StatusOK, newPollResponse(p, cursor, nil))
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+type pollResponse struct {
+	Session  string            `json:"session"`
+	ID       string            `json:"id"`
+	Room     string            `json:"room,omitempty"`
+	Cursor   uint64            `json:"cursor"`
+	Messages []json.RawMessage `json:"messages"`
+	// HistoryTruncated is set on the opening response when the room has
+	// older history than was queued.
+	HistoryTruncated bool `json:"historyTruncated,omitempty"`
+}
+
+func newPollResponse(p *pollClient, cursor uint64, msgs []polledMessage) pollResponse {
+	resp := pollResponse{Session: p.token, ID: p.id, Cursor: cursor, Messages: []json.RawMessage{}}
+	for _, m := range msgs {
+		resp.Messages = append(resp.Messages, m.data)
+		resp.Cursor = m.seq
+	}
+	return resp
+}
+
+// sendHandler serves POST /api/send, broadcasting a chat message from a
+// long-poll session. The message goes through the same limits and
+// transform pipeline as websocket chat. A rejection is answered in the
+// response and, as it would be over a websocket, also queued for the
+// session as a notice.
+func sendHandler(s *pollSessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		p := s.lookup(r.URL.Query().Get("session"))
+		if p == nil || p.isClosed() {
+			writeJSON(w, http.StatusGone, map[string]string{"error": "unknown or expired session"})
+			return
+		}
+		h := s.hub
+		locale := preferredLocale(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"))
+		reject := func(status int, key string) {
+			writeJSON(w, status, map[string]string{"error": h.cfg.catalog.text(key, locale), "key": key})
+		}
+
+		var msg message
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(h.cfg.frameLimit(p.room)))).Decode(&msg); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+		if msg.Type != "chat" && msg.Type != "accept_rules" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "only chat messages can be sent"})
+			return
+		}
+
+		p.sendMu.Lock()
+		defer p.sendMu.Unlock()
+		c := p.sender
+
+		// The checks prepareBroadcast makes ahead of the pipeline, in the
+		// same order.
+		if !c.allowMessage(msg.Type) {
+			key := msgThrottled
+			if c.floodedOut {
+				key = msgRateLimited
+			}
+			reject(http.StatusTooManyRequests, key)
+			return
+		}
+		if field := h.cfg.longField(p.room, &msg); field != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": strings.ReplaceAll(h.cfg.catalog.text(msgFieldTooLong, locale), "{field}", field),
+				"key":   field + "_too_long",
+			})
+			return
+		}
+		if !h.cfg.typeAllowed(msg.Type, false) {
+			reject(http.StatusForbidden, msgTypeNotAllowed)
+			return
+		}
+		if msg.Type == "accept_rules" {
+			c.acceptRules()
+			writeJSON(w, http.StatusOK, map[string]string{})
+			return
+		}
+		if !h.cfg.roomAllows(c.room, msg.Type) {
+			reject(http.StatusForbidden, msgTypeNotAllowed)
+			return
+		}
+
+		if strings.TrimSpace(msg.Text) == "" && len(msg.Attachments) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "empty message"})
+			return
+		}
+
+		msg = relayedFields(msg)
+		if err := c.applyTransforms(&msg); err != nil {
+			var rej *rejection
+			if c.floodedOut {
+				// floodControl's last step, a disconnect.
+				reject(http.StatusTooManyRequests, msgRateLimited)
+				return
+			}
+			if !errors.As(err, &rej) {
+				// Taken but not broadcast, like a command that answers
+				// with a notice.
+				writeJSON(w, http.StatusAccepted, map[string]string{})
+				return
+			}
+			reject(rejectionStatus(rej.key), rej.key)
+			return
+		}
+		data, err := encode(msg, "chat message")
+		if err != nil {
+			reject(http.StatusInternalServerError, msgInternalError)
+			return
+		}
+		if len(data) > h.cfg.frameLimit(p.room) {
+			fitted, ok := c.fitOversized(&msg)
+			if !ok {
+				reject(http.StatusRequestEntityTooLarge, msgTooLarge)
+				return
+			}
+			data = fitted
+		}
+
+		env := envelope{msgType: msg.Type, msgID: msg.ID, data: data, sender: p, room: p.room, mentions: mentionedNicks(msg.Text), depth: h.replyDepth(p.room, msg.ReplyTo)}
+		if timeout := h.cfg.broadcastEnqueueTimeout; timeout > 0 {
+			select {
+			case h.broadcast <- env:
+			case <-time.After(timeout):
+				h.deadLetters.record(h.now(), "broadcast queue full", p.id, env.msgType, env.data)
+				reject(http.StatusServiceUnavailable, msgServerBusy)
+				return
+			}
+		} else {
+			h.broadcast <- env
+		}
+		h.previews.request(msg.ID, p.room, firstLink(msg.Text))
+		h.translations.request(msg.ID, p.room, msg.Text)
+		writeJSON(w, http.StatusOK, map[string]string{"id": msg.ID})
+	}
+}
+
+// rejectionStatus is the HTTP status for a long-poll post the pipeline
+// rejected with key.
+func rejectionStatus(key string) int {
+	switch key {
+	case msgFloodWarning, msgCooldown, msgThrottled:
+		return http.StatusTooManyRequests
+	case msgOverloaded, msgMaintenanceOn:
+		return http.StatusServiceUnavailable
+	case msgNotYetAllowed, msgRulesPending, msgBlocked, msgTypeNotAllowed:
+		return http.StatusForbidden
+	case msgDuplicate:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// openTestPoll opens a long-poll session on the test server at base and
+// returns its token.
+func openTestPoll(t *testing.T, base string) string {
+	t.Helper()
+	resp, err := http.Get(base + "/api/poll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body pollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Session == "" {
+		t.Fatalf("opening a session: status %d, %v", resp.StatusCode, err)
+	}
+	return body.Session
+}
+
+// postTestPoll posts msg from session and returns the response status
+// and its "key", if any.
+func postTestPoll(t *testing.T, base, session string, msg message) (int, string) {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(base+"/api/send?session="+session, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]string
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body["key"]
+}
+
+// collectTestPoll returns the types of the messages queued for session,
+// waiting for at least one.
+func collectTestPoll(t *testing.T, base, session string) []string {
+	t.Helper()
+	resp, err := http.Get(base + "/api/poll?session=" + session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body pollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("polling: status %d, %v", resp.StatusCode, err)
+	}
+	var got []string
+	for _, raw := range body.Messages {
+		var m message
+		_ = json.Unmarshal(raw, &m)
+		got = append(got, m.Key+m.Type)
+	}
+	return got
+}
+
+func TestLongPollPostReachesWebsocket(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	ws := dialTestClient(t, base, "", "")
+	ws.RecvAll(100 * time.Millisecond)
+	session := openTestPoll(t, base)
+
+	if status, key := postTestPoll(t, base, session, message{Type: "chat", Text: "hello"}); status != http.StatusOK {
+		t.Fatalf("post answered %d %s, want 200", status, key)
+	}
+	for _, m := range ws.RecvAll(200 * time.Millisecond) {
+		if m.Type == "chat" && m.Text == "hello" {
+			return
+		}
+	}
+	t.Error("websocket client never received the long-poll chat")
+}
+
+func TestLongPollChatIsRateLimited(t *testing.T) {
+	cfg := testConfig()
+	cfg.chatRate = 1
+	cfg.chatBurst = 1
+	_, base := newTestServer(t, cfg)
+	session := openTestPoll(t, base)
+
+	if status, key := postTestPoll(t, base, session, message{Type: "chat", Text: "one"}); status != http.StatusOK {
+		t.Fatalf("first post answered %d %s, want 200", status, key)
+	}
+	status, key := postTestPoll(t, base, session, message{Type: "chat", Text: "two"})
+	if status != http.StatusTooManyRequests || key != msgFloodWarning {
+		t.Errorf("second post answered %d %s, want %d %s", status, key, http.StatusTooManyRequests, msgFloodWarning)
+	}
+}
+
+func TestLongPollMessagesAreThrottled(t *testing.T) {
+	cfg := testConfig()
+	cfg.messageRate = 1
+	cfg.messageBurst = 1
+	_, base := newTestServer(t, cfg)
+	session := openTestPoll(t, base)
+
+	postTestPoll(t, base, session, message{Type: "chat", Text: "one"})
+	status, key := postTestPoll(t, base, session, message{Type: "chat", Text: "two"})
+	if status != http.StatusTooManyRequests || key != msgThrottled {
+		t.Errorf("second post answered %d %s, want %d %s", status, key, http.StatusTooManyRequests, msgThrottled)
+	}
+}
+
+func TestLongPollRunsThePipeline(t *testing.T) {
+	cfg := testConfig()
+	cfg.dedupWindow = time.Minute
+	_, base := newTestServer(t, cfg)
+	session := openTestPoll(t, base)
+
+	postTestPoll(t, base, session, message{Type: "chat", Text: "same"})
+	if status, key := postTestPoll(t, base, session, message{Type: "chat", Text: "same"}); key != msgDuplicate {
+		t.Errorf("repeated chat answered %d %s, want %s", status, key, msgDuplicate)
+	}
+	if status, _ := postTestPoll(t, base, session, message{Type: "chat", Text: "/who"}); status != http.StatusAccepted {
+		t.Errorf("command answered %d, want %d", status, http.StatusAccepted)
+	}
+	for _, got := range collectTestPoll(t, base, session) {
+		if got == msgWho+"system" {
+			return
+		}
+	}
+	t.Error("the /who reply was not queued for the session")
+}
+
+func TestLongPollFloodDisconnects(t *testing.T) {
+	cfg := testConfig()
+	cfg.chatRate = 1
+	cfg.chatBurst = 1
+	h, base := newTestServer(t, cfg)
+	session := openTestPoll(t, base)
+	waitFor(t, "the session to register", func() bool { return h.clientCount.Load() == 1 })
+
+	var status int
+	var key string
+	for i := 0; i < cfg.floodMaxOffenses+1; i++ {
+		status, key = postTestPoll(t, base, session, message{Type: "chat", Text: strconv.Itoa(i)})
+	}
+	if status != http.StatusTooManyRequests || key != msgRateLimited {
+		t.Errorf("last post answered %d %s, want %d %s", status, key, http.StatusTooManyRequests, msgRateLimited)
+	}
+	waitFor(t, "the session to be removed", func() bool { return h.clientCount.Load() == 0 })
+
+	got := collectTestPoll(t, base, session)
+	if len(got) == 0 || got[len(got)-1] != msgRateLimited+"system" {
+		t.Errorf("session was sent %v, want the rate_limited notice last", got)
+	}
+	if status, _ := postTestPoll(t, base, session, message{Type: "chat", Text: "again"}); status != http.StatusGone {
+		t.Errorf("post after the disconnect answered %d, want %d", status, http.StatusGone)
+	}
+}
+
+func TestLongPollRulesGateChatUntilAccepted(t *testing.T) {
+	cfg := testConfig()
+	cfg.rulesText = "be nice"
+	_, base := newTestServer(t, cfg)
+	session := openTestPoll(t, base)
+
+	status, key := postTestPoll(t, base, session, message{Type: "chat", Text: "too soon"})
+	if status != http.StatusForbidden || key != msgRulesPending {
+		t.Errorf("chat before accepting answered %d %s, want %d %s", status, key, http.StatusForbidden, msgRulesPending)
+	}
+	postTestPoll(t, base, session, message{Type: "accept_rules"})
+	if status, key := postTestPoll(t, base, session, message{Type: "chat", Text: "hi"}); status != http.StatusOK {
+		t.Errorf("chat after accepting answered %d %s, want 200", status, key)
+	}
+}
+
+func TestLongPollPostDropsServerFields(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	ws := dialTestClient(t, base, "", "")
+	ws.RecvAll(100 * time.Millisecond)
+	session := openTestPoll(t, base)
+
+	postTestPoll(t, base, session, message{Type: "chat", Text: "hello", Nick: "admin", Flagged: true})
+	for _, m := range ws.RecvAll(200 * time.Millisecond) {
+		if m.Type == "chat" {
+			if m.Nick != "" || m.Flagged {
+				t.Errorf("relayed chat kept forged fields: nick %q, flagged %t", m.Nick, m.Flagged)
+			}
+			return
+		}
+	}
+	t.Fatal("websocket client never received the long-poll chat")
+}
@@ -1,26 +1,59 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(map[string]string{"status": "ok"}); err != nil {
-		log.Printf("failed to write health response: %v", err)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %v", err)
 	}
 }
 
 func main() {
-	hub := NewHub()
+	cfg := loadConfig()
+	setupLogging(cfg)
+	hub := NewHub(cfg)
+	registerHubMetrics(hub)
 	go hub.Run()
+	if cfg.scheduleFile != "" {
+		go runSchedule(hub, cfg.scheduleFile)
+	}
+	if cfg.memoryHighWater > 0 {
+		go hub.watchMemory(memoryCheckInterval)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/health", healthHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/api/admin/maintenance", requireAdmin(cfg.adminToken, maintenanceHandler(hub)))
+	mux.HandleFunc("/api/admin/reap-idle", requireAdmin(cfg.adminToken, reapIdleHandler(hub)))
+	mux.HandleFunc("/api/admin/rooms/", requireAdmin(cfg.adminToken, roomAdminHandler(hub)))
+	mux.HandleFunc("/api/admin/deadletter", requireAdmin(cfg.adminToken, deadLetterHandler(hub)))
+	mux.HandleFunc("/api/admin/flagged", requireAdmin(cfg.adminToken, flaggedHandler(hub)))
+	mux.HandleFunc("/api/admin/snapshot", requireAdmin(cfg.adminToken, snapshotHandler(hub)))
+	mux.HandleFunc("/api/admin/drain", requireAdmin(cfg.adminToken, drainHandler(hub)))
+	mux.HandleFunc("/api/admin/migrate", requireAdmin(cfg.adminToken, migrateHandler(hub)))
+	mux.HandleFunc("/api/broadcast", requireAdmin(cfg.adminToken, injectHandler(hub)))
+	polls := newPollSessions(hub)
+	mux.HandleFunc("/api/poll", pollHandler(polls))
+	mux.HandleFunc("/api/send", sendHandler(polls))
+	mux.HandleFunc("/api/history", historyHandler(hub))
+	mux.HandleFunc("/api/presence", presenceHandler(hub))
+	mux.HandleFunc("/api/rooms", roomsHandler(hub))
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWebsocket(hub, w, r)
 	})
@@ -30,16 +63,49 @@ func main() {
 		staticDir = "./static"
 	}
 
-	fileServer := http.FileServer(http.Dir(staticDir))
-	mux.Handle("/", fileServer)
+	mux.Handle("/", staticHandler(staticDir))
 
 	addr := ":8080"
 	if port := os.Getenv("PORT"); port != "" {
 		addr = ":" + port
 	}
 
+	srv := newHTTPServer(addr, mux, cfg)
+	go shutdownOnSignal(srv, hub, cfg)
+
 	log.Printf("Starting server on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("server failed: %v", err)
 	}
 }
+
+// newHTTPServer serves handler on addr with the configured timeouts. One
+// server is enough for websockets too: gorilla clears the deadlines when
+// it hijacks a connection, and the pumps set their own.
+func newHTTPServer(addr string, handler http.Handler, cfg config) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  cfg.httpReadTimeout,
+		WriteTimeout: cfg.httpWriteTimeout,
+		IdleTimeout:  cfg.httpIdleTimeout,
+	}
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then tells every client
+// why the server is going away before stopping it.
+func shutdownOnSignal(srv *http.Server, h *hub, cfg config) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("received %s, shutting down", sig)
+
+	h.drain(cfg.shutdownReason, cfg.shutdownReconnectAfter)
+	time.Sleep(shutdownFlushWait)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
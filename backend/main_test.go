@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPTimeoutsSpareWebsockets(t *testing.T) {
+	cfg := testConfig()
+	cfg.httpReadTimeout = 200 * time.Millisecond
+	cfg.httpWriteTimeout = 200 * time.Millisecond
+	h := startTestHub(t, cfg)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("app"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWebsocket(h, w, r)
+	})
+	mux.Handle("/", staticHandler(dir))
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config = newHTTPServer("", mux, cfg)
+	srv.Start()
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+		checkNoConnLeaks(t)
+	})
+
+	ws := dialTestClient(t, srv.URL, "", "")
+	ws.RecvAll(100 * time.Millisecond)
+
+	// A client that never finishes its request headers.
+	slow, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	if _, err := slow.Write([]byte("GET /app.js HTTP/1.1\r\nHost: x\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_ = slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(slow).ReadString('\n'); err == nil {
+		t.Error("the server answered an unfinished request")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("the server left a slow static request open")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("slow request was cut off after %v, want about the %v read timeout", elapsed, cfg.httpReadTimeout)
+	}
+
+	// Well past both timeouts, the websocket still works.
+	time.Sleep(2 * cfg.httpWriteTimeout)
+	ws.Send(message{Type: "ping", ID: "alive"})
+	var ponged bool
+	for _, m := range ws.RecvAll(200 * time.Millisecond) {
+		ponged = ponged || m.Type == "pong"
+	}
+	if !ponged {
+		t.Error("websocket stopped working after the HTTP timeouts passed")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"time"
+)
+
+// memoryCheckInterval is how often watchMemory samples heap usage.
+const memoryCheckInterval = 5 * time.Second
+
+// heapInUse reads the bytes of heap currently allocated.
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// watchMemory samples heap usage every interval and switches the hub's
+// protective mode on above cfg.memoryHighWater and off again below
+// cfg.memoryLowWater. The gap between the two keeps it from flapping.
+// While the mode is on, chat is rejected and history stores nothing.
+func (h *hub) watchMemory(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.checkMemory(h.memUsage())
+	}
+}
+
+func (h *hub) checkMemory(used uint64) {
+	switch {
+	case !h.overloaded.Load() && used >= uint64(h.cfg.memoryHighWater):
+		h.overloaded.Store(true)
+		log.Printf("heap at %d bytes, rejecting chat until it falls below %d", used, h.cfg.memoryLowWater)
+		// History takes nothing new until the pressure is off, and sheds
+		// all but what a joining client would be replayed.
+		if h.history != nil {
+			if n := h.history.trim(max(h.cfg.historyReplay, 0)); n > 0 {
+				log.Printf("dropped %d history entries under memory pressure", n)
+			}
+		}
+	case h.overloaded.Load() && used < uint64(h.cfg.memoryLowWater):
+		h.overloaded.Store(false)
+		log.Printf("heap at %d bytes, accepting chat again", used)
+	}
+}
+
+// rejectWhenOverloaded turns away new chat while memory is under
+// pressure. Other traffic is small and keeps flowing.
+func rejectWhenOverloaded(c *client, msg *message) error {
+	if (msg.Type == "chat" || msg.Type == "encrypted") && c.hub.overloaded.Load() {
+		return notifyReject(msgOverloaded)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryWatermarkRejectsChatAndStopsHistory(t *testing.T) {
+	cfg := testConfig()
+	cfg.memoryHighWater, cfg.memoryLowWater = 1000, 800
+	cfg.historyReplay = 1
+	var used atomic.Uint64
+	h := NewHub(cfg)
+	h.memUsage = used.Load
+	go h.Run()
+	base := serveTestHub(t, h)
+	storeTestChat(t, h, defaultRoom, "older")
+	storeTestChat(t, h, defaultRoom, "newer")
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+
+	// A tick of watchMemory with the heap over the high watermark.
+	used.Store(1200)
+	h.checkMemory(h.memUsage())
+	if !h.overloaded.Load() {
+		t.Fatal("crossing the high watermark didn't enter the protective mode")
+	}
+	if got := h.history.recent(defaultRoom, time.Time{}, 10); len(got) != 1 {
+		t.Errorf("history kept %d entries under pressure, want the 1 a replay needs", len(got))
+	}
+	c.Send(message{Type: "chat", Text: "hello"})
+	if !refusedWith(c.RecvAll(200*time.Millisecond), msgOverloaded) {
+		t.Error("chat wasn't rejected as overloaded")
+	}
+	h.injectSystem("notice", defaultRoom)
+	waitFor(t, "the notice to reach the client", func() bool { return len(c.RecvAll(20*time.Millisecond)) > 0 })
+	if got := h.history.recent(defaultRoom, time.Time{}, 10); len(got) != 1 {
+		t.Errorf("history grew to %d entries under pressure", len(got))
+	}
+
+	// Between the watermarks the mode holds; below the low one it ends.
+	used.Store(900)
+	h.checkMemory(h.memUsage())
+	if !h.overloaded.Load() {
+		t.Error("the protective mode ended above the low watermark")
+	}
+	used.Store(700)
+	h.checkMemory(h.memUsage())
+	if h.overloaded.Load() {
+		t.Fatal("falling below the low watermark didn't end the protective mode")
+	}
+	c.Send(message{Type: "chat", Text: "hello again"})
+	waitFor(t, "chat to be kept again", func() bool {
+		return len(h.history.recent(defaultRoom, time.Time{}, 10)) == 2
+	})
+}
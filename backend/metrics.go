@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Prometheus text-format exporter. Metrics register themselves
+// on creation and are written out by metricsHandler in registration order.
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counter is a monotonically increasing value.
+type counter struct {
+	name, help string
+
+	mu    sync.Mutex
+	value float64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *counter) inc() {
+	c.mu.Lock()
+	c.value++
+	c.mu.Unlock()
+}
+
+func (c *counter) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", c.name, c.help, c.name, c.name, formatValue(c.value))
+}
+
+// gaugeFunc is a gauge whose value is computed when metrics are scraped.
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(g.fn()))
+}
+
+// bandGauge is a gauge split by one label, one value per band, replaced
+// wholesale by set.
+type bandGauge struct {
+	name, help, label string
+	bands             []string
+
+	mu     sync.Mutex
+	values []float64
+}
+
+func newBandGauge(name, help, label string, bands []string) *bandGauge {
+	g := &bandGauge{name: name, help: help, label: label, bands: bands, values: make([]float64, len(bands))}
+	register(g)
+	return g
+}
+
+func (g *bandGauge) set(values []float64) {
+	g.mu.Lock()
+	copy(g.values, values)
+	g.mu.Unlock()
+}
+
+func (g *bandGauge) writeTo(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for i, band := range g.bands {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", g.name, g.label, band, formatValue(g.values[i]))
+	}
+}
+
+// labeledGauge is a gauge split by one label whose values come and go,
+// such as client versions. Labels at zero are not exported.
+type labeledGauge struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newLabeledGauge(name, help, label string) *labeledGauge {
+	g := &labeledGauge{name: name, help: help, label: label, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+func (g *labeledGauge) add(value string, delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.values[value] += delta; g.values[value] == 0 {
+		delete(g.values, value)
+	}
+}
+
+func (g *labeledGauge) writeTo(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	labels := make([]string, 0, len(g.values))
+	for l := range g.values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", g.name, g.label, l, formatValue(g.values[l]))
+	}
+}
+
+// counterVec is a counter split by a fixed set of labels. Callers keep
+// the label values bounded.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// inc adds one to the series with the given label values, in the order
+// the labels were declared.
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(values, "\x00")]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pairs := make([]string, len(c.labels))
+		for i, v := range strings.Split(k, "\x00") {
+			pairs[i] = fmt.Sprintf("%s=%q", c.labels[i], v)
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, strings.Join(pairs, ","), formatValue(c.values[k]))
+	}
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	name, help string
+	bounds     []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	h := &histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+	register(h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.total++
+	h.mu.Unlock()
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.total)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatValue(h.sum), h.name, h.total)
+}
+
+var marshalErrors = newCounter(
+	"useebird_marshal_errors_total",
+	"Outgoing messages that could not be encoded.",
+)
+
+var broadcastsTotal = newCounter(
+	"useebird_broadcasts_total",
+	"Broadcasts fanned out by the hub.",
+)
+
+var upgradesRejected = newCounter(
+	"useebird_upgrades_rejected_total",
+	"Websocket upgrades refused because too many handshakes were in progress.",
+)
+
+var replaysSkipped = newCounter(
+	"useebird_history_replays_skipped_total",
+	"Connections sent no history because too many replays were in progress.",
+)
+
+var hubPanics = newCounter(
+	"useebird_hub_panics_total",
+	"Panics recovered in the hub's Run loop.",
+)
+
+var brokerDropped = newCounter(
+	"useebird_broker_dropped_total",
+	"Broadcasts not published to other instances because the broker queue was full or publishing failed.",
+)
+
+var compressionErrors = newCounter(
+	"useebird_compression_errors_total",
+	"Connections closed because a compressed frame failed to inflate.",
+)
+
+var connectLatency = newHistogram(
+	"useebird_connect_latency_seconds",
+	"Time from the upgrade request arriving to the welcome message being queued.",
+	[]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+)
+
+var sendQueueWait = newHistogram(
+	"useebird_send_queue_wait_seconds",
+	"Time sampled websocket messages spent in a client's send lanes, with SEND_QUEUE_METRICS on.",
+	[]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10},
+)
+
+var connectionAge = newHistogram(
+	"useebird_connection_age_seconds",
+	"How long connections stayed registered, observed when they leave.",
+	[]float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600},
+)
+
+// connectionAgeBands are the upper bounds of the open-connection age
+// bands, matching the labels in openConnectionsByAge. The last band is
+// unbounded.
+var connectionAgeBands = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+var openConnectionsByAge = newBandGauge(
+	"useebird_open_connections_by_age",
+	"Open connections by how long they have been registered, refreshed periodically.",
+	"age",
+	[]string{"0-1m", "1m-10m", "10m-1h", "1h-6h", "6h-24h", "24h+"},
+)
+
+var connectedByVersion = newLabeledGauge(
+	"useebird_connected_clients",
+	"Registered clients by the client version they announced.",
+	"version",
+)
+
+var messagesTotal = newCounterVec(
+	"useebird_messages_total",
+	"Messages received from websocket clients, by type and outcome.",
+	"type", "outcome",
+)
+
+var disconnectsTotal = newCounterVec(
+	"useebird_disconnects_total",
+	"Clients removed from the hub, by reason.",
+	"reason",
+)
+
+var moderationVerdicts = newCounterVec(
+	"useebird_moderation_verdicts_total",
+	"Moderator verdicts on chat, with error for chat it failed to judge.",
+	"verdict",
+)
+
+// Outcomes recorded by useebird_messages_total.
+const (
+	outcomeAccepted    = "accepted"
+	outcomeRejected    = "rejected"
+	outcomeRateLimited = "rate_limited"
+)
+
+// countedTypes are the message types given their own label in
+// useebird_messages_total; anything else is counted as "other", so a
+// client can't grow the series.
+var countedTypes = map[string]bool{
+	"chat": true, "compose": true, "encrypted": true, "typing": true, "meta": true,
+	"webrtc-offer": true, "webrtc-answer": true, "webrtc-ice": true,
+	"webrtc-presence": true, "webrtc-presence-request": true,
+	"subscribe": true, "presence_delivery": true, "block": true, "unblock": true, "mute_room": true, "unmute_room": true,
+	"lang": true, "time_sync": true, "accept_rules": true, "conninfo": true,
+	"poll": true, "vote": true, "poll_close": true, "join": true, "leave": true, "migrated": true,
+	"echo": true, "ping": true, "auth_response": true,
+}
+
+func messageTypeLabel(msgType string) string {
+	if countedTypes[msgType] {
+		return msgType
+	}
+	return "other"
+}
+
+// registerHubMetrics exports gauges that read from a running hub.
+func registerHubMetrics(h *hub) {
+	newGaugeFunc(
+		"useebird_register_queue_depth",
+		"Clients waiting for the hub to process their registration.",
+		func() float64 { return float64(len(h.register)) },
+	)
+	newGaugeFunc(
+		"useebird_upgrades_in_progress",
+		"Websocket handshakes currently holding an upgrade slot.",
+		func() float64 { return float64(len(h.upgrades)) },
+	)
+	newGaugeFunc(
+		"useebird_admission_waiting",
+		"Upgraded connections waiting for the admission ramp.",
+		func() float64 {
+			if h.admission == nil {
+				return 0
+			}
+			return float64(h.admission.waiting.Load())
+		},
+	)
+	newGaugeFunc(
+		"useebird_admission_rate",
+		"Connections per second the admission ramp is admitting.",
+		func() float64 { return h.admission.currentRate() },
+	)
+	newGaugeFunc(
+		"useebird_memory_protection",
+		"1 while chat is rejected because heap usage crossed the high watermark.",
+		func() float64 {
+			if h.overloaded.Load() {
+				return 1
+			}
+			return 0
+		},
+	)
+	newGaugeFunc(
+		"useebird_compressed_connections",
+		"Connections currently writing with per-message deflate.",
+		func() float64 {
+			if !h.compress.Load() {
+				return 0
+			}
+			return float64(deflateConns.Load())
+		},
+	)
+}
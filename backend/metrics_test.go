@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// histogramCount returns how many values h has observed.
+func histogramCount(h *histogram) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.total
+}
+
+func TestConnectLatencyRecordedOnConnect(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	before := histogramCount(connectLatency)
+	dialTestClient(t, base, "", "").RecvAll(100 * time.Millisecond)
+	waitFor(t, "the connect latency to be observed", func() bool { return histogramCount(connectLatency) == before+1 })
+}
+
+func TestConnectionAgeObservedOnLeave(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	c := registerTestClients(t, h, 1)[0]
+	before := histogramCount(connectionAge)
+	h.unregister <- c
+	waitFor(t, "the connection's age to be observed", func() bool { return histogramCount(connectionAge) == before+1 })
+}
+
+func TestOpenConnectionsBandedByAge(t *testing.T) {
+	h := NewHub(testConfig())
+	now := time.Unix(100000, 0)
+	h.now = func() time.Time { return now }
+	for _, age := range []time.Duration{0, 30 * time.Second, 5 * time.Minute, 2 * time.Hour, 48 * time.Hour} {
+		h.clients[newTestClient(randomID())] = &member{connectedAt: now.Add(-age)}
+	}
+	h.updateConnectionAges()
+
+	openConnectionsByAge.mu.Lock()
+	got := append([]float64(nil), openConnectionsByAge.values...)
+	openConnectionsByAge.mu.Unlock()
+	want := []float64{2, 1, 0, 1, 0, 1}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("connections by age band = %v, want %v", got, want)
+		}
+	}
+}
+
+// versionCount returns how many registered clients announced version.
+func versionCount(version string) float64 {
+	connectedByVersion.mu.Lock()
+	defer connectedByVersion.mu.Unlock()
+	return connectedByVersion.values[version]
+}
+
+func TestClientVersionLabel(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                        "unknown",
+		"2.1.0-beta+42":           "2.1.0-beta+42",
+		"1.0 rc":                  "invalid",
+		strings.Repeat("9", 33):   "invalid",
+		strings.Repeat("9", 32):   strings.Repeat("9", 32),
+		"build_7":                 "build_7",
+		`1.0"} evil{version="2.0`: "invalid",
+	} {
+		if got := clientVersionLabel(in); got != want {
+			t.Errorf("clientVersionLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestClientVersionInMetricAndPresence(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	const version = "2.1.0-canary"
+	before := versionCount(version)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws?build="+version, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var welcome message
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the version gauge to count the client", func() bool { return versionCount(version) == before+1 })
+	if got := metaTestPresence(t, h, welcome.Sender).Version; got != version {
+		t.Errorf("presence lists version %q, want %q", got, version)
+	}
+
+	conn.Close()
+	waitFor(t, "the version gauge to drop the client", func() bool { return versionCount(version) == before })
+}
+
+func TestMessagesCountedByTypeAndOutcome(t *testing.T) {
+	cfg := testConfig()
+	cfg.chatRate = 1
+	cfg.chatBurst = 1
+	_, sender, _ := replyTestPair(t, cfg)
+
+	type key struct{ msgType, outcome string }
+	counted := []key{
+		{"chat", outcomeAccepted}, {"chat", outcomeRateLimited},
+		{"typing", outcomeAccepted}, {"ping", outcomeAccepted},
+		{"other", outcomeRejected}, {"bogus", outcomeRejected},
+	}
+	before := make(map[key]float64)
+	for _, k := range counted {
+		before[k] = messageCount(k.msgType, k.outcome)
+	}
+
+	for i := 0; i < 3; i++ {
+		sender.Send(message{Type: "chat", Text: "hi"})
+	}
+	sender.Send(message{Type: "typing", Typing: "start"})
+	sender.Send(message{Type: "typing", Typing: "stop"})
+	sender.Send(message{Type: "bogus"})
+	syncTestConn(t, sender)
+
+	want := map[key]float64{
+		{"chat", outcomeAccepted}: 1, {"chat", outcomeRateLimited}: 2,
+		{"typing", outcomeAccepted}: 2, {"ping", outcomeAccepted}: 1,
+		{"other", outcomeRejected}: 1,
+	}
+	for _, k := range counted {
+		if got := messageCount(k.msgType, k.outcome) - before[k]; got != want[k] {
+			t.Errorf("messages_total{type=%q,outcome=%q} rose by %v, want %v", k.msgType, k.outcome, got, want[k])
+		}
+	}
+}
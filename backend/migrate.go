@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Migration moves clients to another instance without dropping messages.
+// The old side sends each client a "migrate" message carrying the target
+// URL and a token, and keeps relaying to it until the client answers with
+// "migrated" and that token, or migrationTimeout passes. Either way the
+// old connection is then closed normally. The token is
+// "<client id>.<expiry unix>.<hmac>" under migrationSecret, so an
+// instance sharing the secret can tell who is arriving.
+
+// migrationRequest asks Run to start migrating every client to target,
+// reporting how many it told.
+type migrationRequest struct {
+	target string
+	result chan int
+}
+
+// migrationDone tells Run a migrating client confirmed with token, or,
+// with timedOut set, that its time ran out.
+type migrationDone struct {
+	client   Client
+	token    string
+	timedOut bool
+}
+
+// migrationToken issues the token for client id, valid until expiry.
+func migrationToken(secret, id string, expiry time.Time) string {
+	payload := id + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + signNonce(secret, payload)
+}
+
+// startMigration sends each client that isn't already migrating its
+// migrate message and arms its timeout. It must only be called from Run.
+func (h *hub) startMigration(target string) int {
+	timeout := h.cfg.migrationTimeout
+	expiry := h.now().Add(timeout)
+	started := 0
+	for _, c := range h.order {
+		m := h.clients[c]
+		if m.migrationToken != "" {
+			continue
+		}
+		token := migrationToken(h.cfg.migrationSecret, c.ID(), expiry)
+		data, err := encode(message{
+			Type:       "migrate",
+			ID:         h.idGen(),
+			ServerTime: h.serverTime(),
+			URL:        target,
+			Token:      token,
+		}, "migrate")
+		if err != nil {
+			continue
+		}
+		if err := c.Send("migrate", data); err != nil {
+			continue
+		}
+		m.migrationToken = token
+		c := c
+		time.AfterFunc(timeout, func() { h.migrated <- migrationDone{client: c, timedOut: true} })
+		started++
+	}
+	log.Printf("migrating %d clients to %s", started, target)
+	return started
+}
+
+// finishMigration closes a migrating client once it confirms or times
+// out. Confirmations with the wrong token are ignored. It must only be
+// called from Run.
+func (h *hub) finishMigration(d migrationDone) {
+	m, ok := h.clients[d.client]
+	if !ok || m.migrationToken == "" {
+		return
+	}
+	if d.timedOut {
+		log.Printf("client %s did not confirm migration in time", d.client.ID())
+	} else if !hmac.Equal([]byte(d.token), []byte(m.migrationToken)) {
+		return
+	}
+	h.remove(d.client, closeMigrated)
+}
+
+// migrate asks Run to start a migration to target and waits for it to
+// tell the clients. It must not be called from Run.
+func (h *hub) migrate(target string) int {
+	req := migrationRequest{target: target, result: make(chan int, 1)}
+	h.migrations <- req
+	return <-req.result
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// migrateTestClient dials base and returns the connection once it has
+// been told to migrate, with the migrate message.
+func migrateTestClient(t *testing.T, h *hub, base string) (*websocket.Conn, message) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitFor(t, "the client to register", func() bool { return h.clientCount.Load() == 1 })
+	if n := h.migrate("wss://next.example.com/ws"); n != 1 {
+		t.Fatalf("migrate told %d clients, want 1", n)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var m message
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("no migrate message: %v", err)
+		}
+		if m.Type == "migrate" {
+			return conn, m
+		}
+	}
+}
+
+func TestMigrationClosesOnConfirm(t *testing.T) {
+	cfg := testConfig()
+	cfg.migrationSecret = "s3cret"
+	cfg.migrationTimeout = time.Minute
+	h, base := newTestServer(t, cfg)
+	conn, migrate := migrateTestClient(t, h, base)
+	if migrate.URL != "wss://next.example.com/ws" || strings.Count(migrate.Token, ".") != 2 {
+		t.Fatalf("migrate message %+v lacks the target or token", migrate)
+	}
+
+	// Until it confirms, the client still gets the room's traffic, and a
+	// confirmation with the wrong token changes nothing.
+	for _, m := range []message{{Type: "migrated", Token: "forged"}, {Type: "ping", ID: "sync"}} {
+		if err := conn.WriteJSON(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readUntil := func(what string, match func(message) bool) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			var m message
+			if err := conn.ReadJSON(&m); err != nil {
+				t.Fatalf("migrating client closed before %s: %v", what, err)
+			}
+			if match(m) {
+				return
+			}
+		}
+	}
+	readUntil("the pong", func(m message) bool { return m.Type == "pong" })
+	_, resp := injectTest(h, `{"room":"`+defaultRoom+`","type":"system","text":"still here"}`)
+	readUntil("the room's traffic", func(m message) bool { return m.ID == resp["id"] })
+
+	if err := conn.WriteJSON(message{Type: "migrated", Token: migrate.Token}); err != nil {
+		t.Fatal(err)
+	}
+	if code, text := closeTestCode(t, conn); code != websocket.CloseNormalClosure || text != "migrated" {
+		t.Errorf("confirmed migration closed with %d %q, want a normal close", code, text)
+	}
+	waitFor(t, "the client to be removed", func() bool { return h.clientCount.Load() == 0 })
+}
+
+func TestMigrationClosesOnTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.migrationSecret = "s3cret"
+	cfg.migrationTimeout = 200 * time.Millisecond
+	h, base := newTestServer(t, cfg)
+	conn, _ := migrateTestClient(t, h, base)
+	start := time.Now()
+	if code, text := closeTestCode(t, conn); code != websocket.CloseNormalClosure || text != "migrated" {
+		t.Errorf("unconfirmed migration closed with %d %q, want a normal close", code, text)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("closed after %v, before the %v timeout", elapsed, cfg.migrationTimeout)
+	}
+}
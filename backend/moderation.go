@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Verdicts a moderator can return for a chat.
+const (
+	verdictAllow = "allow"
+	verdictBlock = "block"
+	verdictFlag  = "flag"
+)
+
+// Policies for a chat the moderator couldn't judge in time.
+const (
+	moderationFailOpen   = "open"
+	moderationFailClosed = "closed"
+)
+
+// moderator judges a chat before it is broadcast. Implementations wrap an
+// external moderation service.
+type moderator interface {
+	moderate(ctx context.Context, id, sender, text string) (string, error)
+}
+
+// moderationRules is the transform that asks the hub's moderator about
+// each chat, blocking or flagging it on its verdict. It runs on the
+// sender's reader goroutine, so a slow moderator holds up only that
+// sender and never the hub. Flagged is only ever set here: the sender's
+// own value is dropped with the other server fields by relayedFields.
+func moderationRules(c *client, msg *message) error {
+	if msg.Type != "chat" || c.hub.moderator == nil {
+		return nil
+	}
+	switch c.hub.moderate(msg, c.id, c.room) {
+	case verdictBlock:
+		return nackReject(msgBlocked)
+	case verdictFlag:
+		msg.Flagged = true
+	}
+	return nil
+}
+
+// moderate returns the moderator's verdict on msg from sender in room,
+// applying moderationFailure if the moderator errs or times out. A
+// flagged chat is kept in h.flagged for moderators to review.
+func (h *hub) moderate(msg *message, sender, room string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.moderationTimeout)
+	defer cancel()
+	// Chat text may already be HTML-escaped; judge what the user wrote.
+	text := msg.Text
+	if h.cfg.sanitizeHTML {
+		text = html.UnescapeString(text)
+	}
+	verdict, err := h.moderator.moderate(ctx, msg.ID, sender, text)
+	if err == nil && verdict != verdictAllow && verdict != verdictBlock && verdict != verdictFlag {
+		err = fmt.Errorf("unknown verdict %q", verdict)
+	}
+	if err != nil {
+		log.Printf("moderating message %s from %s failed: %v", msg.ID, sender, err)
+		moderationVerdicts.inc("error")
+		if h.cfg.moderationFailure == moderationFailClosed {
+			return verdictBlock
+		}
+		return verdictAllow
+	}
+	moderationVerdicts.inc(verdict)
+	if verdict == verdictFlag {
+		log.Printf("message %s from %s flagged by moderation", msg.ID, sender)
+		if data, err := encode(message{Type: msg.Type, ID: msg.ID, Sender: sender, Room: room, Text: text}, "flagged message"); err == nil {
+			h.flagged.record(h.now(), verdictFlag, sender, msg.Type, data)
+		}
+	}
+	return verdict
+}
+
+// httpModerator calls an external moderation API that accepts
+// {"id","sender","text"} and answers {"verdict"}.
+type httpModerator struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPModerator(url string) *httpModerator {
+	return &httpModerator{url: url, client: &http.Client{}}
+}
+
+func (m *httpModerator) moderate(ctx context.Context, id, sender, text string) (string, error) {
+	body, err := json.Marshal(map[string]string{"id": id, "sender": sender, "text": text})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	var out struct {
+		Verdict string `json:"verdict"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxMessage)).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Verdict, nil
+}
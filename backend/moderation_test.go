@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestModerator serves a moderation endpoint blocking "bad", flagging
+// "meh" and answering "slow" only after a while; anything else is
+// allowed.
+func newTestModerator(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Text string }
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		verdict := verdictAllow
+		switch req.Text {
+		case "bad":
+			verdict = verdictBlock
+		case "meh":
+			verdict = verdictFlag
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"verdict": verdict})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// moderatedChat sends text from sender and returns the chat receiver got,
+// if any, and the key of any nack sender got.
+func moderatedChat(sender, receiver *testConn, text string) (*message, string) {
+	sender.Send(message{Type: "chat", Text: text, ID: "m-" + text})
+	var nack string
+	for _, m := range sender.RecvAll(100 * time.Millisecond) {
+		if m.Type == "nack" {
+			nack = m.Key
+		}
+	}
+	for _, m := range receiver.RecvAll(100 * time.Millisecond) {
+		if m.Type == "chat" && m.Text == text {
+			return &m, nack
+		}
+	}
+	return nil, nack
+}
+
+func moderatedTestServer(t *testing.T, failure string) (*hub, *testConn, *testConn) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.moderationURL = newTestModerator(t)
+	cfg.moderationTimeout = 50 * time.Millisecond
+	cfg.moderationFailure = failure
+	h, base := newTestServer(t, cfg)
+	sender := dialTestClient(t, base, "", "")
+	receiver := dialTestClient(t, base, "", "")
+	sender.RecvAll(100 * time.Millisecond)
+	receiver.RecvAll(100 * time.Millisecond)
+	return h, sender, receiver
+}
+
+func TestModerationVerdicts(t *testing.T) {
+	h, sender, receiver := moderatedTestServer(t, moderationFailOpen)
+
+	if got, nack := moderatedChat(sender, receiver, "fine"); got == nil || got.Flagged || nack != "" {
+		t.Errorf("allowed chat: got %+v, nack %q", got, nack)
+	}
+	if got, nack := moderatedChat(sender, receiver, "bad"); got != nil || nack != msgBlocked {
+		t.Errorf("blocked chat: got %+v, nack %q, want no chat and %s", got, nack, msgBlocked)
+	}
+	got, _ := moderatedChat(sender, receiver, "meh")
+	if got == nil || !got.Flagged {
+		t.Fatalf("flagged chat: got %+v, want it broadcast flagged", got)
+	}
+
+	rec := httptest.NewRecorder()
+	flaggedHandler(h)(rec, httptest.NewRequest(http.MethodGet, "/api/admin/flagged", nil))
+	var body struct{ Entries []deadLetter }
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Entries) != 1 || body.Entries[0].Reason != verdictFlag {
+		t.Fatalf("flagged log holds %+v, want the one flagged chat", body.Entries)
+	}
+	var flagged message
+	_ = json.Unmarshal(body.Entries[0].Message, &flagged)
+	if flagged.ID != "m-meh" || flagged.Text != "meh" || flagged.Room != defaultRoom {
+		t.Errorf("flagged entry is %+v, want the chat m-meh", flagged)
+	}
+}
+
+func TestModerationSenderCannotFlag(t *testing.T) {
+	_, sender, receiver := moderatedTestServer(t, moderationFailOpen)
+
+	sender.Send(message{Type: "chat", Text: "fine", Flagged: true})
+	for _, m := range receiver.RecvAll(200 * time.Millisecond) {
+		if m.Type == "chat" {
+			if m.Flagged {
+				t.Error("chat the moderator allowed kept the sender's own flag")
+			}
+			return
+		}
+	}
+	t.Fatal("receiver never got the chat")
+}
+
+func TestModerationTimeoutFailsOpen(t *testing.T) {
+	_, sender, receiver := moderatedTestServer(t, moderationFailOpen)
+	if got, nack := moderatedChat(sender, receiver, "slow"); got == nil || nack != "" {
+		t.Errorf("timed-out chat failing open: got %+v, nack %q, want it delivered", got, nack)
+	}
+}
+
+func TestModerationTimeoutFailsClosed(t *testing.T) {
+	_, sender, receiver := moderatedTestServer(t, moderationFailClosed)
+	if got, nack := moderatedChat(sender, receiver, "slow"); got != nil || nack != msgBlocked {
+		t.Errorf("timed-out chat failing closed: got %+v, nack %q, want it blocked", got, nack)
+	}
+}
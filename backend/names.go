@@ -0,0 +1,49 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+var (
+	nameAdjectives = []string{
+		"Amber", "Bold", "Blue", "Brave", "Bright", "Calm", "Clever", "Coral",
+		"Crimson", "Daring", "Eager", "Gentle", "Golden", "Green", "Happy", "Jolly",
+		"Keen", "Lively", "Lucky", "Merry", "Misty", "Quick", "Quiet", "Silver",
+		"Sly", "Sunny", "Swift", "Teal", "Tidy", "Violet", "Witty", "Zesty",
+	}
+	nameNouns = []string{
+		"Badger", "Bear", "Crane", "Crow", "Deer", "Dove", "Eagle", "Falcon",
+		"Finch", "Fox", "Hare", "Hawk", "Heron", "Lark", "Lynx", "Magpie",
+		"Marten", "Moose", "Otter", "Owl", "Panda", "Puffin", "Raven", "Robin",
+		"Seal", "Sparrow", "Stork", "Swan", "Tiger", "Wolf", "Wren", "Yak",
+	}
+)
+
+// generateFriendlyName derives a name like "BlueFox42" from a client id.
+// The same id always yields the same name.
+func generateFriendlyName(id string) string {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+
+	adj := nameAdjectives[sum%uint64(len(nameAdjectives))]
+	sum /= uint64(len(nameAdjectives))
+	noun := nameNouns[sum%uint64(len(nameNouns))]
+	sum /= uint64(len(nameNouns))
+	return adj + noun + strconv.FormatUint(sum%100, 10)
+}
+
+// uniqueName returns name, or name with a "-2", "-3", ... discriminator
+// if taken reports it is already in use.
+func uniqueName(name string, taken func(string) bool) string {
+	if !taken(name) {
+		return name
+	}
+	for n := 2; ; n++ {
+		candidate := name + "-" + strconv.Itoa(n)
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestFriendlyNameIsStablePerID(t *testing.T) {
+	pattern := regexp.MustCompile(`^[A-Z][a-z]+[A-Z][a-z]+\d{1,2}$`)
+	for _, id := range []string{"a1b2c3d4e5f60718", "0000000000000000", "x"} {
+		name := generateFriendlyName(id)
+		if !pattern.MatchString(name) {
+			t.Errorf("name %q for %s is not adjective, noun and number", name, id)
+		}
+		if again := generateFriendlyName(id); again != name {
+			t.Errorf("id %s named %q, then %q", id, name, again)
+		}
+	}
+}
+
+func TestUniqueNameAddsDiscriminator(t *testing.T) {
+	taken := map[string]bool{"BlueFox42": true, "BlueFox42-2": true}
+	if got := uniqueName("BlueFox42", func(n string) bool { return taken[n] }); got != "BlueFox42-3" {
+		t.Errorf("got %q, want BlueFox42-3", got)
+	}
+	if got := uniqueName("RedOwl1", func(n string) bool { return taken[n] }); got != "RedOwl1" {
+		t.Errorf("free name became %q", got)
+	}
+}
+
+func TestRegisteredNamesDontCollide(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	// Two clients whose ids derive the same name.
+	h.register <- newTestClient("same")
+	h.register <- newTestClient("same")
+	waitFor(t, "clients to register", func() bool { return h.clientCount.Load() == 2 })
+
+	name := generateFriendlyName("same")
+	entries := h.presenceOf(defaultRoom)
+	if len(entries) != 2 || entries[0].Nick != name || entries[1].Nick != name+"-2" {
+		t.Errorf("got %+v, want %s and %s-2", entries, name, name)
+	}
+}
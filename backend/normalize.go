@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// invisibleRunes are stripped by normalizeText: zero-width spaces and the
+// bidi controls that can reorder text to spoof its meaning. The zero-width
+// joiner and non-joiner are kept, since emoji sequences and some scripts
+// depend on them.
+var invisibleRunes = map[rune]bool{
+	'\u200b': true, // zero-width space
+	'\u2060': true, // word joiner
+	'\ufeff': true, // zero-width no-break space
+	'\u200e': true, // left-to-right mark
+	'\u200f': true, // right-to-left mark
+	'\u061c': true, // arabic letter mark
+	'\u202a': true, // left-to-right embedding
+	'\u202b': true, // right-to-left embedding
+	'\u202c': true, // pop directional formatting
+	'\u202d': true, // left-to-right override
+	'\u202e': true, // right-to-left override
+	'\u2066': true, // left-to-right isolate
+	'\u2067': true, // right-to-left isolate
+	'\u2068': true, // first strong isolate
+	'\u2069': true, // pop directional isolate
+}
+
+// normalizeText strips invisible and bidi control characters, collapses
+// runs of other whitespace within a line to one space, and allows at most
+// maxNewlines consecutive line breaks. With maxNewlines zero, line breaks
+// become spaces.
+func normalizeText(s string, maxNewlines int) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	newlines, space := 0, false
+	for _, r := range strings.ReplaceAll(s, "\r\n", "\n") {
+		switch {
+		case invisibleRunes[r]:
+			continue
+		case r == '\n' || r == '\r':
+			if newlines < maxNewlines {
+				b.WriteRune('\n')
+				newlines++
+				space = false
+			} else if maxNewlines <= 0 {
+				space = true
+			}
+			continue
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		}
+		if space && newlines == 0 {
+			b.WriteRune(' ')
+		}
+		space, newlines = false, 0
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// normalizeRules applies normalizeText to chat and compose text when
+// NORMALIZE_TEXT is on. It runs before the type rules, so text that was
+// only invisible characters is dropped as empty.
+func normalizeRules(c *client, msg *message) error {
+	cfg := c.hub.cfg
+	if cfg.normalizeText && (msg.Type == "chat" || msg.Type == "compose") {
+		msg.Text = normalizeText(msg.Text, cfg.maxNewlines)
+	}
+	return nil
+}
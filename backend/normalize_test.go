@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeText(t *testing.T) {
+	for _, tc := range []struct {
+		name, in    string
+		maxNewlines int
+		want        string
+	}{
+		{"ZeroWidth", "ad\u200bmin\ufeff", 2, "admin"},
+		{"BidiOverride", "invoice\u202eexe.pdf\u202c", 2, "invoiceexe.pdf"},
+		{"JoinersKept", "\U0001f469\u200d\U0001f4bb", 2, "\U0001f469\u200d\U0001f4bb"},
+		{"SpacesCollapsed", "a \t  b", 2, "a b"},
+		{"NewlinesCapped", "a\n\n\n\n\nb", 2, "a\n\nb"},
+		{"CRLF", "a\r\n\r\n\r\nb", 1, "a\nb"},
+		{"NewlinesToSpaces", "a\n\n b", 0, "a b"},
+		{"SpaceAfterNewlineDropped", "a\n   b", 2, "a\nb"},
+	} {
+		if got := normalizeText(tc.in, tc.maxNewlines); got != tc.want {
+			t.Errorf("%s: normalizeText(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeTextAppliedToChat(t *testing.T) {
+	cfg := testConfig()
+	cfg.normalizeText = true
+	cfg.maxNewlines = 1
+	_, sender, receiver := replyTestPair(t, cfg)
+
+	sender.Send(message{Type: "chat", Text: "pay\u200b\u202e me\n\n\n\nnow"})
+	if got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond)); !ok || got.Text != "pay me\nnow" {
+		t.Errorf("room got %q, want the normalized text", got.Text)
+	}
+	sender.Send(message{Type: "chat", Text: "\u200b\u2060\u202e"})
+	if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+		t.Error("a chat of only invisible characters was relayed")
+	}
+}
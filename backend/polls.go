@@ -0,0 +1,201 @@
+package main
+
+import (
+	"html"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// Bounds on a poll's options, checked before it reaches Run.
+	minPollOptions     = 2
+	maxPollOptions     = 10
+	maxPollOptionBytes = 100
+
+	// maxOpenPolls caps the polls open at once, and maxPollsPerClient
+	// those any one client has open.
+	maxOpenPolls      = 32
+	maxPollsPerClient = 3
+
+	// pollUpdateInterval is how often Run broadcasts the tallies of polls
+	// that received votes, so a burst of votes costs one update.
+	pollUpdateInterval = time.Second
+)
+
+// poll is an open poll's state. It is owned by Run.
+type poll struct {
+	id       string
+	creator  string
+	room     string
+	question string
+	options  []string
+	closesAt time.Time
+
+	// votes maps each voter's client id to the option it chose. dirty
+	// is set when they changed since the last poll_update.
+	votes map[string]int
+	dirty bool
+}
+
+// pollView is a poll as broadcast in poll, poll_update and poll_closed
+// messages.
+type pollView struct {
+	ID       string    `json:"id"`
+	Creator  string    `json:"creator"`
+	Question string    `json:"question"`
+	Options  []string  `json:"options"`
+	Counts   []int     `json:"counts"`
+	ClosesAt time.Time `json:"closesAt"`
+}
+
+// pollOp asks Run to create, vote in or close a poll. result receives the
+// key of the reason it was refused, or "" once it is done.
+type pollOp struct {
+	kind   string // "poll", "vote" or "poll_close"
+	client Client
+	msg    message
+	result chan string
+}
+
+// pollRequest validates a poll, vote or poll_close from this client and
+// hands it to Run, telling the client if it was refused. Like chat, polls
+// and votes are refused during maintenance.
+func (c *client) pollRequest(msg message) {
+	if c.hub.maintenance.Load() {
+		c.notify(msgMaintenanceOn)
+		return
+	}
+	if msg.Type == "poll" {
+		msg.Text = strings.TrimSpace(msg.Text)
+		if msg.Text == "" || len(msg.Options) < minPollOptions || len(msg.Options) > maxPollOptions {
+			c.notify(msgPollInvalid)
+			return
+		}
+		for i, o := range msg.Options {
+			o = strings.TrimSpace(o)
+			if o == "" || len(o) > maxPollOptionBytes {
+				c.notify(msgPollInvalid)
+				return
+			}
+			msg.Options[i] = o
+		}
+		if c.hub.cfg.sanitizeHTML {
+			msg.Text = html.EscapeString(msg.Text)
+			for i, o := range msg.Options {
+				msg.Options[i] = html.EscapeString(o)
+			}
+		}
+	}
+	result := make(chan string, 1)
+	c.hub.pollOps <- pollOp{kind: msg.Type, client: c, msg: msg, result: result}
+	if key := <-result; key != "" {
+		c.notify(key)
+	}
+}
+
+// applyPollOp carries out a poll operation. It must only be called from
+// Run.
+func (h *hub) applyPollOp(op pollOp) string {
+	id := op.client.ID()
+	switch op.kind {
+	case "poll":
+		if len(h.polls) >= maxOpenPolls || h.pollsOpenedBy(id) >= maxPollsPerClient {
+			return msgPollLimit
+		}
+		p := &poll{
+			id:       h.idGen(),
+			creator:  id,
+			room:     h.clients[op.client].room,
+			question: op.msg.Text,
+			options:  op.msg.Options,
+			closesAt: h.now().Add(h.cfg.pollDuration),
+			votes:    make(map[string]int),
+		}
+		h.polls[p.id] = p
+		h.broadcastPoll("poll", p)
+		return ""
+	case "vote":
+		p, ok := h.polls[op.msg.PollID]
+		if !ok || p.room != h.clients[op.client].room {
+			return msgPollUnknown
+		}
+		if op.msg.Choice == nil || *op.msg.Choice < 0 || *op.msg.Choice >= len(p.options) {
+			return msgPollInvalid
+		}
+		if prev, voted := p.votes[id]; !voted || prev != *op.msg.Choice {
+			p.votes[id] = *op.msg.Choice
+			p.dirty = true
+		}
+		return ""
+	case "poll_close":
+		p, ok := h.polls[op.msg.PollID]
+		if !ok || p.room != h.clients[op.client].room {
+			return msgPollUnknown
+		}
+		if p.creator != id {
+			return msgPollNotCreator
+		}
+		h.closePoll(p)
+		return ""
+	}
+	return ""
+}
+
+// pollsOpenedBy counts the open polls created by the client with id.
+func (h *hub) pollsOpenedBy(id string) int {
+	n := 0
+	for _, p := range h.polls {
+		if p.creator == id {
+			n++
+		}
+	}
+	return n
+}
+
+// updatePolls broadcasts the tallies of polls with new votes and closes
+// those past their deadline. It must only be called from Run.
+func (h *hub) updatePolls() {
+	now := h.now()
+	for _, p := range h.polls {
+		switch {
+		case !now.Before(p.closesAt):
+			h.closePoll(p)
+		case p.dirty:
+			p.dirty = false
+			h.broadcastPoll("poll_update", p)
+		}
+	}
+}
+
+// closePoll broadcasts a poll's final tally and forgets it. It must only
+// be called from Run.
+func (h *hub) closePoll(p *poll) {
+	delete(h.polls, p.id)
+	h.broadcastPoll("poll_closed", p)
+	log.Printf("poll %s closed with %d votes", p.id, len(p.votes))
+}
+
+func (h *hub) broadcastPoll(msgType string, p *poll) {
+	counts := make([]int, len(p.options))
+	for _, choice := range p.votes {
+		counts[choice]++
+	}
+	msg := message{
+		Type:       msgType,
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Room:       p.room,
+		Poll: &pollView{
+			ID:       p.id,
+			Creator:  p.creator,
+			Question: p.question,
+			Options:  p.options,
+			Counts:   counts,
+			ClosesAt: p.closesAt.UTC(),
+		},
+	}
+	if data, err := encode(msg, msgType); err == nil {
+		h.fanOut(envelope{msgType: msg.Type, msgID: msg.ID, data: data, room: p.room})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextPoll waits for the next message of msgType among what c receives
+// and returns its poll.
+func nextPoll(t *testing.T, c *testConn, msgType string) *pollView {
+	t.Helper()
+	deadline := time.After(2 * pollUpdateInterval)
+	for {
+		select {
+		case m, ok := <-c.in:
+			if !ok {
+				t.Fatalf("connection closed waiting for %s", msgType)
+			}
+			if m.Type == msgType && m.Poll != nil {
+				return m.Poll
+			}
+		case <-deadline:
+			t.Fatalf("no %s", msgType)
+		}
+	}
+}
+
+func choice(i int) *int { return &i }
+
+func TestPollVoteChangeAndClose(t *testing.T) {
+	_, creator, voter := replyTestPair(t, testConfig())
+	creator.Send(message{Type: "poll", Text: "Lunch?", Options: []string{"pizza", "tacos", "salad"}})
+	p := nextPoll(t, voter, "poll")
+	if p.ID == "" || p.Question != "Lunch?" || len(p.Options) != 3 || fmt.Sprint(p.Counts) != "[0 0 0]" {
+		t.Fatalf("poll broadcast as %+v", p)
+	}
+
+	creator.Send(message{Type: "vote", PollID: p.ID, Choice: choice(0)})
+	voter.Send(message{Type: "vote", PollID: p.ID, Choice: choice(0)})
+	voter.Send(message{Type: "vote", PollID: p.ID, Choice: choice(1)})
+	// An update may have gone out between the votes; the one after the
+	// last must have the changed vote.
+	for got := nextPoll(t, voter, "poll_update"); fmt.Sprint(got.Counts) != "[1 1 0]"; got = nextPoll(t, voter, "poll_update") {
+		if fmt.Sprint(got.Counts) != "[1 0 0]" && fmt.Sprint(got.Counts) != "[2 0 0]" {
+			t.Fatalf("tally %v, want it to reach [1 1 0]", got.Counts)
+		}
+	}
+
+	voter.Send(message{Type: "vote", PollID: p.ID, Choice: choice(3)})
+	if !refusedWith(voter.RecvAll(200*time.Millisecond), msgPollInvalid) {
+		t.Error("a vote for a missing option wasn't refused")
+	}
+	voter.Send(message{Type: "vote", PollID: "nope", Choice: choice(0)})
+	if !refusedWith(voter.RecvAll(200*time.Millisecond), msgPollUnknown) {
+		t.Error("a vote in an unknown poll wasn't refused")
+	}
+	voter.Send(message{Type: "poll_close", PollID: p.ID})
+	if !refusedWith(voter.RecvAll(200*time.Millisecond), msgPollNotCreator) {
+		t.Error("closing someone else's poll wasn't refused")
+	}
+
+	creator.Send(message{Type: "poll_close", PollID: p.ID})
+	if got := nextPoll(t, voter, "poll_closed"); got.ID != p.ID || fmt.Sprint(got.Counts) != "[1 1 0]" {
+		t.Errorf("poll closed as %+v, want the final tally [1 1 0]", got)
+	}
+	creator.Send(message{Type: "vote", PollID: p.ID, Choice: choice(2)})
+	if !refusedWith(creator.RecvAll(200*time.Millisecond), msgPollUnknown) {
+		t.Error("a vote in a closed poll wasn't refused")
+	}
+}
+
+func TestPollClosesWhenExpired(t *testing.T) {
+	cfg := testConfig()
+	cfg.pollDuration = 100 * time.Millisecond
+	_, creator, voter := replyTestPair(t, cfg)
+	creator.Send(message{Type: "poll", Text: "Ship it?", Options: []string{"yes", "no"}})
+	p := nextPoll(t, voter, "poll")
+	if got := nextPoll(t, voter, "poll_closed"); got.ID != p.ID {
+		t.Errorf("closed poll %s, want %s", got.ID, p.ID)
+	}
+}
+
+func TestPollOptionsValidated(t *testing.T) {
+	_, creator, voter := replyTestPair(t, testConfig())
+	many := make([]string, maxPollOptions+1)
+	for i := range many {
+		many[i] = fmt.Sprint(i)
+	}
+	for name, options := range map[string][]string{
+		"OneOption":   {"only"},
+		"TooMany":     many,
+		"BlankOption": {"yes", "  "},
+	} {
+		creator.Send(message{Type: "poll", Text: "?", Options: options})
+		if !refusedWith(creator.RecvAll(200*time.Millisecond), msgPollInvalid) {
+			t.Errorf("%s: poll wasn't refused", name)
+		}
+	}
+	for _, m := range voter.RecvAll(100 * time.Millisecond) {
+		if m.Type == "poll" {
+			t.Errorf("an invalid poll was broadcast: %+v", m.Poll)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import "net/http"
+
+// presenceEntry is one member of a room as listed by /api/presence and
+// in a roster.
+type presenceEntry struct {
+	ID      string            `json:"id"`
+	User    string            `json:"user,omitempty"`
+	Nick    string            `json:"nick"`
+	Version string            `json:"version,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// presence returns c's entry, for a member m of Run's. The metadata is
+// shared, not copied: Run replaces a member's map on each update rather
+// than changing it.
+func (m *member) presence(c Client) presenceEntry {
+	return presenceEntry{ID: c.ID(), User: m.user, Nick: m.nick, Version: m.version, Meta: m.meta}
+}
+
+// presenceQuery asks Run who is in room.
+type presenceQuery struct {
+	room   string
+	result chan []presenceEntry
+}
+
+// presenceOf returns the members of room in join order. It asks Run, so
+// it is safe from any goroutine but Run itself.
+func (h *hub) presenceOf(room string) []presenceEntry {
+	result := make(chan []presenceEntry, 1)
+	h.occupants <- presenceQuery{room: room, result: result}
+	return <-result
+}
+
+// roomPresence lists the members of room. It must only be called from
+// Run.
+func (h *hub) roomPresence(room string) []presenceEntry {
+	entries := make([]presenceEntry, 0, len(h.rooms[room]))
+	for _, c := range h.order {
+		if m := h.clients[c]; m.room == room {
+			entries = append(entries, m.presence(c))
+		}
+	}
+	return entries
+}
+
+// presenceHandler serves GET /api/presence?room=, listing who is in a
+// room for consumers without a websocket.
+func presenceHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		// Who is here is as private as what they say.
+		if h.authRequired() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "presence is unavailable while authentication is required"})
+			return
+		}
+		user, err := h.requestUser(r)
+		if err != nil && (err != errNoToken || h.tokensRequired()) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		room, ok := requestedRoom(r.URL.Query().Get("room"))
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid room"})
+			return
+		}
+		if !h.cfg.userMayJoin(room, user) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"room": room, "users": h.presenceOf(room)})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPresenceOfIsSafeWhileClientsComeAndGo(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	stay := registerTestClients(t, h, 3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if n := len(h.presenceOf(defaultRoom)); n < len(stay) {
+					t.Errorf("presence listed %d members, want at least %d", n, len(stay))
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		c := newTestClient(randomID())
+		h.register <- c
+		h.unregister <- c
+	}
+	wg.Wait()
+
+	waitFor(t, "churn to settle", func() bool { return len(h.presenceOf(defaultRoom)) == len(stay) })
+	for i, e := range h.presenceOf(defaultRoom) {
+		if e.ID != stay[i].ID() {
+			t.Errorf("presence[%d] is %s, want %s in join order", i, e.ID, stay[i].ID())
+		}
+	}
+}
+
+func TestPresenceHiddenWhileAuthRequired(t *testing.T) {
+	cfg := testConfig()
+	cfg.authSecret = "secret"
+	h := startTestHub(t, cfg)
+
+	rec := httptest.NewRecorder()
+	presenceHandler(h)(rec, httptest.NewRequest(http.MethodGet, "/api/presence", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("presence with auth required got %d, want 403", rec.Code)
+	}
+}
+
+// metaTestPresence returns the presence entry /api/presence lists for
+// the member with id.
+func metaTestPresence(t *testing.T, h *hub, id string) presenceEntry {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	presenceHandler(h)(rec, httptest.NewRequest(http.MethodGet, "/api/presence", nil))
+	var resp struct {
+		Users []presenceEntry `json:"users"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range resp.Users {
+		if e.ID == id {
+			return e
+		}
+	}
+	t.Fatalf("presence doesn't list %s", id)
+	return presenceEntry{}
+}
+
+func TestMetaSetAndListedInPresence(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	c := dialTestClient(t, base, "", "")
+	other := dialTestClient(t, base, "", "")
+	welcome, _ := c.Recv(time.Second)
+	c.RecvAll(100 * time.Millisecond)
+	other.RecvAll(100 * time.Millisecond)
+
+	c.Send(message{Type: "meta", Meta: map[string]string{"avatar": "https://example.com/a.png"}})
+	var update *message
+	for _, m := range other.RecvAll(200 * time.Millisecond) {
+		if m.Type == "meta" {
+			got := m
+			update = &got
+		}
+	}
+	if update == nil || update.Meta["avatar"] != "https://example.com/a.png" {
+		t.Fatalf("the room got meta update %+v, want the avatar", update)
+	}
+
+	waitFor(t, "presence to list the metadata", func() bool {
+		return metaTestPresence(t, h, welcome.Sender).Meta["avatar"] == "https://example.com/a.png"
+	})
+
+	late := dialTestClient(t, base, "", "")
+	var roster *message
+	for _, m := range late.RecvAll(200 * time.Millisecond) {
+		if m.Type == "roster" {
+			got := m
+			roster = &got
+		}
+	}
+	if roster == nil {
+		t.Fatal("a new client got no roster")
+	}
+	var listed bool
+	for _, e := range roster.Members {
+		listed = listed || (e.ID == welcome.Sender && e.Meta["avatar"] != "")
+	}
+	if !listed {
+		t.Errorf("roster members %+v don't carry the metadata", roster.Members)
+	}
+}
+
+func TestMetaOverKeyLimitRejected(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	c := dialTestClient(t, base, "", "")
+	welcome, _ := c.Recv(time.Second)
+	c.RecvAll(100 * time.Millisecond)
+
+	meta := make(map[string]string, maxMetaKeys+1)
+	for i := 0; i <= maxMetaKeys; i++ {
+		meta["k"+strconv.Itoa(i)] = "v"
+	}
+	c.Send(message{Type: "meta", Meta: meta})
+	if !refusedWith(c.RecvAll(200*time.Millisecond), msgMetaTooMany) {
+		t.Error("sender wasn't told it has too many keys")
+	}
+	if got := metaTestPresence(t, h, welcome.Sender).Meta; len(got) != 0 {
+		t.Errorf("presence lists rejected metadata %v", got)
+	}
+}
+
+func TestPresenceOptOut(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	byQuery, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws?presence=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer byQuery.Close()
+	byMessage := dialTestClient(t, base, "", "")
+	byMessage.Send(message{Type: "presence_delivery", Active: false})
+	syncTestConn(t, byMessage)
+	watcher := dialTestClient(t, base, "", "")
+	watcher.RecvAll(100 * time.Millisecond)
+	byMessage.RecvAll(50 * time.Millisecond)
+
+	newcomer := dialTestClient(t, base, "", "")
+	newcomer.Send(message{Type: "chat", Text: "hello"})
+	newcomer.RecvAll(100 * time.Millisecond)
+	newcomer.conn.Close()
+
+	// isPresence reports whether m is a presence event or a join or
+	// leave announcement.
+	isPresence := func(m message) bool {
+		return m.Type == "presence" || m.Key == msgUserJoined || m.Key == msgUserLeft
+	}
+	check := func(name string, msgs []message, wantPresence bool) {
+		var chat, presence bool
+		for _, m := range msgs {
+			chat = chat || m.Type == "chat"
+			presence = presence || isPresence(m)
+		}
+		if !chat {
+			t.Errorf("%s didn't get the chat", name)
+		}
+		if presence != wantPresence {
+			t.Errorf("%s got presence %t, want %t: %v", name, presence, wantPresence, types(msgs))
+		}
+	}
+	check("watcher", watcher.RecvAll(200*time.Millisecond), true)
+	check("client opted out by message", byMessage.RecvAll(100*time.Millisecond), false)
+
+	var queried []message
+	_ = byQuery.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		var m message
+		if err := byQuery.ReadJSON(&m); err != nil {
+			break
+		}
+		if m.Key != msgConnected {
+			queried = append(queried, m)
+		}
+	}
+	check("client opted out with ?presence=0", queried, false)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare
+// addresses. Invalid entries are logged and skipped.
+func parseTrustedProxies(v string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		if a, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+			continue
+		}
+		log.Printf("ignoring invalid TRUST_PROXY entry %q", s)
+	}
+	return prefixes
+}
+
+// clientIP returns the address of the client behind r. The peer address
+// is used unless it is a trusted proxy, in which case the rightmost
+// untrusted X-Forwarded-For hop is used, falling back to X-Real-IP.
+// Headers from untrusted peers are ignored, so they can't be spoofed.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !isTrusted(peer, trusted) {
+		return host
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	var leftmost string
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// A malformed hop can't be attributed to anyone; stop at the
+			// last hop we could verify.
+			break
+		}
+		leftmost = hop.String()
+		if !isTrusted(hop, trusted) {
+			return leftmost
+		}
+	}
+	if leftmost != "" {
+		return leftmost
+	}
+
+	if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return ip.String()
+	}
+	return host
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, bogus")
+	if len(trusted) != 2 {
+		t.Fatalf("parsed %d trusted proxies, want the 2 valid entries", len(trusted))
+	}
+	for _, tc := range []struct {
+		name, peer, forwardedFor, realIP string
+		trusted                          bool
+		want                             string
+	}{
+		{"NoProxy", "203.0.113.5:4000", "", "", true, "203.0.113.5"},
+		{"NoProxyConfigured", "10.0.0.2:4000", "198.51.100.7", "", false, "10.0.0.2"},
+		{"TrustedProxy", "10.0.0.2:4000", "198.51.100.7", "", true, "198.51.100.7"},
+		{"RightmostUntrustedHop", "10.0.0.2:4000", "1.1.1.1, 198.51.100.7, 10.0.0.9", "", true, "198.51.100.7"},
+		{"ProxyChainOnlyTrusted", "10.0.0.2:4000", "10.0.0.9", "", true, "10.0.0.9"},
+		{"MalformedHopStops", "10.0.0.2:4000", "198.51.100.7, junk, 10.0.0.9", "", true, "10.0.0.9"},
+		{"RealIP", "192.168.1.1:4000", "", "198.51.100.8", true, "198.51.100.8"},
+		{"UntrustedSpoofsHeaders", "203.0.113.5:4000", "198.51.100.7", "198.51.100.8", true, "203.0.113.5"},
+	} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = tc.peer
+		if tc.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		proxies := trusted
+		if !tc.trusted {
+			proxies = nil
+		}
+		if got := clientIP(r, proxies); got != tc.want {
+			t.Errorf("%s: clientIP = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
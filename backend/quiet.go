@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// quietHours is a daily window, possibly spanning midnight, during which
+// non-essential broadcasts are suppressed.
+type quietHours struct {
+	start, end time.Duration // offsets from local midnight
+	loc        *time.Location
+}
+
+// quietSuppressedTypes are the broadcast types dropped during quiet
+// hours, on top of join and leave announcements.
+var quietSuppressedTypes = map[string]bool{
+	"typing":   true,
+	"presence": true,
+}
+
+// parseQuietHours parses a window such as "22:00-07:00".
+func parseQuietHours(v string, loc *time.Location) (*quietHours, error) {
+	from, to, ok := strings.Cut(v, "-")
+	if !ok {
+		return nil, fmt.Errorf("want HH:MM-HH:MM, got %q", v)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	return &quietHours{start: start, end: end, loc: loc}, nil
+}
+
+func parseClock(v string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", v)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active reports whether now falls inside the window. A nil window is
+// never active.
+func (q *quietHours) active(now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	local := now.In(q.loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, q.loc)
+	offset := local.Sub(midnight)
+	if q.start <= q.end {
+		return offset >= q.start && offset < q.end
+	}
+	return offset >= q.start || offset < q.end
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHoursActive(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	overnight, err := parseQuietHours("22:00-07:00", tokyo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daytime, err := parseQuietHours("12:00-13:30", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, min int) time.Time { return time.Date(2024, 1, 2, hour, min, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		q    *quietHours
+		now  time.Time
+		want bool
+	}{
+		{overnight, at(13, 0), true},  // 22:00 in Tokyo
+		{overnight, at(21, 59), true}, // 06:59 in Tokyo
+		{overnight, at(22, 0), false}, // 07:00 in Tokyo
+		{overnight, at(3, 0), false},  // 12:00 in Tokyo
+		{daytime, at(12, 0), true},
+		{daytime, at(13, 30), false},
+		{nil, at(12, 0), false},
+	} {
+		if got := tc.q.active(tc.now); got != tc.want {
+			t.Errorf("active at %s UTC = %t, want %t", tc.now.Format("15:04"), got, tc.want)
+		}
+	}
+	for _, bad := range []string{"22:00", "25:00-07:00", "22:00-7pm"} {
+		if _, err := parseQuietHours(bad, time.UTC); err == nil {
+			t.Errorf("%q parsed as a window", bad)
+		}
+	}
+}
+
+func TestQuietHoursSuppressJoinsButNotChat(t *testing.T) {
+	cfg := testConfig()
+	cfg.quietHours, _ = parseQuietHours("00:00-23:59", time.UTC)
+	h := NewHub(cfg)
+	h.now = func() time.Time { return time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC) }
+	go h.Run()
+	base := serveTestHub(t, h)
+
+	watcher := dialTestClient(t, base, "", "")
+	watcher.RecvAll(100 * time.Millisecond)
+	sender := dialTestClient(t, base, "", "")
+	sender.RecvAll(100 * time.Millisecond)
+	sender.Send(message{Type: "typing", Typing: "start"})
+	sender.Send(message{Type: "chat", Text: "still here"})
+
+	msgs := watcher.RecvAll(200 * time.Millisecond)
+	if _, joined := announced(msgs, msgUserJoined); joined || hasType(msgs, "typing") {
+		t.Errorf("watcher got %v during quiet hours, want no join or typing", types(msgs))
+	}
+	if got, ok := relayedChat(msgs); !ok || got.Text != "still here" {
+		t.Error("chat didn't flow during quiet hours")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is a classic token bucket refilled continuously at rate
+// tokens per second up to burst. It is not safe for concurrent use; each
+// bucket belongs to a single goroutine.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// take removes n tokens, letting the balance go negative so requests
+// larger than the burst still make progress, and returns how long the
+// caller should wait for the balance to recover to zero.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// available returns the tokens in the bucket after refilling it.
+func (b *tokenBucket) available(now time.Time) float64 {
+	b.refill(now)
+	return b.tokens
+}
+
+// allow takes a token if one is available, reporting whether it did.
+// Unlike take it never goes into debt, so a caller over the limit is
+// refused rather than delayed.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// admissionQuiet is how long nobody must be waiting for the admission
+// ramp before a surge is considered over.
+const admissionQuiet = time.Second
+
+// admissionRamp spaces out the initial sync of new connections during a
+// surge. A surge starts with the first connection after a quiet spell.
+// Its first few connections go straight through; the rest are given
+// successive admission slots at a rate that starts at a tenth of the
+// configured maximum and rises linearly to it over the ramp window, so
+// a recovering server is eased back into load. How long a connection
+// waits depends on how many arrived ahead of it. A nil ramp admits
+// immediately. It is safe for concurrent use.
+type admissionRamp struct {
+	maxRate float64
+	minRate float64
+	burst   int
+	window  time.Duration
+
+	// surgeStart is when the current surge began, next is the earliest
+	// slot the next connection can have, and free counts the surge's
+	// connections still let straight through.
+	mu         sync.Mutex
+	surgeStart time.Time
+	next       time.Time
+	free       int
+
+	// waiting counts connections currently held back.
+	waiting atomic.Int64
+}
+
+// newAdmissionRamp returns a ramp rising to rate connections per second
+// over window, or nil if rate is zero.
+func newAdmissionRamp(rate int, window time.Duration) *admissionRamp {
+	if rate <= 0 {
+		return nil
+	}
+	maxRate := float64(rate)
+	minRate := max(maxRate/10, 1)
+	return &admissionRamp{maxRate: maxRate, minRate: minRate, burst: int(minRate), window: window}
+}
+
+// rateAt is the admission rate at t in the current surge. The caller
+// must hold a.mu.
+func (a *admissionRamp) rateAt(t time.Time) float64 {
+	elapsed := t.Sub(a.surgeStart)
+	if a.window <= 0 || elapsed >= a.window {
+		return a.maxRate
+	}
+	return a.minRate + (a.maxRate-a.minRate)*elapsed.Seconds()/a.window.Seconds()
+}
+
+// delay assigns a connection arriving at now its admission slot and
+// returns how long it must wait for it.
+func (a *admissionRamp) delay(now time.Time) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.next) >= admissionQuiet {
+		a.surgeStart, a.free = now, a.burst
+	}
+	if a.free > 0 && !a.next.After(now) {
+		a.free--
+		a.next = now
+		return 0
+	}
+	slot := a.next
+	if slot.Before(now) {
+		slot = now
+	}
+	a.next = slot.Add(time.Duration(float64(time.Second) / a.rateAt(slot)))
+	return slot.Sub(now)
+}
+
+// currentRate is the rate connections are being admitted at, or the
+// full rate outside a surge, for stats.
+func (a *admissionRamp) currentRate() float64 {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if now.Sub(a.next) >= admissionQuiet {
+		return a.maxRate
+	}
+	return a.rateAt(now)
+}
+
+// wait blocks until the caller's turn to be admitted.
+func (a *admissionRamp) wait() {
+	if a == nil {
+		return
+	}
+	delay := a.delay(time.Now())
+	if delay <= 0 {
+		return
+	}
+	a.waiting.Add(1)
+	defer a.waiting.Add(-1)
+	time.Sleep(delay)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// admittedPerSecond floods ramp with arrivals every 5ms for span and
+// returns how many were admitted within each second of the flood.
+func admittedPerSecond(ramp *admissionRamp, span time.Duration) []int {
+	start := time.Now()
+	counts := make([]int, int(span/time.Second))
+	for at := time.Duration(0); at < span; at += 5 * time.Millisecond {
+		admitted := at + ramp.delay(start.Add(at))
+		if sec := int(admitted / time.Second); sec < len(counts) {
+			counts[sec]++
+		}
+	}
+	return counts
+}
+
+func TestAdmissionRampRisesOverWindow(t *testing.T) {
+	counts := admittedPerSecond(newAdmissionRamp(100, 10*time.Second), 10*time.Second)
+	first, last := counts[0], counts[len(counts)-1]
+	if first > 40 {
+		t.Errorf("admitted %d in the first second, want the ramp to start near 10/s", first)
+	}
+	if last < 70 {
+		t.Errorf("admitted %d in the last second, want the ramp near 100/s", last)
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i]+5 < counts[i-1] {
+			t.Errorf("admissions fell from %d to %d in second %d: %v", counts[i-1], counts[i], i, counts)
+		}
+	}
+}
+
+func TestAdmissionRampStaggersConnections(t *testing.T) {
+	ramp := newAdmissionRamp(100, 10*time.Second)
+	now := time.Now()
+	var last time.Duration
+	for i := 0; i < 20; i++ {
+		d := ramp.delay(now)
+		if d < last {
+			t.Fatalf("connection %d waits %v, less than the one before it (%v)", i, d, last)
+		}
+		last = d
+	}
+	if last == 0 {
+		t.Error("a burst of 20 connections was admitted at once")
+	}
+}
+
+func TestAdmissionRampRestartsAfterQuiet(t *testing.T) {
+	ramp := newAdmissionRamp(100, 10*time.Second)
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		ramp.delay(start)
+	}
+	// Long enough for the ramp to reach full rate and the bucket to
+	// refill.
+	later := start.Add(time.Minute)
+	ramp.delay(later)
+	ramp.mu.Lock()
+	rate := ramp.rateAt(later)
+	ramp.mu.Unlock()
+	if rate != ramp.minRate {
+		t.Errorf("rate after a quiet spell is %v, want the ramp to restart at %v", rate, ramp.minRate)
+	}
+}
+
+func TestFloodControlWarnsThenCoolsThenDisconnects(t *testing.T) {
+	cfg := testConfig()
+	cfg.chatRate = 1
+	cfg.chatBurst = 1
+	h, base := newTestServer(t, cfg)
+	receiver := dialTestClient(t, base, "", "")
+	receiver.RecvAll(100 * time.Millisecond)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	receiver.RecvAll(100 * time.Millisecond)
+
+	// The first chat spends the burst; each later one is an offense.
+	for i := 0; i < 4; i++ {
+		if err := conn.WriteJSON(message{Type: "chat", Text: "spam " + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var m message
+		if err = conn.ReadJSON(&m); err != nil {
+			break
+		}
+		if m.Type == "system" && m.Key != msgConnected && m.Key != msgUserJoined {
+			keys = append(keys, m.Key)
+		}
+	}
+	want := []string{msgFloodWarning, msgCooldown, msgRateLimited}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("sender was told %v, want %v", keys, want)
+	}
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != closeCodeFlooding {
+		t.Errorf("connection ended with %v, want close code %d", err, closeCodeFlooding)
+	}
+
+	var chats []string
+	for _, m := range receiver.RecvAll(200 * time.Millisecond) {
+		if m.Type == "chat" {
+			chats = append(chats, m.Text)
+		}
+	}
+	if len(chats) != 1 || chats[0] != "spam 0" {
+		t.Errorf("the room got %v, want only the chat within the limit", chats)
+	}
+	waitFor(t, "the flooder to be removed", func() bool { return h.clientCount.Load() == 1 })
+}
+
+func TestMessageRateLimitDropsBurst(t *testing.T) {
+	cfg := testConfig()
+	cfg.messageRate = 10
+	cfg.messageBurst = 5
+	cfg.chatRate = 0
+	h := NewHub(cfg)
+	c := &client{id: "c1", hub: h, send: make(chan outbound, 16), sendLow: make(chan outbound, 16)}
+
+	before := messageCount("chat", outcomeRateLimited)
+	var accepted int
+	for i := 0; i < 30; i++ {
+		if _, ok := c.prepareBroadcast([]byte(`{"type":"chat","text":"flood ` + strconv.Itoa(i) + `"}`)); ok {
+			accepted++
+		}
+	}
+	if accepted != cfg.messageBurst {
+		t.Errorf("%d of a 30-message burst got through, want the burst of %d", accepted, cfg.messageBurst)
+	}
+	if got := messageCount("chat", outcomeRateLimited) - before; got != float64(30-cfg.messageBurst) {
+		t.Errorf("%v messages counted as rate limited, want %d", got, 30-cfg.messageBurst)
+	}
+	// Keepalives aren't metered, even while the client is throttled.
+	for i := 0; i < 5; i++ {
+		c.prepareBroadcast([]byte(`{"type":"ping"}`))
+	}
+
+	var notices, pongs int
+	for len(h.direct) > 0 {
+		var m message
+		if err := json.Unmarshal((<-h.direct).data, &m); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case m.Key == msgThrottled:
+			notices++
+		case m.Type == "pong":
+			pongs++
+		}
+	}
+	if notices != 1 {
+		t.Errorf("client was told it was throttled %d times, want once", notices)
+	}
+	if pongs != 5 {
+		t.Errorf("%d of 5 pings were answered while throttled", pongs)
+	}
+}
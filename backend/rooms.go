@@ -0,0 +1,271 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRoom is where a client lands when it doesn't name a room.
+const defaultRoom = "lobby"
+
+// roomPattern is what a room name may look like, like a nick but longer.
+var roomPattern = regexp.MustCompile(`^[\p{L}\p{N}_.-]{1,64}$`)
+
+// roomReporter is implemented by clients that asked for a room at
+// connect. Clients that don't implement it join defaultRoom.
+type roomReporter interface {
+	initialRoom() string
+}
+
+// joinRequest asks Run to move a client to another room. done receives
+// "" once it has moved, or the key of the notice refusing the move.
+type joinRequest struct {
+	client Client
+	room   string
+	done   chan string
+}
+
+// requestedRoom returns the room named by a ?room= parameter, defaulting
+// to defaultRoom, and whether the name is valid.
+func requestedRoom(v string) (string, bool) {
+	if v = strings.TrimSpace(v); v == "" {
+		return defaultRoom, true
+	}
+	return v, roomPattern.MatchString(v)
+}
+
+// joinRoom handles a join from this client, moving it to the room it
+// names and telling it where it landed.
+func (c *client) joinRoom(room string) {
+	room = strings.TrimSpace(room)
+	if !roomPattern.MatchString(room) {
+		c.notify(msgRoomInvalid)
+		return
+	}
+	done := make(chan string, 1)
+	c.hub.joins <- joinRequest{client: c, room: room, done: done}
+	if key := <-done; key != "" {
+		c.notify(key)
+		return
+	}
+	c.room = room
+	if c.conn != nil {
+		// The next frame is read under the new room's limit.
+		c.conn.SetReadLimit(int64(c.hub.cfg.frameLimit(room)))
+	}
+	c.reply(message{
+		Type: "system",
+		Key:  msgRoomJoined,
+		Text: strings.ReplaceAll(c.hub.cfg.catalog.text(msgRoomJoined, c.locale), "{room}", room),
+		ID:   c.hub.idGen(),
+		Room: room,
+	})
+	c.sendRules()
+}
+
+// sendRules sends the rules of the client's room, if it has any it hasn't
+// accepted yet.
+func (c *client) sendRules() {
+	rules := c.hub.cfg.rulesFor(c.room)
+	if rules == "" || c.rulesAccepted[c.room] {
+		return
+	}
+	c.reply(message{Type: "rules", Text: rules, ID: c.hub.idGen(), Room: c.room})
+}
+
+// acceptRules records that the client accepted the rules of its room.
+func (c *client) acceptRules() {
+	if c.rulesAccepted == nil {
+		c.rulesAccepted = make(map[string]bool)
+	}
+	c.rulesAccepted[c.room] = true
+}
+
+// enterRoom adds m to room. It must only be called from Run.
+func (h *hub) enterRoom(c Client, m *member, room string) {
+	m.room = room
+	members := h.rooms[room]
+	if members == nil {
+		members = make(map[Client]struct{})
+		h.rooms[room] = members
+	}
+	members[c] = struct{}{}
+}
+
+// leaveRoom takes m out of its room, forgetting the room once it is
+// empty. It must only be called from Run.
+func (h *hub) leaveRoom(c Client, m *member) {
+	typers := h.typers[m.room]
+	h.setTyping(m, false)
+	if h.cfg.maxTypingIndicators > 0 {
+		h.typersChanged(m.room, typers)
+	}
+	members := h.rooms[m.room]
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.rooms, m.room)
+		delete(h.typers, m.room)
+	}
+}
+
+// mayCreateRoom reports whether ROOM_CREATION lets a client join room
+// while nobody is in it.
+func (cfg config) mayCreateRoom(room string) bool {
+	switch cfg.roomCreation {
+	case roomCreationRestricted:
+		_, listed := cfg.rooms[room]
+		return listed || room == defaultRoom
+	case roomCreationClosed:
+		return room == defaultRoom
+	}
+	return true
+}
+
+// entryRefused returns the key of the notice refusing a new connection
+// room, or "" if it may start out there. It asks Run, so it must not be
+// called from Run itself; connections arriving together can overshoot a
+// room's cap slightly, since they are counted before registering.
+func (h *hub) entryRefused(room string) string {
+	members := len(h.presenceOf(room))
+	switch {
+	case members == 0 && !h.cfg.mayCreateRoom(room):
+		return msgRoomNotFound
+	case h.cfg.roomFull(room, members):
+		return msgRoomFull
+	}
+	return ""
+}
+
+// switchRoom moves a client to the room it asked for, announcing it
+// leaving the old room and joining the new one, and sends it the new
+// room's roster. It returns the key of the notice refusing the move, or
+// "". It must only be called from Run.
+func (h *hub) switchRoom(m *member, req joinRequest) string {
+	if req.room == m.room {
+		return ""
+	}
+	if !h.cfg.userMayJoin(req.room, m.user) {
+		return msgRoomPrivate
+	}
+	if h.rooms[req.room] == nil && !h.cfg.mayCreateRoom(req.room) {
+		return msgRoomNotFound
+	}
+	if h.cfg.roomFull(req.room, len(h.rooms[req.room])) {
+		return msgRoomFull
+	}
+	h.leaveRoom(req.client, m)
+	h.broadcastPresence("leave", req.client, m)
+	h.announce(msgUserLeft, h.cfg.leaveTemplate, req.client, m)
+	h.enterRoom(req.client, m, req.room)
+	h.sendRoster(req.client, m)
+	h.broadcastPresence("join", req.client, m)
+	h.announce(msgUserJoined, h.cfg.joinTemplate, req.client, m)
+	return ""
+}
+
+// maxRoomsPage is the most rooms /api/rooms lists at once.
+const maxRoomsPage = 200
+
+// roomSummary is one room as listed by /api/rooms and the admin
+// snapshot. LastActive is the latest any member joined or sent
+// something.
+type roomSummary struct {
+	Name       string    `json:"name"`
+	Clients    int       `json:"clients"`
+	LastActive time.Time `json:"lastActive"`
+	Full       bool      `json:"full"`
+	Private    bool      `json:"private"`
+}
+
+// roomSummaries describes every room with someone in it. It must only be
+// called from Run.
+func (h *hub) roomSummaries() []roomSummary {
+	out := make([]roomSummary, 0, len(h.rooms))
+	for room, members := range h.rooms {
+		s := roomSummary{
+			Name:    room,
+			Clients: len(members),
+			Full:    h.cfg.roomFull(room, len(members)),
+			Private: h.cfg.rooms[room].AllowedUsers != nil,
+		}
+		for c := range members {
+			if at := h.clients[c].lastActive; at.After(s.LastActive) {
+				s.LastActive = at
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// roomsHandler serves GET /api/rooms?sort=&limit=&offset=, listing the
+// rooms with someone in them, most recently active or, with sort=size,
+// largest first. A private room is listed only to the users it admits.
+func roomsHandler(h *hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if h.authRequired() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "rooms are unavailable while authentication is required"})
+			return
+		}
+		user, err := h.requestUser(r)
+		if err != nil && (err != errNoToken || h.tokensRequired()) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		q := r.URL.Query()
+		by := q.Get("sort")
+		if by != "" && by != "activity" && by != "size" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sort must be activity or size"})
+			return
+		}
+		limit, offset := 50, 0
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxRoomsPage {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(maxRoomsPage)})
+				return
+			}
+			limit = n
+		}
+		if v := q.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "offset must be a non-negative number"})
+				return
+			}
+			offset = n
+		}
+
+		result := make(chan []roomSummary, 1)
+		h.roomLists <- result
+		rooms := <-result
+		visible := rooms[:0]
+		for _, s := range rooms {
+			if !s.Private || h.cfg.userMayJoin(s.Name, user) {
+				visible = append(visible, s)
+			}
+		}
+		sort.Slice(visible, func(i, j int) bool {
+			a, b := visible[i], visible[j]
+			if by == "size" && a.Clients != b.Clients {
+				return a.Clients > b.Clients
+			}
+			if !a.LastActive.Equal(b.LastActive) {
+				return a.LastActive.After(b.LastActive)
+			}
+			return a.Name < b.Name
+		})
+		page := visible[min(offset, len(visible)):min(offset+limit, len(visible))]
+		writeJSON(w, http.StatusOK, map[string]any{"rooms": page, "total": len(visible)})
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// chatTestRoom sends a chat from c and reports whether it was broadcast
+// back rather than refused with key.
+func chatTestRoom(t *testing.T, c *testConn, text, key string) bool {
+	t.Helper()
+	c.Send(message{Type: "chat", Text: text})
+	for _, m := range c.RecvAll(100 * time.Millisecond) {
+		switch {
+		case m.Type == "chat" && m.Text == text:
+			return true
+		case m.Type == "system" && m.Key == key:
+			return false
+		}
+	}
+	t.Fatalf("chat %q was neither broadcast nor refused with %s", text, key)
+	return false
+}
+
+// rulesTestRoom returns the room named by the rules message in msgs, or
+// "" if there is none.
+func rulesTestRoom(msgs []message) string {
+	for _, m := range msgs {
+		if m.Type == "rules" {
+			return m.Room
+		}
+	}
+	return ""
+}
+
+func TestRulesGateChatUntilAccepted(t *testing.T) {
+	cfg := testConfig()
+	rules := "be nice"
+	cfg.rooms = map[string]roomConfig{"dev": {Rules: &rules}}
+	_, base := newTestServer(t, cfg)
+
+	lobby := dialTestClient(t, base, "", "")
+	if msgs := lobby.RecvAll(100 * time.Millisecond); hasType(msgs, "rules") {
+		t.Errorf("lobby has no rules, got %v", types(msgs))
+	}
+	if !chatTestRoom(t, lobby, "hi lobby", msgRulesPending) {
+		t.Error("chat refused in a room without rules")
+	}
+
+	dev := dialTestClient(t, base, "dev", "")
+	if room := rulesTestRoom(dev.RecvAll(100 * time.Millisecond)); room != "dev" {
+		t.Errorf("rules sent for room %q, want dev", room)
+	}
+	if chatTestRoom(t, dev, "too soon", msgRulesPending) {
+		t.Error("chat accepted before the rules were")
+	}
+	dev.Send(message{Type: "accept_rules"})
+	if !chatTestRoom(t, dev, "hi dev", msgRulesPending) {
+		t.Error("chat refused after accepting the rules")
+	}
+}
+
+func TestRulesAcceptedPerRoom(t *testing.T) {
+	cfg := testConfig()
+	cfg.rulesText = "be nice"
+	none := ""
+	cfg.rooms = map[string]roomConfig{"open": {Rules: &none}}
+	_, base := newTestServer(t, cfg)
+
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+	c.Send(message{Type: "accept_rules"})
+	if !chatTestRoom(t, c, "in lobby", msgRulesPending) {
+		t.Fatal("chat refused after accepting the lobby's rules")
+	}
+
+	c.Send(message{Type: "join", Room: "other"})
+	if room := rulesTestRoom(c.RecvAll(100 * time.Millisecond)); room != "other" {
+		t.Errorf("rules sent for room %q on join, want other", room)
+	}
+	if chatTestRoom(t, c, "in other", msgRulesPending) {
+		t.Error("accepting the lobby's rules let chat into another room")
+	}
+
+	c.Send(message{Type: "join", Room: "open"})
+	if msgs := c.RecvAll(100 * time.Millisecond); hasType(msgs, "rules") {
+		t.Errorf("room with its rules turned off sent %v", types(msgs))
+	}
+	if !chatTestRoom(t, c, "in open", msgRulesPending) {
+		t.Error("chat refused in a room with its rules turned off")
+	}
+
+	c.Send(message{Type: "join", Room: defaultRoom})
+	if msgs := c.RecvAll(100 * time.Millisecond); hasType(msgs, "rules") {
+		t.Errorf("rules already accepted were sent again: %v", types(msgs))
+	}
+	if !chatTestRoom(t, c, "back in lobby", msgRulesPending) {
+		t.Error("returning to the lobby forgot its accepted rules")
+	}
+}
+
+func TestAnnouncementRoomRefusesChat(t *testing.T) {
+	cfg := testConfig()
+	cfg.rooms = map[string]roomConfig{"announcements": {Types: []string{}}, "chat-only": {Types: []string{"chat"}}}
+	h, base := newTestServer(t, cfg)
+
+	c := dialTestClient(t, base, "announcements", "")
+	c.RecvAll(100 * time.Millisecond)
+	if chatTestRoom(t, c, "can I talk?", msgTypeNotAllowed) {
+		t.Error("chat broadcast in an announcement-only room")
+	}
+	if status, _ := injectTest(h, `{"room":"announcements","type":"system","text":"release tonight"}`); status != http.StatusOK {
+		t.Fatalf("inject got %d", status)
+	}
+	var announced bool
+	for _, m := range c.RecvAll(100 * time.Millisecond) {
+		announced = announced || m.Key == msgExternal
+	}
+	if !announced {
+		t.Error("announcement didn't reach the room")
+	}
+
+	c.Send(message{Type: "join", Room: "chat-only"})
+	c.RecvAll(100 * time.Millisecond)
+	if !chatTestRoom(t, c, "hello", msgTypeNotAllowed) {
+		t.Error("chat refused in a room allowing it")
+	}
+	c.Send(message{Type: "typing", Typing: "start"})
+	var refused bool
+	for _, m := range c.RecvAll(100 * time.Millisecond) {
+		refused = refused || m.Key == msgTypeNotAllowed
+	}
+	if !refused {
+		t.Error("typing accepted in a chat-only room")
+	}
+}
+
+func TestAnnouncementRoomRefusesLongPollChat(t *testing.T) {
+	cfg := testConfig()
+	cfg.rooms = map[string]roomConfig{defaultRoom: {Types: []string{}}}
+	_, base := newTestServer(t, cfg)
+
+	session := openTestPoll(t, base)
+	if status, key := postTestPoll(t, base, session, message{Type: "chat", Text: "hi"}); status != http.StatusForbidden || key != msgTypeNotAllowed {
+		t.Errorf("long-poll chat got %d %s, want 403 %s", status, key, msgTypeNotAllowed)
+	}
+}
+
+func TestRoomSizeLimitOverride(t *testing.T) {
+	cfg := testConfig()
+	cfg.rooms = map[string]roomConfig{"code": {MaxTextBytes: 6000, MaxMessageBytes: 8192}}
+	_, base := newTestServer(t, cfg)
+
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+	if chatTestRoom(t, c, strings.Repeat("a", 3000), "text_too_long") {
+		t.Error("lobby accepted text over the default limit")
+	}
+
+	// Joining raises the frame read limit too, or this frame would
+	// close the connection.
+	c.Send(message{Type: "join", Room: "code"})
+	c.RecvAll(100 * time.Millisecond)
+	if !chatTestRoom(t, c, strings.Repeat("b", 5000), "text_too_long") {
+		t.Error("code room refused text within its limit")
+	}
+	if chatTestRoom(t, c, strings.Repeat("c", 6001), "text_too_long") {
+		t.Error("code room accepted text over its own limit")
+	}
+}
+
+// roomTestClient is a testClient that starts out in room.
+type roomTestClient struct {
+	*testClient
+	room string
+}
+
+func (c roomTestClient) initialRoom() string { return c.room }
+
+// dialTestStatus tries to connect to room, with token if it isn't "",
+// and returns the handshake's HTTP status.
+func dialTestStatus(t *testing.T, base, room, token string) int {
+	t.Helper()
+	u := "ws" + strings.TrimPrefix(base, "http") + "/ws?room=" + room
+	if token != "" {
+		u += "&token=" + token
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		conn.Close()
+		return http.StatusSwitchingProtocols
+	}
+	if resp == nil {
+		t.Fatalf("dial %s: %v", u, err)
+	}
+	return resp.StatusCode
+}
+
+// joinTestRoom asks c to join room and reports whether it got there
+// rather than being refused.
+func joinTestRoom(t *testing.T, c *testConn, room string) bool {
+	t.Helper()
+	c.Send(message{Type: "join", Room: room})
+	for _, m := range c.RecvAll(100 * time.Millisecond) {
+		switch m.Key {
+		case msgRoomJoined:
+			return m.Room == room
+		case msgRoomNotFound, msgRoomPrivate:
+			return false
+		}
+	}
+	t.Fatalf("join %s was neither made nor refused", room)
+	return false
+}
+
+func TestRoomCreationOpen(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+
+	if status := dialTestStatus(t, base, "brand-new", ""); status != http.StatusSwitchingProtocols {
+		t.Errorf("connecting to a new room got %d", status)
+	}
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+	if !joinTestRoom(t, c, "also-new") {
+		t.Error("joining a new room refused")
+	}
+}
+
+func TestRoomCreationRestricted(t *testing.T) {
+	cfg := testConfig()
+	cfg.roomCreation = roomCreationRestricted
+	cfg.rooms = map[string]roomConfig{"listed": {}}
+	_, base := newTestServer(t, cfg)
+
+	if status := dialTestStatus(t, base, "unlisted", ""); status != http.StatusForbidden {
+		t.Errorf("connecting to an unlisted room got %d, want 403", status)
+	}
+	c := dialTestClient(t, base, "listed", "")
+	c.RecvAll(100 * time.Millisecond)
+	if joinTestRoom(t, c, "unlisted") {
+		t.Error("joined an unlisted room")
+	}
+	if !joinTestRoom(t, c, defaultRoom) {
+		t.Error("lobby refused")
+	}
+}
+
+func TestRoomCreationClosed(t *testing.T) {
+	cfg := testConfig()
+	cfg.roomCreation = roomCreationClosed
+	cfg.rooms = map[string]roomConfig{"listed": {}}
+	h, base := newTestServer(t, cfg)
+	h.register <- roomTestClient{newTestClient("already-there"), "ops"}
+	waitFor(t, "ops to exist", func() bool { return len(h.presenceOf("ops")) == 1 })
+
+	for _, room := range []string{"new", "listed"} {
+		if status := dialTestStatus(t, base, room, ""); status != http.StatusForbidden {
+			t.Errorf("connecting to empty room %s got %d, want 403", room, status)
+		}
+	}
+	if status := dialTestStatus(t, base, "ops", ""); status != http.StatusSwitchingProtocols {
+		t.Errorf("connecting to an existing room got %d", status)
+	}
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+	if joinTestRoom(t, c, "new") {
+		t.Error("joined a room that didn't exist")
+	}
+	if !joinTestRoom(t, c, "ops") {
+		t.Error("joining an existing room refused")
+	}
+}
+
+func TestPrivateRoomAdmitsOnlyListedUsers(t *testing.T) {
+	cfg := testConfig()
+	cfg.tokenSecret = "secret"
+	cfg.allowAnonymous = true
+	cfg.rooms = map[string]roomConfig{"staff": {AllowedUsers: []string{"alice"}}}
+	_, base := newTestServer(t, cfg)
+	alice, bob := signTestToken("secret", "alice"), signTestToken("secret", "bob")
+
+	if status := dialTestStatus(t, base, "staff", alice); status != http.StatusSwitchingProtocols {
+		t.Errorf("listed user connecting got %d", status)
+	}
+	if status := dialTestStatus(t, base, "staff", bob); status != http.StatusForbidden {
+		t.Errorf("unlisted user connecting got %d, want 403", status)
+	}
+	if status := dialTestStatus(t, base, "staff", ""); status != http.StatusForbidden {
+		t.Errorf("anonymous client connecting got %d, want 403", status)
+	}
+	if status := dialTestStatus(t, base, "open", bob); status != http.StatusSwitchingProtocols {
+		t.Errorf("connecting to a room without an ACL got %d", status)
+	}
+
+	b := dialTestClient(t, base, "", bob)
+	b.RecvAll(100 * time.Millisecond)
+	if joinTestRoom(t, b, "staff") {
+		t.Error("unlisted user joined the private room")
+	}
+	if !joinTestRoom(t, b, "open") {
+		t.Error("unlisted user refused a room without an ACL")
+	}
+	a := dialTestClient(t, base, "", alice)
+	a.RecvAll(100 * time.Millisecond)
+	if !joinTestRoom(t, a, "staff") {
+		t.Error("listed user refused the private room")
+	}
+}
+
+// listTestRooms calls roomsHandler with query and token, returning the
+// listed room names and total.
+func listTestRooms(t *testing.T, h *hub, query, token string) ([]string, int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms?"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	roomsHandler(h)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rooms?%s got %d: %s", query, rec.Code, rec.Body)
+	}
+	var body struct {
+		Rooms []roomSummary
+		Total int
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(body.Rooms))
+	for i, s := range body.Rooms {
+		names[i] = s.Name
+	}
+	return names, body.Total
+}
+
+func TestRoomsOverview(t *testing.T) {
+	cfg := testConfig()
+	cfg.tokenSecret = "secret"
+	cfg.allowAnonymous = true
+	cfg.rooms = map[string]roomConfig{"staff": {AllowedUsers: []string{"alice"}}, "tiny": {MaxMembers: 2}}
+	h, base := newTestServer(t, cfg)
+	join := func(room string, n int) {
+		for i := 0; i < n; i++ {
+			h.register <- roomTestClient{newTestClient(randomID()), room}
+		}
+		waitFor(t, room+" to fill", func() bool { return len(h.presenceOf(room)) == n })
+		time.Sleep(5 * time.Millisecond)
+	}
+	join("big", 3)
+	join("tiny", 2)
+	join("staff", 1)
+
+	if names, total := listTestRooms(t, h, "", ""); strings.Join(names, ",") != "tiny,big" || total != 2 {
+		t.Errorf("anonymous overview is %v of %d, want tiny,big of 2 by activity", names, total)
+	}
+	if names, _ := listTestRooms(t, h, "sort=size", signTestToken("secret", "bob")); strings.Join(names, ",") != "big,tiny" {
+		t.Errorf("overview for an unlisted user by size is %v, want big,tiny", names)
+	}
+	names, total := listTestRooms(t, h, "limit=2&offset=1", signTestToken("secret", "alice"))
+	if strings.Join(names, ",") != "tiny,big" || total != 3 {
+		t.Errorf("alice's second page is %v of %d, want tiny,big of 3", names, total)
+	}
+
+	result := make(chan []roomSummary, 1)
+	h.roomLists <- result
+	for _, s := range <-result {
+		if s.Full != (s.Name == "tiny") || s.Private != (s.Name == "staff") || s.LastActive.IsZero() {
+			t.Errorf("summary %+v has the wrong flags", s)
+		}
+	}
+	if status := dialTestStatus(t, base, "tiny", ""); status != http.StatusForbidden {
+		t.Errorf("connecting to a full room got %d, want 403", status)
+	}
+}
+
+// syncTestConn waits for a pong, so everything c sent before has been
+// handled.
+func syncTestConn(t *testing.T, c *testConn) {
+	t.Helper()
+	c.Send(message{Type: "ping", ID: "sync"})
+	for {
+		m, ok := c.Recv(time.Second)
+		if !ok {
+			t.Fatal("no pong")
+		}
+		if m.Type == "pong" {
+			return
+		}
+	}
+}
+
+func TestMutedRoomStillDeliversMentionsAndDirect(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	sender := dialTestClient(t, base, "", "")
+	muted := dialTestClient(t, base, "", "")
+	sender.RecvAll(100 * time.Millisecond)
+	var id string
+	for _, m := range muted.RecvAll(100 * time.Millisecond) {
+		if m.Key == msgConnected {
+			id = m.Sender
+		}
+	}
+	var nick string
+	for _, e := range h.presenceOf(defaultRoom) {
+		if e.ID == id {
+			nick = e.Nick
+		}
+	}
+	if nick == "" {
+		t.Fatal("muted client has no nick")
+	}
+
+	got := func() []string {
+		var texts []string
+		for _, m := range muted.RecvAll(100 * time.Millisecond) {
+			if m.Type == "chat" || m.Type == "webrtc-offer" {
+				texts = append(texts, m.Type+":"+m.Text)
+			}
+		}
+		return texts
+	}
+
+	muted.Send(message{Type: "mute_room"})
+	syncTestConn(t, muted)
+	sender.Send(message{Type: "chat", Text: "hello all"})
+	sender.Send(message{Type: "chat", Text: "hey @" + nick + "."})
+	sender.Send(message{Type: "webrtc-offer", Target: id, SDP: "v=0"})
+	sender.Send(message{Type: "webrtc-offer", Target: "someone-else", SDP: "v=0"})
+	if texts, want := strings.Join(got(), "|"), "chat:hey @"+nick+".|webrtc-offer:"; texts != want {
+		t.Errorf("muted client got %q, want %q", texts, want)
+	}
+
+	muted.Send(message{Type: "unmute_room"})
+	syncTestConn(t, muted)
+	sender.Send(message{Type: "chat", Text: "welcome back"})
+	if texts := strings.Join(got(), "|"); texts != "chat:welcome back" {
+		t.Errorf("unmuted client got %q, want the chat", texts)
+	}
+}
+
+func TestRoomsIsolatedAndLeaveReturnsToLobby(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	a := dialTestClient(t, base, "birds", "")
+	b := dialTestClient(t, base, "birds", "")
+	lobby := dialTestClient(t, base, "", "")
+	for _, c := range []*testConn{a, b, lobby} {
+		c.RecvAll(100 * time.Millisecond)
+	}
+	heard := func(c *testConn, text string) bool {
+		for _, m := range c.RecvAll(200 * time.Millisecond) {
+			if m.Type == "chat" && m.Text == text {
+				return true
+			}
+		}
+		return false
+	}
+
+	a.Send(message{Type: "chat", Text: "in birds"})
+	if !heard(b, "in birds") {
+		t.Error("a chat didn't reach its own room")
+	}
+	if heard(lobby, "in birds") {
+		t.Error("a chat reached another room")
+	}
+
+	a.Send(message{Type: "leave"})
+	joined, ok := announced(a.RecvAll(200*time.Millisecond), msgRoomJoined)
+	if !ok || joined.Room != defaultRoom {
+		t.Fatalf("leave answered %+v, want a room_joined for the lobby", joined)
+	}
+	if _, ok := announced(b.RecvAll(200*time.Millisecond), msgUserLeft); !ok {
+		t.Error("the old room wasn't told the client left")
+	}
+	a.Send(message{Type: "chat", Text: "in the lobby"})
+	if !heard(lobby, "in the lobby") {
+		t.Error("after leaving, a chat didn't reach the lobby")
+	}
+	if heard(b, "in the lobby") {
+		t.Error("after leaving, a chat still reached the old room")
+	}
+
+	b.Send(message{Type: "leave"})
+	waitFor(t, "the empty room to be dropped", func() bool {
+		result := make(chan hubSnapshot, 1)
+		h.snapshots <- result
+		for _, r := range (<-result).Rooms {
+			if r.Name == "birds" {
+				return false
+			}
+		}
+		return true
+	})
+}
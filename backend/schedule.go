@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// scheduledAnnouncement is a system message broadcast every interval to
+// room, or to every room if it is "".
+type scheduledAnnouncement struct {
+	every time.Duration
+	text  string
+	room  string
+}
+
+// loadSchedule reads a JSON list of announcements such as
+// [{"every": "1h", "text": "server restarts at midnight", "room": "ops"}].
+func loadSchedule(path string) ([]scheduledAnnouncement, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Every string `json:"every"`
+		Text  string `json:"text"`
+		Room  string `json:"room"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	schedule := make([]scheduledAnnouncement, 0, len(entries))
+	for i, e := range entries {
+		every, err := time.ParseDuration(e.Every)
+		if err != nil || every <= 0 {
+			return nil, fmt.Errorf("%s: entry %d: invalid interval %q", path, i, e.Every)
+		}
+		if e.Text == "" {
+			return nil, fmt.Errorf("%s: entry %d: empty text", path, i)
+		}
+		schedule = append(schedule, scheduledAnnouncement{every: every, text: e.Text, room: e.Room})
+	}
+	return schedule, nil
+}
+
+// runSchedule broadcasts the announcements in path until the process
+// exits, reloading the file on SIGHUP. A schedule that fails to load is
+// logged and the previous one keeps running.
+func runSchedule(h *hub, path string) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	var stop chan struct{}
+	for {
+		if schedule, err := loadSchedule(path); err != nil {
+			log.Printf("ignoring ANNOUNCEMENT_SCHEDULE: %v", err)
+		} else {
+			if stop != nil {
+				close(stop)
+			}
+			stop = make(chan struct{})
+			for _, a := range schedule {
+				go h.announceEvery(a, stop)
+			}
+			log.Printf("loaded %d scheduled announcements from %s", len(schedule), path)
+		}
+		<-reload
+	}
+}
+
+// announceEvery broadcasts a until stop is closed.
+func (h *hub) announceEvery(a scheduledAnnouncement, stop <-chan struct{}) {
+	ticker := time.NewTicker(a.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Every instance runs its own schedule.
+			h.broadcastSystem(msgScheduled, a.text, a.room, true)
+		case <-stop:
+			return
+		}
+	}
+}
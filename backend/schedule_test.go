@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadSchedule(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "schedule.json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	schedule, err := loadSchedule(write(`[{"every": "1h", "text": "restart at midnight"}, {"every": "90s", "text": "hydrate", "room": "ops"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule) != 2 || schedule[0].every != time.Hour || schedule[1].every != 90*time.Second || schedule[1].text != "hydrate" || schedule[0].room != "" || schedule[1].room != "ops" {
+		t.Errorf("loaded %+v", schedule)
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`[{"every": "soon", "text": "x"}]`,
+		`[{"every": "-1m", "text": "x"}]`,
+		`[{"every": "1m", "text": ""}]`,
+	} {
+		if _, err := loadSchedule(write(bad)); err == nil {
+			t.Errorf("schedule %s loaded without error", bad)
+		}
+	}
+}
+
+func TestScheduledAnnouncementBroadcast(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	c := dialTestClient(t, base, "ops", "")
+	elsewhere := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+	elsewhere.RecvAll(100 * time.Millisecond)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.announceEvery(scheduledAnnouncement{every: 20 * time.Millisecond, text: "restart at midnight", room: "ops"}, stop)
+	}()
+	for got, deadline := 0, time.After(time.Second); got < 3; {
+		select {
+		case m := <-c.in:
+			if m.Key != msgScheduled {
+				continue
+			}
+			if m.Text != "restart at midnight" {
+				t.Fatalf("scheduled announcement says %q", m.Text)
+			}
+			got++
+		case <-deadline:
+			t.Fatalf("got %d scheduled announcements in a second, want one every 20ms", got)
+		}
+	}
+	close(stop)
+	<-done
+
+	c.RecvAll(50 * time.Millisecond)
+	if msgs := c.RecvAll(100 * time.Millisecond); len(msgs) != 0 {
+		t.Errorf("announcements kept coming after stop: %v", types(msgs))
+	}
+	for _, m := range elsewhere.RecvAll(50 * time.Millisecond) {
+		if m.Key == msgScheduled {
+			t.Fatal("an announcement for ops reached the lobby")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// shutdownReasons are the machine-readable reasons a server_shutdown can
+// carry, so clients can pick their message and reconnect behaviour.
+var shutdownReasons = map[string]bool{
+	"deploy":      true,
+	"maintenance": true,
+	"overload":    true,
+}
+
+// drainRequest asks Run to tell every client the server is going away,
+// then disconnect them, reporting how many there were.
+type drainRequest struct {
+	reason         string
+	reconnectAfter time.Duration
+	result         chan int
+}
+
+// shutdownFlushWait is how long shutdown leaves the write pumps to send
+// the server_shutdown message and close frame before the process exits.
+const shutdownFlushWait = time.Second
+
+// drainAll sends each client a server_shutdown and removes it, without
+// announcing the departures to a room that is going away too. Because
+// the message is queued on the same lane Close then closes, it is written
+// before the close frame. It reports how many clients it removed on
+// req.result, even if it fails partway, so drain never waits forever.
+// It must only be called from Run.
+func (h *hub) drainAll(req drainRequest) {
+	drained := 0
+	defer func() { req.result <- drained }()
+
+	msg := message{
+		Type:             "server_shutdown",
+		ID:               h.idGen(),
+		ServerTime:       h.serverTime(),
+		Reason:           req.reason,
+		ReconnectAfterMs: req.reconnectAfter.Milliseconds(),
+	}
+	data, err := encode(msg, "shutdown notice")
+	clients := append([]Client(nil), h.order...)
+	for _, c := range clients {
+		if _, ok := h.clients[c]; !ok {
+			continue
+		}
+		if err == nil {
+			_ = c.Send(msg.Type, data)
+		}
+		h.remove(c, closeShutdown)
+		drained++
+	}
+	log.Printf("drained %d clients (reason %s)", drained, req.reason)
+}
+
+// drain asks Run to drain every client and waits for it to finish. It
+// must not be called from Run. New upgrades are refused from the start,
+// so no one connects mid-drain, until the reconnectAfter the drained
+// clients were given has passed; with none they stay refused.
+func (h *hub) drain(reason string, reconnectAfter time.Duration) int {
+	h.draining.Store(true)
+	if reconnectAfter > 0 {
+		time.AfterFunc(reconnectAfter, func() { h.draining.Store(false) })
+	}
+	req := drainRequest{reason: reason, reconnectAfter: reconnectAfter, result: make(chan int, 1)}
+	h.drains <- req
+	return <-req.result
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainRemovesSlowAndHealthyClientsOnce(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	clients := registerTestClients(t, h, 40)
+	for _, c := range clients[:20] {
+		c.stall()
+	}
+
+	done := make(chan int, 1)
+	go func() { done <- h.drain("deploy", time.Second) }()
+	select {
+	case n := <-done:
+		if n != len(clients) {
+			t.Errorf("drained %d clients, want %d", n, len(clients))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain did not return")
+	}
+
+	for _, c := range clients {
+		if n, reason := c.closed(); n != 1 || reason != closeShutdown {
+			t.Errorf("client closed %d times with %v, want once with %v", n, reason, closeShutdown)
+		}
+	}
+	// Healthy clients get the shutdown notice and nothing about the
+	// others leaving.
+	for _, c := range clients[20:] {
+		got := c.received()
+		if len(got) == 0 || got[len(got)-1] != "server_shutdown" {
+			t.Errorf("healthy client received %v, want server_shutdown last", got)
+		}
+	}
+	if n := h.clientCount.Load(); n != 0 {
+		t.Errorf("%d clients left after drain", n)
+	}
+}
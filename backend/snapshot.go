@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// hubSnapshot is a point-in-time dump of hub state for debugging. It
+// leaves out secrets and anything identifying a person, such as remote
+// addresses and message content.
+type hubSnapshot struct {
+	Time           time.Time        `json:"time"`
+	Clients        int              `json:"clients"`
+	Maintenance    bool             `json:"maintenance"`
+	Compression    bool             `json:"compression"`
+	Overloaded     bool             `json:"overloaded"`
+	BroadcastQueue int              `json:"broadcastQueue"`
+	DirectQueue    int              `json:"directQueue"`
+	RegisterQueue  int              `json:"registerQueue"`
+	AdmissionRate  float64          `json:"admissionRate,omitempty"`
+	AdmissionQueue int64            `json:"admissionQueue,omitempty"`
+	Rooms          []roomSummary    `json:"rooms"`
+	History        *historySnapshot `json:"history,omitempty"`
+	Members        []memberSnapshot `json:"members"`
+	DeepestQueues  []queueSnapshot  `json:"deepestQueues"`
+	Config         configSnapshot   `json:"config"`
+}
+
+// historySnapshot is how full the message store is: Stored of its
+// Capacity messages across every room. It is left out with history off.
+type historySnapshot struct {
+	Backend  string `json:"backend"`
+	Capacity int    `json:"capacity"`
+	Stored   int    `json:"stored"`
+}
+
+// maxDeepestQueues is how many clients the snapshot lists by queue depth.
+const maxDeepestQueues = 10
+
+// queueSnapshot is a client's delivery backlog: its queued messages and,
+// with SEND_QUEUE_METRICS on, how long its last sampled message waited.
+type queueSnapshot struct {
+	ID            string `json:"id"`
+	Depth         int    `json:"depth"`
+	LastQueueWait string `json:"lastQueueWait,omitempty"`
+}
+
+type memberSnapshot struct {
+	ID            string    `json:"id"`
+	Nick          string    `json:"nick"`
+	Room          string    `json:"room"`
+	Transport     string    `json:"transport"`
+	Version       string    `json:"version"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	LastActive    time.Time `json:"lastActive"`
+	Subscriptions []string  `json:"subscriptions,omitempty"`
+}
+
+// configSnapshot is the non-secret subset of config. Tokens, secrets and
+// file paths are reduced to whether they are set.
+type configSnapshot struct {
+	OversizePolicy     string `json:"oversizePolicy"`
+	AdminAPI           bool   `json:"adminApi"`
+	AuthRequired       bool   `json:"authRequired"`
+	TokensRequired     bool   `json:"tokensRequired"`
+	StrictProtocol     bool   `json:"strictProtocol"`
+	StrictSenderOrder  bool   `json:"strictSenderOrder"`
+	SanitizeHTML       bool   `json:"sanitizeHtml"`
+	AnnounceJoinLeave  bool   `json:"announceJoinLeave"`
+	QuietHours         bool   `json:"quietHours"`
+	LinkPreviews       bool   `json:"linkPreviews"`
+	Schedule           bool   `json:"schedule"`
+	RegistrationQueue  int    `json:"registrationQueue"`
+	EgressBytesPerSec  int    `json:"egressBytesPerSec"`
+	AdmissionRate      int    `json:"admissionRate"`
+	BroadcastRate      int    `json:"broadcastRate"`
+	CompressMinClients int    `json:"compressMinClients"`
+	DeadLetterCapacity int    `json:"deadLetterCapacity"`
+	MemoryHighWater    int    `json:"memoryHighWater"`
+	DedupWindow        string `json:"dedupWindow"`
+	ReadGrace          string `json:"readGrace"`
+}
+
+// snapshot captures the hub's state. It must only be called from Run.
+func (h *hub) snapshot() hubSnapshot {
+	snap := hubSnapshot{
+		Time:           h.now(),
+		Clients:        len(h.clients),
+		Maintenance:    h.maintenance.Load(),
+		Compression:    h.compress.Load(),
+		Overloaded:     h.overloaded.Load(),
+		BroadcastQueue: len(h.broadcast),
+		DirectQueue:    len(h.direct),
+		RegisterQueue:  len(h.register),
+		AdmissionRate:  h.admission.currentRate(),
+		Members:        make([]memberSnapshot, 0, len(h.clients)),
+		Config: configSnapshot{
+			OversizePolicy:     h.cfg.oversizePolicy,
+			AdminAPI:           h.cfg.adminToken != "",
+			AuthRequired:       h.cfg.authSecret != "",
+			TokensRequired:     h.tokensRequired(),
+			StrictProtocol:     h.cfg.strictProtocol,
+			StrictSenderOrder:  h.cfg.strictSenderOrder,
+			SanitizeHTML:       h.cfg.sanitizeHTML,
+			AnnounceJoinLeave:  h.cfg.announceJoinLeave,
+			QuietHours:         h.cfg.quietHours != nil,
+			LinkPreviews:       h.cfg.linkPreviews,
+			Schedule:           h.cfg.scheduleFile != "",
+			RegistrationQueue:  h.cfg.registrationQueue,
+			EgressBytesPerSec:  h.cfg.egressBytesPerSec,
+			AdmissionRate:      h.cfg.admissionRate,
+			BroadcastRate:      h.cfg.broadcastRate,
+			CompressMinClients: h.cfg.compressMinClients,
+			DeadLetterCapacity: h.cfg.deadLetterCapacity,
+			MemoryHighWater:    h.cfg.memoryHighWater,
+			DedupWindow:        h.cfg.dedupWindow.String(),
+			ReadGrace:          h.cfg.readGrace.String(),
+		},
+	}
+	if h.admission != nil {
+		snap.AdmissionQueue = h.admission.waiting.Load()
+	}
+	snap.Rooms = h.roomSummaries()
+	sort.Slice(snap.Rooms, func(i, j int) bool { return snap.Rooms[i].Name < snap.Rooms[j].Name })
+	if h.history != nil {
+		snap.History = &historySnapshot{Backend: h.cfg.historyStore, Capacity: h.cfg.historySize, Stored: h.history.size()}
+	}
+	for _, c := range h.order {
+		m := h.clients[c]
+		transport := "websocket"
+		if _, ok := c.(*pollClient); ok {
+			transport = "longpoll"
+		}
+		var subs []string
+		for t := range m.subscriptions {
+			subs = append(subs, t)
+		}
+		sort.Strings(subs)
+		snap.Members = append(snap.Members, memberSnapshot{
+			ID:            c.ID(),
+			Nick:          m.nick,
+			Room:          m.room,
+			Transport:     transport,
+			Version:       m.version,
+			ConnectedAt:   m.connectedAt,
+			LastActive:    m.lastActive,
+			Subscriptions: subs,
+		})
+	}
+	snap.DeepestQueues = h.deepestQueues()
+	return snap
+}
+
+// deepestQueues lists the clients with the most queued messages, deepest
+// first, leaving out those with empty queues. It must only be called from
+// Run.
+func (h *hub) deepestQueues() []queueSnapshot {
+	queues := []queueSnapshot{}
+	for _, c := range h.order {
+		r, ok := c.(queueReporter)
+		if !ok {
+			continue
+		}
+		depth := r.queueDepth()
+		if depth == 0 {
+			continue
+		}
+		q := queueSnapshot{ID: c.ID(), Depth: depth}
+		if wait := r.lastQueueWait(); wait > 0 {
+			q.LastQueueWait = wait.String()
+		}
+		queues = append(queues, q)
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Depth > queues[j].Depth })
+	if len(queues) > maxDeepestQueues {
+		queues = queues[:maxDeepestQueues]
+	}
+	return queues
+}
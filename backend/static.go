@@ -0,0 +1,34 @@
+package main
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+	"os"
+)
+
+// fallbackPage is served in place of the app when STATIC_DIR is missing,
+// so a misconfigured deploy says so instead of returning 404 for
+// everything.
+//
+//go:embed fallback.html
+var fallbackPage []byte
+
+// staticHandler serves the frontend build in dir, or the fallback page if
+// dir doesn't exist or isn't a directory.
+func staticHandler(dir string) http.Handler {
+	info, err := os.Stat(dir)
+	if err == nil && info.IsDir() {
+		return http.FileServer(http.Dir(dir))
+	}
+	if err == nil {
+		log.Printf("warning: STATIC_DIR %s is not a directory; serving fallback page", dir)
+	} else {
+		log.Printf("warning: STATIC_DIR unavailable (%v); serving fallback page", err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(fallbackPage)
+	})
+}
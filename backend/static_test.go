@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// staticTestGet fetches path from staticHandler(dir).
+func staticTestGet(dir, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	staticHandler(dir).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestStaticFallsBackWhenDirMissing(t *testing.T) {
+	dir := t.TempDir()
+	notDir := filepath.Join(dir, "file")
+	if err := os.WriteFile(notDir, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, bad := range map[string]string{
+		"Missing": filepath.Join(dir, "missing"),
+		"NotADir": notDir,
+	} {
+		for _, path := range []string{"/", "/app.js"} {
+			if status, body := staticTestGet(bad, path); status != http.StatusOK || body != string(fallbackPage) {
+				t.Errorf("%s: GET %s answered %d without the fallback page", name, path, status)
+			}
+		}
+	}
+}
+
+func TestStaticServesDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("the app"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := staticTestGet(dir, "/"); status != http.StatusOK || body != "the app" {
+		t.Errorf("GET / answered %d %q, want the app's index", status, body)
+	}
+	if status, _ := staticTestGet(dir, "/missing.js"); status != http.StatusNotFound {
+		t.Errorf("a missing file in a real build answered %d, want %d", status, http.StatusNotFound)
+	}
+}
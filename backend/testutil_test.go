@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient is a Client that queues what it is sent in memory. Once
+// stalled it rejects every Send, like a transport whose queue is full.
+type testClient struct {
+	id string
+
+	mu      sync.Mutex
+	msgs    []string
+	stalled bool
+	closes  int
+	reason  closeReason
+}
+
+func newTestClient(id string) *testClient {
+	return &testClient{id: id}
+}
+
+func (c *testClient) ID() string { return c.id }
+
+func (c *testClient) Send(msgType string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stalled {
+		return errSlowClient
+	}
+	c.msgs = append(c.msgs, msgType)
+	return nil
+}
+
+func (c *testClient) Close(reason closeReason) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closes++
+	c.reason = reason
+}
+
+// stall makes every later Send fail.
+func (c *testClient) stall() {
+	c.mu.Lock()
+	c.stalled = true
+	c.mu.Unlock()
+}
+
+// closed returns how many times the hub closed c and the last reason.
+func (c *testClient) closed() (int, closeReason) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closes, c.reason
+}
+
+// received returns the types of the messages c was sent.
+func (c *testClient) received() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.msgs...)
+}
+
+// testConfig is the default configuration with the hub's own background
+// work turned off, so tests only see the traffic they cause. Panics exit,
+// which fails the test rather than letting Run carry on.
+func testConfig() config {
+	cfg := defaultConfig()
+	cfg.hubPanicPolicy = hubPanicExit
+	cfg.fanOutOffloadMinClients = 0
+	return cfg
+}
+
+// startTestHub runs a hub for cfg.
+func startTestHub(t *testing.T, cfg config) *hub {
+	t.Helper()
+	h := NewHub(cfg)
+	go h.Run()
+	return h
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// registerTestClients registers n test clients and waits for Run to
+// admit them all.
+func registerTestClients(t *testing.T, h *hub, n int) []*testClient {
+	t.Helper()
+	want := h.clientCount.Load() + int64(n)
+	clients := make([]*testClient, n)
+	for i := range clients {
+		clients[i] = newTestClient(randomID())
+		h.register <- clients[i]
+	}
+	waitFor(t, "clients to register", func() bool { return h.clientCount.Load() == want })
+	return clients
+}
+
+// newTestServer runs a hub for cfg behind the websocket and long-poll
+// endpoints and returns it with the server's base URL. On cleanup it
+// checks that every connection's goroutines have exited.
+func newTestServer(t *testing.T, cfg config) (*hub, string) {
+	t.Helper()
+	h := startTestHub(t, cfg)
+	return h, serveTestHub(t, h)
+}
+
+// serveTestHub is newTestServer for a hub the test has already started,
+// returning the base URL.
+func serveTestHub(t *testing.T, h *hub) string {
+	t.Helper()
+	polls := newPollSessions(h)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWebsocket(h, w, r)
+	})
+	mux.HandleFunc("/api/poll", pollHandler(polls))
+	mux.HandleFunc("/api/send", sendHandler(polls))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+		checkNoConnLeaks(t)
+	})
+	return srv.URL
+}
+
+// connGoroutines are the functions a connection runs goroutines in. The
+// hub's own goroutines are left out: Run never returns, so every test hub
+// outlives its test.
+var connGoroutines = []string{"(*client).readPump", "(*client).writePump"}
+
+// checkNoConnLeaks fails the test if any connection goroutine is still
+// running a second after the server closed.
+func checkNoConnLeaks(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		leaked := ""
+		for _, g := range strings.Split(string(stacks), "\n\n") {
+			for _, fn := range connGoroutines {
+				if strings.Contains(g, fn) {
+					leaked = g
+				}
+			}
+		}
+		if leaked == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("connection goroutine still running after the server closed:\n%s", leaked)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testConn is a websocket connection to a test server. A reader
+// goroutine decodes what arrives, since a gorilla connection is unusable
+// after a read times out.
+type testConn struct {
+	t    *testing.T
+	conn *websocket.Conn
+	in   chan message
+}
+
+// dialTestClient connects to the test server at base, joining room and
+// presenting a bearer token if they aren't empty.
+func dialTestClient(t *testing.T, base, room, token string) *testConn {
+	t.Helper()
+	q := url.Values{}
+	if room != "" {
+		q.Set("room", room)
+	}
+	if token != "" {
+		q.Set("token", token)
+	}
+	u := "ws" + strings.TrimPrefix(base, "http") + "/ws?" + q.Encode()
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", u, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testConn{t: t, conn: conn, in: make(chan message, 256)}
+	go func() {
+		defer close(c.in)
+		for {
+			var msg message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			c.in <- msg
+		}
+	}()
+	return c
+}
+
+// Send writes msg as JSON.
+func (c *testConn) Send(msg message) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+// Recv returns the next message, or false if none arrives within wait
+// or the connection has closed.
+func (c *testConn) Recv(wait time.Duration) (message, bool) {
+	select {
+	case msg, ok := <-c.in:
+		return msg, ok
+	case <-time.After(wait):
+		return message{}, false
+	}
+}
+
+// RecvAll returns every message that arrives until the connection has
+// been quiet for wait.
+func (c *testConn) RecvAll(wait time.Duration) []message {
+	var msgs []message
+	for {
+		msg, ok := c.Recv(wait)
+		if !ok {
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
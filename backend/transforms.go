@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"strings"
+	"time"
+)
+
+// messageTransform is one step of the pipeline a client's message goes
+// through before broadcast. It may rewrite or annotate msg, or reject it
+// by returning errDropMessage or a *rejection.
+type messageTransform func(c *client, msg *message) error
+
+// errDropMessage rejects a message without telling the sender, for input
+// that is empty or best effort anyway.
+var errDropMessage = errors.New("message dropped")
+
+// rejection rejects a message and tells the sender why: as a system
+// notice, or as a nack of the message's id when nack is set.
+type rejection struct {
+	key  string
+	nack bool
+}
+
+func (r *rejection) Error() string { return r.key }
+
+func notifyReject(key string) error { return &rejection{key: key} }
+func nackReject(key string) error   { return &rejection{key: key, nack: true} }
+
+// defaultTransforms is the pipeline every hub starts with. Order matters:
+// the type-specific rules run first, and the message is only given an id
+// and stamped once nothing earlier has rejected it.
+func defaultTransforms() []messageTransform {
+	return []messageTransform{
+		rejectWhenOverloaded,
+		floodControl,
+		firstMessageGate,
+		rulesGate,
+		runCommands,
+		normalizeRules,
+		chatRules,
+		attachmentRules,
+		composeRules,
+		encryptedRules,
+		typingRules,
+		mergeMetaUpdate,
+		assignID,
+		replyRules,
+		rejectDuplicateChat,
+		moderationRules,
+		stampSender,
+	}
+}
+
+// applyTransforms runs msg through the hub's pipeline, stopping at the
+// first transform that rejects it. It returns that transform's error, or
+// nil if msg survived.
+func (c *client) applyTransforms(msg *message) error {
+	for _, t := range c.hub.transforms {
+		err := t(c, msg)
+		if err == nil {
+			continue
+		}
+		var r *rejection
+		if errors.As(err, &r) {
+			if r.nack {
+				c.nack(msg.ID, r.key)
+			} else {
+				c.notify(r.key)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// rateLimited reports whether a transform rejected a message for going
+// over the chat rate.
+func rateLimited(err error) bool {
+	var r *rejection
+	return errors.As(err, &r) && (r.key == msgFloodWarning || r.key == msgCooldown)
+}
+
+// floodControl applies the chat rate limit with a graduated response:
+// a warning, then a cooldown, then a disconnect. Chat sent during a
+// cooldown is an offense in its own right.
+func floodControl(c *client, msg *message) error {
+	cfg := c.hub.cfg
+	if cfg.chatRate <= 0 || (msg.Type != "chat" && msg.Type != "encrypted") {
+		return nil
+	}
+	now := time.Now()
+	if c.chatLimit == nil {
+		c.chatLimit = newTokenBucket(float64(cfg.chatRate), float64(max(cfg.chatBurst, 1)), now)
+	}
+	cooling := now.Before(c.cooldownUntil)
+	if !cooling && c.chatLimit.allow(now) {
+		return nil
+	}
+
+	if now.Sub(c.firstOffense) > cfg.floodWindow {
+		c.offenses, c.firstOffense = 0, now
+	}
+	c.offenses++
+	switch {
+	case c.offenses >= cfg.floodMaxOffenses:
+		c.disconnectRateLimited()
+		return errDropMessage
+	case cooling:
+		return notifyReject(msgCooldown)
+	case c.offenses == 1:
+		return notifyReject(msgFloodWarning)
+	default:
+		c.cooldownUntil = now.Add(cfg.floodCooldown)
+		return notifyReject(msgCooldown)
+	}
+}
+
+// firstMessageGate rejects chat from a connection younger than
+// firstMessageDelay. Once the delay has passed the gate stays open.
+func firstMessageGate(c *client, msg *message) error {
+	delay := c.hub.cfg.firstMessageDelay
+	if c.gateCleared || delay <= 0 || (msg.Type != "chat" && msg.Type != "encrypted") {
+		return nil
+	}
+	if time.Since(c.connectedAt) < delay {
+		return notifyReject(msgNotYetAllowed)
+	}
+	c.gateCleared = true
+	return nil
+}
+
+// rulesGate rejects chat from a client that hasn't accepted the rules of
+// its room, if the room has any.
+func rulesGate(c *client, msg *message) error {
+	if c.rulesAccepted[c.room] || c.hub.cfg.rulesFor(c.room) == "" || (msg.Type != "chat" && msg.Type != "encrypted") {
+		return nil
+	}
+	return notifyReject(msgRulesPending)
+}
+
+func chatRules(c *client, msg *message) error {
+	if msg.Type != "chat" {
+		return nil
+	}
+	msg.Text = strings.TrimSpace(msg.Text)
+	if msg.Text == "" && len(msg.Attachments) == 0 {
+		return errDropMessage
+	}
+	if c.hub.maintenance.Load() {
+		return notifyReject(msgMaintenanceOn)
+	}
+	if c.hub.cfg.sanitizeHTML {
+		// Escape rather than strip so "<" and ">" used as punctuation
+		// survive as text.
+		msg.Text = html.EscapeString(msg.Text)
+	}
+	if msg.DraftID != "" {
+		c.finishDraft(msg.DraftID)
+	}
+	return nil
+}
+
+// composeRules passes a compose, a preview of the chat with the same
+// draft id. The chat replaces it, so previews are best effort.
+func composeRules(c *client, msg *message) error {
+	if msg.Type != "compose" {
+		return nil
+	}
+	if msg.DraftID == "" || c.hub.maintenance.Load() || !c.allowCompose(msg.DraftID, time.Now()) {
+		return errDropMessage
+	}
+	if c.hub.cfg.sanitizeHTML {
+		msg.Text = html.EscapeString(msg.Text)
+	}
+	return nil
+}
+
+// encryptedRules passes end-to-end ciphertext untouched, with no
+// trimming, escaping or truncation.
+func encryptedRules(c *client, msg *message) error {
+	if msg.Type != "encrypted" {
+		return nil
+	}
+	if msg.Text == "" {
+		return errDropMessage
+	}
+	if c.hub.maintenance.Load() {
+		return notifyReject(msgMaintenanceOn)
+	}
+	return nil
+}
+
+func typingRules(c *client, msg *message) error {
+	if msg.Type != "typing" {
+		return nil
+	}
+	switch msg.Typing {
+	case "start":
+		c.startTyping()
+	case "stop":
+		if c.typingTimer != nil {
+			c.typingTimer.Stop()
+		}
+	default:
+		return errDropMessage
+	}
+	msg.Text = ""
+	return nil
+}
+
+// mergeMetaUpdate folds a meta message into the client's metadata and
+// broadcasts the full result, or nothing if it changed nothing.
+func mergeMetaUpdate(c *client, msg *message) error {
+	if msg.Type != "meta" {
+		return nil
+	}
+	changed, key := c.mergeMeta(msg.Meta)
+	if key != "" {
+		return notifyReject(key)
+	}
+	if !changed {
+		return errDropMessage
+	}
+	msg.Meta = make(map[string]string, len(c.meta))
+	for k, v := range c.meta {
+		msg.Meta[k] = v
+	}
+	return nil
+}
+
+func assignID(c *client, msg *message) error {
+	if msg.ID == "" {
+		msg.ID = c.hub.idGen()
+	}
+	return nil
+}
+
+// replyRules resolves a chat's replyTo against its room's history. It
+// runs once the message has its final id, refusing a message that names
+// itself, one that would go deeper than maxReplyDepth and, unless
+// danglingReplies is set, one whose parent history doesn't hold. A reply
+// to a known parent carries the start of its text.
+func replyRules(c *client, msg *message) error {
+	if msg.Type != "chat" || msg.ReplyTo == "" {
+		return nil
+	}
+	if msg.ReplyTo == msg.ID {
+		return notifyReject(msgSelfReply)
+	}
+	if c.hub.history == nil {
+		return nil
+	}
+	parent, ok := c.hub.history.get(c.room, msg.ReplyTo)
+	if !ok {
+		if c.hub.cfg.danglingReplies {
+			return nil
+		}
+		return notifyReject(msgReplyMissing)
+	}
+	if limit := c.hub.cfg.maxReplyDepth; limit > 0 && parent.depth+1 > limit {
+		return notifyReject(msgReplyTooDeep)
+	}
+	if n := c.hub.cfg.replyQuoteLength; n > 0 {
+		var p message
+		if json.Unmarshal(parent.data, &p) == nil {
+			msg.Quote = quoteOf(p.Text, n)
+		}
+	}
+	return nil
+}
+
+// replyDepth returns the depth in its reply chain of a chat in room
+// replying to replyTo, from the depth history cached for the parent. A
+// parent history doesn't hold counts as the start of a chain.
+func (h *hub) replyDepth(room, replyTo string) int {
+	if replyTo == "" {
+		return 0
+	}
+	if h.history != nil {
+		if parent, ok := h.history.get(room, replyTo); ok {
+			return parent.depth + 1
+		}
+	}
+	return 1
+}
+
+// quoteOf returns the first n characters of text, with an ellipsis if it
+// goes on.
+func quoteOf(text string, n int) string {
+	r := []rune(text)
+	if len(r) <= n {
+		return text
+	}
+	return string(r[:n]) + "…"
+}
+
+func rejectDuplicateChat(c *client, msg *message) error {
+	if msg.Type == "chat" && msg.Text != "" && c.isDuplicate(msg.Text, time.Now()) {
+		return nackReject(msgDuplicate)
+	}
+	return nil
+}
+
+// stampSender records who sent msg, where and when. It comes last so
+// senderSeq only counts messages that are actually broadcast. User is
+// always overwritten, so only a verified client can claim one.
+func stampSender(c *client, msg *message) error {
+	msg.Sender = c.id
+	msg.User = c.user
+	msg.Room = c.room
+	msg.ServerTime = c.hub.serverTime()
+	if c.hub.cfg.strictSenderOrder {
+		c.senderSeq++
+		msg.SenderSeq = c.senderSeq
+	}
+	return nil
+}
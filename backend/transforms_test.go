@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replyTestPair starts a server for cfg with two clients in the lobby,
+// their welcomes drained.
+func replyTestPair(t *testing.T, cfg config) (*hub, *testConn, *testConn) {
+	t.Helper()
+	h, base := newTestServer(t, cfg)
+	sender := dialTestClient(t, base, "", "")
+	receiver := dialTestClient(t, base, "", "")
+	sender.RecvAll(100 * time.Millisecond)
+	receiver.RecvAll(100 * time.Millisecond)
+	return h, sender, receiver
+}
+
+// sendTestParent sends a chat with id from c and waits for history to
+// hold it.
+func sendTestParent(t *testing.T, h *hub, c *testConn, id, text string) {
+	t.Helper()
+	c.Send(message{Type: "chat", ID: id, Text: text})
+	waitFor(t, "the parent to reach history", func() bool {
+		_, ok := h.history.get(defaultRoom, id)
+		return ok
+	})
+}
+
+// relayedChat returns the first chat among msgs.
+func relayedChat(msgs []message) (message, bool) {
+	for _, m := range msgs {
+		if m.Type == "chat" {
+			return m, true
+		}
+	}
+	return message{}, false
+}
+
+// refusedWith reports whether msgs include a notice with key.
+func refusedWith(msgs []message, key string) bool {
+	for _, m := range msgs {
+		if m.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingTransform appends name to *order and then returns err.
+func recordingTransform(order *[]string, name string, err error) messageTransform {
+	return func(c *client, msg *message) error {
+		*order = append(*order, name)
+		msg.Text += name
+		return err
+	}
+}
+
+func TestTransformChainStopsAtRejection(t *testing.T) {
+	h := NewHub(testConfig())
+	var order []string
+	h.transforms = []messageTransform{
+		recordingTransform(&order, "a", nil),
+		recordingTransform(&order, "b", errDropMessage),
+		recordingTransform(&order, "c", nil),
+	}
+	c := &client{id: "c1", hub: h}
+	msg := message{Type: "chat"}
+	if err := c.applyTransforms(&msg); !errors.Is(err, errDropMessage) {
+		t.Fatalf("applyTransforms returned %v, want the rejecting transform's error", err)
+	}
+	if strings.Join(order, "") != "ab" {
+		t.Errorf("transforms ran %v, want a and b only", order)
+	}
+}
+
+func TestTransformChainOrderMatters(t *testing.T) {
+	h := NewHub(testConfig())
+	c := &client{id: "c1", hub: h}
+	run := func(transforms ...messageTransform) message {
+		h.transforms = transforms
+		msg := message{Type: "chat", Text: "<b>"}
+		if err := c.applyTransforms(&msg); err != nil {
+			t.Fatalf("applyTransforms: %v", err)
+		}
+		return msg
+	}
+	wrap := func(c *client, msg *message) error {
+		msg.Text = "<i>" + msg.Text + "</i>"
+		return nil
+	}
+	escape := func(c *client, msg *message) error {
+		msg.Text = html.EscapeString(msg.Text)
+		return nil
+	}
+	if got := run(wrap, escape).Text; got != "&lt;i&gt;&lt;b&gt;&lt;/i&gt;" {
+		t.Errorf("wrap then escape gave %q", got)
+	}
+	if got := run(escape, wrap).Text; got != "<i>&lt;b&gt;</i>" {
+		t.Errorf("escape then wrap gave %q", got)
+	}
+}
+
+func TestReplyCarriesParentQuote(t *testing.T) {
+	cfg := testConfig()
+	cfg.replyQuoteLength = 5
+	h, sender, receiver := replyTestPair(t, cfg)
+	sendTestParent(t, h, sender, "parent", "the original")
+	receiver.RecvAll(100 * time.Millisecond)
+
+	sender.Send(message{Type: "chat", Text: "agreed", ReplyTo: "parent"})
+	got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond))
+	if !ok {
+		t.Fatal("receiver never got the reply")
+	}
+	if got.ReplyTo != "parent" || got.Quote != "the o…" {
+		t.Errorf("reply has replyTo %q quote %q, want parent and the o…", got.ReplyTo, got.Quote)
+	}
+}
+
+func TestReplyToUnknownIDRejected(t *testing.T) {
+	_, sender, receiver := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", Text: "what?", ReplyTo: "nowhere"})
+	if !refusedWith(sender.RecvAll(200*time.Millisecond), msgReplyMissing) {
+		t.Error("sender wasn't told the parent is missing")
+	}
+	if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+		t.Error("a reply to a missing parent was relayed")
+	}
+}
+
+func TestDanglingReplyAllowedWhenConfigured(t *testing.T) {
+	cfg := testConfig()
+	cfg.danglingReplies = true
+	_, sender, receiver := replyTestPair(t, cfg)
+	sender.Send(message{Type: "chat", Text: "what?", ReplyTo: "nowhere"})
+	got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond))
+	if !ok || got.ReplyTo != "nowhere" || got.Quote != "" {
+		t.Errorf("dangling reply relayed %t as %+v, want it kept with no quote", ok, got)
+	}
+}
+
+func TestSelfReplyRejected(t *testing.T) {
+	_, sender, receiver := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", ID: "loop", Text: "me again", ReplyTo: "loop"})
+	if !refusedWith(sender.RecvAll(200*time.Millisecond), msgSelfReply) {
+		t.Error("sender wasn't told a message can't reply to itself")
+	}
+	if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+		t.Error("a message replying to itself was relayed")
+	}
+}
+
+// sendTestChain sends a chain of n chats from c, each replying to the
+// one before once history holds it, and returns the last one's id.
+func sendTestChain(t *testing.T, h *hub, c *testConn, n int) string {
+	t.Helper()
+	parent := ""
+	for i := 1; i <= n; i++ {
+		id := "link" + strconv.Itoa(i)
+		c.Send(message{Type: "chat", ID: id, Text: id, ReplyTo: parent})
+		waitFor(t, "the chain to reach history", func() bool {
+			_, ok := h.history.get(defaultRoom, id)
+			return ok
+		})
+		parent = id
+	}
+	return parent
+}
+
+func TestReplyAtMaxDepthAllowed(t *testing.T) {
+	cfg := testConfig()
+	cfg.maxReplyDepth = 3
+	h, sender, receiver := replyTestPair(t, cfg)
+	// The root and three replies: the last is at depth 3.
+	last := sendTestChain(t, h, sender, 4)
+	if m, _ := h.history.get(defaultRoom, last); m.depth != 3 {
+		t.Errorf("history cached depth %d for the third reply, want 3", m.depth)
+	}
+	if refusedWith(sender.RecvAll(100*time.Millisecond), msgReplyTooDeep) {
+		t.Error("a reply at the maximum depth was refused")
+	}
+	receiver.RecvAll(50 * time.Millisecond)
+}
+
+func TestReplyBeyondMaxDepthRejected(t *testing.T) {
+	cfg := testConfig()
+	cfg.maxReplyDepth = 3
+	h, sender, receiver := replyTestPair(t, cfg)
+	last := sendTestChain(t, h, sender, 4)
+	sender.RecvAll(100 * time.Millisecond)
+	receiver.RecvAll(100 * time.Millisecond)
+
+	sender.Send(message{Type: "chat", Text: "one too many", ReplyTo: last})
+	if !refusedWith(sender.RecvAll(200*time.Millisecond), msgReplyTooDeep) {
+		t.Error("sender wasn't told the chain is too deep")
+	}
+	if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+		t.Error("a reply past the maximum depth was relayed")
+	}
+}
+
+func TestSanitizeHTMLEscapesChat(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sanitize bool
+		text     string
+		want     string
+	}{
+		{"Script", true, "<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"EventHandler", true, `<img src=x onerror="alert(1)">`, "&lt;img src=x onerror=&#34;alert(1)&#34;&gt;"},
+		{"Punctuation", true, "2 < 3 > 1 & done", "2 &lt; 3 &gt; 1 &amp; done"},
+		{"Off", false, "<b>hi</b>", "<b>hi</b>"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.sanitizeHTML = tc.sanitize
+			_, sender, receiver := replyTestPair(t, cfg)
+			sender.Send(message{Type: "chat", Text: tc.text})
+			got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond))
+			if !ok {
+				t.Fatal("receiver never got the chat")
+			}
+			if got.Text != tc.want {
+				t.Errorf("relayed %q, want %q", got.Text, tc.want)
+			}
+		})
+	}
+}
+
+func TestComposePreviewsEndWithFinalChat(t *testing.T) {
+	_, sender, receiver := replyTestPair(t, testConfig())
+	// previews returns the texts of the compose previews among msgs.
+	previews := func(msgs []message) []string {
+		var texts []string
+		for _, m := range msgs {
+			if m.Type == "compose" && m.DraftID == "d1" {
+				texts = append(texts, m.Text)
+			}
+		}
+		return texts
+	}
+
+	sender.Send(message{Type: "compose", DraftID: "d1", Text: "he"})
+	sender.Send(message{Type: "compose", DraftID: "d1", Text: "hel"})
+	if got := previews(receiver.RecvAll(100 * time.Millisecond)); len(got) != 1 || got[0] != "he" {
+		t.Fatalf("previews %q, want he alone with the second throttled", got)
+	}
+
+	time.Sleep(composeInterval)
+	sender.Send(message{Type: "compose", DraftID: "d1", Text: "hell"})
+	sender.Send(message{Type: "chat", DraftID: "d1", Text: "hello"})
+	msgs := receiver.RecvAll(100 * time.Millisecond)
+	if got := previews(msgs); len(got) != 1 || got[0] != "hell" {
+		t.Errorf("previews %q after the throttle window, want hell", got)
+	}
+	final, ok := relayedChat(msgs)
+	if !ok || final.DraftID != "d1" || final.Text != "hello" {
+		t.Fatalf("final chat %+v, want hello for draft d1", final)
+	}
+
+	time.Sleep(composeInterval)
+	sender.Send(message{Type: "compose", DraftID: "d1", Text: "hello!"})
+	if got := previews(receiver.RecvAll(100 * time.Millisecond)); len(got) != 0 {
+		t.Errorf("previews %q forwarded after the final chat", got)
+	}
+}
+
+func TestEncryptedPassesThroughUntouched(t *testing.T) {
+	cfg := testConfig()
+	cfg.sanitizeHTML = true
+	cfg.normalizeText = true
+	_, sender, receiver := replyTestPair(t, cfg)
+	// Not real ciphertext: text any content filter would change.
+	ciphertext := "  <b>c2VjcmV0</b>\u200b\n\n\n\n  "
+	sender.Send(message{Type: "encrypted", Text: ciphertext})
+
+	var got *message
+	for _, m := range receiver.RecvAll(200 * time.Millisecond) {
+		if m.Type == "encrypted" {
+			m := m
+			got = &m
+		}
+	}
+	if got == nil {
+		t.Fatal("receiver never got the encrypted message")
+	}
+	if got.Text != ciphertext {
+		t.Errorf("ciphertext relayed as %q, want it unchanged", got.Text)
+	}
+	if got.ID == "" || got.Sender == "" || len(got.ServerTime) == 0 {
+		t.Errorf("encrypted message relayed with id %q sender %q serverTime %s, want all assigned", got.ID, got.Sender, got.ServerTime)
+	}
+}
+
+func TestDuplicateChatWindow(t *testing.T) {
+	cfg := testConfig()
+	cfg.dedupWindow = 5 * time.Second
+	c := &client{id: "c1", hub: NewHub(cfg)}
+	now := time.Now()
+	if c.isDuplicate("hello world", now) {
+		t.Fatal("the first chat counted as a duplicate")
+	}
+	if !c.isDuplicate("  Hello   WORLD ", now.Add(time.Second)) {
+		t.Error("a rapid repeat differing only in case and spacing wasn't caught")
+	}
+	if c.isDuplicate("hello there", now.Add(time.Second)) {
+		t.Error("different text counted as a duplicate")
+	}
+	if c.isDuplicate("hello world", now.Add(6*time.Second)) {
+		t.Error("the same text after the window counted as a duplicate")
+	}
+
+	off := &client{id: "c2", hub: NewHub(testConfig())}
+	if off.isDuplicate("hi", now) || off.isDuplicate("hi", now) {
+		t.Error("duplicates caught with the window off")
+	}
+}
+
+func TestDuplicateChatNacked(t *testing.T) {
+	cfg := testConfig()
+	cfg.dedupWindow = time.Minute
+	_, sender, receiver := replyTestPair(t, cfg)
+	sender.Send(message{Type: "chat", ID: "m1", Text: "buy now"})
+	sender.Send(message{Type: "chat", ID: "m2", Text: "buy now"})
+	var nacked bool
+	for _, m := range sender.RecvAll(200 * time.Millisecond) {
+		if m.Type == "nack" && m.ID == "m2" && m.Key == msgDuplicate {
+			nacked = true
+		}
+	}
+	if !nacked {
+		t.Error("sender wasn't nacked for the duplicate")
+	}
+	var relayed []string
+	for _, m := range receiver.RecvAll(100 * time.Millisecond) {
+		if m.Type == "chat" {
+			relayed = append(relayed, m.ID)
+		}
+	}
+	if len(relayed) != 1 || relayed[0] != "m1" {
+		t.Errorf("relayed %v, want only m1", relayed)
+	}
+}
+
+func TestTypingStopsAutomatically(t *testing.T) {
+	cfg := testConfig()
+	cfg.typingTimeout = 100 * time.Millisecond
+	_, sender, receiver := replyTestPair(t, cfg)
+	start := time.Now()
+	sender.Send(message{Type: "typing", Typing: "start"})
+
+	var states []string
+	for deadline := time.After(time.Second); len(states) < 2; {
+		select {
+		case m := <-receiver.in:
+			if m.Type == "typing" {
+				states = append(states, m.Typing)
+			}
+		case <-deadline:
+			t.Fatalf("receiver saw typing %v, want start then an automatic stop", states)
+		}
+	}
+	if states[0] != "start" || states[1] != "stop" {
+		t.Errorf("receiver saw typing %v, want start then stop", states)
+	}
+	if took := time.Since(start); took < cfg.typingTimeout {
+		t.Errorf("stop arrived after %v, before the %v timeout", took, cfg.typingTimeout)
+	}
+}
+
+func TestFirstMessageGate(t *testing.T) {
+	cfg := testConfig()
+	cfg.firstMessageDelay = time.Second
+	_, sender, receiver := replyTestPair(t, cfg)
+
+	sender.Send(message{Type: "chat", Text: "too soon"})
+	if !refusedWith(sender.RecvAll(100*time.Millisecond), msgNotYetAllowed) {
+		t.Error("a chat before the gate cleared wasn't refused")
+	}
+	if _, ok := relayedChat(receiver.RecvAll(50 * time.Millisecond)); ok {
+		t.Error("a chat before the gate cleared was relayed")
+	}
+
+	time.Sleep(cfg.firstMessageDelay)
+	sender.Send(message{Type: "chat", Text: "now"})
+	if got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond)); !ok || got.Text != "now" {
+		t.Errorf("after the gate the room got %+v, want the chat", got)
+	}
+}
+
+func TestTypingIndicatorsAggregatedPastCap(t *testing.T) {
+	cfg := testConfig()
+	cfg.maxTypingIndicators = 2
+	_, base := newTestServer(t, cfg)
+	observer := dialTestClient(t, base, "", "")
+	typers := make([]*testConn, 3)
+	for i := range typers {
+		typers[i] = dialTestClient(t, base, "", "")
+	}
+	for _, c := range append(typers, observer) {
+		c.RecvAll(100 * time.Millisecond)
+	}
+	// typing describes the typing events observer gets next: "start" for
+	// an individual one and the count for an aggregate.
+	typing := func() []string {
+		var got []string
+		for _, m := range observer.RecvAll(150 * time.Millisecond) {
+			switch {
+			case m.Type == "typing" && m.Count > 0:
+				got = append(got, strconv.Itoa(m.Count))
+			case m.Type == "typing":
+				got = append(got, m.Typing)
+			}
+		}
+		return got
+	}
+
+	for i := 0; i < 2; i++ {
+		typers[i].Send(message{Type: "typing", Typing: "start"})
+		if got := typing(); len(got) != 1 || got[0] != "start" {
+			t.Fatalf("typer %d within the cap showed %v, want its own start", i+1, got)
+		}
+	}
+	typers[2].Send(message{Type: "typing", Typing: "start"})
+	if got := typing(); len(got) != 1 || got[0] != "3" {
+		t.Fatalf("a third typer past the cap of 2 showed %v, want the count 3", got)
+	}
+	typers[2].Send(message{Type: "typing", Typing: "stop"})
+	if got := strings.Join(typing(), ","); got != "start,start,stop" {
+		t.Errorf("falling back to the cap showed %s, want the two typers re-announced, then the stop", got)
+	}
+}
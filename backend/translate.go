@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	translationTimeout = 10 * time.Second
+	translationWorkers = 2
+	translationQueue   = 32
+
+	// maxTranslationLanguages caps the translations made per chat, so a
+	// room with many languages can't multiply the outbound API calls
+	// without bound.
+	maxTranslationLanguages = 8
+)
+
+// translator turns text into the language lang, a lowercase tag such as
+// "fr". Implementations wrap a translation provider.
+type translator interface {
+	translate(ctx context.Context, text, lang string) (string, error)
+}
+
+// translation is broadcast after a chat once its text has been
+// translated, referring back to the chat by id.
+type translation struct {
+	MessageID string `json:"messageId"`
+	Lang      string `json:"lang"`
+	Text      string `json:"text"`
+}
+
+type translationRequest struct {
+	messageID string
+	room      string
+	text      string
+}
+
+// translationService translates chat into the languages connected
+// clients have declared, on a fixed pool of workers. Requests beyond the
+// queue are dropped.
+type translationService struct {
+	hub        *hub
+	translator translator
+	requests   chan translationRequest
+
+	// langs counts connected clients per language.
+	mu    sync.Mutex
+	langs map[string]int
+}
+
+// newTranslationService starts the worker pool, or returns nil if no
+// translator is configured.
+func newTranslationService(h *hub, tr translator) *translationService {
+	if tr == nil {
+		return nil
+	}
+	s := &translationService{
+		hub:        h,
+		translator: tr,
+		requests:   make(chan translationRequest, translationQueue),
+		langs:      make(map[string]int),
+	}
+	for i := 0; i < translationWorkers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// language reduces a locale to the language translations are made for.
+func language(locale string) string {
+	lang, _, _ := strings.Cut(locale, "-")
+	return lang
+}
+
+// join counts a client reading in locale. A nil service does nothing.
+func (s *translationService) join(locale string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.langs[language(locale)]++
+	s.mu.Unlock()
+}
+
+// leave undoes join.
+func (s *translationService) leave(locale string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lang := language(locale)
+	if s.langs[lang]--; s.langs[lang] <= 0 {
+		delete(s.langs, lang)
+	}
+}
+
+// languages returns the most common languages among connected clients,
+// at most maxTranslationLanguages of them.
+func (s *translationService) languages() []string {
+	s.mu.Lock()
+	langs := make([]string, 0, len(s.langs))
+	for lang := range s.langs {
+		langs = append(langs, lang)
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		if s.langs[langs[i]] != s.langs[langs[j]] {
+			return s.langs[langs[i]] > s.langs[langs[j]]
+		}
+		return langs[i] < langs[j]
+	})
+	s.mu.Unlock()
+	if len(langs) > maxTranslationLanguages {
+		langs = langs[:maxTranslationLanguages]
+	}
+	return langs
+}
+
+// request queues the text of a chat sent in room for translation. The
+// translations go to that room only. A nil service does nothing.
+func (s *translationService) request(messageID, room, text string) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.requests <- translationRequest{messageID: messageID, room: room, text: text}:
+	default:
+		log.Printf("translation queue full, skipping message %s", messageID)
+	}
+}
+
+func (s *translationService) work() {
+	for req := range s.requests {
+		for _, lang := range s.languages() {
+			s.translateOne(req, lang)
+		}
+	}
+}
+
+func (s *translationService) translateOne(req translationRequest, lang string) {
+	ctx, cancel := context.WithTimeout(context.Background(), translationTimeout)
+	defer cancel()
+	// Chat text may already be HTML-escaped; translate what the user wrote.
+	source := req.text
+	if s.hub.cfg.sanitizeHTML {
+		source = html.UnescapeString(source)
+	}
+	text, err := s.translator.translate(ctx, source, lang)
+	if err != nil {
+		log.Printf("translating message %s to %s failed: %v", req.messageID, lang, err)
+		return
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || text == source || len(text) > maxTextBytes {
+		return
+	}
+	if s.hub.cfg.sanitizeHTML {
+		text = html.EscapeString(text)
+	}
+
+	h := s.hub
+	msg := message{
+		Type:        "translation",
+		ID:          h.idGen(),
+		ServerTime:  h.serverTime(),
+		Room:        req.room,
+		Translation: &translation{MessageID: req.messageID, Lang: lang, Text: text},
+	}
+	data, err := encode(msg, "translation")
+	if err != nil {
+		return
+	}
+	h.broadcast <- envelope{msgType: msg.Type, msgID: msg.ID, data: data, room: req.room}
+}
+
+// httpTranslator calls an external translation API that accepts
+// {"text","target"} and answers {"text"}.
+type httpTranslator struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPTranslator(url string) *httpTranslator {
+	return &httpTranslator{url: url, client: &http.Client{Timeout: translationTimeout}}
+}
+
+func (t *httpTranslator) translate(ctx context.Context, text, lang string) (string, error) {
+	body, err := json.Marshal(map[string]string{"text": text, "target": lang})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	var out struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxMessage)).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Text, nil
+}
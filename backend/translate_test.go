@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTranslator tags text with the language and records each call.
+type fakeTranslator struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeTranslator) translate(ctx context.Context, text, lang string) (string, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, lang+":"+text)
+	f.mu.Unlock()
+	return "[" + lang + "] " + text, nil
+}
+
+func (f *fakeTranslator) made() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func TestTranslationPerRecipientLanguage(t *testing.T) {
+	h := NewHub(testConfig())
+	fake := &fakeTranslator{}
+	h.translations = newTranslationService(h, fake)
+	go h.Run()
+	base := serveTestHub(t, h)
+
+	sender := dialTestClient(t, base, "", "")
+	var readers []*testConn
+	for _, locale := range []string{"fr", "fr-CA", "de"} {
+		c := dialTestClient(t, base, "", "")
+		c.Send(message{Type: "lang", Lang: locale})
+		syncTestConn(t, c)
+		readers = append(readers, c)
+	}
+	sender.Send(message{Type: "lang", Lang: "en"})
+	syncTestConn(t, sender)
+	for _, c := range readers {
+		c.RecvAll(50 * time.Millisecond)
+	}
+	sender.RecvAll(50 * time.Millisecond)
+
+	sender.Send(message{Type: "chat", Text: "hello"})
+	var chatID string
+	var langs []string
+	for _, m := range readers[0].RecvAll(300 * time.Millisecond) {
+		switch {
+		case m.Type == "chat":
+			chatID = m.ID
+		case m.Type == "translation" && m.Translation != nil:
+			if m.Translation.MessageID != chatID || m.Translation.Text != "["+m.Translation.Lang+"] hello" {
+				t.Errorf("translation %+v doesn't match chat %s", m.Translation, chatID)
+			}
+			langs = append(langs, m.Translation.Lang)
+		}
+	}
+	sort.Strings(langs)
+	if got := strings.Join(langs, ","); got != "de,en,fr" {
+		t.Errorf("translations were made into %q, want one per language, de,en,fr", got)
+	}
+
+	before := len(fake.made())
+	sender.Send(message{Type: "encrypted", Text: "b3BhcXVl"})
+	readers[0].RecvAll(200 * time.Millisecond)
+	if calls := fake.made(); len(calls) != before {
+		t.Errorf("encrypted message was translated: %v", calls[before:])
+	}
+}
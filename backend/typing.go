@@ -0,0 +1,88 @@
+package main
+
+// routeTyping tracks who is typing and decides how a typing event is
+// shown. While at most maxTypingIndicators clients are typing, events are
+// fanned out individually and routeTyping returns true. Past the cap,
+// individual events are withheld and Run instead broadcasts the number of
+// typers whenever it changes. When the count falls back to the cap, the
+// remaining typers are re-announced individually; clients treat any
+// individual typing event as the end of the aggregate. It must only be
+// called from Run.
+func (h *hub) routeTyping(msg envelope) bool {
+	limit := h.cfg.maxTypingIndicators
+	if limit <= 0 {
+		return true
+	}
+	m, ok := h.clients[msg.sender]
+	if !ok {
+		// The stop a departing client's reader sends arrives after it
+		// was removed, which already updated the count.
+		return h.typers[msg.room] <= limit
+	}
+	before := h.typers[m.room]
+	h.setTyping(m, msg.typing == "start")
+	return h.typersChanged(m.room, before)
+}
+
+// setTyping records whether m is typing, keeping its room's count in
+// h.typers in step. It must only be called from Run.
+func (h *hub) setTyping(m *member, typing bool) {
+	if m.typing == typing {
+		return
+	}
+	m.typing = typing
+	if typing {
+		h.typers[m.room]++
+	} else {
+		h.typers[m.room]--
+	}
+}
+
+// typersChanged broadcasts to room whatever the move from before typers
+// to its current count calls for, and reports whether individual events
+// are being shown. It must only be called from Run.
+func (h *hub) typersChanged(room string, before int) bool {
+	limit := h.cfg.maxTypingIndicators
+	switch now := h.typers[room]; {
+	case now > limit:
+		if now != before {
+			h.broadcastTypingCount(room)
+		}
+		return false
+	case before > limit:
+		h.announceTypers(room)
+	}
+	return true
+}
+
+func (h *hub) broadcastTypingCount(room string) {
+	msg := message{
+		Type:       "typing",
+		ID:         h.idGen(),
+		ServerTime: h.serverTime(),
+		Count:      h.typers[room],
+	}
+	if data, err := encode(msg, "typing count"); err == nil {
+		h.fanOut(envelope{msgType: msg.Type, msgID: msg.ID, data: data, room: room})
+	}
+}
+
+// announceTypers fans out a typing start for every client still typing
+// in room.
+func (h *hub) announceTypers(room string) {
+	for _, c := range h.order {
+		if m := h.clients[c]; !m.typing || m.room != room {
+			continue
+		}
+		msg := message{
+			Type:       "typing",
+			Typing:     "start",
+			ID:         h.idGen(),
+			Sender:     c.ID(),
+			ServerTime: h.serverTime(),
+		}
+		if data, err := encode(msg, "typing start"); err == nil {
+			h.fanOut(envelope{msgType: msg.Type, msgID: msg.ID, data: data, sender: c, room: room, typing: msg.Typing})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed client version. Build metadata is dropped, as it
+// doesn't affect ordering.
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+// parseSemver parses versions such as "1.4", "v2.0.1" and "2.1.0-rc.1".
+// Missing minor and patch numbers count as zero.
+func parseSemver(v string) (semver, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	v, _, _ = strings.Cut(v, "+")
+	v, pre, _ := strings.Cut(v, "-")
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return semver{}, false
+	}
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		nums[i] = n
+	}
+	return semver{major: nums[0], minor: nums[1], patch: nums[2], prerelease: pre}, true
+}
+
+// less reports whether v precedes w. A prerelease precedes its release;
+// prereleases of the same version are compared as strings, which is
+// enough for the usual rc.N and beta.N tags.
+func (v semver) less(w semver) bool {
+	if v.major != w.major {
+		return v.major < w.major
+	}
+	if v.minor != w.minor {
+		return v.minor < w.minor
+	}
+	if v.patch != w.patch {
+		return v.patch < w.patch
+	}
+	switch {
+	case v.prerelease == w.prerelease:
+		return false
+	case v.prerelease == "":
+		return false
+	case w.prerelease == "":
+		return true
+	}
+	return v.prerelease < w.prerelease
+}
+
+// clientVersionAllowed reports whether a client announcing version may
+// connect under the configured minimum. A missing or unparseable version
+// is let in only when allowUnversioned is set.
+func (cfg config) clientVersionAllowed(version string) bool {
+	if cfg.minClientVersion == nil {
+		return true
+	}
+	v, ok := parseSemver(version)
+	if !ok || version == "" {
+		return cfg.allowUnversioned
+	}
+	return !v.less(*cfg.minClientVersion)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSemverLess(t *testing.T) {
+	for _, tc := range []struct {
+		v, w string
+		less bool
+	}{
+		{"1.4", "1.10", true},
+		{"v2.0.1", "2.0.0", false},
+		{"2.1.0-rc.1", "2.1.0", true},
+		{"2.1.0", "2.1.0-rc.1", false},
+		{"2.1.0-rc.1", "2.1.0-rc.2", true},
+		{"1.2.3+build.9", "1.2.3", false},
+	} {
+		v, ok := parseSemver(tc.v)
+		w, wok := parseSemver(tc.w)
+		if !ok || !wok {
+			t.Fatalf("parsing %q or %q failed", tc.v, tc.w)
+		}
+		if got := v.less(w); got != tc.less {
+			t.Errorf("%s < %s = %t, want %t", tc.v, tc.w, got, tc.less)
+		}
+	}
+	for _, bad := range []string{"", "one", "1.2.3.4", "1.-2"} {
+		if _, ok := parseSemver(bad); ok {
+			t.Errorf("parseSemver(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestMinClientVersion(t *testing.T) {
+	floor, _ := parseSemver("2.0.0")
+	for _, tc := range []struct {
+		name, version    string
+		allowUnversioned bool
+		allowed          bool
+	}{
+		{"TooOld", "1.9.9", false, false},
+		{"PrereleaseOfFloor", "2.0.0-rc.1", false, false},
+		{"UpToDate", "2.0.0", false, true},
+		{"Newer", "2.3.1", false, true},
+		{"MissingRefused", "", false, false},
+		{"MissingAllowed", "", true, true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.minClientVersion = &floor
+			cfg.allowUnversioned = tc.allowUnversioned
+			_, base := newTestServer(t, cfg)
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws?clientVersion="+tc.version, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			var first message
+			if err := conn.ReadJSON(&first); err != nil {
+				t.Fatalf("reading the first message: %v", err)
+			}
+			if tc.allowed {
+				if first.Key != msgConnected {
+					t.Errorf("version %q got %q first, want the welcome", tc.version, first.Key)
+				}
+				return
+			}
+			if first.Key != msgUpgrade {
+				t.Errorf("version %q got %q first, want %s", tc.version, first.Key, msgUpgrade)
+			}
+			_, _, err = conn.ReadMessage()
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) || ce.Code != closeCodeUpgradeRequired {
+				t.Errorf("version %q ended with %v, want close code %d", tc.version, err, closeCodeUpgradeRequired)
+			}
+		})
+	}
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"compress/flate"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,188 +25,932 @@ const (
 	writeWait  = 10 * time.Second
 	pongWait   = 60 * time.Second
 	maxMessage = 4096
+
+	// Bounds on the metadata a client may attach to itself.
+	maxMetaKeys  = 10
+	maxMetaBytes = 64
+
+	// Per-field byte limits, so one oversized field can't consume the
+	// whole frame budget.
+	maxTextBytes      = 2048
+	maxIDBytes        = 64
+	maxTargetBytes    = 64
+	maxSentAtBytes    = 64
+	maxLangBytes      = 35
+	maxTokenBytes     = 128
+	maxSDPBytes       = 3072
+	maxCandidateBytes = 512
+
+	// closeCodeKicked is the close code, from the private-use range, sent
+	// to a client an operator disconnected.
+	closeCodeKicked = 4000
+
+	// closeCodeUpgradeRequired is sent to a client older than
+	// MIN_CLIENT_VERSION, after an upgrade_required message.
+	closeCodeUpgradeRequired = 4001
+
+	// closeCodeFlooding is sent to a client disconnected for repeatedly
+	// exceeding the chat or message rate limit.
+	closeCodeFlooding = 4002
+
+	// closeCodeRoomClosed is sent to the members of a room an operator
+	// cleared.
+	closeCodeRoomClosed = 4003
+
+	// composeInterval is the minimum gap between a client's compose
+	// previews; faster previews are dropped.
+	composeInterval = 250 * time.Millisecond
+
+	// finishedDraftMemory is how many finalized draft ids a client
+	// remembers, so previews arriving after their chat are dropped.
+	finishedDraftMemory = 8
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// fieldLimits lists the client-supplied string fields checked against
+// their limits before a message is processed.
+var fieldLimits = []struct {
+	name  string
+	max   int
+	value func(*message) string
+}{
+	{"text", maxTextBytes, func(m *message) string { return m.Text }},
+	{"id", maxIDBytes, func(m *message) string { return m.ID }},
+	{"target", maxTargetBytes, func(m *message) string { return m.Target }},
+	{"replyTo", maxIDBytes, func(m *message) string { return m.ReplyTo }},
+	{"draftId", maxIDBytes, func(m *message) string { return m.DraftID }},
+	{"sentAt", maxSentAtBytes, func(m *message) string { return m.SentAt }},
+	{"clientTime", maxSentAtBytes, func(m *message) string { return m.ClientTime }},
+	{"lang", maxLangBytes, func(m *message) string { return m.Lang }},
+	{"token", maxTokenBytes, func(m *message) string { return m.Token }},
+	{"sdp", maxSDPBytes, func(m *message) string { return m.SDP }},
+	{"candidate", maxCandidateBytes, func(m *message) string { return m.Candidate }},
 }
 
-type hub struct {
-	clients    map[*client]struct{}
-	register   chan *client
-	unregister chan *client
-	broadcast  chan []byte
+// Wire protocol versions, negotiated through Sec-WebSocket-Protocol.
+// v2 adds delivery receipts (pending, ack, nack) for chat senders.
+const (
+	protocolV1 = "useebird.v1"
+	protocolV2 = "useebird.v2"
+
+	latestProtocol = 2
+)
+
+// protocolVersions maps each supported subprotocol to its version number.
+var protocolVersions = map[string]int{
+	protocolV1: 1,
+	protocolV2: 2,
 }
 
-func NewHub() *hub {
-	return &hub{
-		clients:    make(map[*client]struct{}),
-		register:   make(chan *client),
-		unregister: make(chan *client),
-		broadcast:  make(chan []byte, 32),
-	}
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+	// Listed in preference order; the upgrader picks the first one the
+	// client also offers.
+	Subprotocols: []string{protocolV2, protocolV1},
 }
 
 type client struct {
 	id   string
 	hub  *hub
 	conn *websocket.Conn
-	send chan []byte
-}
 
-type message struct {
-	Type       string `json:"type"`
-	Text       string `json:"text,omitempty"`
-	ID         string `json:"id,omitempty"`
-	SentAt     string `json:"sentAt,omitempty"`
-	ServerTime string `json:"serverTime,omitempty"`
-	Sender     string `json:"sender,omitempty"`
-	Target     string `json:"target,omitempty"`
-	SDP        string `json:"sdp,omitempty"`
-	Candidate  string `json:"candidate,omitempty"`
+	// send carries chat, receipts and other high-priority traffic; sendLow
+	// carries presence and status updates, which are dropped first when the
+	// client falls behind. Only send is closed, by Close.
+	send    chan outbound
+	sendLow chan outbound
+
+	// protocol is the negotiated wire protocol version.
+	protocol int
+
+	// deflate records whether permessage-deflate was negotiated. When it
+	// wasn't, because the server, the browser or ?nocompress declined it,
+	// writes are never compressed.
+	deflate bool
+
+	// noPresence records that the client connected with ?presence=0, so
+	// the hub registers it without presence delivery.
+	noPresence bool
+
+	// room is the room the client is in, from ?room at connect and then
+	// from its last join. Owned by the reader goroutine.
+	room string
+
+	// locale selects the language of system messages sent to this client.
+	// Owned by the reader goroutine.
+	locale string
+
+	// version is the client build announced at connect, if any.
+	version string
+
+	// remoteIP is the client's address, resolved through any trusted
+	// proxies.
+	remoteIP string
+
+	// senderSeq numbers this client's broadcasts when strictSenderOrder is
+	// set. Owned by the reader goroutine.
+	senderSeq uint64
+
+	// lastCompose is when the client's last compose preview was relayed,
+	// and finishedDrafts holds the draft ids most recently finalized by a
+	// chat. Owned by the reader goroutine.
+	lastCompose    time.Time
+	finishedDrafts [finishedDraftMemory]string
+	nextFinished   int
+
+	// connectedAt is when the upgrade completed, and gateCleared is set
+	// once the client has waited out firstMessageDelay. Owned by the
+	// reader goroutine after construction.
+	connectedAt time.Time
+	gateCleared bool
+
+	// rulesAccepted records the rooms whose rules the client has accepted
+	// with accept_rules. Owned by the reader goroutine.
+	rulesAccepted map[string]bool
+
+	// chatLimit meters the client's chat against chatRate. offenses counts
+	// the times it was exceeded since firstOffense, and cooldownUntil is
+	// when a flood cooldown ends. Owned by the reader goroutine.
+	chatLimit     *tokenBucket
+	offenses      int
+	firstOffense  time.Time
+	cooldownUntil time.Time
+
+	// messageLimit meters all the client's messages against messageRate.
+	// throttled is set while messages are being dropped, so the client
+	// is told once per run of drops; throttleRuns counts the runs since
+	// firstThrottle. Owned by the reader goroutine.
+	messageLimit  *tokenBucket
+	throttled     bool
+	throttleRuns  int
+	firstThrottle time.Time
+
+	// floodedOut is set once the client has been disconnected for going
+	// over its rate limits. Owned by the reader goroutine.
+	floodedOut bool
+
+	// recentChats maps the hash of each chat sent within dedupWindow to
+	// when it was sent. Owned by the reader goroutine.
+	recentChats map[uint64]time.Time
+
+	// typingTimer broadcasts a typing stop once typingTimeout passes after
+	// the client's last start. It is pending exactly while the client is
+	// typing. Owned by the reader goroutine.
+	typingTimer *time.Timer
+
+	// meta is client-supplied metadata such as an avatar URL or client
+	// version. Owned by the reader goroutine.
+	meta map[string]string
+
+	// egress limits the client's outbound byte rate. Nil means unlimited.
+	// Owned by writePump.
+	egress *tokenBucket
+
+	// authNonce and authTimer track a pending auth challenge; authenticated
+	// is set once it has been answered.
+	authNonce     string
+	authTimer     *time.Timer
+	authenticated atomic.Bool
+
+	// user is the name verified from the client's bearer token, or "" if
+	// it connected anonymously.
+	user string
+
+	// poll is the long-poll session this client keeps the message
+	// pipeline's state for, or nil for a websocket client. Such a client
+	// has no connection; see hubClient.
+	poll *pollClient
+
+	// handshakeTimer closes the connection unless a first message arrives
+	// before it fires; greeted is set when one does.
+	handshakeTimer *time.Timer
+	greeted        atomic.Bool
+
+	closeOnce sync.Once
+
+	// closeMu guards closed, so a fan-out worker calling Send never races
+	// with Close closing the send lane.
+	closeMu sync.RWMutex
+	closed  bool
+
+	// removedFor is why the hub removed the client. It is set by Close
+	// before the send lane is closed, so writePump may read it once it
+	// sees the lane closed.
+	removedFor closeReason
+
+	// overBacklog is set when Send refused a message because the queued
+	// total passed maxSendBacklog, so the close frame says so.
+	overBacklog atomic.Bool
+
+	// enqueued counts messages offered to Send, to pick which are timed
+	// through the queue with sendQueueMetrics on. queueWait is the last
+	// such time in nanoseconds.
+	enqueued  atomic.Uint64
+	queueWait atomic.Int64
+
+	// Session counters, written by the pumps and read by Run when the
+	// client leaves. closeReason records the first reason the client
+	// closed its side.
+	msgsIn, msgsOut   atomic.Int64
+	bytesIn, bytesOut atomic.Int64
+	closeReason       atomic.Value
 }
 
-func (h *hub) Run() {
-	for {
-		select {
-		case c := <-h.register:
-			h.clients[c] = struct{}{}
-			log.Printf("client %s connected", c.id)
-		case c := <-h.unregister:
-			if _, ok := h.clients[c]; ok {
-				delete(h.clients, c)
-				close(c.send)
-				log.Printf("client %s disconnected", c.id)
-			}
-		case msg := <-h.broadcast:
-			for c := range h.clients {
-				select {
-				case c.send <- msg:
-				default:
-					close(c.send)
-					delete(h.clients, c)
-				}
-			}
+// deflateConns counts open connections that negotiated per-message
+// deflate, whether or not compression is currently switched on.
+var deflateConns atomic.Int64
+
+func serveWebsocket(h *hub, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	if h.cfg.headersTooLarge(r.Header) {
+		http.Error(w, "request headers too large", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if h.cfg.strictProtocol && !offersSupportedProtocol(r) {
+		http.Error(w, "unsupported protocol version", http.StatusBadRequest)
+		return
+	}
+	if !h.cfg.userAgentAllowed(r.UserAgent()) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	user, err := h.requestUser(r)
+	if err != nil && (err != errNoToken || h.tokensRequired()) {
+		if err != errNoToken {
+			log.Printf("refusing connection from %s: %v", clientIP(r, h.cfg.trustedProxies), err)
 		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	room, ok := requestedRoom(r.URL.Query().Get("room"))
+	if !ok {
+		http.Error(w, "invalid room", http.StatusBadRequest)
+		return
+	}
+	if !h.cfg.userMayJoin(room, user) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch h.entryRefused(room) {
+	case msgRoomNotFound:
+		http.Error(w, "room not found", http.StatusForbidden)
+		return
+	case msgRoomFull:
+		http.Error(w, "room full", http.StatusForbidden)
+		return
+	}
+	since, ok := requestedSince(r.URL.Query().Get("since"))
+	if !ok {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
 	}
-}
 
-func serveWebsocket(h *hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if h.draining.Load() {
+		refuseUpgrade(w, upgradeDraining)
+		return
+	}
+	release, ok := h.acquireUpgrade()
+	if !ok {
+		upgradesRejected.inc()
+		refuseUpgrade(w, upgradeAtCapacity)
+		return
+	}
+	// The slot covers the handshake only; a connection held back by
+	// the admission ramp afterwards no longer needs it.
+	defer release()
+
+	// ?nocompress=1 lets a CPU-constrained client refuse deflate even if
+	// its browser offers it; the extension is then never negotiated.
+	optOut, _ := strconv.ParseBool(r.URL.Query().Get("nocompress"))
+	u := upgrader
+	u.EnableCompression = h.cfg.compressMinClients > 0 && !optOut
+	deflate := u.EnableCompression && offersDeflate(r)
+	conn, err := u.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("websocket upgrade failed: %v", err)
 		return
 	}
+	if period := h.cfg.tcpKeepAlive; period > 0 {
+		setKeepAlive(conn.UnderlyingConn(), period)
+	}
+	if deflate {
+		deflateConns.Add(1)
+		defer deflateConns.Add(-1)
+	}
 
 	c := &client{
-		id:   randomID(),
-		hub:  h,
-		conn: conn,
-		send: make(chan []byte, 16),
+		id:       h.idGen(),
+		hub:      h,
+		conn:     conn,
+		send:     make(chan outbound, 16),
+		sendLow:  make(chan outbound, 16),
+		protocol: negotiatedProtocol(conn),
+		deflate:  deflate,
+		remoteIP: clientIP(r, h.cfg.trustedProxies),
+		version:  requestedClientVersion(r),
+		locale:   preferredLocale(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language")),
+
+		connectedAt: time.Now(),
+		noPresence:  r.URL.Query().Get("presence") == "0",
+		room:        room,
+		user:        user,
+	}
+	if user != "" {
+		// The id stays per connection, since a user may connect more
+		// than once; stampSender adds the verified name alongside it.
+		c.authenticated.Store(true)
+	}
+	if rate := float64(h.cfg.egressBytesPerSec); rate > 0 {
+		c.egress = newTokenBucket(rate, rate, time.Now())
+	}
+	if !h.cfg.clientVersionAllowed(c.version) {
+		c.refuseOutdated()
+		return
 	}
+	release()
+	// Under a reconnect flood, hold the connection here: nothing is
+	// delivered to it until it is registered.
+	h.admission.wait()
+
+	// The welcome and history are written before registering, so they
+	// come ahead of the roster Run sends on registration and of live
+	// traffic.
+	// A client still owing an answer to the auth challenge gets no
+	// history, just as /api/history is closed while authentication is
+	// required.
+	var replay []storedMessage
+	var truncated bool
+	releaseReplay := func() {}
+	if h.history != nil && (!h.authRequired() || c.authenticated.Load()) {
+		// Past the wait, the client is better off connected without
+		// history, which it can fetch from /api/history, than held.
+		release, ok := acquireSlot(h.replays, h.cfg.replayQueueWait)
+		if ok {
+			releaseReplay = release
+			defer release()
+			replay, truncated = h.replaySet(c.room, since)
+		} else {
+			replaysSkipped.inc()
+			truncated = true
+		}
+	}
+	welcome := message{
+		Type:             "system",
+		Key:              msgConnected,
+		Text:             h.cfg.catalog.text(msgConnected, c.locale),
+		ID:               h.idGen(),
+		ServerTime:       h.serverTime(),
+		Sender:           c.id,
+		User:             c.user,
+		Room:             c.room,
+		HistoryTruncated: truncated,
+		Capabilities: &capabilities{
+			Receipts:          c.protocol >= 2,
+			AuthRequired:      h.authRequired(),
+			Compression:       c.deflate,
+			StrictSenderOrder: h.cfg.strictSenderOrder,
+			History:           h.history != nil,
+			Rooms:             h.cfg.roomCreation != roomCreationClosed || len(h.cfg.rooms) > 0,
+			MaxMessageBytes:   h.cfg.frameLimit(c.room),
+			MaxTextBytes:      h.cfg.textLimit(c.room),
+			MaxMetaKeys:       maxMetaKeys,
+			MaxMetaBytes:      maxMetaBytes,
+			EgressBytesPerSec: h.cfg.egressBytesPerSec,
+			ChatPerSec:        h.cfg.chatRate,
+			ChatBurst:         advertisedBurst(h.cfg.chatRate, h.cfg.chatBurst),
+			MessagesPerSec:    h.cfg.messageRate,
+			MessageBurst:      advertisedBurst(h.cfg.messageRate, h.cfg.messageBurst),
+		},
+	}
+	data, err := encode(welcome, "welcome message")
+	if err != nil {
+		// A client that never learns its id can't function, so tell it the
+		// server failed rather than leaving it connected. It was never
+		// registered, so nobody is told it left.
+		c.closeWith(websocket.CloseInternalServerErr, "")
+		return
+	}
+	if !c.writeText(welcome.Type, data) || !c.replayHistory(replay) {
+		_ = conn.Close()
+		return
+	}
+	releaseReplay()
 	h.register <- c
 
 	go c.writePump()
+	connectLatency.observe(time.Since(start).Seconds())
+	c.sendRules()
 
-	welcome := message{
-		Type:       "system",
-		Text:       "connected",
-		ID:         randomID(),
-		ServerTime: time.Now().UTC().Format(time.RFC3339Nano),
-		Sender:     c.id,
+	if h.authRequired() && !c.authenticated.Load() {
+		c.startAuthChallenge()
 	}
-	if data, err := json.Marshal(welcome); err == nil {
-		c.send <- data
-	} else {
-		log.Printf("failed to marshal welcome message: %v", err)
+	if timeout := h.cfg.handshakeTimeout; timeout > 0 {
+		c.handshakeTimer = time.AfterFunc(timeout, func() {
+			if !c.greeted.Load() {
+				log.Printf("client %s sent nothing within the handshake timeout", c.id)
+				c.closeWith(websocket.ClosePolicyViolation, "handshake timeout")
+			}
+		})
 	}
 
 	c.readPump()
 }
 
 func (c *client) readPump() {
+	c.hub.translations.join(c.locale)
 	defer func() {
+		c.hub.translations.leave(c.locale)
+		if c.authTimer != nil {
+			c.authTimer.Stop()
+		}
+		if c.handshakeTimer != nil {
+			c.handshakeTimer.Stop()
+		}
+		// A client that leaves mid-typing won't send the stop itself.
+		if c.typingTimer != nil && c.typingTimer.Stop() {
+			c.broadcastTypingStop()
+		}
 		c.hub.unregister <- c
 		_ = c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessage)
-	if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-		log.Printf("set read deadline failed: %v", err)
+	// A timed-out read leaves a gorilla connection unusable, so the grace
+	// window can't be a retry after the fact; it is added to every deadline
+	// up front instead.
+	readWait := pongWait + c.hub.cfg.readGrace
+
+	c.conn.SetReadLimit(int64(c.hub.cfg.frameLimit(c.room)))
+	if err := c.conn.SetReadDeadline(time.Now().Add(readWait)); err != nil {
+		c.fail("set read deadline", err)
+		return
 	}
 	c.conn.SetPongHandler(func(string) error {
-		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		if err := c.conn.SetReadDeadline(time.Now().Add(readWait)); err != nil {
+			c.fail("set read deadline", err)
+			return err
+		}
+		return nil
 	})
 
 	for {
-		_, payload, err := c.conn.ReadMessage()
+		payload, err := c.readMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			// Gorilla sends no close frame for a frame that fails to
+			// inflate, so say why rather than just dropping the connection.
+			var corrupt flate.CorruptInputError
+			if errors.As(err, &corrupt) {
+				compressionErrors.inc()
+				log.Printf("closing %s after a malformed compressed frame: %v", c.id, err)
+				c.closeWith(websocket.CloseProtocolError, "invalid compressed frame")
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("unexpected websocket close: %v", err)
 			}
+			c.setCloseReason("read: " + err.Error())
 			break
 		}
+		c.msgsIn.Add(1)
+		c.bytesIn.Add(int64(len(payload)))
+		if c.greeted.CompareAndSwap(false, true) && c.handshakeTimer != nil {
+			c.handshakeTimer.Stop()
+		}
 
-		outgoing := c.prepareBroadcast(payload)
-		if len(outgoing) == 0 {
+		outgoing, ok := c.prepareBroadcast(payload)
+		if !ok {
 			continue
 		}
-		c.hub.broadcast <- outgoing
+		if !c.enqueueBroadcast(outgoing) {
+			continue
+		}
+		if receiptTypes[outgoing.msgType] {
+			c.receipt("ack", outgoing.msgID)
+		}
+		if outgoing.link != "" {
+			c.hub.previews.request(outgoing.msgID, outgoing.room, outgoing.link)
+		}
+		if outgoing.translate != "" {
+			c.hub.translations.request(outgoing.msgID, outgoing.room, outgoing.translate)
+		}
+	}
+}
+
+// readMessage reads the next data message, enforcing maxMessage on the
+// decompressed payload. gorilla's read limit counts frame bytes, which
+// with permessage-deflate are the compressed size, so a small frame could
+// otherwise inflate to an arbitrarily large message.
+func (c *client) readMessage() ([]byte, error) {
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	limit := c.hub.cfg.frameLimit(c.room)
+	payload, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > limit {
+		_ = c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""),
+			time.Now().Add(writeWait))
+		return nil, websocket.ErrReadLimit
+	}
+	return payload, nil
+}
+
+// throttleEgress blocks until the client's egress budget allows a frame
+// of n bytes. The delay is capped at writeWait so a large frame is slowed
+// down rather than held back indefinitely.
+func (c *client) throttleEgress(n int) {
+	if c.egress == nil {
+		return
+	}
+	wait := c.egress.take(float64(n), time.Now())
+	if wait > writeWait {
+		wait = writeWait
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// fail tears down a connection that hit an unrecoverable error. It is safe
+// to call more than once and from either pump: closing the socket makes
+// readPump return, which unregisters the client.
+func (c *client) fail(reason string, err error) {
+	c.closeOnce.Do(func() {
+		log.Printf("client %s failed: %s: %v", c.id, reason, err)
+		c.setCloseReason(reason + ": " + err.Error())
+		_ = c.conn.Close()
+	})
+}
+
+// closeWith sends a close frame with the given code and reason, then
+// closes the socket. Like fail, it is idempotent and readPump handles the
+// unregistration.
+func (c *client) closeWith(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.setCloseReason(strings.TrimSpace(fmt.Sprintf("closed with %d %s", code, reason)))
+		_ = c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(writeWait))
+		_ = c.conn.Close()
+	})
+}
+
+// maxUpgradeRetryAfter is the longest Retry-After, in seconds, sent with
+// an upgrade the server can't take now.
+const maxUpgradeRetryAfter = 5
+
+// Reasons refuseUpgrade gives: no handshake slot came free in time, or
+// the server is sending its clients away.
+const (
+	upgradeAtCapacity = "at_capacity"
+	upgradeDraining   = "draining"
+)
+
+// refuseUpgrade answers an upgrade the server can't take now: a 503
+// with a jittered Retry-After and a JSON body giving the reason, so
+// clients back off rather than reconnect in a loop. Every such refusal
+// goes through it.
+func refuseUpgrade(w http.ResponseWriter, reason string) {
+	w.Header().Set("Retry-After", upgradeRetryAfter())
+	writeJSON(w, http.StatusServiceUnavailable, map[string]string{"reason": reason})
+}
+
+// upgradeRetryAfter picks the Retry-After for a refused upgrade at random
+// between one second and maxUpgradeRetryAfter, so the clients refused in
+// a flood don't all retry in the same second.
+func upgradeRetryAfter() string {
+	return strconv.Itoa(1 + rand.Intn(maxUpgradeRetryAfter))
+}
+
+// acquireUpgrade takes a handshake slot, waiting up to upgradeQueueWait
+// for one. The returned release may be called more than once.
+func (h *hub) acquireUpgrade() (release func(), ok bool) {
+	return acquireSlot(h.upgrades, h.cfg.upgradeQueueWait)
+}
+
+// acquireSlot takes a slot in the semaphore sem, waiting up to wait for
+// one. A nil sem is unlimited. The returned release may be called more
+// than once.
+func acquireSlot(sem chan struct{}, wait time.Duration) (release func(), ok bool) {
+	if sem == nil {
+		return func() {}, true
+	}
+	select {
+	case sem <- struct{}{}:
+	default:
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case sem <- struct{}{}:
+		case <-timer.C:
+			return nil, false
+		}
 	}
+	var once sync.Once
+	return func() { once.Do(func() { <-sem }) }, true
+}
+
+// refuseOutdated tells a client below the minimum version to reload and
+// closes it. The client was never registered, so it writes directly.
+func (c *client) refuseOutdated() {
+	log.Printf("refusing client with version %q below MIN_CLIENT_VERSION", c.version)
+	data, err := encode(message{
+		Type:       "system",
+		Key:        msgUpgrade,
+		Text:       c.hub.cfg.catalog.text(msgUpgrade, c.locale),
+		ServerTime: c.hub.serverTime(),
+	}, "upgrade notice")
+	if err == nil {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		_ = c.conn.WriteMessage(websocket.TextMessage, data)
+	}
+	c.closeWith(closeCodeUpgradeRequired, "upgrade required")
+}
+
+// enqueueBroadcast hands a message to the hub, giving up after the
+// configured enqueue timeout so a congested hub can't stall this reader
+// indefinitely. It reports whether the message was accepted.
+func (c *client) enqueueBroadcast(env envelope) bool {
+	timeout := c.hub.cfg.broadcastEnqueueTimeout
+	if timeout <= 0 {
+		c.hub.broadcast <- env
+		return true
+	}
+
+	select {
+	case c.hub.broadcast <- env:
+		return true
+	case <-time.After(timeout):
+		log.Printf("broadcast queue full, dropping %s message from %s", env.msgType, c.id)
+		c.hub.deadLetters.record(c.hub.now(), "broadcast queue full", c.id, env.msgType, env.data)
+		c.nack(env.msgID, msgServerBusy)
+		return false
+	}
+}
+
+// pingInterval is how often writePump pings: a little under pongWait,
+// less a random share of up to pingJitterPercent.
+func (c *client) pingInterval() time.Duration {
+	interval := (pongWait * 9) / 10
+	if pct := c.hub.cfg.pingJitterPercent; pct > 0 {
+		interval -= time.Duration(rand.Int63n(int64(interval) * int64(pct) / 100))
+	}
+	return interval
 }
 
 func (c *client) writePump() {
-	ticker := time.NewTicker((pongWait * 9) / 10)
+	ticker := time.NewTicker(c.pingInterval())
+	var status <-chan time.Time
+	if interval := c.hub.cfg.serverStatusInterval; interval > 0 {
+		statusTicker := time.NewTicker(interval)
+		defer statusTicker.Stop()
+		status = statusTicker.C
+	}
 	defer func() {
 		ticker.Stop()
 		_ = c.conn.Close()
 	}()
 
 	for {
+		// Drain the high-priority lane first so chat isn't held up behind
+		// presence or status churn.
 		select {
 		case msg, ok := <-c.send:
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("set write deadline failed: %v", err)
+			if !ok {
+				c.writeClose()
+				return
 			}
+			if !c.writeQueued(msg) {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case msg, ok := <-c.send:
 			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.writeClose()
+				return
+			}
+			if !c.writeQueued(msg) {
 				return
 			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				log.Printf("write message failed: %v", err)
+		case msg := <-c.sendLow:
+			if !c.writeQueued(msg) {
 				return
 			}
 		case <-ticker.C:
 			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("set write deadline failed: %v", err)
+				c.fail("set write deadline", err)
+				return
 			}
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+		case <-status:
+			if !c.writeText("server_status", c.hub.statusMessage()) {
+				return
+			}
 		}
 	}
 }
 
-func (c *client) prepareBroadcast(payload []byte) []byte {
+// writeQueued writes a message taken off one of the lanes, first
+// recording how long it waited if it was sampled.
+func (c *client) writeQueued(msg outbound) bool {
+	if !msg.queuedAt.IsZero() {
+		wait := time.Since(msg.queuedAt)
+		c.queueWait.Store(int64(wait))
+		sendQueueWait.observe(wait.Seconds())
+	}
+	return c.writeText(msg.msgType, msg.data)
+}
+
+// writeText sends a text frame of the given message type, honouring the
+// egress limit. It reports false if the connection should be abandoned.
+func (c *client) writeText(msgType string, data []byte) bool {
+	c.throttleEgress(len(data))
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		c.fail("set write deadline", err)
+		return false
+	}
+	c.conn.EnableWriteCompression(c.deflate && c.hub.compress.Load() && c.hub.cfg.compressible(msgType, len(data)))
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Printf("write message failed: %v", err)
+		c.setCloseReason("write: " + err.Error())
+		return false
+	}
+	c.msgsOut.Add(1)
+	c.bytesOut.Add(int64(len(data)))
+	return true
+}
+
+// setCloseReason records why the connection is closing unless a reason
+// was already recorded.
+func (c *client) setCloseReason(reason string) {
+	c.closeReason.CompareAndSwap(nil, reason)
+}
+
+func (c *client) session() sessionStats {
+	reason, _ := c.closeReason.Load().(string)
+	return sessionStats{
+		remoteIP: c.remoteIP,
+		msgsIn:   c.msgsIn.Load(),
+		msgsOut:  c.msgsOut.Load(),
+		bytesIn:  c.bytesIn.Load(),
+		bytesOut: c.bytesOut.Load(),
+		reason:   reason,
+	}
+}
+
+// writeClose sends the close frame matching why the hub removed the
+// client.
+func (c *client) writeClose() {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		c.fail("set write deadline", err)
+		return
+	}
+	code, text := websocket.CloseNormalClosure, ""
+	switch c.removedFor {
+	case closeSlowConsumer:
+		code, text = websocket.CloseTryAgainLater, "send queue full"
+		if c.overBacklog.Load() {
+			code, text = websocket.ClosePolicyViolation, "send backlog exceeded"
+		}
+	case closeKicked:
+		code, text = closeCodeKicked, "kicked"
+	case closeShutdown:
+		code, text = websocket.CloseGoingAway, "server shutting down"
+	case closeMigrated:
+		text = "migrated"
+	case closeRateLimited:
+		code, text = closeCodeFlooding, "rate limited"
+	case closeRoomClosed:
+		code, text = closeCodeRoomClosed, "room_closed"
+	}
+	_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+}
+
+func (c *client) prepareBroadcast(payload []byte) (_ envelope, ok bool) {
 	var msg message
+	outcome := outcomeRejected
+	defer func() {
+		if ok {
+			outcome = outcomeAccepted
+		}
+		messagesTotal.inc(messageTypeLabel(msg.Type), outcome)
+	}()
+
 	if err := json.Unmarshal(payload, &msg); err != nil {
 		log.Printf("invalid message from %s: %v", c.id, err)
-		return nil
+		return envelope{}, false
 	}
 
 	if msg.Type == "" {
-		return nil
+		return envelope{}, false
+	}
+
+	if !c.allowMessage(msg.Type) {
+		outcome = outcomeRateLimited
+		return envelope{}, false
+	}
+
+	if field := c.hub.cfg.longField(c.room, &msg); field != "" {
+		c.notifyFieldTooLong(field)
+		return envelope{}, false
 	}
 
+	if c.hub.authRequired() && !c.authenticated.Load() {
+		if msg.Type == "auth_response" {
+			c.handleAuthResponse(msg.Token)
+			outcome = outcomeAccepted
+		} else {
+			c.notify(msgAuthRequired)
+		}
+		return envelope{}, false
+	}
+
+	// Without AUTH_SECRET or a bearer token nobody authenticates, so
+	// every client is held to the anonymous set.
+	if !c.hub.cfg.typeAllowed(msg.Type, c.authenticated.Load()) {
+		c.notify(msgTypeNotAllowed)
+		return envelope{}, false
+	}
+
+	// Control messages are handled here and go no further; the rest are
+	// relayed once the transform pipeline has vetted them.
+	outcome = outcomeAccepted
 	switch msg.Type {
-	case "chat":
-		msg.Text = strings.TrimSpace(msg.Text)
-		if msg.Text == "" {
-			return nil
+	case "subscribe":
+		c.hub.subscribe <- subscription{client: c, types: msg.Types}
+		return envelope{}, false
+	case "presence_delivery":
+		c.hub.presence <- presenceOpt{client: c, wants: msg.Active}
+		return envelope{}, false
+	case "mute_room", "unmute_room":
+		// No room means the one the client is in.
+		room := strings.TrimSpace(msg.Room)
+		if room == "" {
+			room = c.room
 		}
+		if !roomPattern.MatchString(room) {
+			c.notify(msgRoomInvalid)
+			return envelope{}, false
+		}
+		c.hub.mutes <- muteRequest{client: c, room: room, unmute: msg.Type == "unmute_room"}
+		return envelope{}, false
+	case "block", "unblock":
+		c.hub.blocks <- blockRequest{client: c, users: msg.Users, unblock: msg.Type == "unblock"}
+		return envelope{}, false
+	case "lang":
+		locale := preferredLocale(msg.Lang, "")
+		c.hub.translations.leave(c.locale)
+		c.hub.translations.join(locale)
+		c.locale = locale
+		return envelope{}, false
+	case "time_sync":
+		c.timeSync(msg.ClientTime)
+		return envelope{}, false
+	case "accept_rules":
+		c.acceptRules()
+		return envelope{}, false
+	case "conninfo":
+		c.connInfo(msg.ID)
+		return envelope{}, false
+	case "poll", "vote", "poll_close":
+		c.pollRequest(msg)
+		return envelope{}, false
+	case "join":
+		c.joinRoom(msg.Room)
+		return envelope{}, false
+	case "leave":
+		// Every client is in some room, so leaving one goes back to
+		// the lobby.
+		if c.room != defaultRoom {
+			c.joinRoom(defaultRoom)
+		}
+		return envelope{}, false
+	case "migrated":
+		c.hub.migrated <- migrationDone{client: c, token: msg.Token}
+		return envelope{}, false
+	case "echo":
+		if !c.hub.cfg.debugEcho {
+			log.Printf("unknown message type %q from %s", msg.Type, c.id)
+			outcome = outcomeRejected
+			return envelope{}, false
+		}
+		c.echo(payload, msg)
+		return envelope{}, false
 	case "ping":
+		// A liveness/RTT probe for the server, not for the room.
+		c.reply(message{Type: "pong", ID: msg.ID, SentAt: msg.SentAt})
+		return envelope{}, false
+	case "chat", "compose", "encrypted", "typing", "meta":
 	case "webrtc-offer":
 	case "webrtc-answer":
 	case "webrtc-ice":
@@ -205,30 +958,590 @@ func (c *client) prepareBroadcast(payload []byte) []byte {
 	case "webrtc-presence-request":
 	default:
 		log.Printf("unknown message type %q from %s", msg.Type, c.id)
-		return nil
+		outcome = outcomeRejected
+		return envelope{}, false
+	}
+
+	outcome = outcomeRejected
+	if !c.hub.cfg.roomAllows(c.room, msg.Type) {
+		c.notify(msgTypeNotAllowed)
+		return envelope{}, false
+	}
+	msg = relayedFields(msg)
+	if err := c.applyTransforms(&msg); err != nil {
+		if rateLimited(err) {
+			outcome = outcomeRateLimited
+		}
+		return envelope{}, false
+	}
+
+	data, err := encode(msg, msg.Type+" message")
+	if err != nil {
+		c.nack(msg.ID, msgInternalError)
+		return envelope{}, false
+	}
+
+	if len(data) > c.hub.cfg.frameLimit(c.room) {
+		fitted, ok := c.fitOversized(&msg)
+		if !ok {
+			return envelope{}, false
+		}
+		data = fitted
+	}
+
+	if receiptTypes[msg.Type] {
+		c.receipt("pending", msg.ID)
+	}
+
+	env := envelope{msgType: msg.Type, msgID: msg.ID, data: data, sender: c, room: c.room, target: msg.Target}
+	if msg.Type == "chat" {
+		env.mentions = mentionedNicks(msg.Text)
+		env.depth = c.hub.replyDepth(c.room, msg.ReplyTo)
+	}
+	if msg.Type == "meta" {
+		env.meta = msg.Meta
+	}
+	if msg.Type == "chat" && c.hub.previews != nil {
+		env.link = firstLink(msg.Text)
+	}
+	if msg.Type == "chat" && c.hub.translations != nil {
+		env.translate = msg.Text
+	}
+	if msg.Type == "typing" {
+		env.typing = msg.Typing
+	}
+	return env, true
+}
+
+// relayedFields returns the part of msg a client may set on a message it
+// sends for relay. Everything else, such as nick, key, flagged, preview
+// or poll, is the server's to fill in, so a client can't forge it on its
+// own broadcasts and pass for another user or for the server.
+func relayedFields(msg message) message {
+	return message{
+		Type:        msg.Type,
+		Text:        msg.Text,
+		ID:          msg.ID,
+		SentAt:      msg.SentAt,
+		Target:      msg.Target,
+		SDP:         msg.SDP,
+		Candidate:   msg.Candidate,
+		ReplyTo:     msg.ReplyTo,
+		DraftID:     msg.DraftID,
+		Typing:      msg.Typing,
+		Meta:        msg.Meta,
+		Attachments: msg.Attachments,
+	}
+}
+
+// advertisedBurst is the burst a token bucket for rate and burst really
+// allows, as the welcome's capabilities report it: at least one, or none
+// when the limit is off.
+func advertisedBurst(rate, burst int) int {
+	if rate <= 0 {
+		return 0
+	}
+	return max(burst, 1)
+}
+
+// allowMessage applies the per-client message rate limit, reporting
+// whether a message of msgType may go on. Pings are exempt so a
+// throttled client stays connected. The first message dropped after any
+// that got through draws a throttled notice; the rest are dropped
+// silently. A client throttled floodMaxOffenses times within floodWindow
+// is disconnected.
+func (c *client) allowMessage(msgType string) bool {
+	cfg := c.hub.cfg
+	if cfg.messageRate <= 0 || msgType == "ping" {
+		return true
+	}
+	now := time.Now()
+	if c.messageLimit == nil {
+		c.messageLimit = newTokenBucket(float64(cfg.messageRate), float64(max(cfg.messageBurst, 1)), now)
+	}
+	if c.messageLimit.allow(now) {
+		c.throttled = false
+		return true
+	}
+	if c.throttled {
+		return false
+	}
+	c.throttled = true
+	if now.Sub(c.firstThrottle) > cfg.floodWindow {
+		c.throttleRuns, c.firstThrottle = 0, now
+	}
+	c.throttleRuns++
+	if c.throttleRuns >= cfg.floodMaxOffenses {
+		c.disconnectRateLimited()
+		return false
+	}
+	log.Printf("throttling %s over %d messages/s", c.id, cfg.messageRate)
+	c.notify(msgThrottled)
+	return false
+}
+
+// disconnectRateLimited tells this client it is being disconnected for
+// sending too fast and has Run remove it, closing with closeCodeFlooding
+// once the notice is written.
+func (c *client) disconnectRateLimited() {
+	log.Printf("disconnecting %s for exceeding its rate limit", c.id)
+	c.floodedOut = true
+	data, err := encode(message{
+		Type:       "system",
+		Key:        msgRateLimited,
+		Text:       c.hub.cfg.catalog.text(msgRateLimited, c.locale),
+		ID:         c.hub.idGen(),
+		ServerTime: c.hub.serverTime(),
+	}, "rate limit notice")
+	if err != nil {
+		c.closeWith(closeCodeFlooding, "rate limited")
+		return
+	}
+	c.hub.direct <- directMessage{client: c.hubClient(), msgType: "system", data: data, disconnect: true}
+}
+
+// mergeMeta applies a metadata update, where an empty value deletes its
+// key. The update is applied only if the result stays within the key and
+// size limits; otherwise the message key describing the violation is
+// returned. changed reports whether the stored metadata differs.
+func (c *client) mergeMeta(update map[string]string) (changed bool, violation string) {
+	merged := make(map[string]string, len(c.meta)+len(update))
+	for k, v := range c.meta {
+		merged[k] = v
+	}
+	for k, v := range update {
+		if len(k) > maxMetaBytes || len(v) > maxMetaBytes {
+			return false, msgMetaTooLong
+		}
+		if v == "" {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	if len(merged) > maxMetaKeys {
+		return false, msgMetaTooMany
+	}
+
+	changed = len(merged) != len(c.meta)
+	for k, v := range merged {
+		if old, ok := c.meta[k]; !ok || old != v {
+			changed = true
+		}
+	}
+	c.meta = merged
+	return changed, ""
+}
+
+// isDuplicate reports whether text matches a chat this client sent within
+// the dedup window, and otherwise remembers it. Matching ignores case and
+// runs of whitespace.
+func (c *client) isDuplicate(text string, now time.Time) bool {
+	window := c.hub.cfg.dedupWindow
+	if window <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(strings.Join(strings.Fields(text), " "))))
+	sum := h.Sum64()
+
+	if sent, ok := c.recentChats[sum]; ok && now.Sub(sent) < window {
+		return true
+	}
+	for k, sent := range c.recentChats {
+		if now.Sub(sent) >= window {
+			delete(c.recentChats, k)
+		}
+	}
+	if c.recentChats == nil {
+		c.recentChats = make(map[uint64]time.Time)
+	}
+	c.recentChats[sum] = now
+	return false
+}
+
+// allowCompose reports whether a compose preview for draft may be relayed:
+// the draft must not have been finalized already, and the client must
+// not have sent a preview within composeInterval.
+func (c *client) allowCompose(draft string, now time.Time) bool {
+	for _, id := range c.finishedDrafts {
+		if id == draft {
+			return false
+		}
+	}
+	if now.Sub(c.lastCompose) < composeInterval {
+		return false
+	}
+	c.lastCompose = now
+	return true
+}
+
+// finishDraft records that draft was finalized by a chat message.
+func (c *client) finishDraft(draft string) {
+	c.finishedDrafts[c.nextFinished] = draft
+	c.nextFinished = (c.nextFinished + 1) % finishedDraftMemory
+}
+
+// fitOversized applies the configured oversize policy to a message whose
+// encoded form exceeds its room's frame limit, returning the bytes to broadcast. It
+// reports false, after notifying the sender, if the message is dropped.
+func (c *client) fitOversized(msg *message) ([]byte, bool) {
+	// Truncated ciphertext can't be decrypted, so encrypted messages are
+	// always rejected.
+	if c.hub.cfg.oversizePolicy == oversizeTruncate && msg.Text != "" && msg.Type != "encrypted" {
+		if data, ok := truncateToFit(msg, c.hub.cfg.frameLimit(c.room)); ok {
+			return data, true
+		}
+	}
+
+	log.Printf("dropping oversized %s message from %s", msg.Type, c.id)
+	c.notify(msgTooLarge)
+	return nil, false
+}
+
+// truncateToFit shortens msg.Text, appending an ellipsis and setting
+// Truncated, so that the encoded message is at most limit bytes. It keeps
+// as much text as possible and reports false if nothing fits.
+func truncateToFit(msg *message, limit int) ([]byte, bool) {
+	runes := []rune(msg.Text)
+	msg.Truncated = true
+
+	var best []byte
+	lo, hi := 0, len(runes)-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		msg.Text = string(runes[:mid]) + "…"
+		data, err := encode(msg, "truncated "+msg.Type+" message")
+		if err != nil {
+			return nil, false
+		}
+		if len(data) <= limit {
+			best = data
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
 	}
 
-	if msg.ID == "" {
-		msg.ID = randomID()
+	return best, best != nil
+}
+
+// notify sends the system message for key to this client only, in the
+// client's locale.
+func (c *client) notify(key string) {
+	c.reply(message{
+		Type: "system",
+		Key:  key,
+		Text: c.hub.cfg.catalog.text(key, c.locale),
+		ID:   c.hub.idGen(),
+	})
+}
+
+// notifyFieldTooLong tells this client which field of its message was
+// over its limit. Each field has its own key, <field>_too_long, sharing
+// one translated text.
+func (c *client) notifyFieldTooLong(field string) {
+	text := c.hub.cfg.catalog.text(msgFieldTooLong, c.locale)
+	c.reply(message{
+		Type: "system",
+		Key:  field + "_too_long",
+		Text: strings.ReplaceAll(text, "{field}", field),
+		ID:   c.hub.idGen(),
+	})
+}
+
+// receipt reports the progress of this client's message with the given
+// id: "pending" once it has been accepted, "ack" once it has been queued
+// for broadcast.
+func (c *client) receipt(kind, id string) {
+	if c.protocol < 2 {
+		return
 	}
+	c.reply(message{
+		Type: kind,
+		ID:   id,
+	})
+}
+
+// nack tells this client that its message with the given id was not
+// delivered, with the reason given as a message key.
+func (c *client) nack(id, key string) {
+	c.reply(message{
+		Type: "nack",
+		Key:  key,
+		Text: c.hub.cfg.catalog.text(key, c.locale),
+		ID:   id,
+	})
+}
 
-	msg.Sender = c.id
-	msg.ServerTime = time.Now().UTC().Format(time.RFC3339Nano)
+// startTyping (re)arms the timer that ends the client's typing state if
+// it never sends a stop.
+func (c *client) startTyping() {
+	timeout := c.hub.cfg.typingTimeout
+	if timeout <= 0 {
+		return
+	}
+	if c.typingTimer == nil {
+		c.typingTimer = time.AfterFunc(timeout, c.broadcastTypingStop)
+		return
+	}
+	c.typingTimer.Reset(timeout)
+}
 
-	data, err := json.Marshal(msg)
+// broadcastTypingStop tells everyone the client stopped typing, on its
+// behalf. It may run on the timer's goroutine, so it leaves senderSeq
+// alone; the stop is the server's, not one of the client's messages.
+func (c *client) broadcastTypingStop() {
+	msg := message{
+		Type:       "typing",
+		Typing:     "stop",
+		ID:         c.hub.idGen(),
+		Sender:     c.id,
+		ServerTime: c.hub.serverTime(),
+	}
+	data, err := encode(msg, "typing stop")
 	if err != nil {
-		log.Printf("failed to encode message: %v", err)
+		return
+	}
+	c.hub.broadcast <- envelope{msgType: msg.Type, msgID: msg.ID, data: data, sender: c, typing: msg.Typing}
+}
+
+// echo returns a debug echo to its sender alone: the raw payload, the
+// message as decoded, with unknown fields gone, and when it arrived.
+func (c *client) echo(payload []byte, parsed message) {
+	received := c.hub.clockTime()
+	if parsed.ID == "" {
+		parsed.ID = c.hub.idGen()
+	}
+	parsed.Sender = c.id
+	c.reply(message{
+		Type:        "echo",
+		ID:          parsed.ID,
+		ReceiveTime: received,
+		Raw:         json.RawMessage(payload),
+		Echo:        &parsed,
+	})
+}
+
+// timeSync answers a time_sync request NTP-style, echoing the client's
+// timestamp alongside the server's receive and transmit times so the
+// client can estimate both its clock offset and the round trip.
+func (c *client) timeSync(clientTime string) {
+	received := c.hub.clockTime()
+	c.reply(message{
+		Type:         "time_sync",
+		ClientTime:   clientTime,
+		ReceiveTime:  received,
+		TransmitTime: c.hub.clockTime(),
+	})
+}
+
+// reply stamps msg with the server time and queues it for this client
+// only. Replies are best effort: if the hub's direct queue is full the
+// reply is dropped rather than blocking the reader.
+func (c *client) reply(msg message) {
+	msg.ServerTime = c.hub.serverTime()
+	data, err := encode(msg, msg.Type+" reply")
+	if err != nil {
+		return
+	}
+	select {
+	case c.hub.direct <- directMessage{client: c.hubClient(), msgType: msg.Type, data: data}:
+	default:
+		log.Printf("direct queue full, dropping %s reply to %s", msg.Type, c.id)
+		c.hub.deadLetters.record(c.hub.now(), "direct queue full", c.id, msg.Type, data)
+	}
+}
+
+// hubClient is the Client the hub knows c as: its long-poll session if
+// it has one, otherwise c itself. Requests c's message pipeline makes of
+// Run, such as replies, are addressed to it.
+func (c *client) hubClient() Client {
+	if c.poll != nil {
+		return c.poll
+	}
+	return c
+}
+
+// receiptTypes are the user message types whose senders get delivery
+// receipts.
+var receiptTypes = map[string]bool{
+	"chat":      true,
+	"encrypted": true,
+}
+
+// lowPriorityTypes are delivered on a client's sendLow lane.
+var lowPriorityTypes = map[string]bool{
+	"typing":                  true,
+	"compose":                 true,
+	"presence":                true,
+	"server_status":           true,
+	"webrtc-presence":         true,
+	"webrtc-presence-request": true,
+}
+
+func (c *client) ID() string { return c.id }
+
+func (c *client) clientVersion() string { return c.version }
+
+func (c *client) declinesPresence() bool { return c.noPresence }
+
+func (c *client) initialRoom() string { return c.room }
+
+func (c *client) username() string { return c.user }
+
+// Send queues a message on the lane matching its priority without
+// blocking. A full low-priority lane just drops the message; only a full
+// high-priority lane is reported as an error.
+//
+// With strictSenderOrder every message uses the high-priority lane, since
+// two lanes let a sender's chat overtake its earlier presence updates.
+// Low-priority messages are still dropped rather than disconnecting the
+// client when that lane is full.
+func (c *client) Send(msgType string, data []byte) error {
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+	if c.closed {
+		// The hub removed the client while an offloaded fan-out still
+		// held it; there is no one left to deliver to.
 		return nil
 	}
 
-	return data
+	if limit := c.hub.cfg.maxSendBacklog; limit > 0 && len(c.send)+len(c.sendLow) >= limit {
+		c.overBacklog.Store(true)
+		return errBacklogExceeded
+	}
+
+	low := lowPriorityTypes[msgType]
+	lane := c.send
+	if low && !c.hub.cfg.strictSenderOrder {
+		lane = c.sendLow
+	}
+
+	out := outbound{msgType: msgType, data: data}
+	if c.hub.cfg.sendQueueMetrics && c.enqueued.Add(1)%queueSampleEvery == 0 {
+		out.queuedAt = time.Now()
+	}
+	select {
+	case lane <- out:
+		return nil
+	default:
+		if low {
+			c.hub.deadLetters.record(c.hub.now(), "low-priority queue full", c.id, msgType, data)
+			return nil
+		}
+		return errSlowClient
+	}
+}
+
+// outbound is an encoded message queued on one of a client's lanes, with
+// its type so writePump can decide whether to compress it. queuedAt is set
+// on the messages sampled for sendQueueWait.
+type outbound struct {
+	msgType  string
+	data     []byte
+	queuedAt time.Time
+}
+
+// queueSampleEvery is how many of a client's messages pass through its
+// lanes for each one timed, keeping clock reads off most sends.
+const queueSampleEvery = 16
+
+func (c *client) queueDepth() int { return len(c.send) + len(c.sendLow) }
+
+func (c *client) lastQueueWait() time.Duration { return time.Duration(c.queueWait.Load()) }
+
+// Close closes the high-priority lane, which makes writePump send a close
+// frame for reason and exit.
+func (c *client) Close(reason closeReason) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	c.closed = true
+	c.removedFor = reason
+	close(c.send)
+}
+
+// offersSupportedProtocol reports whether the upgrade request offers at
+// least one protocol version this server speaks.
+func offersSupportedProtocol(r *http.Request) bool {
+	for _, p := range websocket.Subprotocols(r) {
+		if _, ok := protocolVersions[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setKeepAlive enables TCP keepalive probes every period on conn, looking
+// through TLS. Other transports are left alone.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		log.Printf("enable TCP keepalive: %v", err)
+		return
+	}
+	if err := tcp.SetKeepAlivePeriod(period); err != nil {
+		log.Printf("set TCP keepalive period: %v", err)
+	}
+}
+
+// offersDeflate reports whether the handshake offers permessage-deflate,
+// which is the only extension the upgrader negotiates.
+func offersDeflate(r *http.Request) bool {
+	for _, v := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negotiatedProtocol returns the version selected during the upgrade.
+// Clients that didn't ask for one are treated as speaking the latest.
+func negotiatedProtocol(conn *websocket.Conn) int {
+	if v, ok := protocolVersions[conn.Subprotocol()]; ok {
+		return v
+	}
+	return latestProtocol
+}
+
+// maxClientVersion bounds a client version label, keeping the metric's
+// cardinality and the log line in check.
+const maxClientVersion = 32
+
+// clientVersionLabel turns a client-supplied version into a metric label:
+// "unknown" when absent and "invalid" when too long or containing
+// anything but letters, digits, '.', '-', '_' and '+'.
+func clientVersionLabel(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	if len(v) > maxClientVersion {
+		return "invalid"
+	}
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(".-_+", r)) {
+			return "invalid"
+		}
+	}
+	return v
 }
 
-func randomID() string {
-	buf := make([]byte, 8)
-	if _, err := rand.Read(buf); err != nil {
-		ts := time.Now().UnixNano()
-		return hex.EncodeToString([]byte{byte(ts >> 8), byte(ts)})
+// requestedClientVersion reads the build a client announces at connect,
+// as ?clientVersion= or its shorter alias ?build=.
+func requestedClientVersion(r *http.Request) string {
+	q := r.URL.Query()
+	if v := q.Get("clientVersion"); v != "" {
+		return v
 	}
-	return hex.EncodeToString(buf)
+	return q.Get("build")
 }
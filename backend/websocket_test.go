@@ -0,0 +1,1343 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// storeTestChat puts a chat in room's history as if it had been
+// broadcast a second ago.
+func storeTestChat(t *testing.T, h *hub, room, text string) {
+	t.Helper()
+	data, err := json.Marshal(message{Type: "chat", Text: text, Room: room})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.history.add(storedMessage{room: room, at: time.Now().Add(-time.Second), msgType: "chat", data: data})
+}
+
+// types lists the types of msgs, for failure messages.
+func types(msgs []message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.Type
+	}
+	return out
+}
+
+// hasType reports whether msgs include one of type msgType.
+func hasType(msgs []message, msgType string) bool {
+	for _, m := range msgs {
+		if m.Type == msgType {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHistoryReplayedOnConnect(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	storeTestChat(t, h, defaultRoom, "earlier")
+
+	msgs := dialTestClient(t, base, "", "").RecvAll(200 * time.Millisecond)
+	if !hasType(msgs, "chat") {
+		t.Errorf("got %v, want the stored chat replayed", types(msgs))
+	}
+}
+
+func TestHistoryReplayKeepsToByteBudget(t *testing.T) {
+	cfg := testConfig()
+	// Room for the newest two of the roughly 1 KiB chats, not three.
+	cfg.historyReplayBytes = 2500
+	h, base := newTestServer(t, cfg)
+	for i := 0; i < 5; i++ {
+		storeTestChat(t, h, defaultRoom, strings.Repeat(strconv.Itoa(i), 1000))
+	}
+
+	var welcome *message
+	var replayed []string
+	for _, m := range dialTestClient(t, base, "", "").RecvAll(200 * time.Millisecond) {
+		switch {
+		case m.Key == msgConnected:
+			w := m
+			welcome = &w
+		case m.Type == "chat":
+			replayed = append(replayed, m.Text[:1])
+		}
+	}
+	if got := strings.Join(replayed, ""); got != "34" {
+		t.Errorf("replayed %q, want the newest two chats, 34", got)
+	}
+	if welcome == nil || !welcome.HistoryTruncated {
+		t.Errorf("welcome %+v doesn't say history was truncated", welcome)
+	}
+
+	cfg.historyReplayBytes = 0
+	unbounded := NewHub(cfg)
+	unbounded.history = h.history
+	if all, more := unbounded.replaySet(defaultRoom, time.Time{}); len(all) != 5 || more {
+		t.Errorf("without a budget replay has %d, more %t, want all 5 and no more", len(all), more)
+	}
+}
+
+// slowTestStore is a memoryStore whose reads take a while, recording
+// how many were ever in progress at once.
+type slowTestStore struct {
+	*memoryStore
+	active, peak atomic.Int32
+}
+
+func (s *slowTestStore) recent(room string, since time.Time, limit int) []storedMessage {
+	n := s.active.Add(1)
+	defer s.active.Add(-1)
+	for peak := s.peak.Load(); n > peak && !s.peak.CompareAndSwap(peak, n); peak = s.peak.Load() {
+	}
+	time.Sleep(20 * time.Millisecond)
+	return s.memoryStore.recent(room, since, limit)
+}
+
+func TestHistoryReplaysAreBounded(t *testing.T) {
+	cfg := testConfig()
+	cfg.maxReplays = 2
+	store := &slowTestStore{memoryStore: newMemoryStore(10)}
+	h := NewHub(cfg)
+	h.history = store
+	go h.Run()
+	base := serveTestHub(t, h)
+	storeTestChat(t, h, defaultRoom, "earlier")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dialTestClient(t, base, "", "")
+			if !hasType(c.RecvAll(100*time.Millisecond), "chat") {
+				t.Error("client wasn't replayed history")
+			}
+		}()
+	}
+	wg.Wait()
+	if peak := store.peak.Load(); peak != 2 {
+		t.Errorf("%d replays ran at once, want the limit of 2", peak)
+	}
+}
+
+func TestHistoryReplaySkippedPastQueueWait(t *testing.T) {
+	cfg := testConfig()
+	cfg.maxReplays = 1
+	cfg.replayQueueWait = 10 * time.Millisecond
+	h, base := newTestServer(t, cfg)
+	storeTestChat(t, h, defaultRoom, "earlier")
+	h.replays <- struct{}{}
+	defer func() { <-h.replays }()
+
+	var welcome *message
+	msgs := dialTestClient(t, base, "", "").RecvAll(100 * time.Millisecond)
+	for _, m := range msgs {
+		if m.Key == msgConnected {
+			w := m
+			welcome = &w
+		}
+	}
+	if hasType(msgs, "chat") || welcome == nil || !welcome.HistoryTruncated {
+		t.Errorf("with no replay slot got %v, want a welcome saying history was left out and no replay", types(msgs))
+	}
+}
+
+func TestHistoryWithheldUntilAuthenticated(t *testing.T) {
+	cfg := testConfig()
+	cfg.authSecret = "secret"
+	h, base := newTestServer(t, cfg)
+	storeTestChat(t, h, defaultRoom, "earlier")
+
+	msgs := dialTestClient(t, base, "", "").RecvAll(200 * time.Millisecond)
+	if !hasType(msgs, "auth_challenge") {
+		t.Errorf("got %v, want an auth challenge", types(msgs))
+	}
+	if hasType(msgs, "chat") {
+		t.Errorf("unauthenticated client was replayed history: %v", types(msgs))
+	}
+}
+
+func TestUpgradeRetryAfterIsJittered(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		v := upgradeRetryAfter()
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxUpgradeRetryAfter {
+			t.Fatalf("Retry-After %q, want whole seconds from 1 to %d", v, maxUpgradeRetryAfter)
+		}
+		seen[v] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("200 refusals all got Retry-After %v", seen)
+	}
+}
+
+// checkTestRefusal fails t unless resp is refuseUpgrade's answer for
+// reason.
+func checkTestRefusal(t *testing.T, resp *http.Response, reason string) {
+	t.Helper()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("upgrade answered %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if n, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || n < 1 || n > maxUpgradeRetryAfter {
+		t.Errorf("Retry-After %q, want whole seconds from 1 to %d", resp.Header.Get("Retry-After"), maxUpgradeRetryAfter)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body["reason"] != reason {
+		t.Errorf("body %v (%v), want reason %s", body, err, reason)
+	}
+}
+
+func TestSaturatedUpgradesAreRefusedWithRetryAfter(t *testing.T) {
+	cfg := testConfig()
+	cfg.maxUpgrades = 1
+	cfg.upgradeQueueWait = 10 * time.Millisecond
+	h, base := newTestServer(t, cfg)
+	h.upgrades <- struct{}{} // a handshake in progress holds the only slot
+
+	resp, err := http.Get(base + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	checkTestRefusal(t, resp, upgradeAtCapacity)
+}
+
+func TestUpgradesRefusedWhileDraining(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	dialTestClient(t, base, "", "").RecvAll(100 * time.Millisecond)
+	if n := h.drain("deploy", 0); n != 1 {
+		t.Fatalf("drained %d clients, want 1", n)
+	}
+
+	resp, err := http.Get(base + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	checkTestRefusal(t, resp, upgradeDraining)
+}
+
+func TestRelayedChatDropsServerFields(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+	sender := dialTestClient(t, base, "", "")
+	receiver := dialTestClient(t, base, "", "")
+	sender.RecvAll(100 * time.Millisecond)
+	receiver.RecvAll(100 * time.Millisecond)
+
+	sender.Send(message{
+		Type:      "chat",
+		Text:      "hello",
+		Nick:      "admin",
+		User:      "admin",
+		Key:       msgExternal,
+		Flagged:   true,
+		Truncated: true,
+		Action:    true,
+		Quote:     "forged",
+		Preview:   &linkPreview{MessageID: "x", URL: "https://example.com", Title: "forged"},
+		Poll:      &pollView{ID: "forged"},
+		Status:    &serverStatus{Clients: 1000},
+	})
+	for _, m := range receiver.RecvAll(200 * time.Millisecond) {
+		if m.Type != "chat" {
+			continue
+		}
+		if m.Text != "hello" {
+			t.Errorf("relayed text %q, want hello", m.Text)
+		}
+		if m.Nick != "" || m.User != "" || m.Key != "" || m.Flagged || m.Truncated || m.Action || m.Quote != "" ||
+			m.Preview != nil || m.Poll != nil || m.Status != nil {
+			t.Errorf("relayed chat kept fields the sender forged: %+v", m)
+		}
+		return
+	}
+	t.Fatal("receiver never got the chat")
+}
+
+// welcomeTestCapabilities returns the capabilities a client connecting
+// to a server for cfg is welcomed with.
+func welcomeTestCapabilities(t *testing.T, cfg config) capabilities {
+	t.Helper()
+	_, base := newTestServer(t, cfg)
+	for _, m := range dialTestClient(t, base, "", "").RecvAll(100 * time.Millisecond) {
+		if m.Key == msgConnected && m.Capabilities != nil {
+			return *m.Capabilities
+		}
+	}
+	t.Fatal("no welcome with capabilities")
+	return capabilities{}
+}
+
+func TestWelcomeCapabilitiesReflectConfig(t *testing.T) {
+	t.Run("Enabled", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.chatRate, cfg.chatBurst = 2, 4
+		cfg.messageRate, cfg.messageBurst = 20, 0
+		cfg.rooms = map[string]roomConfig{defaultRoom: {MaxTextBytes: 500}}
+		got := welcomeTestCapabilities(t, cfg)
+		if !got.History || !got.Rooms {
+			t.Errorf("history %t rooms %t, want both on by default", got.History, got.Rooms)
+		}
+		if got.ChatPerSec != 2 || got.ChatBurst != 4 || got.MessagesPerSec != 20 || got.MessageBurst != 1 {
+			t.Errorf("rate limits %+v, want chat 2/4 and messages 20/1", got)
+		}
+		if got.MaxTextBytes != 500 {
+			t.Errorf("maxTextBytes %d, want the lobby's 500", got.MaxTextBytes)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.historyStore = historyNone
+		cfg.roomCreation = roomCreationClosed
+		cfg.chatRate, cfg.messageRate = 0, 0
+		got := welcomeTestCapabilities(t, cfg)
+		if got.History || got.Rooms {
+			t.Errorf("history %t rooms %t, want both off", got.History, got.Rooms)
+		}
+		if got.ChatPerSec != 0 || got.ChatBurst != 0 || got.MessagesPerSec != 0 || got.MessageBurst != 0 {
+			t.Errorf("rate limits %+v, want none with the limits off", got)
+		}
+	})
+}
+
+func TestOversizedAfterEnrichment(t *testing.T) {
+	// The frame the client sends fits the lobby's limit; the ids, sender
+	// and timestamp the server adds push the broadcast over it.
+	text := strings.Repeat("a", 260)
+	roomLimits := map[string]roomConfig{defaultRoom: {MaxMessageBytes: 300, MaxTextBytes: 300}}
+
+	t.Run("Truncate", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.rooms = roomLimits
+		cfg.oversizePolicy = oversizeTruncate
+		_, sender, receiver := replyTestPair(t, cfg)
+		sender.Send(message{Type: "chat", Text: text})
+		got, ok := relayedChat(receiver.RecvAll(200 * time.Millisecond))
+		if !ok {
+			t.Fatal("receiver never got the chat")
+		}
+		if !got.Truncated || !strings.HasSuffix(got.Text, "…") || len(got.Text) >= len(text) {
+			t.Errorf("oversized chat relayed with truncated %t and %d bytes of text, want it cut short with an ellipsis", got.Truncated, len(got.Text))
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.rooms = roomLimits
+		cfg.oversizePolicy = oversizeReject
+		_, sender, receiver := replyTestPair(t, cfg)
+		sender.Send(message{Type: "chat", Text: text})
+		if !refusedWith(sender.RecvAll(200*time.Millisecond), msgTooLarge) {
+			t.Error("sender wasn't told the message is too large")
+		}
+		if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+			t.Error("an oversized chat was relayed")
+		}
+	})
+}
+
+func TestEnqueueGivesUpOnBlockedHub(t *testing.T) {
+	cfg := testConfig()
+	cfg.broadcastEnqueueTimeout = 20 * time.Millisecond
+	h := NewHub(cfg) // Run isn't started, so nothing drains the queue
+	for len(h.broadcast) < cap(h.broadcast) {
+		h.broadcast <- envelope{}
+	}
+	c := &client{id: "c1", hub: h, send: make(chan outbound, 16), sendLow: make(chan outbound, 16)}
+
+	start := time.Now()
+	if c.enqueueBroadcast(envelope{msgType: "chat", msgID: "m1", data: []byte(`{}`)}) {
+		t.Fatal("a blocked queue took the message")
+	}
+	if waited := time.Since(start); waited < cfg.broadcastEnqueueTimeout || waited > time.Second {
+		t.Errorf("gave up after %v, want about %v", waited, cfg.broadcastEnqueueTimeout)
+	}
+	select {
+	case d := <-h.direct:
+		var nack message
+		if err := json.Unmarshal(d.data, &nack); err != nil || nack.Type != "nack" || nack.ID != "m1" || nack.Key != msgServerBusy {
+			t.Errorf("sender was sent %s, want a server_busy nack of m1", d.data)
+		}
+	default:
+		t.Error("sender wasn't nacked")
+	}
+}
+
+func TestSenderGetsPendingThenAck(t *testing.T) {
+	_, sender, receiver := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", ID: "c1", Text: "hello"})
+
+	var receipts []string
+	for _, m := range sender.RecvAll(200 * time.Millisecond) {
+		if (m.Type == "pending" || m.Type == "ack") && m.ID == "c1" {
+			receipts = append(receipts, m.Type)
+		}
+	}
+	if got := strings.Join(receipts, ","); got != "pending,ack" {
+		t.Errorf("sender's receipts for c1 were %q, want pending,ack", got)
+	}
+	for _, m := range receiver.RecvAll(100 * time.Millisecond) {
+		if m.Type == "pending" || m.Type == "ack" {
+			t.Errorf("receiver was sent the sender's %s receipt", m.Type)
+		}
+	}
+}
+
+// dialTestProtocols opens a websocket offering protocols, returning the
+// connection, or nil and the handshake's status if it was refused.
+func dialTestProtocols(t *testing.T, base string, protocols ...string) (*websocket.Conn, int) {
+	t.Helper()
+	d := websocket.Dialer{Subprotocols: protocols}
+	conn, resp, err := d.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, resp.StatusCode
+}
+
+// sendTestReceipted sends a chat on conn and reports whether its
+// receipts came back.
+func sendTestReceipted(t *testing.T, conn *websocket.Conn) bool {
+	t.Helper()
+	if err := conn.WriteJSON(message{Type: "chat", ID: "r1", Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		var m message
+		if err := conn.ReadJSON(&m); err != nil {
+			return false
+		}
+		if m.Type == "ack" && m.ID == "r1" {
+			return true
+		}
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	_, base := newTestServer(t, testConfig())
+
+	v2, _ := dialTestProtocols(t, base, protocolV1, protocolV2)
+	if got := v2.Subprotocol(); got != protocolV2 {
+		t.Errorf("offering v1 and v2 selected %q, want the highest, %s", got, protocolV2)
+	}
+	if !sendTestReceipted(t, v2) {
+		t.Error("a v2 client got no receipts")
+	}
+
+	v1, _ := dialTestProtocols(t, base, protocolV1)
+	if got := v1.Subprotocol(); got != protocolV1 {
+		t.Errorf("offering v1 selected %q", got)
+	}
+	if sendTestReceipted(t, v1) {
+		t.Error("a v1 client was sent receipts it doesn't understand")
+	}
+
+	if conn, _ := dialTestProtocols(t, base, "useebird.v9"); conn == nil {
+		t.Error("without STRICT_PROTOCOL an unsupported version was refused")
+	}
+}
+
+func TestStrictProtocolRefusesUnsupportedVersion(t *testing.T) {
+	cfg := testConfig()
+	cfg.strictProtocol = true
+	_, base := newTestServer(t, cfg)
+	if conn, status := dialTestProtocols(t, base, "useebird.v9"); conn != nil || status != http.StatusBadRequest {
+		t.Errorf("an unsupported version got status %d, want %d", status, http.StatusBadRequest)
+	}
+	if conn, _ := dialTestProtocols(t, base, protocolV1); conn == nil {
+		t.Error("a supported version was refused")
+	}
+}
+
+func TestUpgradeWithoutSubprotocol(t *testing.T) {
+	for name, strict := range map[string]bool{"Lenient": false, "Strict": true} {
+		strict := strict
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.strictProtocol = strict
+			_, base := newTestServer(t, cfg)
+
+			conn, status := dialTestProtocols(t, base)
+			switch {
+			case strict && (conn != nil || status != http.StatusBadRequest):
+				t.Errorf("an upgrade without a subprotocol got status %d, want %d", status, http.StatusBadRequest)
+			case !strict && conn == nil:
+				t.Errorf("an upgrade without a subprotocol got status %d, want it accepted", status)
+			case !strict && !sendTestReceipted(t, conn):
+				t.Error("an unversioned client wasn't treated as the latest version")
+			}
+
+			if conn, status := dialTestProtocols(t, base, protocolV2); conn == nil {
+				t.Errorf("an upgrade offering %s got status %d", protocolV2, status)
+			}
+		})
+	}
+}
+
+// deadlineFailConn is a connection whose read deadline can't be set once
+// the upgrader is done with it, like a socket the kernel has torn down.
+// Only the read side can be made to fail: gorilla's SetWriteDeadline just
+// records the deadline and never reaches the connection.
+type deadlineFailConn struct {
+	net.Conn
+}
+
+func (c *deadlineFailConn) SetReadDeadline(time.Time) error {
+	return errors.New("deadline unsupported")
+}
+
+// wrappingWriter hands the upgrader the hijacked connection wrapped by
+// wrap, so a test can stand in for the socket under a real upgrade.
+type wrappingWriter struct {
+	http.ResponseWriter
+	wrap func(net.Conn) net.Conn
+}
+
+func (w *wrappingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.wrap(conn), rw, nil
+}
+
+// wrappedTestServer runs h behind a websocket endpoint whose connections
+// are wrapped by wrap, checking for leaked connections on cleanup.
+func wrappedTestServer(t *testing.T, h *hub, wrap func(net.Conn) net.Conn) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWebsocket(h, &wrappingWriter{w, wrap}, r)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		checkNoConnLeaks(t)
+	})
+	return srv.URL
+}
+
+func TestDeadlineErrorFailsTheClient(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	base := wrappedTestServer(t, h, func(conn net.Conn) net.Conn { return &deadlineFailConn{conn} })
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(time.Second)
+	select {
+	case <-c.in:
+	default:
+		t.Fatal("connection still open after its read deadline couldn't be set")
+	}
+	waitFor(t, "the client to be unregistered", func() bool { return h.clientCount.Load() == 0 })
+}
+
+func TestConnectionStormDuringBroadcasts(t *testing.T) {
+	h, base := newTestServer(t, testConfig())
+	// Enough listeners that every fan-out keeps Run busy for a while.
+	registerTestClients(t, h, 200)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				h.injectSystem("busy", defaultRoom)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	var wg sync.WaitGroup
+	var slowest atomic.Int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			c := dialTestClient(t, base, "", "")
+			for {
+				m, ok := c.Recv(2 * time.Second)
+				if !ok {
+					t.Error("no welcome during the broadcast storm")
+					return
+				}
+				if m.Key == msgConnected {
+					break
+				}
+			}
+			took := int64(time.Since(start))
+			for {
+				prev := slowest.Load()
+				if took <= prev || slowest.CompareAndSwap(prev, took) {
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if took := time.Duration(slowest.Load()); took > time.Second {
+		t.Errorf("slowest handshake took %v while broadcasting, want under a second", took)
+	}
+}
+
+func TestServerStatusSentPeriodically(t *testing.T) {
+	t.Run("Enabled", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.serverStatusInterval = 30 * time.Millisecond
+		_, base := newTestServer(t, cfg)
+		c := dialTestClient(t, base, "", "")
+		deadline := time.After(time.Second)
+		for n := 0; n < 3; {
+			select {
+			case m := <-c.in:
+				if m.Type != "server_status" {
+					continue
+				}
+				if m.Status == nil || m.Status.Clients != 1 {
+					t.Fatalf("server_status carried %+v, want a load hint counting 1 client", m.Status)
+				}
+				n++
+			case <-deadline:
+				t.Fatalf("got %d server_status messages in a second, want one every 30ms", n)
+			}
+		}
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		_, base := newTestServer(t, testConfig())
+		if msgs := dialTestClient(t, base, "", "").RecvAll(200 * time.Millisecond); hasType(msgs, "server_status") {
+			t.Error("server_status sent with the interval off")
+		}
+	})
+}
+
+func TestEgressLimitSlowsBursts(t *testing.T) {
+	const rate, frames, size = 64000, 12, 8000
+	cfg := testConfig()
+	cfg.egressBytesPerSec = rate
+	h, base := newTestServer(t, cfg)
+	c := dialTestClient(t, base, "", "")
+	c.RecvAll(100 * time.Millisecond)
+
+	text := strings.Repeat("x", size)
+	start := time.Now()
+	for i := 0; i < frames; i++ {
+		h.injectSystem(text, defaultRoom)
+	}
+	for got := 0; got < frames; {
+		m, ok := c.Recv(2 * time.Second)
+		if !ok {
+			t.Fatalf("got %d of %d large messages", got, frames)
+		}
+		if m.Text == text {
+			got++
+		}
+	}
+	// The bucket starts full, so only what's past the first second's
+	// worth has to wait.
+	want := time.Duration(float64(frames*size-rate) / rate * float64(time.Second))
+	if took := time.Since(start); took < want*9/10 {
+		t.Errorf("%d bytes arrived in %v, faster than %d bytes/s allows (%v)", frames*size, took, rate, want)
+	}
+}
+
+func TestFullLowLaneDoesNotHoldUpChat(t *testing.T) {
+	h := NewHub(testConfig())
+	c := &client{id: "c1", hub: h, send: make(chan outbound, 16), sendLow: make(chan outbound, 16)}
+	for len(c.sendLow) < cap(c.sendLow) {
+		if err := c.Send("typing", []byte(`{}`)); err != nil {
+			t.Fatalf("typing on a free low lane: %v", err)
+		}
+	}
+	if err := c.Send("presence", []byte(`{}`)); err != nil {
+		t.Errorf("overflowing the low lane returned %v, want the update dropped quietly", err)
+	}
+	if err := c.Send("chat", []byte(`{}`)); err != nil {
+		t.Fatalf("chat behind a full low lane: %v", err)
+	}
+	if len(c.send) != 1 || len(c.sendLow) != cap(c.sendLow) {
+		t.Fatalf("lanes hold %d high and %d low, want the chat alone on the high lane", len(c.send), len(c.sendLow))
+	}
+	if out := <-c.send; out.msgType != "chat" {
+		t.Errorf("high lane carries %s, want chat", out.msgType)
+	}
+}
+
+// deadlineRecordConn remembers the last read deadline set on it.
+type deadlineRecordConn struct {
+	net.Conn
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *deadlineRecordConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *deadlineRecordConn) readDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+func TestReadGraceExtendsReadDeadline(t *testing.T) {
+	cfg := testConfig()
+	cfg.readGrace = 5 * time.Second
+	h := startTestHub(t, cfg)
+	conns := make(chan *deadlineRecordConn, 1)
+	base := wrappedTestServer(t, h, func(conn net.Conn) net.Conn {
+		rec := &deadlineRecordConn{Conn: conn}
+		conns <- rec
+		return rec
+	})
+
+	start := time.Now()
+	dialTestClient(t, base, "", "").RecvAll(100 * time.Millisecond)
+	rec := <-conns
+	waitFor(t, "a read deadline", func() bool { return !rec.readDeadline().IsZero() })
+	if got, want := rec.readDeadline().Sub(start), pongWait+cfg.readGrace; got < want || got > want+time.Second {
+		t.Errorf("read deadline set %v ahead, want pongWait plus the %v grace, %v", got, cfg.readGrace, want)
+	}
+}
+
+func TestCompressionBombClosedAsTooBig(t *testing.T) {
+	cfg := testConfig()
+	cfg.compressMinClients = 1
+	h, base := newTestServer(t, cfg)
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("deflate wasn't negotiated: %q", ext)
+	}
+
+	// A run of one byte deflates to a frame far under the limit but
+	// inflates to four times it.
+	bomb := strings.Repeat("a", h.cfg.frameLimit(defaultRoom)*4)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(bomb)); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := closeTestCode(t, conn); code != websocket.CloseMessageTooBig {
+		t.Errorf("closed with %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+}
+
+func marshalErrorCount() float64 {
+	marshalErrors.mu.Lock()
+	defer marshalErrors.mu.Unlock()
+	return marshalErrors.value
+}
+
+func TestMarshalFailureNacksSender(t *testing.T) {
+	h := NewHub(testConfig())
+	// json.RawMessage refuses to marshal invalid JSON, standing in for any
+	// field that can't be encoded.
+	h.transforms = append(h.transforms, func(c *client, msg *message) error {
+		msg.Raw = json.RawMessage("{")
+		return nil
+	})
+	c := &client{id: "c1", hub: h, send: make(chan outbound, 16), sendLow: make(chan outbound, 16)}
+
+	before := marshalErrorCount()
+	if _, ok := c.prepareBroadcast([]byte(`{"type":"chat","id":"m1","text":"hi"}`)); ok {
+		t.Fatal("a message that can't be encoded was accepted for broadcast")
+	}
+	if got := marshalErrorCount(); got != before+1 {
+		t.Errorf("marshal errors went from %v to %v, want one more", before, got)
+	}
+	select {
+	case d := <-h.direct:
+		var nack message
+		if err := json.Unmarshal(d.data, &nack); err != nil || nack.Type != "nack" || nack.ID != "m1" || nack.Key != msgInternalError {
+			t.Errorf("sender was sent %s, want an internal_error nack of m1", d.data)
+		}
+	default:
+		t.Error("sender wasn't nacked")
+	}
+}
+
+func TestFieldLimitBoundaries(t *testing.T) {
+	setters := map[string]func(*message, string){
+		"text":       func(m *message, v string) { m.Text = v },
+		"id":         func(m *message, v string) { m.ID = v },
+		"target":     func(m *message, v string) { m.Target = v },
+		"replyTo":    func(m *message, v string) { m.ReplyTo = v },
+		"draftId":    func(m *message, v string) { m.DraftID = v },
+		"sentAt":     func(m *message, v string) { m.SentAt = v },
+		"clientTime": func(m *message, v string) { m.ClientTime = v },
+		"lang":       func(m *message, v string) { m.Lang = v },
+		"token":      func(m *message, v string) { m.Token = v },
+		"sdp":        func(m *message, v string) { m.SDP = v },
+		"candidate":  func(m *message, v string) { m.Candidate = v },
+	}
+	cfg := testConfig()
+	for _, f := range fieldLimits {
+		set, ok := setters[f.name]
+		if !ok {
+			t.Errorf("no test for the %s limit", f.name)
+			continue
+		}
+		var atLimit, overLimit message
+		set(&atLimit, strings.Repeat("a", f.max))
+		set(&overLimit, strings.Repeat("a", f.max+1))
+		if got := cfg.longField(defaultRoom, &atLimit); got != "" {
+			t.Errorf("%s of %d bytes, its limit, reported %s too long", f.name, f.max, got)
+		}
+		if got := cfg.longField(defaultRoom, &overLimit); got != f.name {
+			t.Errorf("%s of %d bytes reported %q too long, want %s", f.name, f.max+1, got, f.name)
+		}
+	}
+}
+
+func TestFieldTooLongNamesTheField(t *testing.T) {
+	_, sender, receiver := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "chat", ID: strings.Repeat("a", maxIDBytes+1), Text: "hi"})
+	if !refusedWith(sender.RecvAll(200*time.Millisecond), "id_too_long") {
+		t.Error("sender wasn't told the id is too long")
+	}
+	if _, ok := relayedChat(receiver.RecvAll(100 * time.Millisecond)); ok {
+		t.Error("a chat with an over-long id was relayed")
+	}
+}
+
+func TestSenderMessagesArriveInOrder(t *testing.T) {
+	// Fewer than a send queue holds, so the burst can't get either client
+	// dropped as a slow consumer.
+	const n = 12
+	for _, strict := range []bool{false, true} {
+		strict := strict
+		t.Run("Strict="+strconv.FormatBool(strict), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.chatRate, cfg.messageRate = 0, 0
+			cfg.strictSenderOrder = strict
+			_, sender, receiver := replyTestPair(t, cfg)
+			for i := 0; i < n; i++ {
+				sender.Send(message{Type: "chat", Text: strconv.Itoa(i)})
+			}
+			var got []message
+			for _, m := range receiver.RecvAll(200 * time.Millisecond) {
+				if m.Type == "chat" {
+					got = append(got, m)
+				}
+			}
+			if len(got) != n {
+				t.Fatalf("receiver got %d of %d chats", len(got), n)
+			}
+			for i, m := range got {
+				if m.Text != strconv.Itoa(i) {
+					t.Fatalf("chat %d carries %q, want them in send order", i, m.Text)
+				}
+				if strict && m.SenderSeq != uint64(i+1) {
+					t.Errorf("chat %d has senderSeq %d, want %d", i, m.SenderSeq, i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeSyncExchange(t *testing.T) {
+	h, sender, receiver := replyTestPair(t, testConfig())
+	clientTime := "2024-01-02T03:04:05.123Z"
+	before := time.Now()
+	sender.Send(message{Type: "time_sync", ClientTime: clientTime})
+
+	var reply *message
+	for _, m := range sender.RecvAll(200 * time.Millisecond) {
+		if m.Type == "time_sync" {
+			m := m
+			reply = &m
+		}
+	}
+	after := time.Now()
+	if reply == nil {
+		t.Fatal("no time_sync reply")
+	}
+	if reply.ClientTime != clientTime {
+		t.Errorf("reply echoes clientTime %q, want %q", reply.ClientTime, clientTime)
+	}
+	received, err1 := time.Parse(time.RFC3339Nano, reply.ReceiveTime)
+	transmitted, err2 := time.Parse(time.RFC3339Nano, reply.TransmitTime)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("reply times %q and %q don't parse", reply.ReceiveTime, reply.TransmitTime)
+	}
+	if received.Before(before) || transmitted.Before(received) || transmitted.After(after) {
+		t.Errorf("received %v and transmitted %v, want them in order within %v to %v", received, transmitted, before, after)
+	}
+
+	if hasType(receiver.RecvAll(100*time.Millisecond), "time_sync") {
+		t.Error("time_sync reached another client")
+	}
+	if n := len(h.history.recent(defaultRoom, time.Time{}, 10)); n != 0 {
+		t.Errorf("history holds %d messages after a time sync", n)
+	}
+}
+
+func TestCloseCodeFollowsRemovalReason(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		remove func(h *hub)
+		code   int
+		text   string
+	}{
+		{"Kicked", func(h *hub) { h.reapSync(0) }, closeCodeKicked, "kicked"},
+		{"Shutdown", func(h *hub) { h.drain("deploy", time.Second) }, websocket.CloseGoingAway, "server shutting down"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h, base := newTestServer(t, testConfig())
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			waitFor(t, "the client to register", func() bool { return h.clientCount.Load() == 1 })
+			tc.remove(h)
+			if code, text := closeTestCode(t, conn); code != tc.code || text != tc.text {
+				t.Errorf("closed with %d %q, want %d %q", code, text, tc.code, tc.text)
+			}
+		})
+	}
+}
+
+func TestKeepAliveToleratesNonTCPConns(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	setKeepAlive(a, time.Second)
+	setKeepAlive(tls.Client(b, &tls.Config{}), time.Second)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	setKeepAlive(conn, time.Second)
+	setKeepAlive(tls.Client(conn, &tls.Config{}), time.Second)
+}
+
+func TestKeepAliveOnWrappedUpgrade(t *testing.T) {
+	cfg := testConfig()
+	cfg.tcpKeepAlive = time.Second
+	h := startTestHub(t, cfg)
+	// The wrapper hides the *net.TCPConn, as a non-TCP transport would.
+	base := wrappedTestServer(t, h, func(conn net.Conn) net.Conn { return &deadlineRecordConn{Conn: conn} })
+	if welcome, ok := dialTestClient(t, base, "", "").Recv(time.Second); !ok || welcome.Key != msgConnected {
+		t.Errorf("got %+v, want the welcome on a non-TCP connection", welcome)
+	}
+}
+
+func TestNoCompressOptOut(t *testing.T) {
+	cfg := testConfig()
+	cfg.compressMinClients = 1
+	_, base := newTestServer(t, cfg)
+	dialer := websocket.Dialer{EnableCompression: true}
+	for _, tc := range []struct {
+		query   string
+		deflate bool
+	}{
+		{"", true},
+		{"?nocompress=1", false},
+	} {
+		conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws"+tc.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ext := resp.Header.Get("Sec-Websocket-Extensions")
+		if got := strings.Contains(ext, "permessage-deflate"); got != tc.deflate {
+			t.Errorf("/ws%s negotiated %q, want deflate %t", tc.query, ext, tc.deflate)
+		}
+		// Without the extension gorilla rejects a frame with the
+		// compressed bit set, so reading the welcome proves it was sent
+		// plain.
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Errorf("/ws%s: reading the welcome: %v", tc.query, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestPingAnsweredWithUnicastPong(t *testing.T) {
+	_, sender, other := replyTestPair(t, testConfig())
+	sender.Send(message{Type: "ping", ID: "rtt", SentAt: "2024-01-02T03:04:05Z"})
+	var pong *message
+	for _, m := range sender.RecvAll(200 * time.Millisecond) {
+		if m.Type == "pong" {
+			got := m
+			pong = &got
+		}
+	}
+	if pong == nil || pong.ID != "rtt" || pong.SentAt != "2024-01-02T03:04:05Z" {
+		t.Errorf("sender got pong %+v, want one echoing the id and sentAt", pong)
+	}
+	for _, m := range other.RecvAll(100 * time.Millisecond) {
+		if m.Type == "ping" || m.Type == "pong" {
+			t.Errorf("the room was sent a %s", m.Type)
+		}
+	}
+}
+
+// messageCount returns how many messages of msgType ended with outcome.
+func messageCount(msgType, outcome string) float64 {
+	messagesTotal.mu.Lock()
+	defer messagesTotal.mu.Unlock()
+	return messagesTotal.values[msgType+"\x00"+outcome]
+}
+
+func TestDebugEcho(t *testing.T) {
+	t.Run("On", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.debugEcho = true
+		_, sender, other := replyTestPair(t, cfg)
+		sender.Send(message{Type: "echo", Text: "hi"})
+		var echo *message
+		for _, m := range sender.RecvAll(200 * time.Millisecond) {
+			if m.Type == "echo" {
+				got := m
+				echo = &got
+			}
+		}
+		if echo == nil {
+			t.Fatal("sender got no echo")
+		}
+		if echo.Echo == nil || echo.Echo.Text != "hi" || echo.Echo.Sender == "" || echo.ID == "" {
+			t.Errorf("echo carries parsed %+v and id %q, want the text, sender and an id", echo.Echo, echo.ID)
+		}
+		if !strings.Contains(string(echo.Raw), `"hi"`) || echo.ReceiveTime == "" {
+			t.Errorf("echo has raw %s and receive time %q, want the payload and a time", echo.Raw, echo.ReceiveTime)
+		}
+		if msgs := other.RecvAll(100 * time.Millisecond); hasType(msgs, "echo") {
+			t.Errorf("the echo was delivered to another client: %v", types(msgs))
+		}
+	})
+
+	t.Run("Off", func(t *testing.T) {
+		_, sender, other := replyTestPair(t, testConfig())
+		before := messageCount("echo", outcomeRejected)
+		sender.Send(message{Type: "echo", Text: "hi"})
+		if hasType(sender.RecvAll(200*time.Millisecond), "echo") {
+			t.Error("echo answered with DEBUG_ECHO off")
+		}
+		if hasType(other.RecvAll(100*time.Millisecond), "echo") {
+			t.Error("echo relayed with DEBUG_ECHO off")
+		}
+		if got := messageCount("echo", outcomeRejected); got != before+1 {
+			t.Errorf("rejected echoes went from %v to %v, want one more", before, got)
+		}
+	})
+}
+
+// timeoutOnceConn fails its second write, the first frame after the
+// upgrade response, with a timeout, and lets every other write through.
+type timeoutOnceConn struct {
+	net.Conn
+	mu          sync.Mutex
+	writes      int
+	afterFailed int
+}
+
+func (c *timeoutOnceConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	writes := c.writes
+	if writes > 2 {
+		c.afterFailed++
+	}
+	c.mu.Unlock()
+	if writes == 2 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *timeoutOnceConn) writesAfterFailure() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.afterFailed
+}
+
+// A write timeout closes the client at once. gorilla keeps the first
+// write error and returns it from every later write, so a connection
+// that would have recovered never gets another frame on the wire.
+func TestWriteTimeoutClosesTheClient(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	conns := make(chan *timeoutOnceConn, 1)
+	base := wrappedTestServer(t, h, func(conn net.Conn) net.Conn {
+		c := &timeoutOnceConn{Conn: conn}
+		conns <- c
+		return c
+	})
+	c := dialTestClient(t, base, "", "")
+	rec := <-conns
+	waitFor(t, "the client to be unregistered", func() bool { return h.clientCount.Load() == 0 })
+	if msgs := c.RecvAll(100 * time.Millisecond); len(msgs) != 0 {
+		t.Errorf("client got %v after its write timed out", types(msgs))
+	}
+	if n := rec.writesAfterFailure(); n != 0 {
+		t.Errorf("%d writes reached the connection after the timeout", n)
+	}
+}
+
+func TestBacklogCountsBothLanes(t *testing.T) {
+	cfg := testConfig()
+	cfg.maxSendBacklog = 20
+	c := &client{id: "c1", hub: NewHub(cfg), send: make(chan outbound, 16), sendLow: make(chan outbound, 16)}
+	for i := 0; i < 12; i++ {
+		if err := c.Send("typing", []byte(`{}`)); err != nil {
+			t.Fatalf("typing %d: %v", i, err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if err := c.Send("chat", []byte(`{}`)); err != nil {
+			t.Fatalf("chat %d: %v", i, err)
+		}
+	}
+	// The chat lane has room; it's the total that is over.
+	if err := c.Send("chat", []byte(`{}`)); !errors.Is(err, errBacklogExceeded) {
+		t.Errorf("a chat past the backlog got %v, want %v", err, errBacklogExceeded)
+	}
+	if !c.overBacklog.Load() {
+		t.Error("the client wasn't marked as over its backlog")
+	}
+}
+
+// stalledConn holds every write while stalled, like a peer that has
+// stopped reading, and lets them through again once resumed.
+type stalledConn struct {
+	net.Conn
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+func (c *stalledConn) stall() {
+	c.mu.Lock()
+	c.resumed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+func (c *stalledConn) resume() {
+	c.mu.Lock()
+	close(c.resumed)
+	c.mu.Unlock()
+}
+
+func (c *stalledConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+	return c.Conn.Write(p)
+}
+
+func TestStalledReaderDisconnectedAtBacklog(t *testing.T) {
+	cfg := testConfig()
+	// Below the lane capacity, so the backlog trips before a lane fills.
+	cfg.maxSendBacklog = 10
+	h := startTestHub(t, cfg)
+	conns := make(chan *stalledConn, 1)
+	base := wrappedTestServer(t, h, func(conn net.Conn) net.Conn {
+		c := &stalledConn{Conn: conn}
+		conns <- c
+		return c
+	})
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var welcome message
+	if err := conn.ReadJSON(&welcome); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the client to register", func() bool { return h.clientCount.Load() == 1 })
+	stalled := <-conns
+	stalled.stall()
+
+	for i := 0; i < 2*cfg.maxSendBacklog; i++ {
+		injectTest(h, `{"room":"`+defaultRoom+`","type":"system","text":"backlog `+strconv.Itoa(i)+`"}`)
+	}
+	waitFor(t, "the stalled client to be disconnected", func() bool { return h.clientCount.Load() == 0 })
+	stalled.resume()
+	if code, text := closeTestCode(t, conn); code != websocket.ClosePolicyViolation || text != "send backlog exceeded" {
+		t.Errorf("stalled client closed with %d %q, want a policy violation for its backlog", code, text)
+	}
+}
+
+func TestStalledClientTopsDeepestQueues(t *testing.T) {
+	h := startTestHub(t, testConfig())
+	conns := make(chan *stalledConn, 2)
+	base := wrappedTestServer(t, h, func(conn net.Conn) net.Conn {
+		c := &stalledConn{Conn: conn}
+		conns <- c
+		return c
+	})
+	dial := func() (*websocket.Conn, string) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		var welcome message
+		if err := conn.ReadJSON(&welcome); err != nil {
+			t.Fatal(err)
+		}
+		return conn, welcome.Sender
+	}
+	_, stalledID := dial()
+	stalled := <-conns
+	healthy, _ := dial()
+	go func() {
+		for {
+			if _, _, err := healthy.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, "both clients to register", func() bool { return h.clientCount.Load() == 2 })
+	stalled.stall()
+	defer stalled.resume()
+
+	// Fewer than a lane holds, so the stalled client stays connected.
+	for i := 0; i < 8; i++ {
+		injectTest(h, `{"room":"`+defaultRoom+`","type":"system","text":"queued `+strconv.Itoa(i)+`"}`)
+	}
+	var queues []queueSnapshot
+	waitFor(t, "the stalled client's queue to fill", func() bool {
+		result := make(chan hubSnapshot, 1)
+		h.snapshots <- result
+		queues = (<-result).DeepestQueues
+		return len(queues) == 1 && queues[0].Depth >= 7
+	})
+	if queues[0].ID != stalledID {
+		t.Errorf("deepest queue is %s's, want the stalled client %s", queues[0].ID, stalledID)
+	}
+}
+
+func TestPingIntervalsJittered(t *testing.T) {
+	base := (pongWait * 9) / 10
+	for _, pct := range []int{0, 10, 50} {
+		cfg := testConfig()
+		cfg.pingJitterPercent = pct
+		h := NewHub(cfg)
+		seen := make(map[time.Duration]bool)
+		shortest, longest := base, time.Duration(0)
+		for i := 0; i < 200; i++ {
+			c := &client{id: strconv.Itoa(i), hub: h}
+			d := c.pingInterval()
+			shortest, longest = min(shortest, d), max(longest, d)
+			if d > base || d < base-base*time.Duration(pct)/100 {
+				t.Fatalf("with %d%% jitter an interval was %v, outside %d%% below %v", pct, d, pct, base)
+			}
+			seen[d] = true
+		}
+		switch {
+		case pct == 0 && len(seen) != 1:
+			t.Errorf("without jitter clients got %d different intervals", len(seen))
+		case pct > 0 && len(seen) < 150:
+			t.Errorf("with %d%% jitter 200 clients got only %d different intervals", pct, len(seen))
+		case pct > 0 && longest-shortest < base*time.Duration(pct)/200:
+			t.Errorf("with %d%% jitter intervals only spread from %v to %v", pct, shortest, longest)
+		}
+	}
+}
+
+func TestHandshakeTimeoutClosesSilentClients(t *testing.T) {
+	cfg := testConfig()
+	cfg.handshakeTimeout = 150 * time.Millisecond
+	_, base := newTestServer(t, cfg)
+
+	silent, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	if code, text := closeTestCode(t, silent); code != websocket.ClosePolicyViolation || text != "handshake timeout" {
+		t.Errorf("silent client closed with %d %q, want %d %q", code, text, websocket.ClosePolicyViolation, "handshake timeout")
+	}
+
+	// One message is enough; the client may then go quiet.
+	talker := dialTestClient(t, base, "", "")
+	syncTestConn(t, talker)
+	time.Sleep(300 * time.Millisecond)
+	syncTestConn(t, talker)
+}
+
+// counterValue returns c's current value.
+func counterValue(c *counter) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+func TestCorruptCompressedFrameClosesWithProtocolError(t *testing.T) {
+	cfg := testConfig()
+	cfg.compressMinClients = 1
+	_, base := newTestServer(t, cfg)
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Fatal("compression wasn't negotiated")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("reading the welcome: %v", err)
+	}
+
+	// A final text frame with RSV1 set whose deflate data starts a block
+	// of the reserved type 3, so it can't inflate. Client frames must be
+	// masked; a zero mask leaves the payload as written.
+	before := counterValue(compressionErrors)
+	frame := []byte{0xc1, 0x80 | 2, 0, 0, 0, 0, 0x07, 0x00}
+	if _, err := conn.UnderlyingConn().Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	if code, text := closeTestCode(t, conn); code != websocket.CloseProtocolError || text != "invalid compressed frame" {
+		t.Errorf("corrupt frame closed with %d %q, want %d %q", code, text, websocket.CloseProtocolError, "invalid compressed frame")
+	}
+	if got := counterValue(compressionErrors) - before; got != 1 {
+		t.Errorf("compression_errors_total rose by %v, want 1", got)
+	}
+}